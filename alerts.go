@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// webhookTimeout bounds each alert POST so an unreachable endpoint cannot stall a run
+const webhookTimeout = 10 * time.Second
+
+// AlertRule is a condition from the alerts section that produces an alert each time a device meets it
+type AlertRule struct {
+	Name       string  `yaml:"name"`
+	Type       string  `yaml:"type"`        // stop or speed
+	MinMinutes float64 `yaml:"min_minutes"` // stop: shortest stop that raises an alert
+	AboveKmh   float64 `yaml:"above_kmh"`   // speed: speed that raises an alert
+	Zone       string  `yaml:"zone"`        // only raise the alert inside this zone of parameters.zones_file
+}
+
+// alert is one occurrence of an alert rule
+type alert struct {
+	Rule      string    `json:"rule"`
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Value     float64   `json:"value"` // stop duration in minutes, or maximum speed in km/h
+	Zone      string    `json:"zone,omitempty"`
+}
+
+// checkAlerts validates the alert rules against the loaded zones
+func checkAlerts(config *Config, zones *zoneSet) error {
+	for i, rule := range config.Alerts.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		switch rule.Type {
+		case "stop":
+			if rule.MinMinutes <= 0 {
+				return fmt.Errorf("alert rule %s: stop rules need min_minutes", name)
+			}
+		case "speed":
+			if rule.AboveKmh <= 0 {
+				return fmt.Errorf("alert rule %s: speed rules need above_kmh", name)
+			}
+		default:
+			return fmt.Errorf("alert rule %s: unknown type %q (use stop or speed)", name, rule.Type)
+		}
+		if rule.Zone != "" && (zones == nil || !zones.has(rule.Zone)) {
+			return fmt.Errorf("alert rule %s: zone %q is not defined in parameters.zones_file", name, rule.Zone)
+		}
+	}
+	return nil
+}
+
+// evaluateAlerts applies the alert rules to records grouped by device and sorted by time,
+// returning the alerts in time order
+func evaluateAlerts(records []Record, config *Config, zones *zoneSet) []alert {
+	var alerts []alert
+	for start := 0; start < len(records); {
+		end := start + 1
+		for end < len(records) && records[end].ID == records[start].ID {
+			end++
+		}
+		group := records[start:end]
+		for i, rule := range config.Alerts.Rules {
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("rule_%d", i+1)
+			}
+			switch rule.Type {
+			case "stop":
+				alerts = append(alerts, stopAlerts(group, rule, config.Parameters.TripStopRadiusM, zones)...)
+			case "speed":
+				alerts = append(alerts, speedAlerts(group, rule, zones)...)
+			}
+		}
+		start = end
+	}
+
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].Start.Before(alerts[j].Start) })
+	return alerts
+}
+
+// inZone reports whether a point is inside the rule's zone, or true when the rule has none
+func (rule AlertRule) inZone(lat, lon float64, zones *zoneSet) bool {
+	return rule.Zone == "" || zones.locate(lat, lon) == rule.Zone
+}
+
+// stopAlerts raises an alert for each stop of a device lasting at least the rule's minimum
+func stopAlerts(group []Record, rule AlertRule, radiusM float64, zones *zoneSet) []alert {
+	var alerts []alert
+	for _, s := range findStays(group, rule.MinMinutes*60, radiusM) {
+		first, last := &group[s.first], &group[s.last]
+		if !rule.inZone(first.Latitude, first.Longitude, zones) {
+			continue
+		}
+		alerts = append(alerts, alert{
+			Rule:      rule.Name,
+			Type:      rule.Type,
+			ID:        first.ID,
+			Start:     first.Timestamp,
+			End:       last.Timestamp,
+			Latitude:  first.Latitude,
+			Longitude: first.Longitude,
+			Value:     last.Timestamp.Sub(first.Timestamp).Minutes(),
+			Zone:      rule.Zone,
+		})
+	}
+	return alerts
+}
+
+// speedAlerts raises an alert for each run of consecutive points faster than the rule's limit,
+// located at the fastest point of the run
+func speedAlerts(group []Record, rule AlertRule, zones *zoneSet) []alert {
+	var alerts []alert
+	var current *alert
+	for i := range group {
+		r := &group[i]
+		if r.Outlier {
+			continue
+		}
+		if r.Speed <= rule.AboveKmh || !rule.inZone(r.Latitude, r.Longitude, zones) {
+			current = nil
+			continue
+		}
+		if current == nil {
+			alerts = append(alerts, alert{Rule: rule.Name, Type: rule.Type, ID: r.ID, Start: r.Timestamp, Zone: rule.Zone})
+			current = &alerts[len(alerts)-1]
+		}
+		current.End = r.Timestamp
+		if r.Speed > current.Value {
+			current.Value = r.Speed
+			current.Latitude, current.Longitude = r.Latitude, r.Longitude
+		}
+	}
+	return alerts
+}
+
+// writeAlertReport writes one CSV row per alert
+func writeAlertReport(filename string, alerts []alert) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create alert report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"rule", "type", "ID", "start", "end", "duration_seconds", "latitude", "longitude", "value", "zone"})
+	for _, a := range alerts {
+		_ = writer.Write([]string{
+			a.Rule,
+			a.Type,
+			a.ID,
+			a.Start.Format(outputTimeLayout),
+			a.End.Format(outputTimeLayout),
+			strconv.FormatFloat(a.End.Sub(a.Start).Seconds(), 'f', 0, 64),
+			strconv.FormatFloat(a.Latitude, 'f', 6, 64),
+			strconv.FormatFloat(a.Longitude, 'f', 6, 64),
+			strconv.FormatFloat(a.Value, 'f', 1, 64),
+			a.Zone,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// postAlerts sends each alert as a JSON POST to the webhook URL. Delivery failures are
+// reported on stderr and counted, but do not stop the run.
+func postAlerts(url string, alerts []alert) int {
+	client := &http.Client{Timeout: webhookTimeout}
+	failed := 0
+	for _, a := range alerts {
+		body, err := json.Marshal(a)
+		if err != nil {
+			failed++
+			continue
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logWarn("Alert webhook failed: %v", err)
+			failed++
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logWarn("Alert webhook returned %s", resp.Status)
+			failed++
+		}
+	}
+	return failed
+}
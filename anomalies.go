@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Trajectory anomaly types set in Record.Anomaly
+const (
+	anomalyFrozen   = "frozen_position"
+	anomalyStraight = "straight_line"
+	anomalyTeleport = "teleport"
+)
+
+// Anomaly detection defaults and tolerances
+const (
+	defaultAnomalyFrozenPoints   = 10
+	defaultAnomalyStraightPoints = 20
+	defaultAnomalyJumpKmh        = 1000.0 // faster than an airliner
+	anomalyJumpMinKm             = 10.0   // shorter jumps are left to the outlier filter
+	anomalyStraightBearingDeg    = 0.5    // largest turn between segments on a straight line
+	anomalyStraightSpeedRatio    = 0.01   // largest speed change, relative to the first segment
+	anomalyStraightMinKmh        = 5.0    // standing still is not driving in a straight line
+)
+
+// anomalySettings are the anomaly thresholds with their defaults applied
+type anomalySettings struct {
+	frozenPoints   int
+	straightPoints int
+	jumpKmh        float64
+}
+
+// newAnomalySettings validates the anomaly thresholds and applies their defaults
+func newAnomalySettings(config *Config) (anomalySettings, error) {
+	p := &config.Parameters
+	s := anomalySettings{frozenPoints: p.AnomalyFrozenPoints, straightPoints: p.AnomalyStraightPoints, jumpKmh: p.AnomalyJumpKmh}
+	if s.frozenPoints < 0 || s.straightPoints < 0 || s.jumpKmh < 0 {
+		return s, fmt.Errorf("anomaly_frozen_points, anomaly_straight_points and anomaly_jump_kmh must not be negative")
+	}
+	if s.frozenPoints == 0 {
+		s.frozenPoints = defaultAnomalyFrozenPoints
+	}
+	if s.straightPoints == 0 {
+		s.straightPoints = defaultAnomalyStraightPoints
+	}
+	if s.jumpKmh == 0 {
+		s.jumpKmh = defaultAnomalyJumpKmh
+	}
+	if s.frozenPoints < 2 || s.straightPoints < 3 {
+		return s, fmt.Errorf("anomaly_frozen_points must be at least 2 and anomaly_straight_points at least 3")
+	}
+	return s, nil
+}
+
+// detectAnomalies marks the points of a time-sorted group that are part of a pattern a real
+// receiver does not produce, and which points to a simulated or spoofed position source:
+//   - frozen_position: the same coordinates, to the last digit, for frozenPoints points in a
+//     row while the time moves on; a real receiver wanders a little even when standing still
+//   - straight_line: straightPoints points in a row on a straight line at a constant speed,
+//     as a route simulator draws them
+//   - teleport: a jump of more than 10 km at more than jumpKmh, such as to another continent;
+//     both ends of the jump are marked
+//
+// A point is marked with one anomaly; a teleport takes precedence. Outliers are not looked at.
+func detectAnomalies(group []Record, s anomalySettings) {
+	var points []*Record
+	for i := range group {
+		if !group[i].Outlier {
+			points = append(points, &group[i])
+		}
+	}
+	mark := func(run []*Record, anomaly string) {
+		for _, r := range run {
+			if r.Anomaly == "" || anomaly == anomalyTeleport {
+				r.Anomaly = anomaly
+			}
+		}
+	}
+
+	// Frozen positions
+	start := 0
+	for i := 1; i <= len(points); i++ {
+		if i < len(points) && points[i].Latitude == points[start].Latitude && points[i].Longitude == points[start].Longitude &&
+			points[i].Timestamp.After(points[i-1].Timestamp) {
+			continue
+		}
+		if i-start >= s.frozenPoints {
+			mark(points[start:i], anomalyFrozen)
+		}
+		start = i
+	}
+
+	// Straight lines at a constant speed. Segment i runs from points[i-1] to points[i]; a run
+	// of segments continues while each follows on from the previous one, keeps its bearing,
+	// and keeps the speed of the run's first segment.
+	moving := func(i int) bool {
+		r := points[i]
+		return r.PreviousRow == points[i-1].OriginalRow && r.TimeDiff > 0 && computedSpeed(r) >= anomalyStraightMinKmh
+	}
+	sameLine := func(i, first int) bool {
+		turn := math.Abs(math.Mod(points[i].Bearing-points[i-1].Bearing+540, 360) - 180)
+		speed := computedSpeed(points[first])
+		return turn <= anomalyStraightBearingDeg && math.Abs(computedSpeed(points[i])-speed) <= anomalyStraightSpeedRatio*speed
+	}
+	first := -1 // first segment of the current run
+	flush := func(last int) {
+		if first > 0 && last-first+2 >= s.straightPoints {
+			mark(points[first-1:last+1], anomalyStraight)
+		}
+		first = -1
+	}
+	for i := 1; i < len(points); i++ {
+		if !moving(i) {
+			flush(i - 1)
+			continue
+		}
+		if first > 0 && !sameLine(i, first) {
+			flush(i - 1)
+		}
+		if first < 0 {
+			first = i
+		}
+	}
+	flush(len(points) - 1)
+
+	// Teleports
+	for i := 1; i < len(points); i++ {
+		r := points[i]
+		if r.PreviousRow == points[i-1].OriginalRow && r.Distance > anomalyJumpMinKm &&
+			(r.TimeDiff <= 0 || computedSpeed(r) > s.jumpKmh) {
+			mark(points[i-1:i+1], anomalyTeleport)
+		}
+	}
+}
+
+// trajectoryAnomaly is one row of the anomalies report: a run of consecutive points of a
+// device marked with the same anomaly
+type trajectoryAnomaly struct {
+	ID         string
+	Anomaly    string
+	Start, End time.Time
+	Points     int
+	Distance   float64 // kilometers between the first and last point, along the track
+	Latitude   float64 // first point
+	Longitude  float64
+}
+
+// collectAnomalies returns the runs of marked points, by device and then time
+func collectAnomalies(records []Record) []trajectoryAnomaly {
+	var found []trajectoryAnomaly
+	groups := groupByID(records)
+	for _, id := range sortedIDs(groups) {
+		group := groups[id]
+		sortByTime(group)
+		var current *trajectoryAnomaly
+		for i := range group {
+			r := &group[i]
+			if r.Outlier {
+				continue
+			}
+			if current != nil && r.Anomaly == current.Anomaly {
+				current.End = r.Timestamp
+				current.Points++
+				current.Distance += r.Distance
+				continue
+			}
+			if current != nil {
+				found = append(found, *current)
+				current = nil
+			}
+			if r.Anomaly != "" {
+				current = &trajectoryAnomaly{ID: id, Anomaly: r.Anomaly, Start: r.Timestamp, End: r.Timestamp,
+					Points: 1, Latitude: r.Latitude, Longitude: r.Longitude}
+			}
+		}
+		if current != nil {
+			found = append(found, *current)
+		}
+	}
+	return found
+}
+
+// writeAnomalyReport writes one CSV row per trajectory anomaly
+func writeAnomalyReport(filename string, anomalies []trajectoryAnomaly) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create anomaly report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"ID", "anomaly", "start", "end", "points", "duration_seconds", "distance_km", "speed_kmh", "latitude", "longitude"})
+	for _, a := range anomalies {
+		duration := a.End.Sub(a.Start).Seconds()
+		speed := 0.0
+		if duration > 0 {
+			speed = a.Distance / (duration / 3600)
+		}
+		_ = writer.Write([]string{
+			a.ID,
+			a.Anomaly,
+			a.Start.Format(outputTimeLayout),
+			a.End.Format(outputTimeLayout),
+			strconv.Itoa(a.Points),
+			strconv.FormatFloat(duration, 'f', 0, 64),
+			strconv.FormatFloat(a.Distance, 'f', 3, 64),
+			strconv.FormatFloat(speed, 'f', 1, 64),
+			strconv.FormatFloat(a.Latitude, 'f', 6, 64),
+			strconv.FormatFloat(a.Longitude, 'f', 6, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
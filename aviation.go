@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Unit conversions for output.units: aviation
+const (
+	kmhPerKnot   = 1.852
+	feetPerMeter = 1 / 0.3048
+)
+
+// aviationColumnNames are the default columns replaced under output.units: aviation, and
+// what replaces them
+var aviationColumnNames = map[string][]string{
+	"speed_kmh":        {"speed_kts"},
+	"window_speed_kmh": {"window_speed_kts"},
+	"altitude":         {"altitude_ft", "vertical_speed_fpm"},
+}
+
+// checkUnits validates output.units and output.kml_altitude
+func checkUnits(config *Config) error {
+	switch config.Output.Units {
+	case "", "metric", "aviation":
+	default:
+		return fmt.Errorf("unknown output.units %q (use metric or aviation)", config.Output.Units)
+	}
+	switch config.Output.KMLAltitude {
+	case "", "clamp", "absolute":
+	default:
+		return fmt.Errorf("unknown output.kml_altitude %q (use clamp or absolute)", config.Output.KMLAltitude)
+	}
+	return nil
+}
+
+// aviationDefaultColumns returns the default column names with the speeds and altitude in
+// aviation units
+func aviationDefaultColumns(names []string) []string {
+	replaced := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		if aviation, ok := aviationColumnNames[name]; ok {
+			replaced = append(replaced, aviation...)
+		} else {
+			replaced = append(replaced, name)
+		}
+	}
+	return replaced
+}
+
+// kmlAltitudeMode returns the KML altitude mode of output.kml_altitude
+func kmlAltitudeMode(config *Config) string {
+	if config.Output.KMLAltitude == "absolute" {
+		return "absolute"
+	}
+	return "clampToGround"
+}
+
+// kmlHeights returns the height in meters of each point of a device's group in the KML
+// coordinates: 0 when tracks are clamped to the ground, and with output.kml_altitude:
+// absolute the altitude, carried forward over points without one so the track does not
+// drop to sea level
+func kmlHeights(group []Record, config *Config) []float64 {
+	heights := make([]float64, len(group))
+	if config.Output.KMLAltitude != "absolute" {
+		return heights
+	}
+	last := 0.0
+	for i := range group {
+		if group[i].HasAltitude {
+			last = group[i].Altitude
+		}
+		heights[i] = last
+	}
+	return heights
+}
+
+// kmlPointMode returns the altitudeMode element of KML points, or nothing when they are
+// clamped to the ground, which is the KML default
+func kmlPointMode(config *Config) string {
+	if config.Output.KMLAltitude != "absolute" {
+		return ""
+	}
+	return "<altitudeMode>absolute</altitudeMode>"
+}
+
+// kmlCoordinates returns the KML coordinates of a point at the given height
+func kmlCoordinates(record *Record, height float64, coord func(float64) string) string {
+	return coord(record.Longitude) + "," + coord(record.Latitude) + "," + strconv.FormatFloat(height, 'f', -1, 64)
+}
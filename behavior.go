@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Driving event types set in Record.Event
+const (
+	eventHarshBrake  = "harsh_brake"
+	eventHarshAccel  = "harsh_accel"
+	eventHarshCorner = "harsh_corner"
+)
+
+// drivingEventsEnabled reports whether any driving event threshold is configured
+func drivingEventsEnabled(config *Config) bool {
+	p := &config.Parameters
+	return p.HarshBrakeMps2 > 0 || p.HarshAccelMps2 > 0 || p.HarshCornerMps2 > 0
+}
+
+// checkDrivingEvents validates the driving event thresholds
+func checkDrivingEvents(config *Config) error {
+	p := &config.Parameters
+	if p.HarshBrakeMps2 < 0 || p.HarshAccelMps2 < 0 || p.HarshCornerMps2 < 0 {
+		return fmt.Errorf("harsh_brake_mps2, harsh_accel_mps2 and harsh_corner_mps2 must not be negative")
+	}
+	return nil
+}
+
+// detectDrivingEvents marks harsh braking, acceleration and cornering in a time-sorted group.
+// The speed change between two consecutive segments is divided by the time between their
+// midpoints, and an event is set on the point joining the segments when the result exceeds
+// a threshold. Cornering uses the lateral acceleration: the mean speed of the two segments
+// times the rate at which the bearing turns between them.
+func detectDrivingEvents(group []Record, config *Config) {
+	brake, accel := config.Parameters.HarshBrakeMps2, config.Parameters.HarshAccelMps2
+	corner := config.Parameters.HarshCornerMps2
+	prev := -1 // last point that ends a usable segment
+	for i := range group {
+		r := &group[i]
+		if r.Outlier {
+			continue
+		}
+		if r.PreviousRow == 0 || r.TimeDiff <= 0 {
+			prev = -1
+			continue
+		}
+		if prev >= 0 && group[prev].OriginalRow == r.PreviousRow {
+			p := &group[prev]
+			seconds := (p.TimeDiff + r.TimeDiff) / 2
+			change := (r.Speed - p.Speed) / 3.6 / seconds
+			switch {
+			case brake > 0 && -change > brake:
+				p.setEvent(eventHarshBrake, -change)
+			case accel > 0 && change > accel:
+				p.setEvent(eventHarshAccel, change)
+			}
+			// A segment without movement has no meaningful bearing
+			if corner > 0 && p.Distance > 0 && r.Distance > 0 {
+				turn := math.Abs(math.Mod(r.Bearing-p.Bearing+540, 360) - 180)
+				lateral := (p.Speed + r.Speed) / 2 / 3.6 * (turn * math.Pi / 180 / seconds)
+				if lateral > corner {
+					p.setEvent(eventHarshCorner, lateral)
+				}
+			}
+		}
+		prev = i
+	}
+}
+
+// setEvent records a driving event on the point, keeping the stronger one when a point
+// qualifies for more than one
+func (r *Record) setEvent(event string, magnitude float64) {
+	if r.Event == "" || magnitude > r.EventMagnitude {
+		r.Event, r.EventMagnitude = event, magnitude
+	}
+}
+
+// drivingEvent is one row of the driving events report
+type drivingEvent struct {
+	ID        string
+	Timestamp time.Time
+	Latitude  float64
+	Longitude float64
+	Event     string
+	Magnitude float64 // m/s²
+	Speed     float64 // km/h at the end of the segment before the event
+}
+
+// collectDrivingEvents returns the marked events in record order
+func collectDrivingEvents(records []Record) []drivingEvent {
+	var events []drivingEvent
+	for i := range records {
+		r := &records[i]
+		if r.Event == "" {
+			continue
+		}
+		events = append(events, drivingEvent{
+			ID:        r.ID,
+			Timestamp: r.Timestamp,
+			Latitude:  r.Latitude,
+			Longitude: r.Longitude,
+			Event:     r.Event,
+			Magnitude: r.EventMagnitude,
+			Speed:     r.Speed,
+		})
+	}
+	return events
+}
+
+// writeDrivingEvents writes one CSV row per driving event
+func writeDrivingEvents(filename string, events []drivingEvent) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create driving events report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"ID", "timestamp", "latitude", "longitude", "event", "magnitude_mps2", "speed_kmh"})
+	for _, e := range events {
+		_ = writer.Write([]string{
+			e.ID,
+			e.Timestamp.Format(outputTimeLayout),
+			strconv.FormatFloat(e.Latitude, 'f', 6, 64),
+			strconv.FormatFloat(e.Longitude, 'f', 6, 64),
+			e.Event,
+			strconv.FormatFloat(e.Magnitude, 'f', 2, 64),
+			strconv.FormatFloat(e.Speed, 'f', 1, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// defaultScorePenalty is the number of score points deducted per event per 100 km
+const defaultScorePenalty = 10.0
+
+// behaviorScore holds the driving events of one device on one day
+type behaviorScore struct {
+	ID       string
+	Day      time.Time
+	Distance float64 // kilometers
+	Speeding int     // runs of consecutive points above parameters.speeding_kmh
+	Brakes   int
+	Accels   int
+	Corners  int
+}
+
+// events returns the total number of events of the day
+func (s *behaviorScore) events() int {
+	return s.Speeding + s.Brakes + s.Accels + s.Corners
+}
+
+// eventsPer100km returns the event rate, or 0 when the device did not move
+func (s *behaviorScore) eventsPer100km() float64 {
+	if s.Distance <= 0 {
+		return 0
+	}
+	return float64(s.events()) / s.Distance * 100
+}
+
+// score returns 100 less the penalty for each event per 100 km, and not below 0
+func (s *behaviorScore) score(penalty float64) float64 {
+	return math.Max(0, 100-penalty*s.eventsPer100km())
+}
+
+// checkBehaviorScores makes sure there is something to score
+func checkBehaviorScores(config *Config) error {
+	if config.Parameters.SpeedingKmh < 0 || config.Parameters.ScorePenalty < 0 {
+		return fmt.Errorf("speeding_kmh and score_penalty must not be negative")
+	}
+	if config.Parameters.SpeedingKmh == 0 && !drivingEventsEnabled(config) {
+		return fmt.Errorf("output.behavior_scores requires parameters.speeding_kmh or a harsh_*_mps2 threshold")
+	}
+	return nil
+}
+
+// scoreBehavior counts the driving events and speeding runs per device and day, sorted by
+// device ID and day, for records grouped by device and sorted by time. Days start at midnight
+// in loc; a speeding run counts towards the day it starts on.
+func scoreBehavior(records []Record, config *Config, loc *time.Location) []behaviorScore {
+	type key struct {
+		id  string
+		day time.Time
+	}
+	day := rollupPeriods["daily"]
+	limit := config.Parameters.SpeedingKmh
+	scores := make(map[key]*behaviorScore)
+	speeding := false
+	for i := range records {
+		r := &records[i]
+		if i > 0 && records[i-1].ID != r.ID {
+			speeding = false
+		}
+		k := key{r.ID, day(r.Timestamp.In(loc))}
+		s, ok := scores[k]
+		if !ok {
+			s = &behaviorScore{ID: r.ID, Day: k.day}
+			scores[k] = s
+		}
+		if r.Outlier {
+			continue
+		}
+		s.Distance += r.Distance
+		switch r.Event {
+		case eventHarshBrake:
+			s.Brakes++
+		case eventHarshAccel:
+			s.Accels++
+		case eventHarshCorner:
+			s.Corners++
+		}
+		if limit > 0 && r.Speed > limit {
+			if !speeding {
+				s.Speeding++
+			}
+			speeding = true
+		} else {
+			speeding = false
+		}
+	}
+
+	result := make([]behaviorScore, 0, len(scores))
+	for _, s := range scores {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Day.Before(result[j].Day)
+	})
+	return result
+}
+
+// writeBehaviorScores writes one CSV row per device and day
+func writeBehaviorScores(filename string, scores []behaviorScore, config *Config) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create behavior score report: %w", err)
+	}
+	defer file.Close()
+
+	penalty := config.Parameters.ScorePenalty
+	if penalty == 0 {
+		penalty = defaultScorePenalty
+	}
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"ID", "day", "distance_km", "speeding", "harsh_brake", "harsh_accel", "harsh_corner", "events_per_100km", "score"})
+	for i := range scores {
+		s := &scores[i]
+		_ = writer.Write([]string{
+			s.ID,
+			s.Day.Format("2006-01-02"),
+			strconv.FormatFloat(s.Distance, 'f', outputPrecision(config, "distance"), 64),
+			strconv.Itoa(s.Speeding),
+			strconv.Itoa(s.Brakes),
+			strconv.Itoa(s.Accels),
+			strconv.Itoa(s.Corners),
+			strconv.FormatFloat(s.eventsPer100km(), 'f', 2, 64),
+			strconv.FormatFloat(s.score(penalty), 'f', 1, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
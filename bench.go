@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// benchSteps are the pipeline steps in the order they run; read is the time spent reading
+// the CSV file and parse the rest of the run's read step
+var benchSteps = []string{"read", "parse", "group", "compute", "filter", "sort", "write"}
+
+// benchResult is the outcome of a bench run, written as JSON by --json
+type benchResult struct {
+	Records      int                `json:"records"`
+	Devices      int                `json:"devices"`
+	Runs         int                `json:"runs"`
+	Formats      []string           `json:"formats"`
+	StepSeconds  map[string]float64 `json:"step_seconds"` // median over the runs
+	TotalSeconds float64            `json:"total_seconds"`
+	RecordsPerS  float64            `json:"records_per_second"`
+}
+
+// runBench implements the bench subcommand: it generates a synthetic input of the requested
+// size, runs the normal pipeline on it and reports how long each step took. Each run is a
+// separate process, exactly as a normal run, and the median over the runs is reported.
+func runBench(args []string, config *Config) int {
+	var overrides repeatedString
+	var formats stringList
+	fs := flag.NewFlagSet("gps-processor bench", flag.ContinueOnError)
+	records := fs.Int("records", 1000000, "number of GPS fixes to generate")
+	devices := fs.Int("devices", 100, "number of devices the fixes are spread over")
+	runs := fs.Int("runs", 3, "number of runs; the median time of each step is reported")
+	seed := fs.Int64("seed", 1, "seed of the generated data, so runs on different builds compare")
+	fs.Var(&formats, "format", "output formats to write (default: from the config)")
+	cpuProfile := fs.String("cpu-profile", "", "write a pprof CPU profile of the last run to this file")
+	memProfile := fs.String("mem-profile", "", "write a pprof heap profile of the last run to this file")
+	jsonFile := fs.String("json", "", "also write the results as JSON to this file")
+	keep := fs.Bool("keep", false, "keep the generated input and outputs, and print where they are")
+	fs.Var(&overrides, "set", "override a config value, e.g. parameters.filter_above_kph=2.5; may be repeated")
+	profile := fs.String("profile", "", "apply the named profile from the config file")
+	fs.Usage = func() {
+		fmt.Println("Usage: gps-processor bench [config_file] [--records N] [--devices N] [--runs N] [--format LIST]")
+		fmt.Println("                           [--cpu-profile FILE] [--mem-profile FILE] [--json FILE]")
+		fmt.Println("\nGenerates synthetic GPS tracks, processes them with the given configuration and")
+		fmt.Println("reports the time taken by each pipeline step.")
+	}
+	args, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	if err != nil {
+		return exitUsage
+	}
+	if *records <= 0 || *devices <= 0 || *runs <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: --records, --devices and --runs must be positive")
+		return exitUsage
+	}
+
+	if len(args) > 0 {
+		if err := loadConfig(args[0], config); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config file: %v\n", err)
+			return exitConfigError
+		}
+	}
+	if *profile != "" {
+		if err := applyProfile(config, *profile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitConfigError
+		}
+	}
+	if _, err := applyEnvOverrides(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitConfigError
+	}
+	if err := applySetOverrides(config, overrides); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitConfigError
+	}
+	if len(formats) > 0 {
+		config.Output.Formats = formats
+	}
+
+	// The run's outputs and profiles are relative to the bench directory, so make the
+	// profile paths absolute first
+	for _, path := range []*string{cpuProfile, memProfile, jsonFile} {
+		if *path != "" {
+			if *path, err = filepath.Abs(*path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return exitUsage
+			}
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: unable to find the gps-processor executable: %v\n", err)
+		return exitError
+	}
+
+	dir, err := os.MkdirTemp(config.Parameters.TempDir, "gps-bench-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitError
+	}
+	if *keep {
+		fmt.Printf("Bench files are kept in %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	fmt.Printf("Generating %d fixes for %d devices...\n", *records, *devices)
+	inputFile := filepath.Join(dir, "bench.csv")
+	if err := writeBenchInput(inputFile, config, *records, *devices, *seed); err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating input: %v\n", err)
+		return exitError
+	}
+	if err := writeBenchConfig(filepath.Join(dir, "config.yaml"), config, dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing bench config: %v\n", err)
+		return exitError
+	}
+
+	steps := make(map[string][]float64)
+	var totals []float64
+	for run := 1; run <= *runs; run++ {
+		fmt.Printf("Run %d of %d...\n", run, *runs)
+		// Reading the file without parsing it separates the I/O from the parsing
+		readSeconds, err := timeCSVRead(inputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+			return exitError
+		}
+
+		reportFile := filepath.Join(dir, "report.json")
+		cmdArgs := []string{"bench.csv", "config.yaml", "--quiet", "--report", reportFile}
+		if run == *runs {
+			if *cpuProfile != "" {
+				cmdArgs = append(cmdArgs, "--cpu-profile", *cpuProfile)
+			}
+			if *memProfile != "" {
+				cmdArgs = append(cmdArgs, "--mem-profile", *memProfile)
+			}
+		}
+		cmd := exec.Command(exe, cmdArgs...)
+		cmd.Dir = dir
+		var output bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &output, &output
+		runErr := cmd.Run()
+		report, err := readBenchReport(reportFile)
+		if err != nil || report.ExitCode != exitOK {
+			os.Stderr.Write(output.Bytes())
+			fmt.Fprintf(os.Stderr, "Error: bench run %d failed: %v\n", run, firstError(err, runErr))
+			return exitError
+		}
+
+		report.StepSeconds["parse"] = math.Max(report.StepSeconds["read"]-readSeconds, 0)
+		report.StepSeconds["read"] = math.Min(readSeconds, report.StepSeconds["read"])
+		for step, seconds := range report.StepSeconds {
+			steps[step] = append(steps[step], seconds)
+		}
+		totals = append(totals, report.DurationSeconds)
+	}
+
+	result := benchResult{
+		Records:      *records,
+		Devices:      *devices,
+		Runs:         *runs,
+		Formats:      config.Output.Formats,
+		StepSeconds:  make(map[string]float64),
+		TotalSeconds: medianOf(totals),
+	}
+	if len(result.Formats) == 0 {
+		result.Formats = defaultOutputFormats
+	}
+	for step, seconds := range steps {
+		result.StepSeconds[step] = medianOf(seconds)
+	}
+	if result.TotalSeconds > 0 {
+		result.RecordsPerS = float64(*records) / result.TotalSeconds
+	}
+	printBenchResult(os.Stdout, &result)
+
+	if *jsonFile != "" {
+		data, err := json.MarshalIndent(&result, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*jsonFile, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing results: %v\n", err)
+			return exitOutputError
+		}
+	}
+	return exitOK
+}
+
+// writeBenchInput writes the bench input: car tracks without position noise, reporting
+// every 10 seconds on average
+func writeBenchInput(filename string, config *Config, records, devices int, seed int64) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, 1<<20)
+	opts := generateOptions{
+		Devices:   devices,
+		Points:    records,
+		Profile:   speedProfiles["car"],
+		IntervalS: 10,
+		Start:     time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC),
+		Latitude:  52.5,
+		Longitude: 5.0,
+		Seed:      seed,
+	}
+	if err := writeSyntheticTracks(w, config, opts); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeBenchConfig writes the configuration the bench runs use: the given one with the
+// outputs in the bench directory and everything that reaches outside the machine, or
+// depends on the real input, turned off
+func writeBenchConfig(filename string, config *Config, dir string) error {
+	bench := *config
+	bench.Columns.AutoDetect = ""
+	bench.Columns.CRS = ""
+	// Generated data has a single ID column and RFC 3339 timestamps
+	bench.Columns.IDColumns = nil
+	bench.Columns.Date, bench.Columns.Time, bench.Columns.TimestampFormat = "", "", ""
+	bench.Parameters.IncludeIDs = nil
+	bench.Parameters.ExcludeIDs = nil
+	bench.Parameters.IDPattern = ""
+	bench.Parameters.CheckpointInterval = 0
+	bench.Output.Directory = dir
+	bench.Output.Filename = ""
+	bench.Output.IfExists = "overwrite"
+	bench.BigQuery.Table = ""
+	bench.Notify.WebhookURL = ""
+	bench.Alerts.WebhookURL = ""
+	data, err := yaml.Marshal(&bench)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// timeCSVRead returns how long reading every row of a CSV file takes, without parsing the
+// values
+func timeCSVRead(filename string) (float64, error) {
+	start := time.Now()
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	r := csv.NewReader(bufio.NewReaderSize(file, 1<<20))
+	r.ReuseRecord = true
+	for {
+		if _, err := r.Read(); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start).Seconds(), nil
+}
+
+// readBenchReport reads the run report of a bench run
+func readBenchReport(filename string) (*runReport, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	report := &runReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, err
+	}
+	defer os.Remove(filename)
+	return report, nil
+}
+
+// firstError returns the first error that is not nil
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printBenchResult prints the time of each step and its share of the total
+func printBenchResult(w io.Writer, result *benchResult) {
+	fmt.Fprintf(w, "\n%d fixes, %d devices, formats %v, median of %d runs:\n\n", result.Records, result.Devices, result.Formats, result.Runs)
+	fmt.Fprintf(w, "  %-10s %10s %7s\n", "step", "seconds", "share")
+	printed := make(map[string]bool)
+	printStep := func(step string) {
+		seconds := result.StepSeconds[step]
+		share := 0.0
+		if result.TotalSeconds > 0 {
+			share = 100 * seconds / result.TotalSeconds
+		}
+		fmt.Fprintf(w, "  %-10s %10.3f %6.1f%%\n", step, seconds, share)
+		printed[step] = true
+	}
+	for _, step := range benchSteps {
+		printStep(step)
+	}
+	// Steps added to the pipeline later are still shown
+	var others []string
+	for step := range result.StepSeconds {
+		if !printed[step] {
+			others = append(others, step)
+		}
+	}
+	sort.Strings(others)
+	for _, step := range others {
+		printStep(step)
+	}
+	fmt.Fprintf(w, "  %-10s %10.3f\n\n", "total", result.TotalSeconds)
+	fmt.Fprintf(w, "%.0f fixes per second\n", result.RecordsPerS)
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BigQuery API settings
+const (
+	bigQueryAPI         = "https://bigquery.googleapis.com/bigquery/v2"
+	bigQueryUploadAPI   = "https://bigquery.googleapis.com/upload/bigquery/v2"
+	bigQueryScope       = "https://www.googleapis.com/auth/bigquery"
+	bigQueryJobTimeout  = 30 * time.Minute // longest wait for a load job to finish
+	bigQueryPollSeconds = 2
+)
+
+// bigQueryTimestampColumns are the computed columns that load as TIMESTAMP; other columns
+// are typed by their values
+var bigQueryTimestampColumns = map[string]bool{"timestamp": true, "prev_timestamp": true}
+
+// bigQueryInvalidName matches the characters BigQuery does not allow in column names
+var bigQueryInvalidName = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// bigQueryField is one column of a BigQuery table schema
+type bigQueryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// bigQueryName turns an output column name into a valid BigQuery column name
+func bigQueryName(name string) string {
+	name = bigQueryInvalidName.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// bigQueryType returns the BigQuery type an output column loads as
+func bigQueryType(column *outputColumn, config *Config) string {
+	switch {
+	case bigQueryTimestampColumns[column.Name]:
+		return "TIMESTAMP"
+	case column.Boolean:
+		return "BOOL"
+	case column.Name == "geometry" && config.Output.Geometry == "wkt":
+		return "GEOGRAPHY"
+	case column.Integer:
+		return "INT64"
+	case column.Numeric:
+		return "FLOAT64"
+	}
+	return "STRING"
+}
+
+// bigQuerySchema returns the table schema of the ndjson output
+func bigQuerySchema(config *Config) ([]bigQueryField, error) {
+	columns, err := selectedColumns(config)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]bigQueryField, len(columns))
+	for i := range columns {
+		fields[i] = bigQueryField{Name: bigQueryName(columns[i].Name), Type: bigQueryType(&columns[i], config), Mode: "NULLABLE"}
+	}
+	return fields, nil
+}
+
+// writeOutputNDJSON writes the processed records as newline-delimited JSON, one object per
+// record with the selected output columns, in the form BigQuery loads. Keys are the column
+// names made valid for BigQuery, and values are typed as in the schema written with it.
+func writeOutputNDJSON(filename string, records []Record, config *Config) error {
+	columns, err := selectedColumns(config)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(columns))
+	types := make([]string, len(columns))
+	for i := range columns {
+		names[i] = bigQueryName(columns[i].Name)
+		types[i] = bigQueryType(&columns[i], config)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create output file: %w", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriterSize(file, csvWriteBufferSize)
+	bar := newProgress("Writing output NDJSON", len(records))
+
+	var buf []byte
+	for i := range records {
+		buf = append(buf[:0], '{')
+		for j := range columns {
+			if j > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, names[j])
+			buf = append(buf, ':')
+			value := columns[j].Value(&records[i])
+			switch types[j] {
+			case "INT64", "FLOAT64":
+				if isJSONNumber(value) {
+					buf = append(buf, value...)
+				} else {
+					buf = append(buf, "null"...)
+				}
+			case "BOOL":
+				buf = append(buf, strconv.FormatBool(value == "true")...)
+			case "GEOGRAPHY":
+				if value == "" {
+					buf = append(buf, "null"...)
+				} else {
+					buf = appendJSONString(buf, value)
+				}
+			default:
+				buf = appendJSONString(buf, value)
+			}
+		}
+		buf = append(buf, '}', '\n')
+		if _, err := writer.Write(buf); err != nil {
+			return fmt.Errorf("error writing row: %w", err)
+		}
+		_ = bar.Add(1)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing output file: %w", err)
+	}
+
+	bar.Finish()
+	return nil
+}
+
+// schemaFilename returns the path of the BigQuery schema, <basename>_schema.json next to the outputs
+func schemaFilename(inputFile string, config *Config) string {
+	return strings.TrimSuffix(reportFilename(inputFile, "schema", config), ".csv") + ".json"
+}
+
+// writeBigQuerySchema writes the schema in the JSON form that bq load accepts
+func writeBigQuerySchema(filename string, fields []bigQueryField) error {
+	data, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write schema: %w", err)
+	}
+	return nil
+}
+
+// bigQueryCredentials returns the service account key file of the bigquery section
+func bigQueryCredentials(config *Config) string {
+	if config.BigQuery.Credentials != "" {
+		return config.BigQuery.Credentials
+	}
+	return os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+}
+
+// checkBigQuery validates the bigquery section when a table is set
+func checkBigQuery(config *Config, formats []outputFormat) error {
+	b := &config.BigQuery
+	if b.Table == "" {
+		return nil
+	}
+	if b.Project == "" || b.Dataset == "" {
+		return fmt.Errorf("bigquery.table requires bigquery.project and bigquery.dataset")
+	}
+	switch b.WriteDisposition {
+	case "", "append", "truncate":
+	default:
+		return fmt.Errorf("unknown bigquery.write_disposition %q (use append or truncate)", b.WriteDisposition)
+	}
+	found := false
+	for _, format := range formats {
+		found = found || format.Name == "ndjson"
+	}
+	if !found {
+		return fmt.Errorf("bigquery.table requires the ndjson output format")
+	}
+	if bigQueryCredentials(config) == "" {
+		return fmt.Errorf("bigquery.table requires bigquery.credentials or GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	_, err := readServiceAccount(bigQueryCredentials(config))
+	return err
+}
+
+// serviceAccount holds the fields of a Google service account key file used to get a token
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// readServiceAccount reads and parses a service account key file
+func readServiceAccount(filename string) (*serviceAccount, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read BigQuery credentials: %w", err)
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("invalid BigQuery credentials %s: %w", filename, err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" || account.TokenURI == "" {
+		return nil, fmt.Errorf("invalid BigQuery credentials %s: not a service account key file", filename)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid BigQuery credentials %s: private_key is not PEM encoded", filename)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("invalid BigQuery credentials %s: private_key is not an RSA key", filename)
+	}
+	account.key = key
+	return &account, nil
+}
+
+// token exchanges a signed JWT for an OAuth access token with the BigQuery scope
+func (a *serviceAccount) token(client *http.Client) (string, error) {
+	now := time.Now()
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encode(map[string]interface{}{
+		"iss":   a.ClientEmail,
+		"scope": bigQueryScope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.PostForm(a.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to get BigQuery access token: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := decodeGoogleResponse(resp, &result); err != nil {
+		return "", fmt.Errorf("unable to get BigQuery access token: %w", err)
+	}
+	return result.AccessToken, nil
+}
+
+// bigQueryJob is the part of a BigQuery job resource the loader reads
+type bigQueryJob struct {
+	JobReference struct {
+		ProjectID string `json:"projectId"`
+		JobID     string `json:"jobId"`
+		Location  string `json:"location"`
+	} `json:"jobReference"`
+	Status struct {
+		State       string `json:"state"`
+		ErrorResult *struct {
+			Message string `json:"message"`
+		} `json:"errorResult"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"status"`
+	Statistics struct {
+		Load struct {
+			OutputRows string `json:"outputRows"`
+		} `json:"load"`
+	} `json:"statistics"`
+}
+
+// loadBigQuery loads the ndjson output files into the configured table, one load job per
+// file, and returns the number of rows loaded. With write_disposition truncate, the first
+// file replaces the table's contents and the others are appended to it.
+func loadBigQuery(files []string, fields []bigQueryField, config *Config) (int, error) {
+	account, err := readServiceAccount(bigQueryCredentials(config))
+	if err != nil {
+		return 0, err
+	}
+	client := &http.Client{Timeout: 10 * time.Minute}
+	token, err := account.token(client)
+	if err != nil {
+		return 0, err
+	}
+
+	b := &config.BigQuery
+	rows := 0
+	for i, file := range files {
+		disposition := "WRITE_APPEND"
+		if b.WriteDisposition == "truncate" && i == 0 {
+			disposition = "WRITE_TRUNCATE"
+		}
+		job := map[string]interface{}{
+			"configuration": map[string]interface{}{
+				"load": map[string]interface{}{
+					"destinationTable":  map[string]string{"projectId": b.Project, "datasetId": b.Dataset, "tableId": b.Table},
+					"sourceFormat":      "NEWLINE_DELIMITED_JSON",
+					"schema":            map[string]interface{}{"fields": fields},
+					"createDisposition": "CREATE_IF_NEEDED",
+					"writeDisposition":  disposition,
+				},
+			},
+		}
+		logInfo("Loading %s into BigQuery table %s.%s.%s...", file, b.Project, b.Dataset, b.Table)
+		loaded, err := runLoadJob(client, token, file, job, b.Project)
+		if err != nil {
+			return rows, fmt.Errorf("loading %s: %w", file, err)
+		}
+		rows += loaded
+	}
+	return rows, nil
+}
+
+// runLoadJob starts a load job with a resumable upload of the file and waits for it to finish
+func runLoadJob(client *http.Client, token, filename string, job interface{}, project string) (int, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", bigQueryUploadAPI+"/projects/"+url.PathEscape(project)+"/jobs?uploadType=resumable", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	err = decodeGoogleResponse(resp, nil)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return 0, fmt.Errorf("BigQuery did not return an upload session")
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	req, err = http.NewRequest("PUT", session, file)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	var status bigQueryJob
+	err = decodeGoogleResponse(resp, &status)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// Poll the job until BigQuery has processed the upload
+	ref := status.JobReference
+	deadline := time.Now().Add(bigQueryJobTimeout)
+	for status.Status.State != "DONE" {
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("job %s did not finish within %v", ref.JobID, bigQueryJobTimeout)
+		}
+		time.Sleep(bigQueryPollSeconds * time.Second)
+		jobURL := bigQueryAPI + "/projects/" + url.PathEscape(ref.ProjectID) + "/jobs/" + url.PathEscape(ref.JobID)
+		if ref.Location != "" {
+			jobURL += "?location=" + url.QueryEscape(ref.Location)
+		}
+		req, err := http.NewRequest("GET", jobURL, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		err = decodeGoogleResponse(resp, &status)
+		resp.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if status.Status.ErrorResult != nil {
+		messages := []string{status.Status.ErrorResult.Message}
+		for _, e := range status.Status.Errors {
+			if e.Message != messages[0] {
+				messages = append(messages, e.Message)
+			}
+		}
+		return 0, fmt.Errorf("job %s failed: %s", ref.JobID, strings.Join(messages, "; "))
+	}
+	rows, _ := strconv.Atoi(status.Statistics.Load.OutputRows)
+	return rows, nil
+}
+
+// decodeGoogleResponse turns an error status into an error with Google's message, and
+// otherwise decodes the JSON body into result unless it is nil
+func decodeGoogleResponse(resp *http.Response, result interface{}) error {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var failure struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+			Description string `json:"error_description"`
+		}
+		_ = json.Unmarshal(data, &failure)
+		message := failure.Error.Message
+		if message == "" {
+			message = failure.Description
+		}
+		if message == "" {
+			message = strings.TrimSpace(string(data))
+		}
+		return fmt.Errorf("%s: %s", resp.Status, message)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Chart layout, in pixels
+const (
+	chartWidth       = 800
+	chartPanelHeight = 200
+	chartLeft        = 60 // room for the value labels
+	chartRight       = 20
+	chartTop         = 30 // room for the panel title
+	chartBottom      = 30 // room for the time labels
+)
+
+// chartTimeSteps are the spacings of the time axis labels, from which the first giving at
+// most six labels is used
+var chartTimeSteps = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	24 * time.Hour, 7 * 24 * time.Hour, 28 * 24 * time.Hour,
+}
+
+// chartsDirectory returns the path of the charts, <basename>_charts next to the outputs
+func chartsDirectory(inputFile string, config *Config) string {
+	return strings.TrimSuffix(reportFilename(inputFile, "charts", config), ".csv")
+}
+
+// writeCharts writes an SVG chart per device to the directory, named after the device ID,
+// and returns the directory and the number of charts. Like the vector tiles, the directory
+// is replaced whole.
+func writeCharts(dir string, records []Record, config *Config) (string, int, error) {
+	dir, err := resolveOutputPath(dir, config)
+	if err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".*.tmp")
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to create charts directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	_ = os.Chmod(tmp, 0755)
+
+	loc, err := reportLocation(config)
+	if err != nil {
+		return "", 0, err
+	}
+	groups := groupByID(records)
+	names := deviceFileNames(sortedIDs(groups), config)
+	bar := newProgress("Writing charts", len(groups))
+	for _, id := range sortedIDs(groups) {
+		group := groups[id]
+		sortByTime(group)
+		chart := deviceChart(id, group, loc, config)
+		if err := os.WriteFile(filepath.Join(tmp, names[id]+".svg"), []byte(chart), 0644); err != nil {
+			return "", 0, fmt.Errorf("unable to write chart: %w", err)
+		}
+		_ = bar.Add(1)
+	}
+	bar.Finish()
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", 0, fmt.Errorf("unable to replace %s: %w", dir, err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", 0, fmt.Errorf("unable to move charts directory into place: %w", err)
+	}
+	for _, id := range sortedIDs(groups) {
+		config.manifest.add(filepath.Join(dir, names[id]+".svg"), "charts", len(groups[id]))
+	}
+	return dir, len(groups), nil
+}
+
+// deviceChart draws the speed of a device's time-sorted points over time and, when they have
+// altitudes, the elevation below it, as an SVG document. Outliers are marked with red squares,
+// since they are what the chart is most often opened to find. Times are shown in loc.
+func deviceChart(id string, group []Record, loc *time.Location, config *Config) string {
+	var speed, elevation chartSeries
+	for i := range group {
+		r := &group[i]
+		if r.PreviousRow != 0 {
+			speed.add(r.Timestamp, r.Speed, r.Outlier)
+		} else {
+			speed.gap()
+		}
+		if r.HasAltitude {
+			elevation.add(r.Timestamp, r.Altitude, r.Outlier)
+		}
+	}
+
+	panels := 1
+	if len(elevation.times) > 0 {
+		panels = 2
+	}
+	var c svgCanvas
+	height := panels*chartPanelHeight + 30
+	c.rect(0, 0, chartWidth, float64(height), color.RGBA{255, 255, 255, 255})
+	c.text(chartLeft, 18, "Device "+deviceLabel(id, config), color.RGBA{0, 0, 0, 255})
+	start, end := group[0].Timestamp, group[len(group)-1].Timestamp
+	c.chartPanel(30, "Speed (km/h)", &speed, true, start, end, loc, color.RGBA{31, 119, 180, 255})
+	if panels == 2 {
+		c.chartPanel(30+chartPanelHeight, "Elevation (m)", &elevation, false, start, end, loc, color.RGBA{44, 160, 44, 255})
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" font-family=\"sans-serif\" font-size=\"11\">\n", chartWidth, height, chartWidth, height)
+	b.WriteString(c.body.String())
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// chartSeries is a series of values over time, split into runs where the values have a gap
+type chartSeries struct {
+	times    []time.Time
+	values   []float64
+	outliers []int // indexes of the values of outliers
+	breaks   []int // indexes where a new run starts
+}
+
+func (s *chartSeries) add(t time.Time, v float64, outlier bool) {
+	if outlier {
+		s.outliers = append(s.outliers, len(s.values))
+	}
+	s.times = append(s.times, t)
+	s.values = append(s.values, v)
+}
+
+// gap ends the current run, so the line is not drawn across missing values
+func (s *chartSeries) gap() {
+	if n := len(s.values); n > 0 && (len(s.breaks) == 0 || s.breaks[len(s.breaks)-1] != n) {
+		s.breaks = append(s.breaks, n)
+	}
+}
+
+// chartPanel draws a series as a line chart in the panel starting at top, with the time
+// running from start to end. With fromZero the value axis starts at zero rather than at the
+// lowest value.
+func (c *svgCanvas) chartPanel(top float64, title string, s *chartSeries, fromZero bool, start, end time.Time, loc *time.Location, col color.RGBA) {
+	black := color.RGBA{0, 0, 0, 255}
+	grid := color.RGBA{221, 221, 221, 255}
+	left, right := float64(chartLeft), float64(chartWidth-chartRight)
+	plotTop, bottom := top+chartTop, top+chartPanelHeight-chartBottom
+	c.text(left, top+18, title, black)
+
+	low, high := math.Inf(1), math.Inf(-1)
+	if fromZero || len(s.values) == 0 {
+		low, high = 0, 0
+	}
+	for _, v := range s.values {
+		low, high = math.Min(low, v), math.Max(high, v)
+	}
+	step := niceLength((high - low) / 4)
+	if high == low {
+		high = low + step
+	}
+	low = math.Floor(low/step) * step
+	high = math.Ceil(high/step) * step
+	span := end.Sub(start).Seconds()
+	if span <= 0 {
+		span = 1
+	}
+	x := func(t time.Time) float64 { return left + (right-left)*t.Sub(start).Seconds()/span }
+	y := func(v float64) float64 { return bottom - (bottom-plotTop)*(v-low)/(high-low) }
+
+	for v := low; v <= high+step/2; v += step {
+		c.rect(left, y(v), right-left, 1, grid)
+		c.text(4, y(v)+4, fmt.Sprintf("%g", math.Round(v*1e6)/1e6), black)
+	}
+	timeStep := chartTimeSteps[len(chartTimeSteps)-1]
+	for _, d := range chartTimeSteps {
+		if end.Sub(start) <= 6*d {
+			timeStep = d
+			break
+		}
+	}
+	layout := "15:04"
+	if timeStep >= 24*time.Hour {
+		layout = "2006-01-02"
+	} else if start.In(loc).YearDay() != end.In(loc).YearDay() || start.In(loc).Year() != end.In(loc).Year() {
+		layout = "01-02 15:04"
+	}
+	// Labels fall on whole steps in loc; days and weeks start at midnight
+	_, offset := start.In(loc).Zone()
+	shift := time.Duration(offset) * time.Second
+	for t := start.Add(shift).Truncate(timeStep).Add(-shift); !t.After(end); t = t.Add(timeStep) {
+		if t.Before(start) {
+			continue
+		}
+		c.rect(x(t), plotTop, 1, bottom-plotTop, grid)
+		c.text(x(t)-15, bottom+15, t.In(loc).Format(layout), black)
+	}
+	c.rect(left, bottom, right-left, 1, black)
+
+	from := 0
+	for _, to := range append(append([]int(nil), s.breaks...), len(s.values)) {
+		xs := make([]float64, 0, to-from)
+		ys := make([]float64, 0, to-from)
+		for i := from; i < to; i++ {
+			xs = append(xs, x(s.times[i]))
+			ys = append(ys, y(s.values[i]))
+		}
+		c.polyline(xs, ys, col, 1.5)
+		from = to
+	}
+	for _, i := range s.outliers {
+		c.rect(x(s.times[i])-2, y(s.values[i])-2, 4, 4, color.RGBA{214, 39, 40, 255})
+	}
+}
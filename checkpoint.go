@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkpointState is the progress of an interrupted run, saved as state.json in the checkpoint directory
+type checkpointState struct {
+	InputFile    string              `json:"input_file"`
+	InputSize    int64               `json:"input_size"`
+	InputModTime time.Time           `json:"input_mod_time"`
+	ConfigHash   string              `json:"config_hash"`
+	RowsRead     int                 `json:"rows_read"`     // row number of the last input row read, header is row 1
+	ByteOffset   int64               `json:"byte_offset"`   // offset just past the last row read (CSV read without conversion only)
+	Batches      int                 `json:"batches"`       // number of committed record batch files
+	ReadComplete bool                `json:"read_complete"` // the whole input has been read
+	Outputs      map[string][]string `json:"outputs"`       // files written for each completed output format
+}
+
+// checkpoint periodically saves reading progress and completed outputs so an
+// interrupted run can be resumed with --resume
+type checkpoint struct {
+	dir      string
+	interval int // rows between checkpoints
+	state    checkpointState
+	saved    int      // number of records already saved in batch files
+	restored []Record // records read before the interruption
+}
+
+// checkpointDir returns the configured checkpoint directory, or a default next to the outputs
+func checkpointDir(inputFile string, config *Config) string {
+	if config.Parameters.CheckpointDir != "" {
+		return config.Parameters.CheckpointDir
+	}
+	ext := filepath.Ext(inputFile)
+	base := filepath.Base(inputFile[:len(inputFile)-len(ext)])
+	dir := config.Output.Directory
+	if dir == "" {
+		dir = filepath.Dir(inputFile)
+	}
+	return filepath.Join(dir, base+".checkpoint")
+}
+
+// configHash fingerprints the configuration so a run is not resumed with different settings
+func configHash(config *Config) string {
+	data, _ := yaml.Marshal(config)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// openCheckpoint prepares checkpointing for a run. When resume is set and a matching
+// checkpoint exists, its saved records are restored so reading can continue where it stopped.
+// It returns nil when checkpointing is disabled and no resume was requested.
+func openCheckpoint(inputFile string, config *Config, resume bool) (*checkpoint, error) {
+	if config.Parameters.CheckpointInterval <= 0 && !resume {
+		return nil, nil
+	}
+	info, err := os.Stat(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file: %w", err)
+	}
+
+	cp := &checkpoint{
+		dir:      checkpointDir(inputFile, config),
+		interval: config.Parameters.CheckpointInterval,
+		state: checkpointState{
+			InputFile:    inputFile,
+			InputSize:    info.Size(),
+			InputModTime: info.ModTime(),
+			ConfigHash:   configHash(config),
+			RowsRead:     1,
+			Outputs:      make(map[string][]string),
+		},
+	}
+
+	if resume {
+		found, err := cp.load()
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return cp, nil
+		}
+	}
+
+	// Start afresh, discarding any stale checkpoint
+	if err := os.RemoveAll(cp.dir); err != nil {
+		return nil, fmt.Errorf("unable to clear checkpoint: %w", err)
+	}
+	if err := os.MkdirAll(cp.dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create checkpoint directory: %w", err)
+	}
+	return cp, cp.writeState()
+}
+
+// load reads a saved checkpoint and restores its records. It reports false without error
+// when there is no checkpoint to resume.
+func (c *checkpoint) load() (bool, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, "state.json"))
+	if os.IsNotExist(err) {
+		logInfo("No checkpoint found; starting from the beginning.")
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to read checkpoint: %w", err)
+	}
+
+	var saved checkpointState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return false, fmt.Errorf("unable to parse checkpoint: %w", err)
+	}
+	if saved.InputSize != c.state.InputSize || !saved.InputModTime.Equal(c.state.InputModTime) {
+		return false, fmt.Errorf("cannot resume: %s has changed since the checkpoint was written", c.state.InputFile)
+	}
+	if saved.ConfigHash != c.state.ConfigHash {
+		return false, fmt.Errorf("cannot resume: the configuration has changed since the checkpoint was written")
+	}
+	if saved.Outputs == nil {
+		saved.Outputs = make(map[string][]string)
+	}
+	c.state = saved
+
+	for i := 1; i <= c.state.Batches; i++ {
+		batch, err := readRecordBatch(c.batchFile(i))
+		if err != nil {
+			return false, fmt.Errorf("unable to read checkpoint records: %w", err)
+		}
+		c.restored = append(c.restored, batch...)
+	}
+	c.saved = len(c.restored)
+
+	logInfo("Resuming from checkpoint: %d rows already read, %d records restored", c.state.RowsRead-1, len(c.restored))
+	return true, nil
+}
+
+// resuming reports whether reading continues from a saved position
+func (c *checkpoint) resuming() bool {
+	return c != nil && c.state.RowsRead > 1
+}
+
+// startRow returns the row number of the last row read before the interruption
+func (c *checkpoint) startRow() int {
+	if c == nil {
+		return 1
+	}
+	return c.state.RowsRead
+}
+
+// restoredRecords returns the records read before the interruption
+func (c *checkpoint) restoredRecords() []Record {
+	if c == nil {
+		return nil
+	}
+	return c.restored
+}
+
+// seek positions an input reader after the last row read before the interruption. CSV files
+// read without conversion are repositioned by byte offset; other inputs, including CSV files
+// converted from another encoding, skip the rows already read.
+func (c *checkpoint) seek(reader rowReader, closer io.Closer) (rowReader, error) {
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %w", err)
+	}
+	if _, ok := reader.(*csvInput); ok {
+		file := closer.(*os.File)
+		if _, err := file.Seek(c.state.ByteOffset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("unable to seek to checkpoint: %w", err)
+		}
+		// The field count would otherwise be taken from the first row after the checkpoint
+		rest := &csvInput{Reader: csv.NewReader(file), base: c.state.ByteOffset}
+		rest.FieldsPerRecord = len(header)
+		return &resumedCSV{resumedReader{header: header, rest: rest}, rest}, nil
+	}
+	// Without file offsets, progress is counted in rows as on a fresh run
+	for row := 1; row < c.state.RowsRead; row++ {
+		if _, err := reader.Read(); err != nil {
+			return nil, fmt.Errorf("error skipping to checkpoint: %w", err)
+		}
+	}
+	return &resumedReader{header: header, rest: reader}, nil
+}
+
+// due reports whether enough rows have been read since the last checkpoint to save another
+func (c *checkpoint) due(rowsRead int) bool {
+	return c != nil && c.interval > 0 && rowsRead-c.state.RowsRead >= c.interval
+}
+
+// saveRead saves the records parsed since the last checkpoint and the reading position
+func (c *checkpoint) saveRead(records []Record, rowsRead int, byteOffset int64, complete bool) error {
+	if c == nil {
+		return nil
+	}
+	if len(records) > c.saved {
+		c.state.Batches++
+		if err := writeRecordBatch(c.batchFile(c.state.Batches), records[c.saved:]); err != nil {
+			c.state.Batches--
+			return fmt.Errorf("unable to save checkpoint records: %w", err)
+		}
+		c.saved = len(records)
+	}
+	c.state.RowsRead = rowsRead
+	c.state.ByteOffset = byteOffset
+	c.state.ReadComplete = complete
+	logDebug("Checkpoint saved after %d rows", rowsRead-1)
+	return c.writeState()
+}
+
+// outputDone returns the files written for a format in an earlier attempt, if it completed
+func (c *checkpoint) outputDone(format string) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	files, ok := c.state.Outputs[format]
+	return files, ok
+}
+
+// markOutput records that all files of an output format have been written
+func (c *checkpoint) markOutput(format string, files []string) error {
+	if c == nil {
+		return nil
+	}
+	c.state.Outputs[format] = files
+	return c.writeState()
+}
+
+// remove deletes the checkpoint after a successful run
+func (c *checkpoint) remove() {
+	if c != nil {
+		os.RemoveAll(c.dir)
+	}
+}
+
+// resumedReader returns the header row first and then continues from a later position in the input
+type resumedReader struct {
+	header []string
+	rest   rowReader
+}
+
+func (r *resumedReader) Read() ([]string, error) {
+	if r.header != nil {
+		header := r.header
+		r.header = nil
+		return header, nil
+	}
+	return r.rest.Read()
+}
+
+// resumedCSV is a resumedReader over a CSV file read as it is, which reports offsets in the
+// file. Other resumed inputs have no InputOffset, so their progress is counted in rows.
+type resumedCSV struct {
+	resumedReader
+	csv *csvInput
+}
+
+// InputOffset returns the byte offset in the input file just past the last row read
+func (r *resumedCSV) InputOffset() int64 {
+	return r.csv.InputOffset()
+}
+
+// writeState saves state.json, replacing the previous one only once fully written
+func (c *checkpoint) writeState() error {
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(c.dir, "state.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to save checkpoint: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(c.dir, "state.json"))
+}
+
+// batchFile returns the path of the i-th record batch file
+func (c *checkpoint) batchFile(i int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("records-%05d.gob", i))
+}
+
+// writeRecordBatch saves records to a gob file
+func writeRecordBatch(filename string, records []Record) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	if err := gob.NewEncoder(writer).Encode(records); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readRecordBatch loads records saved by writeRecordBatch
+func readRecordBatch(filename string) ([]Record, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	err = gob.NewDecoder(bufio.NewReader(file)).Decode(&records)
+	return records, err
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gps-processor/geohash"
+	"gps-processor/solar"
+)
+
+// outputColumn describes a column that can appear in the processed output
+type outputColumn struct {
+	Name    string
+	Numeric bool // written as a number in Excel output
+	Integer bool // holds whole numbers, for outputs with typed columns
+	Boolean bool // holds true or false, for outputs with typed columns
+	Value   func(record *Record) string
+
+	// Append appends the formatted value to buf without allocating; it is optional and
+	// used by the CSV writer's fast path when set
+	Append func(buf []byte, record *Record) []byte
+
+	// Float and Precision are set for decimal columns whose number of decimals is
+	// configurable: Precision names the setting (coordinate, distance or speed)
+	Float     func(record *Record) float64
+	Precision string
+}
+
+// defaultPrecision is the number of decimals written for decimal columns, matching %f
+const defaultPrecision = 6
+
+// defaultProjectedPrecision is the number of decimals written for projected coordinates in meters
+const defaultProjectedPrecision = 3
+
+// floatColumn returns a decimal column formatted with six decimals, like %f. When precision
+// is set, the decimals come from the matching output precision setting instead.
+func floatColumn(name string, precision string, value func(r *Record) float64) outputColumn {
+	return withDecimals(outputColumn{Name: name, Numeric: true, Float: value, Precision: precision}, defaultPrecision)
+}
+
+// withDecimals returns a copy of a decimal column formatted with the given number of
+// decimals; -1 writes as many decimals as needed to represent the value exactly
+func withDecimals(column outputColumn, decimals int) outputColumn {
+	value := column.Float
+	column.Value = func(r *Record) string { return strconv.FormatFloat(value(r), 'f', decimals, 64) }
+	column.Append = func(buf []byte, r *Record) []byte { return strconv.AppendFloat(buf, value(r), 'f', decimals, 64) }
+	return column
+}
+
+// outputPrecision returns the configured number of decimals for a precision setting
+func outputPrecision(config *Config, precision string) int {
+	switch precision {
+	case "coordinate":
+		return config.Output.CoordinatePrecision
+	case "distance":
+		return config.Output.DistancePrecision
+	case "speed":
+		return config.Output.SpeedPrecision
+	case "projected":
+		return config.Output.ProjectedPrecision
+	}
+	return defaultPrecision
+}
+
+// checkPrecision validates the output precision settings
+func checkPrecision(config *Config) error {
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"coordinate_precision", config.Output.CoordinatePrecision},
+		{"distance_precision", config.Output.DistancePrecision},
+		{"speed_precision", config.Output.SpeedPrecision},
+		{"projected_precision", config.Output.ProjectedPrecision},
+	} {
+		if setting.value < -1 || setting.value > 17 {
+			return fmt.Errorf("invalid output.%s %d (use 0 to 17 decimals, or -1 for as many as needed)", setting.name, setting.value)
+		}
+	}
+	return nil
+}
+
+// intColumn returns a numeric column holding an integer
+func intColumn(name string, value func(r *Record) int) outputColumn {
+	return outputColumn{
+		Name:    name,
+		Numeric: true,
+		Integer: true,
+		Value:   func(r *Record) string { return strconv.Itoa(value(r)) },
+		Append:  func(buf []byte, r *Record) []byte { return strconv.AppendInt(buf, int64(value(r)), 10) },
+	}
+}
+
+// availableColumns lists every column that can be selected with output.columns
+var availableColumns = []outputColumn{
+	{Name: "ID", Value: func(r *Record) string { return r.ID }},
+	floatColumn("latitude", "coordinate", func(r *Record) float64 { return r.Latitude }),
+	floatColumn("longitude", "coordinate", func(r *Record) float64 { return r.Longitude }),
+	{
+		Name:   "timestamp",
+		Value:  func(r *Record) string { return r.Timestamp.Format(outputTimeLayout) },
+		Append: func(buf []byte, r *Record) []byte { return r.Timestamp.AppendFormat(buf, outputTimeLayout) },
+	},
+	intColumn("original_row", func(r *Record) int { return r.OriginalRow }),
+	intColumn("previous_row", func(r *Record) int { return r.PreviousRow }),
+	floatColumn("prev_latitude", "coordinate", func(r *Record) float64 { return r.PrevLatitude }),
+	floatColumn("prev_longitude", "coordinate", func(r *Record) float64 { return r.PrevLongitude }),
+	{Name: "prev_timestamp", Value: func(r *Record) string {
+		// Format previous timestamp, handle zero value
+		if r.PrevTimestamp.IsZero() {
+			return ""
+		}
+		return r.PrevTimestamp.Format(outputTimeLayout)
+	}, Append: func(buf []byte, r *Record) []byte {
+		if r.PrevTimestamp.IsZero() {
+			return buf
+		}
+		return r.PrevTimestamp.AppendFormat(buf, outputTimeLayout)
+	}},
+	floatColumn("time_diff_seconds", "", func(r *Record) float64 { return r.TimeDiff }),
+	floatColumn("distance_km", "distance", func(r *Record) float64 { return r.Distance }),
+	floatColumn("speed_kmh", "speed", func(r *Record) float64 { return r.Speed }),
+	floatColumn("speed_kts", "speed", func(r *Record) float64 { return r.Speed / kmhPerKnot }),
+	floatColumn("bearing_deg", "", func(r *Record) float64 { return r.Bearing }),
+	floatColumn("window_speed_kmh", "speed", func(r *Record) float64 { return r.WindowSpeed }),
+	floatColumn("window_speed_kts", "speed", func(r *Record) float64 { return r.WindowSpeed / kmhPerKnot }),
+	{Name: "outlier", Boolean: true, Value: func(r *Record) string { return strconv.FormatBool(r.Outlier) }},
+	{Name: "simplified", Boolean: true, Value: func(r *Record) string { return strconv.FormatBool(r.Simplified) }},
+	intColumn("trip", func(r *Record) int { return r.Trip }),
+	{Name: "event", Value: func(r *Record) string { return r.Event }},
+	{Name: "anomaly", Value: func(r *Record) string { return r.Anomaly }},
+	floatColumn("energy_kwh", "", func(r *Record) float64 { return r.Energy }),
+	{Name: "altitude", Numeric: true, Value: func(r *Record) string {
+		if !r.HasAltitude {
+			return ""
+		}
+		return strconv.FormatFloat(r.Altitude, 'f', -1, 64)
+	}},
+	{Name: "altitude_ft", Numeric: true, Value: func(r *Record) string {
+		if !r.HasAltitude {
+			return ""
+		}
+		return strconv.FormatFloat(r.Altitude*feetPerMeter, 'f', 1, 64)
+	}},
+	{Name: "vertical_speed_mps", Numeric: true, Value: func(r *Record) string {
+		if !r.HasVerticalSpeed {
+			return ""
+		}
+		return strconv.FormatFloat(r.VerticalSpeed, 'f', 2, 64)
+	}},
+	{Name: "vertical_speed_fpm", Numeric: true, Value: func(r *Record) string {
+		if !r.HasVerticalSpeed {
+			return ""
+		}
+		return strconv.FormatFloat(r.VerticalSpeed*feetPerMeter*60, 'f', 0, 64)
+	}},
+	floatColumn("easting", "projected", func(r *Record) float64 { return r.Easting }),
+	floatColumn("northing", "projected", func(r *Record) float64 { return r.Northing }),
+}
+
+// projectedColumns are only available when output.crs is set, and are added to the
+// default columns when it is
+var projectedColumns = []string{"easting", "northing"}
+
+// defaultColumns is the column set and order written when output.columns is not configured
+var defaultColumns = []string{
+	"ID",
+	"latitude",
+	"longitude",
+	"timestamp",
+	"original_row",
+	"previous_row",
+	"prev_latitude",
+	"prev_longitude",
+	"prev_timestamp",
+	"time_diff_seconds",
+	"distance_km",
+	"speed_kmh",
+}
+
+// passthroughColumn returns an output column for the i-th unmapped input column
+func passthroughColumn(name string, i int) outputColumn {
+	return outputColumn{Name: name, Value: func(r *Record) string {
+		if i < len(r.Passthrough) {
+			return r.Passthrough[i]
+		}
+		return ""
+	}}
+}
+
+// configuredColumns returns the columns that only exist because of other settings, such
+// as the geohash, H3, reference distance, source file, device metadata and route columns. They are added to the default columns.
+func configuredColumns(config *Config) []outputColumn {
+	var columns []outputColumn
+	if precision := config.Output.GeohashPrecision; precision > 0 {
+		columns = append(columns, outputColumn{Name: "geohash", Value: func(r *Record) string {
+			return geohash.Encode(r.Latitude, r.Longitude, precision)
+		}})
+	}
+	for _, resolution := range config.Output.H3Resolutions {
+		columns = append(columns, outputColumn{Name: fmt.Sprintf("h3_r%d", resolution), Value: func(r *Record) string {
+			return h3Cell(r.Latitude, r.Longitude, resolution)
+		}})
+	}
+	if config.Output.DayNight {
+		columns = append(columns, outputColumn{Name: "day_night", Value: func(r *Record) string {
+			return dayNight(r)
+		}})
+	}
+	if config.Output.Geometry != "" {
+		columns = append(columns, outputColumn{Name: "geometry", Value: func(r *Record) string {
+			return pointGeometry(r.Longitude, r.Latitude, config)
+		}})
+	}
+	if len(config.Parameters.ReferencePoints) > 0 {
+		calc, err := selectedDistance(config)
+		if err != nil {
+			calc = distanceCalculators[defaultDistanceMethod]
+		}
+		for _, ref := range config.Parameters.ReferencePoints {
+			point := &Record{Latitude: ref.Latitude, Longitude: ref.Longitude}
+			columns = append(columns, floatColumn(referenceColumnName(ref), "distance", func(r *Record) float64 {
+				return calc.Distance(r, point)
+			}))
+		}
+	}
+	if config.Parameters.SpeedSource == "both" {
+		columns = append(columns, sourceSpeedColumn(config))
+	}
+	if len(config.Parameters.MergeWith) > 0 {
+		// original_row alone is ambiguous once several files are merged
+		columns = append(columns, outputColumn{Name: "source_file", Value: func(r *Record) string {
+			if r.SourceFile < len(config.inputFiles) {
+				return config.inputFiles[r.SourceFile]
+			}
+			return ""
+		}})
+	}
+	if config.metadata != nil {
+		columns = append(columns, metadataColumns(config.metadata)...)
+	}
+	if newRouteSet(config) != nil {
+		columns = append(columns,
+			outputColumn{Name: "route_distance_m", Numeric: true, Value: func(r *Record) string {
+				if r.RouteDistance < 0 {
+					return "" // no planned route for this device
+				}
+				return strconv.FormatFloat(r.RouteDistance, 'f', 1, 64)
+			}},
+			outputColumn{Name: "off_route", Boolean: true, Value: func(r *Record) string { return strconv.FormatBool(r.OffRoute) }},
+		)
+	}
+	return columns
+}
+
+// dayNight returns "day" when the sun was up at the record's place and time, else "night"
+func dayNight(r *Record) string {
+	if solar.IsDaylight(r.Latitude, r.Longitude, r.Timestamp) {
+		return "day"
+	}
+	return "night"
+}
+
+// referenceColumnName returns the name of the distance column for a reference point
+func referenceColumnName(ref ReferencePoint) string {
+	return "dist_" + strings.ReplaceAll(strings.TrimSpace(ref.Name), " ", "_") + "_km"
+}
+
+// checkReferencePoints validates the configured reference points
+func checkReferencePoints(config *Config) error {
+	seen := make(map[string]bool)
+	for _, ref := range config.Parameters.ReferencePoints {
+		if strings.TrimSpace(ref.Name) == "" {
+			return fmt.Errorf("reference point at %f,%f has no name", ref.Latitude, ref.Longitude)
+		}
+		if ref.Latitude < -90 || ref.Latitude > 90 || ref.Longitude < -180 || ref.Longitude > 180 {
+			return fmt.Errorf("reference point %q has invalid coordinates %f,%f", ref.Name, ref.Latitude, ref.Longitude)
+		}
+		name := referenceColumnName(ref)
+		if seen[name] {
+			return fmt.Errorf("duplicate reference point name %q", ref.Name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// selectedColumns resolves output.columns to output columns, in the configured order.
+// Passthrough columns may be placed explicitly; the rest are appended after the selected
+// columns, skipping any whose name clashes with a computed or configured column.
+func selectedColumns(config *Config) ([]outputColumn, error) {
+	if err := checkPrecision(config); err != nil {
+		return nil, err
+	}
+	if config.Output.GeohashPrecision < 0 || config.Output.GeohashPrecision > geohash.MaxPrecision {
+		return nil, fmt.Errorf("invalid output.geohash_precision %d (use 1 to %d, or 0 for no geohash column)",
+			config.Output.GeohashPrecision, geohash.MaxPrecision)
+	}
+	if len(config.Output.H3Resolutions) > 0 && !h3Available {
+		return nil, fmt.Errorf("output.h3_resolutions is not available in this build of gps-processor, which was compiled without cgo (build with CGO_ENABLED=1)")
+	}
+	for _, resolution := range config.Output.H3Resolutions {
+		if resolution < 0 || resolution > h3MaxResolution {
+			return nil, fmt.Errorf("invalid H3 resolution %d in output.h3_resolutions (use 0 to %d)", resolution, h3MaxResolution)
+		}
+	}
+	if err := checkReferencePoints(config); err != nil {
+		return nil, err
+	}
+	configured := configuredColumns(config)
+
+	names := config.Output.Columns
+	if len(names) == 0 {
+		names = defaultColumns
+		if config.Output.CRS != "" {
+			names = append(append([]string(nil), names...), projectedColumns...)
+		}
+		if config.Parameters.SpeedWindow != "" {
+			names = append(append([]string(nil), names...), "window_speed_kmh")
+		}
+		if config.Parameters.OutlierFilter == "flag" {
+			names = append(append([]string(nil), names...), "outlier")
+		}
+		if config.Parameters.SimplifyEpsilonM > 0 {
+			names = append(append([]string(nil), names...), "simplified")
+		}
+		if config.Parameters.TripStopMinutes > 0 {
+			names = append(append([]string(nil), names...), "trip")
+		}
+		if drivingEventsEnabled(config) {
+			names = append(append([]string(nil), names...), "event")
+		}
+		if config.Output.Anomalies {
+			names = append(append([]string(nil), names...), "anomaly")
+		}
+		if config.Energy.Fuel != "" {
+			names = append(append([]string(nil), names...), "energy_kwh")
+		}
+		if config.Columns.Altitude != "" {
+			names = append(append([]string(nil), names...), "altitude")
+		}
+		if config.Output.Units == "aviation" {
+			names = aviationDefaultColumns(names)
+		}
+		for _, column := range configured {
+			names = append(append([]string(nil), names...), column.Name)
+		}
+		for _, d := range config.Output.DerivedColumns {
+			names = append(append([]string(nil), names...), strings.TrimSpace(d.Name))
+		}
+	}
+
+	byName, derived, err := columnsByName(config, configured)
+	if err != nil {
+		return nil, err
+	}
+	configured = append(configured, derived...)
+
+	columns := make([]outputColumn, 0, len(names)+len(config.passthroughColumns))
+	used := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		column, ok := byName[name]
+		if !ok {
+			if name == "geohash" {
+				return nil, fmt.Errorf("output column %q requires output.geohash_precision to be set", name)
+			}
+			if strings.HasPrefix(name, "h3_r") {
+				return nil, fmt.Errorf("output column %q requires its resolution in output.h3_resolutions", name)
+			}
+			if config.Output.PassthroughColumns {
+				return nil, fmt.Errorf("unknown output column %q (not a computed column or an input column)", name)
+			}
+			return nil, fmt.Errorf("unknown output column %q (available: %s)", name, availableColumnNames())
+		}
+		if config.Output.CRS == "" && containsString(projectedColumns, name) {
+			return nil, fmt.Errorf("output column %q requires output.crs to be set", name)
+		}
+		if column.Precision != "" {
+			column = withDecimals(column, outputPrecision(config, column.Precision))
+		}
+		columns = append(columns, column)
+		used[name] = true
+	}
+
+	// Append the passthrough columns that were not placed explicitly
+	for i, name := range config.passthroughColumns {
+		if used[name] || isComputedColumn(name) || isConfiguredColumn(configured, name) {
+			continue
+		}
+		columns = append(columns, passthroughColumn(name, i))
+		used[name] = true
+	}
+	return columns, nil
+}
+
+// columnsByName returns every column that can be written or used in expressions, by name:
+// the passthrough, computed, configured and derived columns. It also returns the derived
+// columns.
+func columnsByName(config *Config, configured []outputColumn) (map[string]outputColumn, []outputColumn, error) {
+	byName := make(map[string]outputColumn, len(availableColumns)+len(config.passthroughColumns))
+	for i, name := range config.passthroughColumns {
+		byName[name] = passthroughColumn(name, i)
+	}
+	// Computed columns take precedence over input columns with the same name
+	for _, column := range availableColumns {
+		byName[column.Name] = column
+	}
+	for _, column := range configured {
+		byName[column.Name] = column
+	}
+	derived, err := derivedColumns(config, byName)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, column := range derived {
+		byName[column.Name] = column
+	}
+	return byName, derived, nil
+}
+
+// isComputedColumn reports whether name is one of the built-in output columns
+func isComputedColumn(name string) bool {
+	for _, column := range availableColumns {
+		if column.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isConfiguredColumn reports whether name is one of the given configured columns
+func isConfiguredColumn(configured []outputColumn, name string) bool {
+	for _, column := range configured {
+		if column.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// availableColumnNames returns a comma-separated list of the selectable column names
+func availableColumnNames() string {
+	names := make([]string, len(availableColumns))
+	for i, column := range availableColumns {
+		names[i] = column.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// columnHeader returns the header row for the given columns
+func columnHeader(columns []outputColumn) []string {
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Name
+	}
+	return header
+}
+
+// formatRow formats a record as a row with one value per column
+func formatRow(record *Record, columns []outputColumn) []string {
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		row[i] = column.Value(record)
+	}
+	return row
+}
+
+// appendCSVRow appends a record as a CSV line, quoting fields the same way encoding/csv does.
+// Columns with an Append function are formatted straight into buf.
+func appendCSVRow(buf []byte, record *Record, columns []outputColumn) []byte {
+	for i, column := range columns {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		if column.Append != nil {
+			buf = column.Append(buf, record)
+		} else {
+			buf = appendCSVField(buf, column.Value(record))
+		}
+	}
+	return append(buf, '\n')
+}
+
+// appendCSVField appends a single CSV field, quoting it when encoding/csv would
+func appendCSVField(buf []byte, field string) []byte {
+	if !csvFieldNeedsQuotes(field) {
+		return append(buf, field...)
+	}
+	buf = append(buf, '"')
+	for i := 0; i < len(field); i++ {
+		if field[i] == '"' {
+			buf = append(buf, '"')
+		}
+		buf = append(buf, field[i])
+	}
+	return append(buf, '"')
+}
+
+// csvFieldNeedsQuotes mirrors the quoting rule of encoding/csv for a comma delimiter
+func csvFieldNeedsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.ContainsAny(field, ",\"\r\n") {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comparison defaults
+const (
+	defaultCompareTolerance = 1e-6 // absolute difference numeric values may have
+	compareExamples         = 10   // rows listed per kind of difference
+)
+
+// compareTolerance is how far a numeric value may be from the expected one: within the
+// absolute tolerance, or within the relative tolerance of the expected value
+type compareTolerance struct {
+	abs, rel float64
+}
+
+// within reports whether a value is close enough to the expected one
+func (t compareTolerance) within(actual, expected float64) bool {
+	diff := math.Abs(actual - expected)
+	return diff <= t.abs || diff <= t.rel*math.Abs(expected) || actual == expected
+}
+
+// columnDiff summarizes the differences in one column
+type columnDiff struct {
+	rows    int     // rows with a difference beyond the tolerance
+	maxDiff float64 // largest numeric difference, NaN when only text differs
+	maxAt   string  // row with the largest difference
+}
+
+// comparison is the result of comparing the processed records with an expected CSV output
+type comparison struct {
+	expectedFile     string
+	tolerance        compareTolerance
+	actualRows       int
+	expectedRows     int
+	matchedRows      int
+	keyed            bool     // rows were matched by ID and timestamp rather than position
+	onlyActual       []string // rows missing from the expected file
+	onlyExpected     []string // expected rows the run did not produce
+	onlyActualCols   []string
+	onlyExpectedCols []string
+	columns          []string // compared columns, in output order
+	diffs            map[string]*columnDiff
+	examples         []string
+}
+
+// matches reports whether the run reproduced the expected output within the tolerances
+func (c *comparison) matches() bool {
+	return len(c.onlyActual) == 0 && len(c.onlyExpected) == 0 && len(c.diffs) == 0
+}
+
+// compareOutput compares the records, formatted with the output columns, with an expected
+// CSV output such as one written by an earlier version. Rows are matched by the ID and
+// timestamp columns when both files have them, and by position otherwise. Columns found in
+// both files are compared: numbers within the tolerance, timestamps as instants and
+// anything else as text.
+func compareOutput(records []Record, columns []outputColumn, expectedFile string, tolerance compareTolerance) (*comparison, error) {
+	file, err := os.Open(expectedFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open expected output: %w", err)
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("expected output %s is empty", expectedFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read expected output %s: %w", expectedFile, err)
+	}
+	expectedIndex := make(map[string]int, len(header))
+	for i, name := range header {
+		expectedIndex[strings.TrimSpace(name)] = i
+	}
+
+	c := &comparison{expectedFile: expectedFile, tolerance: tolerance, actualRows: len(records),
+		diffs: make(map[string]*columnDiff)}
+	actualIndex := make(map[string]int, len(columns))
+	for i, column := range columns {
+		actualIndex[column.Name] = i
+		if _, ok := expectedIndex[column.Name]; ok {
+			c.columns = append(c.columns, column.Name)
+		} else {
+			c.onlyActualCols = append(c.onlyActualCols, column.Name)
+		}
+	}
+	for _, name := range header {
+		if _, ok := actualIndex[strings.TrimSpace(name)]; !ok {
+			c.onlyExpectedCols = append(c.onlyExpectedCols, strings.TrimSpace(name))
+		}
+	}
+
+	_, idOK := actualIndex["ID"]
+	_, timeOK := actualIndex["timestamp"]
+	_, expectedIDOK := expectedIndex["ID"]
+	_, expectedTimeOK := expectedIndex["timestamp"]
+	c.keyed = idOK && timeOK && expectedIDOK && expectedTimeOK
+	actualKey := func(row []string, n int) string {
+		if c.keyed {
+			return row[actualIndex["ID"]] + " " + normalizedTimestamp(row[actualIndex["timestamp"]])
+		}
+		return fmt.Sprintf("row %d", n+2)
+	}
+	expectedKey := func(row []string, n int) string {
+		if c.keyed {
+			return rowField(row, expectedIndex["ID"]) + " " + normalizedTimestamp(rowField(row, expectedIndex["timestamp"]))
+		}
+		return fmt.Sprintf("row %d", n+2)
+	}
+
+	// Index the expected rows; a key may repeat, so each is a queue
+	expected := make(map[string][][]string)
+	var expectedOrder []string
+	for n := 0; ; n++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read expected output %s: %w", expectedFile, err)
+		}
+		key := expectedKey(row, n)
+		if len(expected[key]) == 0 {
+			expectedOrder = append(expectedOrder, key)
+		}
+		expected[key] = append(expected[key], row)
+		c.expectedRows++
+	}
+
+	for n := range records {
+		row := formatRow(&records[n], columns)
+		key := actualKey(row, n)
+		queue := expected[key]
+		if len(queue) == 0 {
+			c.onlyActual = append(c.onlyActual, key)
+			continue
+		}
+		want := queue[0]
+		expected[key] = queue[1:]
+		c.matchedRows++
+		for _, name := range c.columns {
+			c.compareField(key, name, row[actualIndex[name]], rowField(want, expectedIndex[name]))
+		}
+	}
+	for _, key := range expectedOrder {
+		for range expected[key] {
+			c.onlyExpected = append(c.onlyExpected, key)
+		}
+	}
+	return c, nil
+}
+
+// compareField compares one value with the expected one and records any difference
+func (c *comparison) compareField(key, name, actual, expected string) {
+	if actual == expected {
+		return
+	}
+	diff := math.NaN()
+	a, aErr := strconv.ParseFloat(actual, 64)
+	e, eErr := strconv.ParseFloat(expected, 64)
+	switch {
+	case aErr == nil && eErr == nil:
+		if c.tolerance.within(a, e) {
+			return
+		}
+		diff = math.Abs(a - e)
+	case actual != "" && normalizedTimestamp(actual) == normalizedTimestamp(expected):
+		return
+	}
+
+	d := c.diffs[name]
+	if d == nil {
+		d = &columnDiff{maxDiff: math.NaN()}
+		c.diffs[name] = d
+	}
+	d.rows++
+	if !math.IsNaN(diff) && (math.IsNaN(d.maxDiff) || diff > d.maxDiff) {
+		d.maxDiff, d.maxAt = diff, key
+	}
+	if len(c.examples) < compareExamples {
+		c.examples = append(c.examples, fmt.Sprintf("%s: %s expected %q, got %q", key, name, expected, actual))
+	}
+}
+
+// rowField returns a value of a CSV row, or "" when the row is short
+func rowField(row []string, i int) string {
+	if i < len(row) {
+		return row[i]
+	}
+	return ""
+}
+
+// normalizedTimestamp rewrites an RFC 3339 timestamp in UTC, so the same instant written
+// with another offset or precision matches; other values are returned as they are
+func normalizedTimestamp(value string) string {
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value))
+	if err != nil {
+		return value
+	}
+	return t.UTC().Format(outputTimeLayout)
+}
+
+// print writes the comparison as a human-readable report
+func (c *comparison) print(w io.Writer) {
+	fmt.Fprintf(w, "=== Comparison with %s ===\n", c.expectedFile)
+	how := "by position"
+	if c.keyed {
+		how = "by ID and timestamp"
+	}
+	fmt.Fprintf(w, "Rows: %d produced, %d expected, %d matched %s\n", c.actualRows, c.expectedRows, c.matchedRows, how)
+	fmt.Fprintf(w, "Tolerance: %g absolute, %g relative\n", c.tolerance.abs, c.tolerance.rel)
+	if len(c.onlyExpectedCols) > 0 {
+		fmt.Fprintf(w, "Columns only in the expected file (not compared): %s\n", strings.Join(c.onlyExpectedCols, ", "))
+	}
+	if len(c.onlyActualCols) > 0 {
+		fmt.Fprintf(w, "Columns only in this run (not compared): %s\n", strings.Join(c.onlyActualCols, ", "))
+	}
+	printRowList(w, "Expected rows not produced", c.onlyExpected)
+	printRowList(w, "Produced rows not expected", c.onlyActual)
+
+	if len(c.diffs) > 0 {
+		fmt.Fprintln(w, "\nColumns with differences beyond the tolerance:")
+		fmt.Fprintf(w, "  %-24s %8s  %s\n", "column", "rows", "largest difference")
+		for _, name := range c.columns {
+			d := c.diffs[name]
+			if d == nil {
+				continue
+			}
+			largest := "text differs"
+			if !math.IsNaN(d.maxDiff) {
+				largest = fmt.Sprintf("%g (%s)", d.maxDiff, d.maxAt)
+			}
+			fmt.Fprintf(w, "  %-24s %8d  %s\n", name, d.rows, largest)
+		}
+		fmt.Fprintln(w, "\nFirst differences:")
+		for _, example := range c.examples {
+			fmt.Fprintf(w, "  %s\n", example)
+		}
+	}
+
+	if c.matches() {
+		fmt.Fprintln(w, "\n✓ The output matches the expected file")
+	} else {
+		fmt.Fprintln(w, "\n✗ The output differs from the expected file")
+	}
+}
+
+// printRowList prints the number of rows in a list and the first few of them
+func printRowList(w io.Writer, title string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%s: %d\n", title, len(keys))
+	shown := append([]string(nil), keys...)
+	sort.Strings(shown)
+	if len(shown) > compareExamples {
+		shown = shown[:compareExamples]
+	}
+	for _, key := range shown {
+		fmt.Fprintf(w, "  %s\n", key)
+	}
+	if len(keys) > len(shown) {
+		fmt.Fprintf(w, "  ... and %d more\n", len(keys)-len(shown))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gps-processor/expr"
+)
+
+// DerivedColumn is an output column computed from other columns with an expression
+type DerivedColumn struct {
+	Name     string `yaml:"name"`
+	Expr     string `yaml:"expr"`     // e.g. speed_kmh / 3.6
+	Decimals *int   `yaml:"decimals"` // for numbers (default: 6, -1 = as many as needed)
+}
+
+// columnVariables makes output columns available to expressions by name
+type columnVariables struct {
+	byName map[string]outputColumn
+	values []func(r *Record) expr.Value // by variable index
+}
+
+// lookup resolves a column name for expr.Compile. Names match exactly or, when that is
+// unambiguous, regardless of case, so id refers to the ID column.
+func (v *columnVariables) lookup(name string) (int, expr.Kind, bool) {
+	column, ok := v.byName[name]
+	if !ok {
+		matches := 0
+		for other, c := range v.byName {
+			if strings.EqualFold(other, name) {
+				column = c
+				matches++
+			}
+		}
+		if matches != 1 {
+			return 0, 0, false
+		}
+	}
+	var kind expr.Kind
+	var value func(r *Record) expr.Value
+	switch {
+	case column.Float != nil:
+		kind, value = expr.Number, func(r *Record) expr.Value { return expr.NumberValue(column.Float(r)) }
+	case column.Boolean:
+		kind, value = expr.Bool, func(r *Record) expr.Value { return expr.BoolValue(column.Value(r) == "true") }
+	case column.Numeric:
+		// Whole numbers, or empty for a missing altitude
+		kind, value = expr.Number, func(r *Record) expr.Value { return expr.NumberValue(expr.StringValue(column.Value(r)).Float()) }
+	default:
+		kind, value = expr.String, func(r *Record) expr.Value { return expr.StringValue(column.Value(r)) }
+	}
+	v.values = append(v.values, value)
+	return len(v.values) - 1, kind, true
+}
+
+// env returns the values of the variables for a record
+func (v *columnVariables) env(r *Record) expr.Env {
+	return func(i int) expr.Value { return v.values[i](r) }
+}
+
+// derivedColumns compiles output.derived_columns against the other columns, given by name.
+// Each derived column may also use the ones defined before it.
+func derivedColumns(config *Config, byName map[string]outputColumn) ([]outputColumn, error) {
+	if len(config.Output.DerivedColumns) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]outputColumn, len(byName))
+	for name, column := range byName {
+		known[name] = column
+	}
+	var columns []outputColumn
+	for _, d := range config.Output.DerivedColumns {
+		name := strings.TrimSpace(d.Name)
+		if name == "" {
+			return nil, fmt.Errorf("output.derived_columns: a column has no name")
+		}
+		// A derived column may replace an input column, but not another output column
+		if _, exists := known[name]; exists && !containsString(config.passthroughColumns, name) {
+			return nil, fmt.Errorf("output.derived_columns: %q is already a column", name)
+		}
+		vars := &columnVariables{byName: known}
+		e, err := expr.Compile(d.Expr, vars.lookup)
+		if err != nil {
+			return nil, fmt.Errorf("output.derived_columns %q: %w", name, err)
+		}
+		decimals := defaultPrecision
+		if d.Decimals != nil {
+			decimals = *d.Decimals
+		}
+		if decimals < -1 || decimals > 17 {
+			return nil, fmt.Errorf("output.derived_columns %q: invalid decimals %d (use 0 to 17, or -1 for as many as needed)", name, decimals)
+		}
+
+		column := outputColumn{Name: name}
+		switch e.Kind() {
+		case expr.Number:
+			column.Numeric = true
+			column.Float = func(r *Record) float64 { return e.Eval(vars.env(r)).Num }
+			column.Value = func(r *Record) string {
+				f := column.Float(r)
+				if math.IsNaN(f) {
+					return ""
+				}
+				return strconv.FormatFloat(f, 'f', decimals, 64)
+			}
+		case expr.Bool:
+			column.Boolean = true
+			column.Value = func(r *Record) string { return strconv.FormatBool(e.Eval(vars.env(r)).Bool) }
+		default:
+			column.Value = func(r *Record) string { return e.Eval(vars.env(r)).Str }
+		}
+		known[name] = column
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// detectSampleRows is how many data rows are inspected when detecting columns
+const detectSampleRows = 200
+
+// columnNameHints lists common header names for each mapped column, best match first
+var columnNameHints = map[string][]string{
+	"id":        {"id", "device_id", "deviceid", "device", "imei", "vehicle_id", "vehicle", "unit_id", "unit", "tracker_id", "tracker", "track_id", "name"},
+	"latitude":  {"latitude", "lat", "lat_deg", "y"},
+	"longitude": {"longitude", "lon", "lng", "long", "lon_deg", "x"},
+	"timestamp": {"timestamp", "time", "datetime", "date_time", "ts", "gps_time", "recorded_at", "time_utc", "date"},
+}
+
+// columnMapping is a proposed assignment of input columns to the mapped roles
+type columnMapping struct {
+	ID        string
+	Latitude  string
+	Longitude string
+	Timestamp string
+}
+
+// complete reports whether every role has been assigned a column
+func (m columnMapping) complete() bool {
+	return m.ID != "" && m.Latitude != "" && m.Longitude != "" && m.Timestamp != ""
+}
+
+// readSample reads the header and up to n data rows from the input file
+func readSample(filename, encoding string, n int) ([]string, [][]string, error) {
+	reader, closer, err := openInput(filename, encoding)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closer.Close()
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading header: %w", err)
+	}
+	var rows [][]string
+	for len(rows) < n {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading row: %w", err)
+		}
+		rows = append(rows, row)
+	}
+	return header, rows, nil
+}
+
+// columnStats summarizes the sampled values of one input column
+type columnStats struct {
+	floats     int     // values that parse as numbers
+	minFloat   float64 // smallest numeric value
+	maxFloat   float64 // largest numeric value
+	timestamps int     // values that parse as timestamps
+	distinct   int     // number of distinct values
+	nonEmpty   int     // number of non-empty values
+}
+
+// sampleStats computes per-column statistics over the sampled rows
+func sampleStats(header []string, rows [][]string) []columnStats {
+	stats := make([]columnStats, len(header))
+	for i := range header {
+		seen := make(map[string]bool)
+		st := &stats[i]
+		for _, row := range rows {
+			if i >= len(row) {
+				continue
+			}
+			value := strings.TrimSpace(row[i])
+			if value == "" {
+				continue
+			}
+			st.nonEmpty++
+			seen[value] = true
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				if st.floats == 0 || f < st.minFloat {
+					st.minFloat = f
+				}
+				if st.floats == 0 || f > st.maxFloat {
+					st.maxFloat = f
+				}
+				st.floats++
+			}
+			if _, err := time.Parse(time.RFC3339, value); err == nil {
+				st.timestamps++
+			}
+		}
+		st.distinct = len(seen)
+	}
+	return stats
+}
+
+// nameScore rates how well a header name matches the hints for a role (0 = no match)
+func nameScore(name string, role string) int {
+	normalized := strings.ToLower(strings.TrimSpace(name))
+	hints := columnNameHints[role]
+	for i, hint := range hints {
+		if normalized == hint {
+			return 100 - i
+		}
+	}
+	for _, hint := range hints {
+		if len(hint) > 2 && strings.Contains(normalized, hint) {
+			return 20
+		}
+	}
+	return 0
+}
+
+// detectColumns proposes a column mapping from the header names and the sampled values
+func detectColumns(header []string, rows [][]string) columnMapping {
+	stats := sampleStats(header, rows)
+	used := make(map[int]bool)
+
+	// pick chooses the best-scoring unused column for a role
+	pick := func(role string, dataScore func(st columnStats) int) string {
+		best, bestScore := -1, 0
+		for i, name := range header {
+			if used[i] {
+				continue
+			}
+			score := nameScore(name, role) + dataScore(stats[i])
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			return ""
+		}
+		used[best] = true
+		return header[best]
+	}
+
+	// allNumericWithin scores columns whose sampled values are all numbers within ±limit
+	allNumericWithin := func(limit float64) func(st columnStats) int {
+		return func(st columnStats) int {
+			if st.nonEmpty == 0 || st.floats != st.nonEmpty {
+				return -100
+			}
+			if st.minFloat < -limit || st.maxFloat > limit {
+				return -100
+			}
+			return 30
+		}
+	}
+
+	var m columnMapping
+	m.Timestamp = pick("timestamp", func(st columnStats) int {
+		if st.nonEmpty > 0 && st.timestamps == st.nonEmpty {
+			return 60
+		}
+		return -100
+	})
+	m.Latitude = pick("latitude", allNumericWithin(90))
+	m.Longitude = pick("longitude", allNumericWithin(180))
+	m.ID = pick("id", func(st columnStats) int {
+		// Device IDs repeat across rows, unlike coordinates or timestamps
+		if st.nonEmpty == 0 {
+			return -100
+		}
+		if st.distinct < st.nonEmpty {
+			return 10
+		}
+		return 0
+	})
+	return m
+}
+
+// autoDetectColumns checks whether the configured columns exist in the input and, if not,
+// proposes a mapping detected from the header and data. In "apply" mode the mapping is used
+// directly; in "prompt" mode the user is asked to confirm it on an interactive terminal.
+func autoDetectColumns(inputFile string, config *Config) error {
+	mode := config.Columns.AutoDetect
+	if mode == "" || mode == "off" {
+		return nil
+	}
+	if mode != "prompt" && mode != "apply" {
+		return &configError{fmt.Errorf("unknown columns.auto_detect mode %q (supported: off, prompt, apply)", mode)}
+	}
+
+	header, rows, err := readSample(inputFile, config.Columns.Encoding, detectSampleRows)
+	if err != nil {
+		return err
+	}
+	if _, err := findColumns(header, config); err == nil {
+		return nil // the configured mapping already matches
+	}
+
+	m := detectColumns(header, rows)
+	if !m.complete() {
+		return &configError{fmt.Errorf("configured columns not found and auto-detection could not map every column (header: %s)",
+			strings.Join(header, ", "))}
+	}
+
+	fmt.Println("Configured columns were not found in the input. Detected mapping:")
+	fmt.Printf("  id:        %s\n", m.ID)
+	fmt.Printf("  latitude:  %s\n", m.Latitude)
+	fmt.Printf("  longitude: %s\n", m.Longitude)
+	fmt.Printf("  timestamp: %s\n", m.Timestamp)
+
+	if mode == "prompt" {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return &configError{fmt.Errorf("configured columns not found; confirm the detected mapping interactively or set columns.auto_detect to apply")}
+		}
+		fmt.Print("Use this mapping? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return &configError{fmt.Errorf("detected column mapping rejected")}
+		}
+	}
+
+	config.Columns.ID = m.ID
+	config.Columns.Latitude = m.Latitude
+	config.Columns.Longitude = m.Longitude
+	config.Columns.Timestamp = m.Timestamp
+	logInfo("Using detected column mapping.")
+	return nil
+}
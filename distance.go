@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"gps-processor/geodesic"
+	"gps-processor/haversine"
+)
+
+// defaultDistanceMethod is used when parameters.distance_method is not set
+const defaultDistanceMethod = "haversine"
+
+// fastDistanceMaxDegrees is the largest latitude or longitude difference for which the fast
+// distance method uses the equirectangular approximation; at about 11 km its error relative
+// to haversine is far below GPS noise
+const fastDistanceMaxDegrees = 0.1
+
+// distanceCalculator measures the distance in kilometers between consecutive points of a track.
+// It receives whole records so implementations can use more than the coordinates.
+type distanceCalculator interface {
+	Distance(from, to *Record) float64
+}
+
+// distanceFunc adapts a plain function to the distanceCalculator interface
+type distanceFunc func(from, to *Record) float64
+
+func (f distanceFunc) Distance(from, to *Record) float64 {
+	return f(from, to)
+}
+
+// distanceCalculators holds the available distance methods by name, selected with
+// parameters.distance_method; add implementations with registerDistance
+var distanceCalculators = map[string]distanceCalculator{}
+
+// registerDistance makes a distance calculator selectable under the given name
+func registerDistance(name string, calc distanceCalculator) {
+	distanceCalculators[name] = calc
+}
+
+func init() {
+	// Great-circle distance on a spherical earth
+	registerDistance("haversine", distanceFunc(func(from, to *Record) float64 {
+		return haversine.Distance(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	}))
+	// Fast flat-earth approximation, accurate for short hops between fixes
+	registerDistance("equirectangular", distanceFunc(func(from, to *Record) float64 {
+		return haversine.Equirectangular(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	}))
+	// Equirectangular for short segments such as 1 Hz fixes a few meters apart, haversine otherwise
+	registerDistance("fast", distanceFunc(func(from, to *Record) float64 {
+		if math.Abs(to.Latitude-from.Latitude) < fastDistanceMaxDegrees &&
+			math.Abs(to.Longitude-from.Longitude) < fastDistanceMaxDegrees {
+			return haversine.Equirectangular(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+		}
+		return haversine.Distance(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	}))
+	// Ellipsoidal distance on WGS84, falling back to haversine for nearly antipodal points
+	registerDistance("geodesic", distanceFunc(func(from, to *Record) float64 {
+		if d, ok := geodesic.Distance(from.Latitude, from.Longitude, to.Latitude, to.Longitude); ok {
+			return d
+		}
+		return haversine.Distance(from.Latitude, from.Longitude, to.Latitude, to.Longitude)
+	}))
+}
+
+// selectedDistance returns the distance calculator chosen in the configuration
+func selectedDistance(config *Config) (distanceCalculator, error) {
+	name := strings.ToLower(strings.TrimSpace(config.Parameters.DistanceMethod))
+	if name == "" {
+		name = defaultDistanceMethod
+	}
+	calc, ok := distanceCalculators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown distance method %q (supported: %s)", name, supportedDistanceMethods())
+	}
+	if config.Parameters.Distance3D {
+		calc = distance3D{horizontal: calc}
+	}
+	return calc, nil
+}
+
+// distance3D adds the change of altitude to the distances of a horizontal distance method
+// (parameters.distance_3d), where both points have an altitude
+type distance3D struct {
+	horizontal distanceCalculator
+}
+
+func (d distance3D) Distance(from, to *Record) float64 {
+	distance := d.horizontal.Distance(from, to)
+	if from.HasAltitude && to.HasAltitude {
+		return haversine.WithAltitude(distance, to.Altitude-from.Altitude)
+	}
+	return distance
+}
+
+// supportedDistanceMethods returns a comma-separated list of the registered distance methods
+func supportedDistanceMethods() string {
+	names := make([]string, 0, len(distanceCalculators))
+	for name := range distanceCalculators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
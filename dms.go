@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// coordinateFormats are the values of columns.coordinate_format
+var coordinateFormats = []string{"decimal", "dms"}
+
+// checkCoordinateFormat validates columns.coordinate_format
+func checkCoordinateFormat(config *Config) error {
+	switch config.Columns.CoordinateFormat {
+	case "", "decimal":
+		return nil
+	case "dms":
+		if config.Columns.CRS != "" {
+			return fmt.Errorf("columns.coordinate_format dms cannot be combined with columns.crs")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown columns.coordinate_format %q (use %s)", config.Columns.CoordinateFormat, strings.Join(coordinateFormats, " or "))
+}
+
+// parseDMS parses a coordinate in degrees, minutes and seconds, such as 40°26'46"N,
+// 40°26'46.3" N, N 40 26 46, 40°26.767'N or -40°26'46". Minutes and seconds are optional,
+// so plain decimal degrees are accepted too. hemispheres holds the two letters allowed for
+// the axis, positive first: "NS" for latitudes, which stay within 90°, and "EW" for
+// longitudes, which stay within 180°.
+func parseDMS(s string, hemispheres string) (float64, error) {
+	invalid := fmt.Errorf("%q is not a coordinate in degrees, minutes and seconds", s)
+	value := strings.ToUpper(strings.TrimSpace(s))
+	if value == "" {
+		return 0, invalid
+	}
+
+	// A hemisphere letter may come first or last
+	negative := false
+	if k := strings.IndexByte(hemispheres, value[0]); k >= 0 {
+		negative, value = k == 1, value[1:]
+	} else if k := strings.IndexByte(hemispheres, value[len(value)-1]); k >= 0 {
+		negative, value = k == 1, value[:len(value)-1]
+	}
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "-") {
+		if negative {
+			return 0, fmt.Errorf("%q has both a minus sign and a southern or western hemisphere", s)
+		}
+		negative, value = true, value[1:]
+	}
+
+	// The numbers are separated by symbols (° ' " ′ ″ º) or spaces; a minus sign is only
+	// allowed in front of the degrees
+	for _, r := range value {
+		if (unicode.IsLetter(r) && r != 'º') || r == '-' {
+			return 0, invalid
+		}
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if len(parts) == 0 || len(parts) > 3 {
+		return 0, invalid
+	}
+	var degrees float64
+	scale := 1.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, invalid
+		}
+		// Only the last part may have a fraction, and minutes and seconds stay below 60
+		if i < len(parts)-1 && strings.Contains(part, ".") {
+			return 0, fmt.Errorf("%q has a fraction before its last part", s)
+		}
+		if i > 0 && n >= 60 {
+			return 0, fmt.Errorf("%q has minutes or seconds of 60 or more", s)
+		}
+		degrees += n / scale
+		scale *= 60
+	}
+	limit := 180.0
+	if hemispheres == "NS" {
+		limit = 90
+	}
+	if degrees > limit {
+		return 0, fmt.Errorf("%q is more than %g degrees", s, limit)
+	}
+	if negative {
+		degrees = -degrees
+	}
+	return degrees, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseDMS(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		hemispheres string
+		want        float64
+		wantErr     bool
+	}{
+		{name: "degrees minutes seconds", value: `40°26'46"N`, hemispheres: "NS", want: 40.446111},
+		{name: "hemisphere first", value: "S 40 26 46", hemispheres: "NS", want: -40.446111},
+		{name: "decimal minutes", value: "40°26.767'N", hemispheres: "NS", want: 40.446117},
+		{name: "minus sign", value: `-73°59'8"`, hemispheres: "EW", want: -73.985556},
+		{name: "decimal degrees", value: "12.5", hemispheres: "EW", want: 12.5},
+		{name: "pole", value: "90°0'0\"S", hemispheres: "NS", want: -90},
+		{name: "antimeridian", value: "180 W", hemispheres: "EW", want: -180},
+		{name: "latitude beyond 90", value: `90°0'1"N`, hemispheres: "NS", wantErr: true},
+		{name: "latitude of 91", value: "91", hemispheres: "NS", wantErr: true},
+		{name: "longitude beyond 180", value: `180°30'E`, hemispheres: "EW", wantErr: true},
+		{name: "180 degrees latitude", value: "180 N", hemispheres: "NS", wantErr: true},
+		{name: "minutes of 60", value: `40°60'0"N`, hemispheres: "NS", wantErr: true},
+		{name: "seconds of 60", value: `40°26'60"N`, hemispheres: "NS", wantErr: true},
+		{name: "fractional seconds below 60", value: `40°26'59.99"N`, hemispheres: "NS", want: 40.449997},
+		{name: "negative minutes", value: `40°-26'46"N`, hemispheres: "NS", wantErr: true},
+		{name: "minus sign and southern hemisphere", value: "-40 26 S", hemispheres: "NS", wantErr: true},
+		{name: "wrong hemisphere", value: "40 26 E", hemispheres: "NS", wantErr: true},
+		{name: "fraction before the last part", value: "40.5 26", hemispheres: "NS", wantErr: true},
+		{name: "empty", value: " ", hemispheres: "NS", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDMS(tt.value, tt.hemispheres)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseDMS(%q) = %f, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-6 {
+				t.Errorf("parseDMS(%q) = %f, want %f", tt.value, got, tt.want)
+			}
+		})
+	}
+}
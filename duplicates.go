@@ -0,0 +1,93 @@
+package main
+
+import "fmt"
+
+// duplicatePolicy decides what happens to a device's points that share a timestamp, which
+// otherwise get a zero time difference and a speed of 0
+type duplicatePolicy struct {
+	mode    string   // first, last, average or reject; keep leaves the points as they are
+	removed []Record // points merged away, for the KML filtered layer
+	keep    bool     // remember the removed points
+}
+
+// newDuplicatePolicy builds the policy of parameters.duplicate_timestamps.
+// It returns nil when duplicates are kept.
+func newDuplicatePolicy(config *Config) (*duplicatePolicy, error) {
+	switch mode := config.Parameters.DuplicateTimestamps; mode {
+	case "", "keep":
+		return nil, nil
+	case "first", "last", "average", "reject":
+		return &duplicatePolicy{mode: mode, keep: config.Output.KMLFilteredLayer}, nil
+	default:
+		return nil, fmt.Errorf("unknown duplicate_timestamps %q (supported: keep, first, last, average, reject)", mode)
+	}
+}
+
+// apply merges the points of a time-sorted group that share a timestamp into one and returns
+// the resulting group and the number of points merged away. first and last keep the point
+// that came first or last in the input; average keeps the first with the mean position and
+// altitude of them all. reject fails on the first duplicate instead.
+func (d *duplicatePolicy) apply(id string, group []Record) ([]Record, int, error) {
+	if d == nil {
+		return group, 0, nil
+	}
+	kept := group[:0]
+	merged := 0
+	for start := 0; start < len(group); {
+		end := start + 1
+		for end < len(group) && group[end].Timestamp.Equal(group[start].Timestamp) {
+			end++
+		}
+		if end-start == 1 {
+			kept = append(kept, group[start])
+			start = end
+			continue
+		}
+		if d.mode == "reject" {
+			return nil, 0, fmt.Errorf("device %s has %d points at %s (rows %d and %d); duplicate_timestamps is reject",
+				id, end-start, group[start].Timestamp.Format(outputTimeLayout), group[start].OriginalRow, group[start+1].OriginalRow)
+		}
+
+		// The group is sorted by input row within a timestamp
+		point := group[start]
+		switch d.mode {
+		case "last":
+			point = group[end-1]
+		case "average":
+			point = averagePoints(group[start:end])
+		}
+		if d.keep {
+			for i := start; i < end; i++ {
+				if group[i].OriginalRow != point.OriginalRow {
+					d.removed = append(d.removed, group[i])
+				}
+			}
+		}
+		kept = append(kept, point)
+		merged += end - start - 1
+		start = end
+	}
+	return kept, merged, nil
+}
+
+// averagePoints returns the first point with the mean position of the points, and the mean
+// altitude of those that have one
+func averagePoints(points []Record) Record {
+	point := points[0]
+	var lat, lon, alt float64
+	altitudes := 0
+	for i := range points {
+		lat += points[i].Latitude
+		lon += points[i].Longitude
+		if points[i].HasAltitude {
+			alt += points[i].Altitude
+			altitudes++
+		}
+	}
+	point.Latitude = lat / float64(len(points))
+	point.Longitude = lon / float64(len(points))
+	if altitudes > 0 {
+		point.Altitude, point.HasAltitude = alt/float64(altitudes), true
+	}
+	return point
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checkEmissions validates the emissions settings: every class used must have a factor
+func checkEmissions(config *Config) error {
+	e := &config.Emissions
+	for class, factor := range e.Factors {
+		if factor < 0 {
+			return fmt.Errorf("emissions factor for %q must not be negative", class)
+		}
+	}
+	if e.DefaultClass != "" {
+		if _, ok := e.Factors[e.DefaultClass]; !ok {
+			return fmt.Errorf("emissions.default_class %q has no entry in emissions.factors", e.DefaultClass)
+		}
+	}
+	ids := make([]string, 0, len(e.Classes))
+	for id := range e.Classes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if _, ok := e.Factors[e.Classes[id]]; !ok {
+			return fmt.Errorf("emissions class %q of device %s has no entry in emissions.factors (defined: %s)",
+				e.Classes[id], id, strings.Join(emissionClasses(config), ", "))
+		}
+	}
+	return nil
+}
+
+// emissionClasses returns the classes that have an emissions factor, sorted
+func emissionClasses(config *Config) []string {
+	classes := make([]string, 0, len(config.Emissions.Factors))
+	for class := range config.Emissions.Factors {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// deviceClass returns the emissions class of a device and its factor in kg CO2 per km, or
+// false when the device has no class
+func deviceClass(id string, config *Config) (string, float64, bool) {
+	class, ok := config.Emissions.Classes[id]
+	if !ok {
+		class = config.Emissions.DefaultClass
+	}
+	factor, ok := config.Emissions.Factors[class]
+	return class, factor, ok
+}
+
+// writeEmissionsReport writes the estimated CO2 per trip or, when byDay is set, per day, from
+// the distance totals of energyByTrip or energyByDay. Devices without a class get an empty co2_kg.
+func writeEmissionsReport(filename string, rows []energyRow, byDay bool, config *Config) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create emissions report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	header := []string{"ID", "trip", "start", "end"}
+	if byDay {
+		header = []string{"ID", "day"}
+	}
+	_ = writer.Write(append(header, "class", "distance_km", "co2_kg"))
+	for _, row := range rows {
+		line := []string{row.ID, strconv.Itoa(row.Trip), row.Start.Format(outputTimeLayout), row.End.Format(outputTimeLayout)}
+		if byDay {
+			line = []string{row.ID, row.Start.Format("2006-01-02")}
+		}
+		class, factor, ok := deviceClass(row.ID, config)
+		co2 := ""
+		if ok {
+			co2 = strconv.FormatFloat(row.Distance*factor, 'f', 3, 64)
+		} else {
+			class = ""
+		}
+		_ = writer.Write(append(line,
+			class,
+			strconv.FormatFloat(row.Distance, 'f', outputPrecision(config, "distance"), 64),
+			co2,
+		))
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// encodingSampleSize is how much of a CSV input is looked at to detect its encoding
+const encodingSampleSize = 64 << 10
+
+// utf8BOM is the byte order mark some programs, Excel among them, write at the start of UTF-8 files
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// checkEncoding validates columns.encoding
+func checkEncoding(config *Config) error {
+	_, err := inputEncoding(config.Columns.Encoding)
+	return err
+}
+
+// inputEncoding returns the encoding named by columns.encoding, or nil for auto detection
+func inputEncoding(name string) (encoding.Encoding, error) {
+	switch name {
+	case "", "auto":
+		return nil, nil
+	case "utf-16", "UTF-16":
+		// Without a byte order mark, UTF-16 is little-endian as Windows writes it
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, &configError{fmt.Errorf("unknown columns.encoding %q (use auto, utf-8, utf-16, windows-1252 or another WHATWG encoding name)", name)}
+	}
+	return enc, nil
+}
+
+// inputDecoder returns the decoder of a CSV input, or nil when the input is UTF-8 and is read
+// as it is, together with the length of the UTF-8 byte order mark to skip. A byte order mark
+// always decides the encoding; otherwise the named encoding is used, or with auto the
+// encoding is detected from the start of the file: UTF-16 from its zero bytes, UTF-8 when
+// it is valid, and Windows-1252 otherwise. The file is left at its start.
+func inputDecoder(file *os.File, name string) (transform.Transformer, int64, error) {
+	enc, err := inputEncoding(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	sample := make([]byte, encodingSampleSize)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, 0, fmt.Errorf("error reading input: %w", err)
+	}
+	sample = sample[:n]
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("error reading input: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(sample, utf8BOM):
+		return nil, int64(len(utf8BOM)), nil
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}), bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).NewDecoder(), 0, nil
+	case enc == nil:
+		enc = detectEncoding(sample, n == encodingSampleSize)
+		logDebug("Input encoding detected as %s", encodingName(enc))
+	}
+	if enc == unicode.UTF8 {
+		return nil, 0, nil
+	}
+	return enc.NewDecoder(), 0, nil
+}
+
+// detectEncoding guesses the encoding of a file without a byte order mark from its start.
+// CSV files are mostly ASCII, so UTF-16 shows as a zero in every other byte. When the sample
+// is truncated, a character cut off at its end does not count against UTF-8.
+func detectEncoding(sample []byte, truncated bool) encoding.Encoding {
+	var even, odd int
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			even++
+		} else {
+			odd++
+		}
+	}
+	switch half := len(sample) / 2; {
+	case half > 0 && odd > half/2 && even < odd/8:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case half > 0 && even > half/2 && odd < even/8:
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	}
+	if truncated {
+		for i := len(sample) - 1; i >= 0 && i >= len(sample)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(sample[i]) {
+				if !utf8.FullRune(sample[i:]) {
+					sample = sample[:i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(sample) {
+		return unicode.UTF8
+	}
+	return charmap.Windows1252
+}
+
+// encodingName returns the name of an input encoding for messages
+func encodingName(enc encoding.Encoding) string {
+	switch enc {
+	case unicode.UTF8:
+		return "UTF-8"
+	case charmap.Windows1252:
+		return "Windows-1252"
+	}
+	return "UTF-16"
+}
+
+// csvInput reads the rows of a CSV input read as it is, reporting offsets in the file
+type csvInput struct {
+	*csv.Reader
+	base int64 // byte offset at which the reader starts, past a byte order mark
+}
+
+// InputOffset returns the byte offset in the input file just past the last row read
+func (r *csvInput) InputOffset() int64 {
+	return r.base + r.Reader.InputOffset()
+}
+
+// decodedInput reads the rows of a CSV input converted to UTF-8. It has no InputOffset, as
+// offsets in the converted text are not offsets in the file.
+type decodedInput struct {
+	rowReader
+}
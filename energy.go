@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Physical constants of the energy model
+const (
+	gravity    = 9.81  // m/s²
+	airDensity = 1.225 // kg/m³ at sea level and 15 °C
+)
+
+// fuelTypes maps the values of energy.fuel to the energy content of a liter of fuel in kWh;
+// electric vehicles draw from the battery and report no liters
+var fuelTypes = map[string]float64{
+	"diesel":   10.0,
+	"gasoline": 8.9,
+	"electric": 0,
+}
+
+// Vehicle defaults, roughly a mid-size car
+const (
+	defaultVehicleMassKg      = 1500.0
+	defaultDragAreaM2         = 0.7
+	defaultRollingResistance  = 0.01
+	defaultEngineEfficiency   = 0.3
+	defaultElectricEfficiency = 0.85
+)
+
+// checkEnergy validates the energy model settings
+func checkEnergy(config *Config) error {
+	e := &config.Energy
+	if e.Fuel == "" {
+		return nil
+	}
+	if _, ok := fuelTypes[e.Fuel]; !ok {
+		return fmt.Errorf("unknown energy.fuel %q (use diesel, gasoline or electric)", e.Fuel)
+	}
+	if e.MassKg < 0 || e.DragAreaM2 < 0 || e.RollingResistance < 0 || e.AuxiliaryKW < 0 {
+		return fmt.Errorf("energy.mass_kg, drag_area_m2, rolling_resistance and auxiliary_kw must not be negative")
+	}
+	if e.Efficiency < 0 || e.Efficiency > 1 || e.Regeneration < 0 || e.Regeneration > 1 {
+		return fmt.Errorf("energy.efficiency and energy.regeneration must be between 0 and 1")
+	}
+	return nil
+}
+
+// vehicleModel holds the energy settings with defaults applied
+type vehicleModel struct {
+	mass, dragArea, rolling, efficiency, auxiliaryKW, regeneration float64
+}
+
+// newVehicleModel returns the vehicle model, or nil when energy.fuel is not set
+func newVehicleModel(config *Config) *vehicleModel {
+	e := &config.Energy
+	if e.Fuel == "" {
+		return nil
+	}
+	m := &vehicleModel{
+		mass:         e.MassKg,
+		dragArea:     e.DragAreaM2,
+		rolling:      e.RollingResistance,
+		efficiency:   e.Efficiency,
+		auxiliaryKW:  e.AuxiliaryKW,
+		regeneration: e.Regeneration,
+	}
+	if m.mass == 0 {
+		m.mass = defaultVehicleMassKg
+	}
+	if m.dragArea == 0 {
+		m.dragArea = defaultDragAreaM2
+	}
+	if m.rolling == 0 {
+		m.rolling = defaultRollingResistance
+	}
+	if m.efficiency == 0 {
+		m.efficiency = defaultEngineEfficiency
+		if e.Fuel == "electric" {
+			m.efficiency = defaultElectricEfficiency
+		}
+	}
+	if e.Fuel != "electric" {
+		m.regeneration = 0 // combustion engines cannot recover braking energy
+	}
+	return m
+}
+
+// estimateEnergy sets the energy used over each segment of a time-sorted group, in kWh. The
+// power at the wheels overcomes inertia, air drag and rolling resistance at the segment's
+// average speed; the change from the previous segment's speed gives the acceleration. Energy
+// drawn is that work divided by the drivetrain efficiency, plus the auxiliary load while
+// moving. An electric vehicle recovers part of the braking work. The ground is taken as flat.
+func (m *vehicleModel) estimateEnergy(group []Record) {
+	prevSpeed := 0.0 // m/s over the previous segment
+	for i := range group {
+		r := &group[i]
+		if r.Outlier || r.PreviousRow == 0 || r.TimeDiff <= 0 {
+			if !r.Outlier {
+				prevSpeed = 0
+			}
+			continue
+		}
+		v := r.Speed / 3.6
+		a := (v - prevSpeed) / r.TimeDiff
+		prevSpeed = v
+
+		force := m.mass*a + 0.5*airDensity*m.dragArea*v*v
+		if v > 0 {
+			force += m.rolling * m.mass * gravity
+		}
+		work := force * v * r.TimeDiff / 3.6e6 // J to kWh
+		if work >= 0 {
+			r.Energy = work / m.efficiency
+		} else {
+			r.Energy = work * m.regeneration
+		}
+		if r.Distance > 0 {
+			r.Energy += m.auxiliaryKW * r.TimeDiff / 3600
+		}
+	}
+}
+
+// fuelLiters converts energy to liters of fuel, or returns false for electric vehicles
+func fuelLiters(kwh float64, config *Config) (float64, bool) {
+	density := fuelTypes[config.Energy.Fuel]
+	if density == 0 {
+		return 0, false
+	}
+	return kwh / density, true
+}
+
+// energyRow holds the distance and energy of one trip or one day of a device; the CO2
+// estimates use the distance
+type energyRow struct {
+	ID         string
+	Trip       int       // trip number, for the per-trip report
+	Start, End time.Time // the trip's time span, or the start of the day
+	Distance   float64   // kilometers
+	Energy     float64   // kWh
+}
+
+// energyByTrip returns the energy used on each trip
+func energyByTrip(records []Record) []energyRow {
+	trips := collectTrips(records)
+	rows := make([]energyRow, len(trips))
+	for i, t := range trips {
+		rows[i] = energyRow{ID: t.ID, Trip: t.Trip, Start: t.Start, End: t.End, Distance: t.Distance, Energy: t.Energy}
+	}
+	return rows
+}
+
+// energyByDay totals the energy per device and day, sorted by device ID and day. Days start
+// at midnight in loc and each segment counts towards the day of the point it ends at.
+func energyByDay(records []Record, loc *time.Location) []energyRow {
+	type key struct {
+		id  string
+		day time.Time
+	}
+	day := rollupPeriods["daily"]
+	totals := make(map[key]*energyRow)
+	for i := range records {
+		r := &records[i]
+		if r.Outlier {
+			continue
+		}
+		k := key{r.ID, day(r.Timestamp.In(loc))}
+		row, ok := totals[k]
+		if !ok {
+			row = &energyRow{ID: r.ID, Start: k.day}
+			totals[k] = row
+		}
+		row.Distance += r.Distance
+		row.Energy += r.Energy
+	}
+
+	rows := make([]energyRow, 0, len(totals))
+	for _, row := range totals {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].ID != rows[j].ID {
+			return rows[i].ID < rows[j].ID
+		}
+		return rows[i].Start.Before(rows[j].Start)
+	})
+	return rows
+}
+
+// writeEnergyReport writes the per-trip or, when byDay is set, the per-day energy estimates
+func writeEnergyReport(filename string, rows []energyRow, byDay bool, config *Config) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create energy report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	header := []string{"ID", "trip", "start", "end"}
+	if byDay {
+		header = []string{"ID", "day"}
+	}
+	_ = writer.Write(append(header, "distance_km", "energy_kwh", "fuel_l"))
+	for _, row := range rows {
+		line := []string{row.ID, strconv.Itoa(row.Trip), row.Start.Format(outputTimeLayout), row.End.Format(outputTimeLayout)}
+		if byDay {
+			line = []string{row.ID, row.Start.Format("2006-01-02")}
+		}
+		fuel := ""
+		if liters, ok := fuelLiters(row.Energy, config); ok {
+			fuel = strconv.FormatFloat(liters, 'f', 3, 64)
+		}
+		_ = writer.Write(append(line,
+			strconv.FormatFloat(row.Distance, 'f', outputPrecision(config, "distance"), 64),
+			strconv.FormatFloat(row.Energy, 'f', 3, 64),
+			fuel,
+		))
+	}
+	writer.Flush()
+	return writer.Error()
+}
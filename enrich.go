@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxEnrichLine is the longest JSON line accepted back from the enrichment command
+const maxEnrichLine = 16 * 1024 * 1024
+
+// enrichFields are the record fields sent to the enrichment command. They are informational:
+// the same keys in the command's output are not read back.
+var enrichFields = []string{"id", "latitude", "longitude", "timestamp", "original_row", "time_diff_seconds", "distance_km", "speed_kmh", "trip"}
+
+func init() {
+	registerStage(processingStage{
+		Name:        "external_command",
+		Description: "pipe the records as JSON lines through pipeline.command and add the fields it returns",
+		Run:         runEnrichCommand,
+		Check:       checkEnrichCommand,
+	})
+}
+
+// runEnrichCommand writes each record as a JSON object on its own line to the standard input
+// of pipeline.command and reads JSON objects back from its standard output. Returned objects
+// are matched to the records by original_row; records the command leaves out are dropped.
+// Keys the command adds become output columns, after any passthrough columns of the input.
+func runEnrichCommand(records []Record, config *Config) ([]Record, error) {
+	command := config.Pipeline.Command
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start %s: %w", command[0], err)
+	}
+
+	// Feed the command while its output is read, so neither side blocks on a full pipe
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writeEnrichInput(stdin, records, config)
+	}()
+
+	byRow := make(map[int]int, len(records))
+	for i, record := range records {
+		byRow[record.OriginalRow] = i
+	}
+	columns := make(map[string]int, len(config.passthroughColumns))
+	for i, name := range config.passthroughColumns {
+		columns[name] = i
+	}
+	sent := make(map[string]bool, len(enrichFields))
+	for _, name := range enrichFields {
+		sent[name] = true
+	}
+
+	type enriched struct {
+		index  int
+		values map[string]string
+	}
+	var results []enriched
+	added := make(map[string]bool)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxEnrichLine)
+	line := 0
+	var readErr error
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &object); err != nil {
+			readErr = fmt.Errorf("output line %d: %w", line, err)
+			break
+		}
+		var row int
+		if err := json.Unmarshal(object["original_row"], &row); err != nil {
+			readErr = fmt.Errorf("output line %d: missing or invalid original_row", line)
+			break
+		}
+		index, ok := byRow[row]
+		if !ok {
+			readErr = fmt.Errorf("output line %d: original_row %d was not sent", line, row)
+			break
+		}
+		values := make(map[string]string, len(object))
+		for key, raw := range object {
+			if sent[key] {
+				continue
+			}
+			values[key] = enrichValue(raw)
+			if _, ok := columns[key]; !ok {
+				added[key] = true
+			}
+		}
+		results = append(results, enriched{index, values})
+	}
+	if readErr == nil {
+		readErr = scanner.Err()
+	}
+	if readErr != nil {
+		// Stop the command so a half-read pipe does not leave it running
+		_ = cmd.Process.Kill()
+		io.Copy(io.Discard, stdout)
+	}
+	waitErr := cmd.Wait()
+	if err := <-writeErr; err != nil && readErr == nil && waitErr == nil {
+		return nil, fmt.Errorf("writing to %s: %w", command[0], err)
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if waitErr != nil {
+		return nil, fmt.Errorf("%s: %w", command[0], waitErr)
+	}
+
+	// New columns are appended in name order so repeated runs produce the same layout
+	names := make([]string, 0, len(added))
+	for name := range added {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		columns[name] = len(config.passthroughColumns)
+		config.passthroughColumns = append(config.passthroughColumns, name)
+	}
+
+	kept := make([]Record, 0, len(results))
+	for _, result := range results {
+		record := records[result.index]
+		passthrough := make([]string, len(config.passthroughColumns))
+		copy(passthrough, record.Passthrough)
+		for key, value := range result.values {
+			passthrough[columns[key]] = value
+		}
+		record.Passthrough = passthrough
+		kept = append(kept, record)
+	}
+	return kept, nil
+}
+
+// checkEnrichCommand makes sure there is a command to run
+func checkEnrichCommand(config *Config) error {
+	if len(config.Pipeline.Command) == 0 {
+		return fmt.Errorf("requires pipeline.command")
+	}
+	return nil
+}
+
+// writeEnrichInput writes the records as JSON lines and closes w
+func writeEnrichInput(w io.WriteCloser, records []Record, config *Config) error {
+	defer w.Close()
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	for i := range records {
+		r := &records[i]
+		object := make(map[string]interface{}, len(enrichFields)+len(r.Passthrough))
+		for j, name := range config.passthroughColumns {
+			if j < len(r.Passthrough) {
+				object[name] = r.Passthrough[j]
+			}
+		}
+		object["id"] = r.ID
+		object["latitude"] = r.Latitude
+		object["longitude"] = r.Longitude
+		object["timestamp"] = r.Timestamp.Format(time.RFC3339Nano)
+		object["original_row"] = r.OriginalRow
+		object["time_diff_seconds"] = r.TimeDiff
+		object["distance_km"] = r.Distance
+		object["speed_kmh"] = r.Speed
+		object["trip"] = r.Trip
+		if err := encoder.Encode(object); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// enrichValue converts a JSON value returned by the command to an output cell
+func enrichValue(raw json.RawMessage) string {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return string(raw)
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	// Objects and arrays are kept as compact JSON
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return string(raw)
+	}
+	return compact.String()
+}
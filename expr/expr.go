@@ -0,0 +1,530 @@
+// Package expr compiles and evaluates small expressions over named values, such as
+// speed_kmh / 3.6 or speed_kmh > 1 && ID != "TEST". Expressions are typed when compiled, so
+// mistakes like comparing a bool to a number are reported before any data is processed.
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of a value
+type Kind int
+
+// The kinds of values
+const (
+	Number Kind = iota
+	String
+	Bool
+)
+
+// String returns the name of the kind, for error messages
+func (k Kind) String() string {
+	switch k {
+	case Number:
+		return "number"
+	case String:
+		return "string"
+	}
+	return "bool"
+}
+
+// Value is the result of an expression or the value of a variable. Only the field of its
+// kind is set. A missing number is NaN.
+type Value struct {
+	Kind Kind
+	Num  float64
+	Str  string
+	Bool bool
+}
+
+// NumberValue, StringValue and BoolValue return a value of each kind
+func NumberValue(f float64) Value { return Value{Kind: Number, Num: f} }
+func StringValue(s string) Value  { return Value{Kind: String, Str: s} }
+func BoolValue(b bool) Value      { return Value{Kind: Bool, Bool: b} }
+
+// Float returns the value as a number. Strings are parsed, and those that are empty or not
+// numbers give NaN, so that text columns holding numbers can be used in arithmetic.
+func (v Value) Float() float64 {
+	switch v.Kind {
+	case Number:
+		return v.Num
+	case String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v.Str), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	if v.Bool {
+		return 1
+	}
+	return 0
+}
+
+// Text returns the value formatted as text, with numbers in their shortest form and NaN as ""
+func (v Value) Text() string {
+	switch v.Kind {
+	case Number:
+		if math.IsNaN(v.Num) {
+			return ""
+		}
+		return strconv.FormatFloat(v.Num, 'f', -1, 64)
+	case String:
+		return v.Str
+	}
+	return strconv.FormatBool(v.Bool)
+}
+
+// Variables resolves the name of a variable to the index Env is called with and its kind.
+// ok is false for unknown names.
+type Variables func(name string) (index int, kind Kind, ok bool)
+
+// Env returns the value of the variable with the given index
+type Env func(index int) Value
+
+// Expr is a compiled expression
+type Expr struct {
+	kind Kind
+	eval func(env Env) Value
+}
+
+// Kind returns the kind of the values the expression evaluates to
+func (e *Expr) Kind() Kind {
+	return e.kind
+}
+
+// Eval evaluates the expression
+func (e *Expr) Eval(env Env) Value {
+	return e.eval(env)
+}
+
+// Compile parses an expression and checks its types.
+//
+// Operands are numbers (1, 2.5, 1e3), strings in double or single quotes, true, false and
+// variables. Variable names are made of letters, digits and underscores; other names can be
+// written in backquotes, e.g. `speed (km/h)`. The operators are, from the lowest to the
+// highest precedence: ||, &&, comparisons (== != < <= > >=), + -, * / %, and the unary - and !.
+// + joins two strings. Comparing two strings compares them as text; otherwise strings are
+// read as numbers, with missing numbers unequal to everything. The functions are abs, sqrt,
+// floor, ceil, round(x[, decimals]), min, max, num (string to number), missing (empty or
+// NaN), if(condition, then, else), contains, starts_with, ends_with, lower and upper.
+func Compile(src string, vars Variables) (*Expr, error) {
+	tokens, err := scan(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, vars: vars}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos+1)
+	}
+	return e, nil
+}
+
+// Token kinds
+const (
+	tokenEOF = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+// token is a lexical element of an expression
+type token struct {
+	kind int
+	text string  // operator or name, or the value of a string
+	num  float64 // value of a number
+	pos  int     // byte offset in the source
+}
+
+// String describes a token for error messages
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// operators are the operator tokens, two-character ones first
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ","}
+
+// scan splits an expression into tokens
+func scan(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.' ||
+				(src[j] == 'e' || src[j] == 'E') ||
+				(src[j] == '+' || src[j] == '-') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+			f, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", src[i:j], i+1)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[i:j], num: f, pos: i})
+			i = j
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			var text strings.Builder
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' && j+1 < len(src) && c != '`' {
+					j++
+				}
+				text.WriteByte(src[j])
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated %c at position %d", c, i+1)
+			}
+			kind := tokenString
+			if c == '`' {
+				kind = tokenIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: text.String(), pos: i})
+			i = j + 1
+		case isLetter(c):
+			j := i
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[i:j], pos: i})
+			i = j
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i+1)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' }
+
+// parser compiles tokens by recursive descent, one function per precedence level
+type parser struct {
+	tokens []token
+	next   int
+	vars   Variables
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+// accept consumes the next token if it is one of the given operators
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.next++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+// expect consumes the given operator or fails
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		t := p.peek()
+		return fmt.Errorf("expected %q, found %s at position %d", op, t, t.pos+1)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (*Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkKinds("||", Bool, left, right); err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		left = &Expr{Bool, func(env Env) Value { return BoolValue(l(env).Bool || r(env).Bool) }}
+	}
+}
+
+func (p *parser) parseAnd() (*Expr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkKinds("&&", Bool, left, right); err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		left = &Expr{Bool, func(env Env) Value { return BoolValue(l(env).Bool && r(env).Bool) }}
+	}
+}
+
+func (p *parser) parseComparison() (*Expr, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	l, r := left.eval, right.eval
+	switch {
+	case left.kind == Bool || right.kind == Bool:
+		if left.kind != right.kind || (op != "==" && op != "!=") {
+			return nil, fmt.Errorf("cannot compare %s %s %s", left.kind, op, right.kind)
+		}
+		equal := op == "=="
+		return &Expr{Bool, func(env Env) Value { return BoolValue((l(env).Bool == r(env).Bool) == equal) }}, nil
+	case left.kind == String && right.kind == String:
+		return &Expr{Bool, func(env Env) Value { return BoolValue(compare(op, strings.Compare(l(env).Str, r(env).Str))) }}, nil
+	}
+	return &Expr{Bool, func(env Env) Value {
+		a, b := l(env).Float(), r(env).Float()
+		if math.IsNaN(a) || math.IsNaN(b) {
+			// Missing numbers are only unequal
+			return BoolValue(op == "!=")
+		}
+		c := 0
+		if a < b {
+			c = -1
+		} else if a > b {
+			c = 1
+		}
+		return BoolValue(compare(op, c))
+	}}, nil
+}
+
+// compare applies a comparison operator to the result of comparing two values
+func compare(op string, c int) bool {
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func (p *parser) parseSum() (*Expr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		if op == "+" && left.kind == String && right.kind == String {
+			left = &Expr{String, func(env Env) Value { return StringValue(l(env).Str + r(env).Str) }}
+			continue
+		}
+		if err := checkArithmetic(op, left, right); err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			left = &Expr{Number, func(env Env) Value { return NumberValue(l(env).Float() + r(env).Float()) }}
+		} else {
+			left = &Expr{Number, func(env Env) Value { return NumberValue(l(env).Float() - r(env).Float()) }}
+		}
+	}
+}
+
+func (p *parser) parseProduct() (*Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkArithmetic(op, left, right); err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		switch op {
+		case "*":
+			left = &Expr{Number, func(env Env) Value { return NumberValue(l(env).Float() * r(env).Float()) }}
+		case "/":
+			left = &Expr{Number, func(env Env) Value { return NumberValue(l(env).Float() / r(env).Float()) }}
+		default:
+			left = &Expr{Number, func(env Env) Value { return NumberValue(math.Mod(l(env).Float(), r(env).Float())) }}
+		}
+	}
+}
+
+func (p *parser) parseUnary() (*Expr, error) {
+	op, ok := p.accept("-", "!")
+	if !ok {
+		return p.parsePrimary()
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	e := operand.eval
+	if op == "!" {
+		if err := checkKinds("!", Bool, operand); err != nil {
+			return nil, err
+		}
+		return &Expr{Bool, func(env Env) Value { return BoolValue(!e(env).Bool) }}, nil
+	}
+	if err := checkArithmetic("-", operand); err != nil {
+		return nil, err
+	}
+	return &Expr{Number, func(env Env) Value { return NumberValue(-e(env).Float()) }}, nil
+}
+
+func (p *parser) parsePrimary() (*Expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokenNumber:
+		p.next++
+		v := NumberValue(t.num)
+		return &Expr{Number, func(Env) Value { return v }}, nil
+	case tokenString:
+		p.next++
+		v := StringValue(t.text)
+		return &Expr{String, func(Env) Value { return v }}, nil
+	case tokenIdent:
+		p.next++
+		if _, call := p.accept("("); call {
+			return p.parseCall(t)
+		}
+		if t.text == "true" || t.text == "false" {
+			v := BoolValue(t.text == "true")
+			return &Expr{Bool, func(Env) Value { return v }}, nil
+		}
+		index, kind, ok := p.vars(t.text)
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q at position %d", t.text, t.pos+1)
+		}
+		return &Expr{kind, func(env Env) Value { return env(index) }}, nil
+	case tokenOperator:
+		if t.text == "(" {
+			p.next++
+			e, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos+1)
+}
+
+// parseCall compiles the arguments of a function call and the call itself
+func (p *parser) parseCall(name token) (*Expr, error) {
+	var args []*Expr
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	f, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos+1)
+	}
+	e, err := f(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name.text, err)
+	}
+	return e, nil
+}
+
+// checkKinds fails unless every operand has the given kind
+func checkKinds(op string, kind Kind, operands ...*Expr) error {
+	for _, e := range operands {
+		if e.kind != kind {
+			return fmt.Errorf("%s needs %s operands, not %s", op, kind, e.kind)
+		}
+	}
+	return nil
+}
+
+// checkArithmetic fails when an operand of an arithmetic operator is a bool; strings are
+// read as numbers
+func checkArithmetic(op string, operands ...*Expr) error {
+	for _, e := range operands {
+		if e.kind == Bool {
+			return fmt.Errorf("%s needs number operands, not bool", op)
+		}
+	}
+	return nil
+}
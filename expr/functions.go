@@ -0,0 +1,144 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// function compiles a call from its compiled arguments
+type function func(args []*Expr) (*Expr, error)
+
+// functions are the functions expressions may call
+var functions = map[string]function{
+	"abs":         mathFunction(math.Abs),
+	"sqrt":        mathFunction(math.Sqrt),
+	"floor":       mathFunction(math.Floor),
+	"ceil":        mathFunction(math.Ceil),
+	"round":       compileRound,
+	"min":         extremeFunction(math.Min),
+	"max":         extremeFunction(math.Max),
+	"num":         compileNum,
+	"missing":     compileMissing,
+	"if":          compileIf,
+	"contains":    stringTest(strings.Contains),
+	"starts_with": stringTest(strings.HasPrefix),
+	"ends_with":   stringTest(strings.HasSuffix),
+	"lower":       stringFunction(strings.ToLower),
+	"upper":       stringFunction(strings.ToUpper),
+}
+
+// mathFunction compiles a function of one number
+func mathFunction(f func(float64) float64) function {
+	return func(args []*Expr) (*Expr, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument")
+		}
+		if err := checkArithmetic("argument", args...); err != nil {
+			return nil, err
+		}
+		a := args[0].eval
+		return &Expr{Number, func(env Env) Value { return NumberValue(f(a(env).Float())) }}, nil
+	}
+}
+
+// compileRound compiles round(x), to a whole number, and round(x, decimals)
+func compileRound(args []*Expr) (*Expr, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, fmt.Errorf("takes 1 or 2 arguments")
+	}
+	if err := checkArithmetic("argument", args...); err != nil {
+		return nil, err
+	}
+	a := args[0].eval
+	if len(args) == 1 {
+		return &Expr{Number, func(env Env) Value { return NumberValue(math.Round(a(env).Float())) }}, nil
+	}
+	d := args[1].eval
+	return &Expr{Number, func(env Env) Value {
+		scale := math.Pow(10, math.Round(d(env).Float()))
+		return NumberValue(math.Round(a(env).Float()*scale) / scale)
+	}}, nil
+}
+
+// extremeFunction compiles min or max of one or more numbers
+func extremeFunction(f func(a, b float64) float64) function {
+	return func(args []*Expr) (*Expr, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("takes at least 1 argument")
+		}
+		if err := checkArithmetic("argument", args...); err != nil {
+			return nil, err
+		}
+		return &Expr{Number, func(env Env) Value {
+			result := args[0].eval(env).Float()
+			for _, arg := range args[1:] {
+				result = f(result, arg.eval(env).Float())
+			}
+			return NumberValue(result)
+		}}, nil
+	}
+}
+
+// compileNum compiles num(x), which reads a string as a number, or NaN when it is not one
+func compileNum(args []*Expr) (*Expr, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("takes 1 argument")
+	}
+	a := args[0].eval
+	return &Expr{Number, func(env Env) Value { return NumberValue(a(env).Float()) }}, nil
+}
+
+// compileMissing compiles missing(x), which is true for empty strings and missing numbers
+func compileMissing(args []*Expr) (*Expr, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("takes 1 argument")
+	}
+	a := args[0].eval
+	return &Expr{Bool, func(env Env) Value {
+		v := a(env)
+		return BoolValue(v.Kind == String && strings.TrimSpace(v.Str) == "" || v.Kind == Number && math.IsNaN(v.Num))
+	}}, nil
+}
+
+// compileIf compiles if(condition, then, else); then and else must have the same kind
+func compileIf(args []*Expr) (*Expr, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("takes 3 arguments")
+	}
+	if args[0].kind != Bool {
+		return nil, fmt.Errorf("the condition must be bool, not %s", args[0].kind)
+	}
+	if args[1].kind != args[2].kind {
+		return nil, fmt.Errorf("both results must have the same kind, not %s and %s", args[1].kind, args[2].kind)
+	}
+	cond, then, otherwise := args[0].eval, args[1].eval, args[2].eval
+	return &Expr{args[1].kind, func(env Env) Value {
+		if cond(env).Bool {
+			return then(env)
+		}
+		return otherwise(env)
+	}}, nil
+}
+
+// stringTest compiles a test of a string against another, such as contains(ID, "TEST")
+func stringTest(f func(s, t string) bool) function {
+	return func(args []*Expr) (*Expr, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("takes 2 arguments")
+		}
+		a, b := args[0].eval, args[1].eval
+		return &Expr{Bool, func(env Env) Value { return BoolValue(f(a(env).Text(), b(env).Text())) }}, nil
+	}
+}
+
+// stringFunction compiles a function of one string
+func stringFunction(f func(string) string) function {
+	return func(args []*Expr) (*Expr, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument")
+		}
+		a := args[0].eval
+		return &Expr{String, func(env Env) Value { return StringValue(f(a(env).Text())) }}, nil
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gps-processor/expr"
+)
+
+// RecordFilter keeps the records for which parameters.filter is true
+type RecordFilter struct {
+	source string
+	expr   *expr.Expr
+	vars   *columnVariables
+}
+
+// NewRecordFilter compiles parameters.filter against the output columns. It returns nil
+// when no filter is configured. The passthrough columns must be known, so it is called once
+// the input header has been read.
+func NewRecordFilter(config *Config) (*RecordFilter, error) {
+	source := strings.TrimSpace(config.Parameters.Filter)
+	if source == "" {
+		return nil, nil
+	}
+	byName, _, err := columnsByName(config, configuredColumns(config))
+	if err != nil {
+		return nil, err
+	}
+	vars := &columnVariables{byName: byName}
+	e, err := expr.Compile(source, vars.lookup)
+	if err != nil {
+		return nil, fmt.Errorf("parameters.filter: %w", err)
+	}
+	if e.Kind() != expr.Bool {
+		return nil, fmt.Errorf("parameters.filter must be true or false for each record, not a %s", e.Kind())
+	}
+	return &RecordFilter{source: source, expr: e, vars: vars}, nil
+}
+
+// keep reports whether a record passes the filter; every record passes a nil filter
+func (f *RecordFilter) keep(r *Record) bool {
+	return f == nil || f.expr.Eval(f.vars.env(r)).Bool
+}
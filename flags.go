@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// stringList is a flag value that can be repeated or given as a comma-separated list
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// repeatedString is a flag value that collects every occurrence without splitting on commas
+type repeatedString []string
+
+func (l *repeatedString) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedString) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseArgs parses flags that may appear before, between or after the positional
+// arguments, and returns the positional arguments in their original order
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
@@ -0,0 +1,68 @@
+package geodesic
+
+import (
+	"math"
+)
+
+// WGS84 ellipsoid parameters
+const (
+	semiMajorAxis = 6378.137          // equatorial radius in kilometers
+	flattening    = 1 / 298.257223563 // ellipsoid flattening
+	semiMinorAxis = semiMajorAxis * (1 - flattening)
+)
+
+// maxIterations bounds Vincenty's iteration, which converges in a few steps except for
+// nearly antipodal points
+const maxIterations = 200
+
+// Distance calculates the distance between two points in kilometers along the WGS84
+// ellipsoid using Vincenty's inverse formula. It reports false if the iteration does not
+// converge, which can only happen for nearly antipodal points.
+func Distance(lat1, lon1, lat2, lon2 float64) (float64, bool) {
+	if lat1 == lat2 && lon1 == lon2 {
+		return 0, true
+	}
+
+	// Convert decimal degrees to radians and reduce latitudes to the auxiliary sphere
+	L := (lon2 - lon1) * math.Pi / 180
+	U1 := math.Atan((1 - flattening) * math.Tan(lat1*math.Pi/180))
+	U2 := math.Atan((1 - flattening) * math.Tan(lat2*math.Pi/180))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	var sinSigma, cosSigma, sigma, cosSqAlpha, cos2SigmaM float64
+	for i := 0; ; i++ {
+		if i == maxIterations {
+			return 0, false
+		}
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma = math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		if sinSigma == 0 {
+			return 0, true // coincident points
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha = 1 - sinAlpha*sinAlpha
+		cos2SigmaM = 0
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha // zero on equatorial lines
+		}
+		C := flattening / 16 * cosSqAlpha * (4 + flattening*(4-3*cosSqAlpha))
+		previous := lambda
+		lambda = L + (1-C)*flattening*sinAlpha*
+			(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-previous) < 1e-12 {
+			break
+		}
+	}
+
+	uSq := cosSqAlpha * (semiMajorAxis*semiMajorAxis - semiMinorAxis*semiMinorAxis) / (semiMinorAxis * semiMinorAxis)
+	A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+	deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+		B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+
+	return semiMinorAxis * A * (sigma - deltaSigma), true
+}
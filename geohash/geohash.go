@@ -0,0 +1,45 @@
+package geohash
+
+// base32 is the geohash alphabet
+const base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// MaxPrecision is the longest supported geohash, about 3.7 cm by 1.9 cm
+const MaxPrecision = 12
+
+// Encode returns the geohash of a point with the given number of characters
+func Encode(lat, lon float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLon, maxLon := -180.0, 180.0
+
+	hash := make([]byte, 0, precision)
+	bit, ch := 0, 0
+	even := true // geohash bits alternate between longitude and latitude, longitude first
+	for len(hash) < precision {
+		if even {
+			mid := (minLon + maxLon) / 2
+			if lon >= mid {
+				ch = ch<<1 | 1
+				minLon = mid
+			} else {
+				ch <<= 1
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch = ch<<1 | 1
+				minLat = mid
+			} else {
+				ch <<= 1
+				maxLat = mid
+			}
+		}
+		even = !even
+
+		if bit++; bit == 5 {
+			hash = append(hash, base32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// geojsonRecordSeparator starts each GeoJSON text in an RFC 8142 sequence
+const geojsonRecordSeparator = 0x1E
+
+// writeOutputGeoJSONSeq writes the processed records as a GeoJSON text sequence (RFC 8142):
+// one Point feature per record, each on its own line and preceded by a record separator, so
+// the file can be read as a stream instead of as one large FeatureCollection. The feature
+// properties are the selected output columns, in order.
+func writeOutputGeoJSONSeq(filename string, records []Record, config *Config) error {
+	columns, err := selectedColumns(config)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create output file: %w", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriterSize(file, csvWriteBufferSize)
+	bar := newProgress("Writing output GeoJSONSeq", len(records))
+
+	var buf []byte
+	for i := range records {
+		buf = appendGeoJSONFeature(buf[:0], &records[i], columns, config)
+		if _, err := writer.Write(buf); err != nil {
+			return fmt.Errorf("error writing feature: %w", err)
+		}
+		_ = bar.Add(1)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing output file: %w", err)
+	}
+
+	bar.Finish()
+	return nil
+}
+
+// appendGeoJSONFeature appends one record as a separator-prefixed, newline-terminated Point
+// feature. Numeric columns are written as JSON numbers and empty ones as null.
+func appendGeoJSONFeature(buf []byte, record *Record, columns []outputColumn, config *Config) []byte {
+	precision := outputPrecision(config, "coordinate")
+	buf = append(buf, geojsonRecordSeparator)
+	buf = append(buf, `{"type":"Feature","geometry":{"type":"Point","coordinates":[`...)
+	buf = strconv.AppendFloat(buf, record.Longitude, 'f', precision, 64)
+	buf = append(buf, ',')
+	buf = strconv.AppendFloat(buf, record.Latitude, 'f', precision, 64)
+	buf = append(buf, `]},"properties":{`...)
+	for i := range columns {
+		column := &columns[i]
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, column.Name)
+		buf = append(buf, ':')
+		value := column.Value(record)
+		switch {
+		case value == "" && column.Numeric:
+			buf = append(buf, "null"...)
+		case column.Numeric && isJSONNumber(value):
+			buf = append(buf, value...)
+		default:
+			buf = appendJSONString(buf, value)
+		}
+	}
+	return append(buf, "}}\n"...)
+}
+
+// isJSONNumber reports whether a formatted numeric value can be written unquoted. Values are
+// formatted by strconv, so only infinities and NaN fall outside the JSON number syntax.
+func isJSONNumber(value string) bool {
+	f, err := strconv.ParseFloat(value, 64)
+	return err == nil && !math.IsInf(f, 0) && !math.IsNaN(f)
+}
+
+// appendJSONString appends s as a JSON string
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
+}
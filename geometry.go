@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// geometryFormats are the values of output.geometry
+var geometryFormats = []string{"wkt", "wkb"}
+
+// OGC geometry type codes used in WKB
+const (
+	wkbPoint      = 1
+	wkbLineString = 2
+)
+
+// checkGeometry validates output.geometry
+func checkGeometry(config *Config) error {
+	if config.Output.Geometry == "" {
+		return nil
+	}
+	for _, format := range geometryFormats {
+		if config.Output.Geometry == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output.geometry %q (use %s)", config.Output.Geometry, strings.Join(geometryFormats, " or "))
+}
+
+// pointGeometry returns a position as a WKT POINT or hex WKB point, in the format of
+// output.geometry. Coordinates are longitude first, as both formats expect.
+func pointGeometry(lon, lat float64, config *Config) string {
+	return lineGeometry([][2]float64{{lon, lat}}, config)
+}
+
+// lineGeometry returns a path of longitude, latitude pairs as a WKT LINESTRING or hex WKB
+// line string in the format of output.geometry; a single position is written as a point and
+// an empty path as an empty string
+func lineGeometry(path [][2]float64, config *Config) string {
+	if len(path) == 0 {
+		return ""
+	}
+	if config.Output.Geometry == "wkb" {
+		return hex.EncodeToString(appendWKB(nil, path))
+	}
+
+	precision := outputPrecision(config, "coordinate")
+	var b strings.Builder
+	if len(path) == 1 {
+		b.WriteString("POINT(")
+	} else {
+		b.WriteString("LINESTRING(")
+	}
+	for i, p := range path {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(strconv.FormatFloat(p[0], 'f', precision, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(p[1], 'f', precision, 64))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// appendWKB appends the little-endian WKB encoding of a point or, for longer paths, a line string
+func appendWKB(buf []byte, path [][2]float64) []byte {
+	buf = append(buf, 1) // little-endian byte order
+	if len(path) == 1 {
+		buf = binary.LittleEndian.AppendUint32(buf, wkbPoint)
+	} else {
+		buf = binary.LittleEndian.AppendUint32(buf, wkbLineString)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(path)))
+	}
+	for _, p := range path {
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(p[0]))
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(p[1]))
+	}
+	return buf
+}
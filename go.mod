@@ -3,10 +3,27 @@ module gps-processor
 go 1.24
 
 require (
-        github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
-        github.com/rivo/uniseg v0.4.7 // indirect
-        github.com/schollz/progressbar/v3 v3.18.0 // indirect
-        golang.org/x/sys v0.29.0 // indirect
-        golang.org/x/term v0.28.0 // indirect
-        gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/schollz/progressbar/v3 v3.18.0
+	github.com/segmentio/kafka-go v0.4.51
+	github.com/uber/h3-go/v4 v4.5.0
+	github.com/xuri/excelize/v2 v2.9.1
+	golang.org/x/image v0.25.0
+	golang.org/x/term v0.32.0
+	golang.org/x/text v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	github.com/richardlehane/mscfb v1.0.4 // indirect
+	github.com/richardlehane/msoleps v1.0.4 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/tiendc/go-deepcopy v1.6.0 // indirect
+	github.com/xuri/efp v0.0.1 // indirect
+	github.com/xuri/nfp v0.0.1 // indirect
+	golang.org/x/crypto v0.38.0 // indirect
+	golang.org/x/net v0.40.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 )
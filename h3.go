@@ -0,0 +1,21 @@
+//go:build cgo
+
+package main
+
+import "github.com/uber/h3-go/v4"
+
+// h3Available reports whether this build can compute the h3_r<N> columns. The H3 library
+// is C code, so builds without cgo leave them out.
+const h3Available = true
+
+// h3MaxResolution is the finest H3 resolution
+const h3MaxResolution = h3.MaxResolution
+
+// h3Cell returns the index of the H3 cell at resolution that contains the point
+func h3Cell(latitude, longitude float64, resolution int) string {
+	cell, err := h3.LatLngToCell(h3.NewLatLng(latitude, longitude), resolution)
+	if err != nil {
+		return ""
+	}
+	return cell.String()
+}
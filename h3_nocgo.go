@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package main
+
+// h3Available reports whether this build can compute the h3_r<N> columns. The H3 library
+// is C code, so builds without cgo leave them out.
+const h3Available = false
+
+// h3MaxResolution is the finest H3 resolution
+const h3MaxResolution = 15
+
+// h3Cell is never called without cgo, as output.h3_resolutions is rejected
+func h3Cell(latitude, longitude float64, resolution int) string {
+	return ""
+}
@@ -24,3 +24,44 @@ func Distance(lat1, lon1, lat2, lon2 float64) float64 {
 
 	return distance
 }
+
+// Bearing calculates the initial bearing from the first point to the second in degrees,
+// measured clockwise from true north in the range [0, 360)
+func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	// Convert decimal degrees to radians
+	lat1 = lat1 * math.Pi / 180
+	lat2 = lat2 * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	bearing := math.Atan2(y, x) * 180 / math.Pi
+
+	return math.Mod(bearing+360, 360)
+}
+
+// Equirectangular approximates the distance between two points in kilometers by projecting
+// them onto a plane. It is much cheaper than Distance and accurate for the short distances
+// between consecutive GPS fixes, but degrades over long distances and near the poles.
+func Equirectangular(lat1, lon1, lat2, lon2 float64) float64 {
+	// Convert decimal degrees to radians
+	lat1 = lat1 * math.Pi / 180
+	lat2 = lat2 * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	if dLon > math.Pi {
+		dLon -= 2 * math.Pi
+	} else if dLon < -math.Pi {
+		dLon += 2 * math.Pi
+	}
+
+	x := dLon * math.Cos((lat1+lat2)/2)
+	y := lat2 - lat1
+	return earthRadius * math.Sqrt(x*x+y*y)
+}
+
+// WithAltitude combines a distance along the surface in kilometers with a change of altitude
+// in meters into the straight-line distance in kilometers, sqrt(d² + h²). The surface is taken
+// as flat over the distance, which holds for the short segments between consecutive fixes.
+func WithAltitude(distance, altitudeChange float64) float64 {
+	return math.Hypot(distance, altitudeChange/1000)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTML report settings
+const (
+	htmlReportMapWidth = 900
+	htmlReportCharts   = 50 // devices charted, so large fleets do not make the report unwieldy
+)
+
+// htmlReportAudit are the counts of how the records went from the input to the outputs, in
+// the order the steps run
+var htmlReportAudit = []string{
+	"input_records", "merge_duplicates", "invalid_rows", "ragged_rows_rejected", "gps_rollover_corrected", "implausible_timestamps",
+	"already_processed", "stitch_overlap", "home_points_removed", "sensitive_points_fuzzed", "sensitive_points_removed",
+	"devices_dropped", "duplicate_points_merged", "processed_records", "first_points_removed",
+	"speed_filtered", "expression_filtered", "output_records",
+}
+
+// htmlReportFilename returns the path of the HTML report, <basename>_report.html next to the outputs
+func htmlReportFilename(inputFile string, config *Config) string {
+	return strings.TrimSuffix(reportFilename(inputFile, "report", config), ".csv") + ".html"
+}
+
+// writeHTMLReport writes a self-contained HTML page with the summary statistics, how many
+// records each step removed, a map of the trajectories and the per-device charts. Everything
+// is inline, so the file can be mailed or archived on its own.
+func writeHTMLReport(filename, inputFile string, records []Record, counts map[string]int, config *Config) error {
+	loc, err := reportLocation(config)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create HTML report: %w", err)
+	}
+	defer file.Close()
+
+	summaries := summarizeDevices(records)
+	distance := func(km float64) string {
+		return strconv.FormatFloat(km, 'f', config.Output.DistancePrecision, 64)
+	}
+
+	fmt.Fprintln(file, "<!DOCTYPE html>")
+	fmt.Fprintln(file, "<html lang=\"en\">")
+	fmt.Fprintln(file, "<head>")
+	fmt.Fprintln(file, "<meta charset=\"utf-8\">")
+	fmt.Fprintf(file, "<title>GPS Processing Report: %s</title>\n", html.EscapeString(inputFile))
+	fmt.Fprintln(file, "<style>")
+	fmt.Fprintln(file, "body { font-family: sans-serif; margin: 2em; color: #222; }")
+	fmt.Fprintln(file, "table { border-collapse: collapse; margin-bottom: 1.5em; }")
+	fmt.Fprintln(file, "th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }")
+	fmt.Fprintln(file, "td.n { text-align: right; }")
+	fmt.Fprintln(file, "th { background: #f0f0f0; }")
+	fmt.Fprintln(file, "svg { display: block; margin-bottom: 1em; }")
+	fmt.Fprintln(file, "</style>")
+	fmt.Fprintln(file, "</head>")
+	fmt.Fprintln(file, "<body>")
+	fmt.Fprintln(file, "<h1>GPS Processing Report</h1>")
+	fmt.Fprintf(file, "<p>Input file: %s<br>\nGenerated: %s</p>\n",
+		html.EscapeString(inputFile), time.Now().In(loc).Format(outputTimeLayout))
+
+	// Summary
+	var total, maxSpeed float64
+	var first, last time.Time
+	for i, s := range summaries {
+		total += s.Distance
+		maxSpeed = max(maxSpeed, s.MaxSpeed)
+		if i == 0 || s.StartTime.Before(first) {
+			first = s.StartTime
+		}
+		if i == 0 || s.EndTime.After(last) {
+			last = s.EndTime
+		}
+	}
+	fmt.Fprintln(file, "<h2>Summary</h2>")
+	fmt.Fprintln(file, "<table>")
+	writeHTMLRow(file, "Devices", strconv.Itoa(len(summaries)))
+	writeHTMLRow(file, "Output records", strconv.Itoa(len(records)))
+	if len(summaries) > 0 {
+		writeHTMLRow(file, "First timestamp", first.In(loc).Format(outputTimeLayout))
+		writeHTMLRow(file, "Last timestamp", last.In(loc).Format(outputTimeLayout))
+	}
+	writeHTMLRow(file, "Total distance (km)", distance(total))
+	writeHTMLRow(file, "Maximum speed (km/h)", fmt.Sprintf("%.2f", maxSpeed))
+	fmt.Fprintln(file, "</table>")
+
+	// How the records went from the input to the outputs, then the other counts of the run
+	fmt.Fprintln(file, "<h2>Record Audit</h2>")
+	fmt.Fprintln(file, "<table>")
+	audited := make(map[string]bool)
+	for _, name := range htmlReportAudit {
+		audited[name] = true
+		if n, ok := counts[name]; ok {
+			writeHTMLRow(file, countLabel(name), strconv.Itoa(n))
+		}
+	}
+	fmt.Fprintln(file, "</table>")
+	var others []string
+	for name := range counts {
+		if !audited[name] {
+			others = append(others, name)
+		}
+	}
+	if len(others) > 0 {
+		sort.Strings(others)
+		fmt.Fprintln(file, "<h2>Other Counts</h2>")
+		fmt.Fprintln(file, "<table>")
+		for _, name := range others {
+			writeHTMLRow(file, countLabel(name), strconv.Itoa(counts[name]))
+		}
+		fmt.Fprintln(file, "</table>")
+	}
+
+	if len(records) > 0 {
+		fmt.Fprintln(file, "<h2>Map</h2>")
+		fmt.Fprint(file, plotSVG(records, htmlReportMapWidth, config))
+	}
+
+	// Per-device statistics and charts
+	fmt.Fprintln(file, "<h2>Devices</h2>")
+	fmt.Fprintln(file, "<table>")
+	fmt.Fprintln(file, "<tr><th>ID</th><th>Points</th><th>Start</th><th>End</th><th>Distance (km)</th><th>Average speed (km/h)</th><th>Maximum speed (km/h)</th></tr>")
+	for _, s := range summaries {
+		fmt.Fprintf(file, "<tr><td>%s</td><td class=\"n\">%d</td><td>%s</td><td>%s</td><td class=\"n\">%s</td><td class=\"n\">%.2f</td><td class=\"n\">%.2f</td></tr>\n",
+			html.EscapeString(deviceLabel(s.ID, config)), s.Points, s.StartTime.In(loc).Format(outputTimeLayout),
+			s.EndTime.In(loc).Format(outputTimeLayout), distance(s.Distance), s.AvgSpeed, s.MaxSpeed)
+	}
+	fmt.Fprintln(file, "</table>")
+
+	if len(records) > 0 {
+		fmt.Fprintln(file, "<h2>Charts</h2>")
+		groups := groupByID(records)
+		ids := sortedIDs(groups)
+		if len(ids) > htmlReportCharts {
+			fmt.Fprintf(file, "<p>Charts of the first %d of %d devices.</p>\n", htmlReportCharts, len(ids))
+			ids = ids[:htmlReportCharts]
+		}
+		for _, id := range ids {
+			group := groups[id]
+			sortByTime(group)
+			fmt.Fprint(file, deviceChart(id, group, loc, config))
+		}
+	}
+
+	fmt.Fprintln(file, "</body>")
+	fmt.Fprintln(file, "</html>")
+	return nil
+}
+
+// writeHTMLRow writes a table row of a heading cell and a value cell
+func writeHTMLRow(w io.Writer, heading, value string) {
+	fmt.Fprintf(w, "<tr><th>%s</th><td>%s</td></tr>\n", html.EscapeString(heading), html.EscapeString(value))
+}
+
+// countLabel turns a run report count name such as first_points_removed into a label
+func countLabel(name string) string {
+	label := strings.ReplaceAll(name, "_", " ")
+	return strings.ToUpper(label[:1]) + label[1:]
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+)
+
+// supportedLanguages are the languages of the console messages. English is the default and
+// needs no catalog; the others fall back to English for messages they do not translate.
+var supportedLanguages = []language.Tag{language.English, language.Spanish}
+
+// messageCatalogs holds the translations of each language, keyed by the English message
+// format or help line
+var messageCatalogs = map[language.Tag]map[string]string{
+	language.Spanish: spanishMessages,
+}
+
+// printer formats console messages in the chosen language, with its number formatting. It
+// is nil for English, which keeps the plain fmt formatting.
+var printer *message.Printer
+
+// translations holds the catalog of the chosen language, keyed by the English text. It is
+// nil for English.
+var translations map[string]string
+
+// setLanguage chooses the language of the console messages from a language name such as es
+// or a locale such as es_ES.UTF-8
+func setLanguage(name string) error {
+	tag, ok := matchLanguage(name)
+	if !ok {
+		return fmt.Errorf("unsupported language %q (supported: en, es)", name)
+	}
+	printer, translations = nil, nil
+	if tag != language.English {
+		b := catalog.NewBuilder(catalog.Fallback(language.English))
+		for key, msg := range messageCatalogs[tag] {
+			if err := b.SetString(tag, key, msg); err != nil {
+				return fmt.Errorf("message catalog %s: %w", tag, err)
+			}
+		}
+		printer = message.NewPrinter(tag, message.Catalog(b))
+		translations = messageCatalogs[tag]
+	}
+	return nil
+}
+
+// matchLanguage returns the supported language of a language name or locale
+func matchLanguage(name string) (language.Tag, bool) {
+	// Locales look like es_ES.UTF-8 or de_DE@euro; C and POSIX mean no particular language
+	name = strings.SplitN(strings.SplitN(name, ".", 2)[0], "@", 2)[0]
+	if name == "" || name == "C" || name == "POSIX" {
+		return language.English, true
+	}
+	tag, err := language.Parse(strings.ReplaceAll(name, "_", "-"))
+	if err != nil {
+		return language.English, false
+	}
+	_, i, confidence := language.NewMatcher(supportedLanguages).Match(tag)
+	if confidence == language.No {
+		return language.English, false
+	}
+	return supportedLanguages[i], true
+}
+
+// languageFromEnvironment chooses the language of the console messages from the locale
+// variables, in the order POSIX gives them precedence. An unsupported locale leaves the
+// messages in English.
+func languageFromEnvironment() {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			_ = setLanguage(value)
+			return
+		}
+	}
+}
+
+// localize formats a console message in the chosen language
+func localize(format string, args ...interface{}) string {
+	if printer == nil {
+		return fmt.Sprintf(format, args...)
+	}
+	return printer.Sprintf(format, args...)
+}
+
+// translate returns a fixed text in the chosen language. The text is looked up as is rather
+// than formatted, so a % in it is kept.
+func translate(text string) string {
+	if translated, ok := translations[text]; ok {
+		return translated
+	}
+	return text
+}
+
+// printHelp prints a line of the help text in the chosen language
+func printHelp(line string) {
+	fmt.Println(translate(line))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestTranslate(t *testing.T) {
+	catalog := map[string]string{
+		"Show this help message and exit": "Muestra esta ayuda y sale",
+		"Keep 100% of the rows":           "Conserva el 100% de las filas",
+	}
+	saved := messageCatalogs[language.Spanish]
+	messageCatalogs[language.Spanish] = catalog
+	defer func() {
+		messageCatalogs[language.Spanish] = saved
+		_ = setLanguage("en")
+	}()
+
+	tests := []struct {
+		name string
+		lang string
+		text string
+		want string
+	}{
+		{name: "translated", lang: "es", text: "Show this help message and exit", want: "Muestra esta ayuda y sale"},
+		{name: "translated with a percent sign", lang: "es", text: "Keep 100% of the rows", want: "Conserva el 100% de las filas"},
+		{name: "untranslated with a percent sign", lang: "es", text: "Speed above 50% of the limit (%d)", want: "Speed above 50% of the limit (%d)"},
+		{name: "English", lang: "en", text: "Keep 100% of the rows", want: "Keep 100% of the rows"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := setLanguage(tt.lang); err != nil {
+				t.Fatal(err)
+			}
+			if got := translate(tt.text); got != tt.want {
+				t.Errorf("translate(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// idFilter decides which device IDs are processed
+type idFilter struct {
+	include map[string]bool
+	exclude map[string]bool
+	pattern *regexp.Regexp
+}
+
+// newIDFilter builds an ID filter from the configuration.
+// It returns nil when no include, exclude or pattern rule is configured.
+func newIDFilter(config *Config) (*idFilter, error) {
+	p := &config.Parameters
+	if len(p.IncludeIDs) == 0 && len(p.ExcludeIDs) == 0 && p.IDPattern == "" {
+		return nil, nil
+	}
+
+	f := &idFilter{
+		include: make(map[string]bool, len(p.IncludeIDs)),
+		exclude: make(map[string]bool, len(p.ExcludeIDs)),
+	}
+	for _, id := range p.IncludeIDs {
+		f.include[id] = true
+	}
+	for _, id := range p.ExcludeIDs {
+		f.exclude[id] = true
+	}
+	if p.IDPattern != "" {
+		pattern, err := regexp.Compile(p.IDPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id_pattern: %w", err)
+		}
+		f.pattern = pattern
+	}
+	return f, nil
+}
+
+// Match reports whether records for the device ID should be processed.
+// An ID must be in the include list (if any), match the pattern (if any),
+// and not be in the exclude list.
+func (f *idFilter) Match(id string) bool {
+	if f == nil {
+		return true
+	}
+	if f.exclude[id] {
+		return false
+	}
+	if len(f.include) > 0 && !f.include[id] {
+		return false
+	}
+	if f.pattern != nil && !f.pattern.MatchString(id) {
+		return false
+	}
+	return true
+}
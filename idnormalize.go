@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultIDSeparator joins the values of columns.id_columns
+const defaultIDSeparator = "-"
+
+// idSeparator returns the separator of composite device IDs
+func idSeparator(config *Config) string {
+	if config.Columns.IDSeparator != "" {
+		return config.Columns.IDSeparator
+	}
+	return defaultIDSeparator
+}
+
+// idColumnName names the device ID column, or the columns of a composite ID, for messages
+func idColumnName(config *Config) string {
+	if len(config.Columns.IDColumns) > 0 {
+		return strings.Join(config.Columns.IDColumns, "+")
+	}
+	return config.Columns.ID
+}
+
+// IDReplacement is a regular expression replacement applied to device IDs
+type IDReplacement struct {
+	Pattern string `yaml:"pattern"` // regular expression, e.g. ^0+
+	With    string `yaml:"with"`    // replacement; $1 refers to the first group
+}
+
+// idNormalizer rewrites device IDs as they are read, so one device reported under several
+// spellings, e.g. with and without an IMEI: prefix, ends up in one group
+type idNormalizer struct {
+	trim     bool
+	prefixes []string
+	replace  []*regexp.Regexp
+	with     []string
+	caseMode string // upper, lower or "" to keep
+}
+
+// newIDNormalizer builds the normalizer of columns.id_rules. It returns nil when no rule is
+// configured.
+func newIDNormalizer(config *Config) (*idNormalizer, error) {
+	rules := &config.Columns.IDRules
+	if !rules.Trim && len(rules.StripPrefixes) == 0 && len(rules.Replace) == 0 && rules.Case == "" {
+		return nil, nil
+	}
+	n := &idNormalizer{trim: rules.Trim, prefixes: rules.StripPrefixes, caseMode: rules.Case}
+	switch rules.Case {
+	case "", "upper", "lower":
+	default:
+		return nil, fmt.Errorf("unknown columns.id_rules.case %q (use upper or lower)", rules.Case)
+	}
+	for _, r := range rules.Replace {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid columns.id_rules.replace pattern %q: %w", r.Pattern, err)
+		}
+		n.replace = append(n.replace, re)
+		n.with = append(n.with, r.With)
+	}
+	return n, nil
+}
+
+// apply returns the normalized ID. The rules run in a fixed order: trim, strip_prefixes
+// (the first that matches), replace (each in turn), then case.
+func (n *idNormalizer) apply(id string) string {
+	if n == nil {
+		return id
+	}
+	if n.trim {
+		id = strings.TrimSpace(id)
+	}
+	for _, prefix := range n.prefixes {
+		if strings.HasPrefix(id, prefix) {
+			id = id[len(prefix):]
+			break
+		}
+	}
+	for i, re := range n.replace {
+		id = re.ReplaceAllString(id, n.with[i])
+	}
+	switch n.caseMode {
+	case "upper":
+		id = strings.ToUpper(id)
+	case "lower":
+		id = strings.ToLower(id)
+	}
+	return id
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gps-processor/projection"
+
+	"golang.org/x/text/transform"
+)
+
+// rowReader is the common interface of the CSV and Excel input readers
+type rowReader interface {
+	Read() ([]string, error)
+}
+
+// inputColumns holds the positions of the mapped columns in the input header
+type inputColumns struct {
+	ID          int
+	Latitude    int
+	Longitude   int
+	Timestamp   int
+	Altitude    int   // optional altitude column, -1 when not configured
+	Speed       int   // optional source speed column, -1 when not configured
+	Date        int   // separate date column, -1 when timestamps are in one column
+	Time        int   // separate time column, -1 when timestamps are in one column
+	Passthrough []int // unmapped columns carried through to the output
+
+	// CRS converts projected input coordinates to WGS84; nil when the input is already WGS84
+	CRS projection.Projection
+	// Numbers is how coordinates, altitudes and speeds are written
+	Numbers numberFormat
+	// SpeedFactor converts source speeds to km/h (columns.speed_unit)
+	SpeedFactor float64
+	// DMS is set when coordinates are in degrees, minutes and seconds (columns.coordinate_format)
+	DMS bool
+	// Timestamps parses the timestamp, or the date and time joined by a space
+	Timestamps timestampParser
+	// IDs normalizes the device IDs (columns.id_rules); nil when they are kept as read
+	IDs *idNormalizer
+	// IDParts are the columns joined into the device ID (columns.id_columns), the first of
+	// which is ID; nil when the ID is a single column
+	IDParts     []int
+	IDSeparator string
+}
+
+// maxInvalidRowWarnings is the number of skipped rows reported as warnings; later ones are
+// debug messages
+const maxInvalidRowWarnings = 20
+
+// numberFormat describes how numbers are written in the input. Scientific notation such as
+// 5.2e1 is always accepted.
+type numberFormat struct {
+	decimal   string // decimal separator, "" for a point
+	thousands string // digit group separator, removed before parsing; "" for none
+}
+
+// inputNumberFormat returns the number format of columns.decimal_separator and
+// columns.thousands_separator
+func inputNumberFormat(config *Config) (numberFormat, error) {
+	f := numberFormat{thousands: config.Columns.ThousandsSeparator}
+	switch config.Columns.DecimalSeparator {
+	case "", ".":
+	case ",":
+		f.decimal = ","
+	default:
+		return f, &configError{fmt.Errorf("invalid columns.decimal_separator %q (use . or ,)", config.Columns.DecimalSeparator)}
+	}
+	switch f.thousands {
+	case "", ",", ".", " ", "'", "_":
+	default:
+		return f, &configError{fmt.Errorf("invalid columns.thousands_separator %q (use , . ' _ or a space)", f.thousands)}
+	}
+	decimal := f.decimal
+	if decimal == "" {
+		decimal = "."
+	}
+	if f.thousands == decimal {
+		return f, &configError{fmt.Errorf("columns.thousands_separator and the decimal separator are both %q", decimal)}
+	}
+	return f, nil
+}
+
+// parse parses a number, ignoring surrounding spaces and digit group separators
+func (f numberFormat) parse(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if f.thousands != "" {
+		s = strings.ReplaceAll(s, f.thousands, "")
+	}
+	if f.decimal != "" {
+		s = strings.Replace(s, f.decimal, ".", 1)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// openInput opens the input file and returns a reader over its rows, header first,
+// choosing the reader by file extension. CSV files are converted from the encoding named by
+// columns.encoding, or detected when it is auto or empty.
+func openInput(filename, encoding string) (rowReader, io.Closer, error) {
+	if isExcelFile(filename) {
+		return openXLSX(filename)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open file: %w", err)
+	}
+	decoder, bom, err := inputDecoder(file, encoding)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if decoder != nil {
+		return decodedInput{csv.NewReader(transform.NewReader(file, decoder))}, file, nil
+	}
+	if _, err := file.Seek(bom, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error reading input: %w", err)
+	}
+	return &csvInput{Reader: csv.NewReader(file), base: bom}, file, nil
+}
+
+// readInput reads and parses the input file, continuing from the checkpoint when resuming
+func readInput(filename string, config *Config, cp *checkpoint) ([]Record, error) {
+	reader, closer, err := openInput(filename, config.Columns.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	_, converted := reader.(decodedInput)
+
+	if cp.resuming() {
+		if reader, err = cp.seek(reader, closer); err != nil {
+			return nil, err
+		}
+	}
+
+	if isExcelFile(filename) {
+		// The row count is not known up front, so show an indeterminate spinner
+		return readRecords(reader, newProgress("Reading Excel", -1), config, cp)
+	}
+	if converted {
+		// Offsets in the converted text are not file offsets to size the progress bar by
+		return readRecords(reader, newProgress("Reading CSV", -1), config, cp)
+	}
+
+	// Size the progress bar by bytes so the file is only read once
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file: %w", err)
+	}
+	bar := newByteProgress("Reading CSV", info.Size())
+
+	return readRecords(reader, bar, config, cp)
+}
+
+// findColumns locates the configured columns in the header
+func findColumns(header []string, config *Config) (inputColumns, error) {
+	cols := inputColumns{ID: -1, Latitude: -1, Longitude: -1, Timestamp: -1, Altitude: -1, Speed: -1, Date: -1, Time: -1}
+	for i, col := range header {
+		// Unset optional columns must not match empty header cells
+		if col == "" {
+			continue
+		}
+		switch col {
+		case config.Columns.ID:
+			cols.ID = i
+		case config.Columns.Latitude:
+			cols.Latitude = i
+		case config.Columns.Longitude:
+			cols.Longitude = i
+		case config.Columns.Timestamp:
+			cols.Timestamp = i
+		case config.Columns.Altitude:
+			cols.Altitude = i
+		case config.Columns.Speed:
+			cols.Speed = i
+		case config.Columns.Date:
+			cols.Date = i
+		case config.Columns.Time:
+			cols.Time = i
+		}
+	}
+
+	// A composite ID is built from several columns; the first takes the place of the ID column
+	if len(config.Columns.IDColumns) > 0 {
+		for _, name := range config.Columns.IDColumns {
+			found := -1
+			for i, col := range header {
+				if col == name {
+					found = i
+					break
+				}
+			}
+			if found == -1 {
+				return cols, fmt.Errorf("missing ID column %s", name)
+			}
+			cols.IDParts = append(cols.IDParts, found)
+		}
+		cols.ID = cols.IDParts[0]
+		cols.IDSeparator = idSeparator(config)
+	}
+
+	// Validate all required columns exist; separate date and time columns replace the timestamp
+	timeFound := cols.Timestamp != -1
+	if config.Columns.Date != "" {
+		timeFound = cols.Date != -1 && cols.Time != -1
+		cols.Timestamp = -1
+	}
+	if cols.ID == -1 || cols.Latitude == -1 || cols.Longitude == -1 || !timeFound {
+		return cols, fmt.Errorf("missing required columns (%s, %s, %s, %s)",
+			idColumnName(config), config.Columns.Latitude, config.Columns.Longitude, timestampColumnName(config))
+	}
+	if config.Columns.Altitude != "" && cols.Altitude == -1 {
+		return cols, fmt.Errorf("missing altitude column %s", config.Columns.Altitude)
+	}
+	if config.Columns.Speed != "" && cols.Speed == -1 {
+		return cols, fmt.Errorf("missing speed column %s", config.Columns.Speed)
+	}
+
+	// Projected inputs hold easting in the longitude column and northing in the latitude column
+	crs, err := projection.Parse(config.Columns.CRS)
+	if err != nil {
+		return cols, err
+	}
+	cols.CRS = crs
+	if cols.SpeedFactor, err = sourceSpeedFactor(config); err != nil {
+		return cols, err
+	}
+	if cols.Numbers, err = inputNumberFormat(config); err != nil {
+		return cols, err
+	}
+	cols.DMS = config.Columns.CoordinateFormat == "dms"
+	if cols.Timestamps, err = newTimestampParser(config); err != nil {
+		return cols, err
+	}
+	if cols.IDs, err = newIDNormalizer(config); err != nil {
+		return cols, err
+	}
+
+	// Remember the unmapped columns so they can be carried through to the output
+	if config.Output.PassthroughColumns {
+		idPart := make(map[int]bool, len(cols.IDParts))
+		for _, i := range cols.IDParts {
+			idPart[i] = true
+		}
+		for i := range header {
+			if i != cols.ID && i != cols.Latitude && i != cols.Longitude && i != cols.Timestamp && i != cols.Altitude &&
+				i != cols.Speed && i != cols.Date && i != cols.Time && !idPart[i] {
+				cols.Passthrough = append(cols.Passthrough, i)
+			}
+		}
+	}
+	return cols, nil
+}
+
+// setDeviceID stores the device ID of a row in its ID column, where parseRecord reads it:
+// the id_columns joined, if configured, normalized by columns.id_rules
+func (cols *inputColumns) setDeviceID(row []string) {
+	id := row[cols.ID]
+	if len(cols.IDParts) > 0 {
+		parts := make([]string, len(cols.IDParts))
+		for i, index := range cols.IDParts {
+			parts[i] = strings.TrimSpace(row[index])
+		}
+		id = strings.Join(parts, cols.IDSeparator)
+	}
+	row[cols.ID] = cols.IDs.apply(id)
+}
+
+// coordinate parses a latitude or longitude in the input's coordinate format; hemispheres
+// are the letters allowed in degrees, minutes and seconds
+func (cols *inputColumns) coordinate(s, hemispheres string) (float64, error) {
+	if cols.DMS {
+		return parseDMS(s, hemispheres)
+	}
+	return cols.Numbers.parse(s)
+}
+
+// parseRecord converts an input row into a record
+func parseRecord(row []string, cols inputColumns, rowNumber int) (Record, error) {
+	// Parse latitude and longitude
+	lat, err := cols.coordinate(row[cols.Latitude], "NS")
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid latitude at row %d: %w", rowNumber, err)
+	}
+	lon, err := cols.coordinate(row[cols.Longitude], "EW")
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid longitude at row %d: %w", rowNumber, err)
+	}
+
+	if cols.CRS != nil {
+		lat, lon = cols.CRS.ToWGS84(lon, lat)
+	}
+
+	// Parse timestamp
+	var ts time.Time
+	if cols.Date >= 0 {
+		ts, err = cols.Timestamps.parse(strings.TrimSpace(row[cols.Date]) + " " + strings.TrimSpace(row[cols.Time]))
+	} else {
+		ts, err = cols.Timestamps.parse(row[cols.Timestamp])
+	}
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid timestamp at row %d: %w", rowNumber, err)
+	}
+
+	// Altitude is optional per row; an empty cell means the fix had none
+	var alt float64
+	hasAlt := false
+	if cols.Altitude >= 0 && strings.TrimSpace(row[cols.Altitude]) != "" {
+		if alt, err = cols.Numbers.parse(row[cols.Altitude]); err != nil {
+			return Record{}, fmt.Errorf("invalid altitude at row %d: %w", rowNumber, err)
+		}
+		hasAlt = true
+	}
+
+	// The source speed is optional in the same way
+	var speed float64
+	hasSpeed := false
+	if cols.Speed >= 0 && strings.TrimSpace(row[cols.Speed]) != "" {
+		if speed, err = cols.Numbers.parse(row[cols.Speed]); err != nil {
+			return Record{}, fmt.Errorf("invalid speed at row %d: %w", rowNumber, err)
+		}
+		speed *= cols.SpeedFactor
+		hasSpeed = true
+	}
+
+	// Collect passthrough values in input column order
+	var passthrough []string
+	if len(cols.Passthrough) > 0 {
+		passthrough = make([]string, len(cols.Passthrough))
+		for i, idx := range cols.Passthrough {
+			passthrough[i] = row[idx]
+		}
+	}
+
+	return Record{
+		ID:             row[cols.ID],
+		Latitude:       lat,
+		Longitude:      lon,
+		Timestamp:      ts,
+		Altitude:       alt,
+		HasAltitude:    hasAlt,
+		SourceSpeed:    speed,
+		HasSourceSpeed: hasSpeed,
+		OriginalRow:    rowNumber,
+		Passthrough:    passthrough,
+	}, nil
+}
+
+// readRecords parses GPS records from a row reader whose first row is the header,
+// saving progress to the checkpoint (if any) as it goes
+func readRecords(reader rowReader, bar ProgressReporter, config *Config, cp *checkpoint) ([]Record, error) {
+	ids, err := newIDFilter(config)
+	if err != nil {
+		return nil, err
+	}
+	skipInvalid := config.Columns.InvalidRows == "skip"
+	config.invalidRows = 0
+	config.raggedRows.fitted, config.raggedRows.rejected = 0, 0
+
+	// Read the header
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %w", err)
+	}
+
+	// Find column indices based on configuration
+	cols, err := findColumns(header, config)
+	if err != nil {
+		return nil, err
+	}
+	config.passthroughColumns = nil
+	for _, idx := range cols.Passthrough {
+		config.passthroughColumns = append(config.passthroughColumns, header[idx])
+	}
+
+	// CSV readers report the byte offset of each row, used for byte-based progress and checkpoints
+	offset := func() int64 { return 0 }
+	r, byteProgress := reader.(interface{ InputOffset() int64 })
+	if byteProgress {
+		offset = r.InputOffset
+	}
+	var lastOffset int64
+
+	records := cp.restoredRecords()
+	rowNumber := cp.startRow() // Starting from 1 to account for header
+
+	// Read the rest of the rows
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		rowNumber++
+
+		// Update progress bar
+		if byteProgress {
+			pos := offset()
+			_ = bar.Add(int(pos - lastOffset))
+			lastOffset = pos
+		} else {
+			_ = bar.Add(1)
+		}
+
+		if errors.Is(err, csv.ErrFieldCount) {
+			var rejected *raggedRowError
+			row, err = fitRow(row, len(header), rowNumber, config)
+			if errors.As(err, &rejected) && rejected.skip {
+				if config.raggedRows.rejected++; config.raggedRows.rejected <= maxInvalidRowWarnings {
+					logWarn("Skipping %v", err)
+				} else {
+					logDebug("Skipping %v", err)
+				}
+				continue
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+
+		// Skip devices that were not selected, by their normalized ID
+		cols.setDeviceID(row)
+		if !ids.Match(row[cols.ID]) {
+			continue
+		}
+
+		record, err := parseRecord(row, cols, rowNumber)
+		if err != nil && skipInvalid {
+			if config.invalidRows++; config.invalidRows <= maxInvalidRowWarnings {
+				logWarn("Skipping %v", err)
+			} else {
+				logDebug("Skipping %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+
+		if cp.due(rowNumber) {
+			if err := cp.saveRead(records, rowNumber, offset(), false); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := cp.saveRead(records, rowNumber, offset(), true); err != nil {
+		return nil, err
+	}
+	bar.Finish()
+	if config.invalidRows > 0 {
+		logWarn("Skipped %d rows that could not be parsed", config.invalidRows)
+	}
+	if config.raggedRows.fitted > 0 {
+		logWarn("Fitted %d rows with missing or extra fields to the header", config.raggedRows.fitted)
+	}
+	if config.raggedRows.rejected > 0 {
+		logWarn("Skipped %d rows with missing or extra fields", config.raggedRows.rejected)
+	}
+	return records, nil
+}
+
+// raggedRowError is a row with more or fewer fields than the header. skip is set when
+// columns.ragged_rows leaves the row out rather than stopping the run.
+type raggedRowError struct {
+	row, fields, width int
+	skip               bool
+}
+
+func (e *raggedRowError) Error() string {
+	return fmt.Sprintf("row %d: %d fields where the header has %d", e.row, e.fields, e.width)
+}
+
+// fitRow applies columns.ragged_rows to a row the CSV reader found to have more or fewer
+// fields than the header: pad fills missing trailing fields with empty ones and drops extra
+// ones, truncate only drops extra ones, and reject leaves the row out. The error is a
+// *raggedRowError when the row is not used.
+func fitRow(row []string, width, rowNumber int, config *Config) ([]string, error) {
+	mode := config.Columns.RaggedRows
+	ragged := &raggedRowError{row: rowNumber, fields: len(row), width: width}
+	switch {
+	case mode == "pad" && len(row) < width:
+		row = append(row, make([]string, width-len(row))...)
+	case (mode == "pad" || mode == "truncate") && len(row) > width:
+		row = row[:width]
+	case mode == "truncate" || mode == "reject":
+		ragged.skip = true
+		return nil, ragged
+	default:
+		return nil, fmt.Errorf("%w (set columns.ragged_rows to pad, truncate or reject)", ragged)
+	}
+	config.raggedRows.fitted++
+	return row, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// Kafka client settings
+const (
+	defaultKafkaGroup     = "gps-processor"
+	defaultKafkaBatchSize = 100
+	// kafkaFlushDelay is how long the stream waits for another fix before it publishes the
+	// fixes read so far, so a quiet topic does not hold them back
+	kafkaFlushDelay = 200 * time.Millisecond
+	kafkaTimeout    = 10 * time.Second
+)
+
+// kafkaSource is the consumer side of a Kafka stream, implemented by *kafka.Reader
+type kafkaSource interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaSink is the producer side of a Kafka stream, implemented by *kafka.Writer
+type kafkaSink interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// newKafkaClients connects the stream to the brokers of the stream section: a consumer of the
+// input topic in the configured group and a producer for the output topic
+func newKafkaClients(config *Config) (kafkaSource, kafkaSink, error) {
+	st := &config.Stream
+	if st.KafkaInputTopic == "" || st.KafkaOutputTopic == "" {
+		return nil, nil, fmt.Errorf("stream.kafka_brokers requires stream.kafka_input_topic and stream.kafka_output_topic")
+	}
+	if st.KafkaInputTopic == st.KafkaOutputTopic {
+		return nil, nil, fmt.Errorf("stream.kafka_output_topic must differ from stream.kafka_input_topic")
+	}
+	if st.KafkaBatchSize < 0 {
+		return nil, nil, fmt.Errorf("stream.kafka_batch_size must not be negative")
+	}
+	group := st.KafkaGroup
+	if group == "" {
+		group = defaultKafkaGroup
+	}
+	batchSize := kafkaBatchSize(config)
+
+	dialer := &kafka.Dialer{Timeout: kafkaTimeout, DualStack: true}
+	transport := &kafka.Transport{DialTimeout: kafkaTimeout}
+	if st.KafkaTLS {
+		dialer.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		transport.TLS = dialer.TLS
+	}
+	if st.KafkaUsername != "" {
+		mechanism := plain.Mechanism{Username: st.KafkaUsername, Password: st.KafkaPassword}
+		dialer.SASLMechanism = mechanism
+		transport.SASL = mechanism
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     st.KafkaBrokers,
+		GroupID:     group,
+		Topic:       st.KafkaInputTopic,
+		Dialer:      dialer,
+		StartOffset: kafka.FirstOffset,
+		// Offsets are only committed explicitly, once the fixes are published
+		CommitInterval: 0,
+		// The consumer keeps retrying unreachable brokers, so say why no fixes arrive
+		ErrorLogger: kafka.LoggerFunc(logWarn),
+	})
+	writer := &kafka.Writer{
+		Addr:  kafka.TCP(st.KafkaBrokers...),
+		Topic: st.KafkaOutputTopic,
+		// The input key, normally the device ID, picks the partition, so each device's
+		// fixes stay in order
+		Balancer:     &kafka.Hash{},
+		BatchSize:    batchSize,
+		BatchTimeout: 10 * time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+		Transport:    transport,
+		ErrorLogger:  kafka.LoggerFunc(logWarn),
+	}
+	return reader, writer, nil
+}
+
+// kafkaBatchSize returns stream.kafka_batch_size or its default
+func kafkaBatchSize(config *Config) int {
+	if n := config.Stream.KafkaBatchSize; n > 0 {
+		return n
+	}
+	return defaultKafkaBatchSize
+}
+
+// runKafka processes the fixes of the input topic until ctx is cancelled or the state store
+// or Kafka fails. The enriched fixes are published in batches, and the offsets of a batch are
+// committed only after the producer has acknowledged it, so a stopped or crashed stream
+// resumes with the fixes it had not yet published rather than losing them.
+func (s *streamProcessor) runKafka(ctx context.Context, source kafkaSource, sink kafkaSink, batchSize int) error {
+	var fetched, enriched []kafka.Message
+	// A batch being published is not cut short by the stream being stopped
+	publish := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), kafkaTimeout)
+		defer cancel()
+		if len(enriched) > 0 {
+			if err := sink.WriteMessages(ctx, enriched...); err != nil {
+				return fmt.Errorf("unable to publish to Kafka: %w", err)
+			}
+			s.written += len(enriched)
+		}
+		if len(fetched) > 0 {
+			if err := source.CommitMessages(ctx, fetched...); err != nil {
+				return fmt.Errorf("unable to commit Kafka offsets: %w", err)
+			}
+		}
+		fetched, enriched = fetched[:0], enriched[:0]
+		return nil
+	}
+
+	for {
+		fetchCtx, cancel := ctx, context.CancelFunc(func() {})
+		if len(fetched) > 0 {
+			fetchCtx, cancel = context.WithTimeout(ctx, kafkaFlushDelay)
+		}
+		msg, err := source.FetchMessage(fetchCtx)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			// The fixes read before the stream was stopped are still published
+			return publish()
+		case errors.Is(err, context.DeadlineExceeded):
+			if err := publish(); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			return fmt.Errorf("unable to read from Kafka: %w", err)
+		}
+
+		// Deleted keys have no fix to enrich, but their offsets are committed all the same
+		if len(msg.Value) > 0 {
+			data, err := s.next(msg.Value)
+			if err != nil {
+				// The fixes before this one are complete, so they are not processed twice
+				return errors.Join(err, publish())
+			}
+			if data != nil {
+				enriched = append(enriched, kafka.Message{Key: msg.Key, Value: data})
+			}
+		}
+		fetched = append(fetched, msg)
+		if len(fetched) >= batchSize {
+			if err := publish(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafka is an input topic and an output topic in memory. It logs each publish and commit,
+// and once the input is used up it stops the stream.
+type fakeKafka struct {
+	input      []kafka.Message
+	next       int
+	stop       context.CancelFunc
+	publishErr error
+
+	published []kafka.Message
+	events    []string
+}
+
+func (f *fakeKafka) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if f.next < len(f.input) {
+		f.next++
+		return f.input[f.next-1], nil
+	}
+	// A quiet topic: wait for the flush delay, or stop the stream when there is none
+	if _, ok := ctx.Deadline(); !ok {
+		f.stop()
+	}
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (f *fakeKafka) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	f.events = append(f.events, fmt.Sprintf("commit %d-%d", msgs[0].Offset, msgs[len(msgs)-1].Offset))
+	return nil
+}
+
+func (f *fakeKafka) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	if f.publishErr != nil {
+		return f.publishErr
+	}
+	f.published = append(f.published, msgs...)
+	f.events = append(f.events, fmt.Sprintf("publish %d", len(msgs)))
+	return nil
+}
+
+func (f *fakeKafka) Close() error { return nil }
+
+func TestRunKafka(t *testing.T) {
+	fixes := []struct{ id, timestamp string }{
+		{"a", "2024-01-01T00:00:00Z"},
+		{"a", "2024-01-01T00:01:00Z"},
+		{"b", "2024-01-01T00:00:00Z"},
+		{"a", "2024-01-01T00:02:00Z"},
+		{"b", "2024-01-01T00:01:00Z"},
+	}
+	var input []kafka.Message
+	for i, fix := range fixes {
+		input = append(input, kafka.Message{Offset: int64(i), Key: []byte(fix.id),
+			Value: []byte(fmt.Sprintf(`{"id":%q,"lat":52.0,"lon":4.%d,"time":%q}`, fix.id, i, fix.timestamp))})
+	}
+	// A deleted key is committed without being published
+	input = append(input, kafka.Message{Offset: 5, Key: []byte("a")})
+
+	tests := []struct {
+		name       string
+		batchSize  int
+		publishErr error
+		wantEvents []string
+		wantErr    bool
+	}{
+		{
+			name:       "published in batches before their offsets are committed",
+			batchSize:  2,
+			wantEvents: []string{"publish 1", "commit 0-1", "publish 1", "commit 2-3", "publish 1", "commit 4-5"},
+		},
+		{
+			name:       "quiet topic flushes what was read",
+			batchSize:  100,
+			wantEvents: []string{"publish 3", "commit 0-5"},
+		},
+		{
+			name:       "nothing is committed when publishing fails",
+			batchSize:  100,
+			publishErr: errors.New("broker down"),
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			config.Columns.ID, config.Columns.Latitude, config.Columns.Longitude, config.Columns.Timestamp = "id", "lat", "lon", "time"
+			s, err := newStreamProcessor(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, stop := context.WithCancel(context.Background())
+			defer stop()
+			f := &fakeKafka{input: input, stop: stop, publishErr: tt.publishErr}
+
+			err = s.runKafka(ctx, f, f, tt.batchSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runKafka error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(f.events, tt.wantEvents) {
+				t.Errorf("events %v, want %v", f.events, tt.wantEvents)
+			}
+			if tt.wantErr {
+				return
+			}
+			var keys []string
+			for _, msg := range f.published {
+				keys = append(keys, string(msg.Key))
+			}
+			if want := []string{"a", "a", "b"}; !reflect.DeepEqual(keys, want) {
+				t.Errorf("published keys %v, want %v", keys, want)
+			}
+		})
+	}
+}
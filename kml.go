@@ -2,15 +2,20 @@ package main
 
 import (
 	"fmt"
+	"html"
+	"io"
 	"os"
-	"sort"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/schollz/progressbar/v3"
 )
 
+// kmlArrowIcon points north; KML turns it clockwise by the heading
+const kmlArrowIcon = "http://earth.google.com/images/kml-icons/track-directional/track-0.png"
+
 // writeOutputKML writes the processed records to a KML file for visualization
-func writeOutputKML(filename string, records []Record) error {
+func writeOutputKML(filename string, records []Record, config *Config) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return fmt.Errorf("unable to create KML file: %w", err)
@@ -23,19 +28,13 @@ func writeOutputKML(filename string, records []Record) error {
 		groups[record.ID] = append(groups[record.ID], record)
 	}
 
+	// Format coordinates with the configured precision
+	coord := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', config.Output.CoordinatePrecision, 64)
+	}
+
 	// Create progress bar for KML generation
-	bar := progressbar.NewOptions(
-		len(groups),
-		progressbar.OptionSetDescription("Writing output KML"),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "=",
-			SaucerHead:    ">",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}),
-	)
+	bar := newProgress("Writing output KML", len(groups))
 
 	// XML header
 	fmt.Fprintln(file, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>")
@@ -56,29 +55,41 @@ func writeOutputKML(filename string, records []Record) error {
 	fmt.Fprintln(file, "    </IconStyle>")
 	fmt.Fprintln(file, "  </Style>")
 
-	// Define some common colors
-	colors := []string{
-		"ff0000ff", // Red
-		"ff00ff00", // Green
-		"ffff0000", // Blue
-		"ff00ffff", // Yellow
-		"ffff00ff", // Magenta
+	// Start and end of each trajectory
+	fmt.Fprintln(file, "  <Style id=\"startStyle\">")
+	fmt.Fprintln(file, "    <IconStyle>")
+	fmt.Fprintln(file, "      <Icon><href>http://maps.google.com/mapfiles/kml/paddle/grn-circle.png</href></Icon>")
+	fmt.Fprintln(file, "    </IconStyle>")
+	fmt.Fprintln(file, "  </Style>")
+	fmt.Fprintln(file, "  <Style id=\"endStyle\">")
+	fmt.Fprintln(file, "    <IconStyle>")
+	fmt.Fprintln(file, "      <Icon><href>http://maps.google.com/mapfiles/kml/paddle/red-square.png</href></Icon>")
+	fmt.Fprintln(file, "    </IconStyle>")
+	fmt.Fprintln(file, "  </Style>")
+
+	// Driving events stand out as larger orange points
+	if drivingEventsEnabled(config) {
+		fmt.Fprintln(file, "  <Style id=\"eventStyle\">")
+		fmt.Fprintln(file, "    <IconStyle>")
+		fmt.Fprintln(file, "      <color>ff0080ff</color>") // Orange
+		fmt.Fprintln(file, "      <scale>1.2</scale>")
+		fmt.Fprintln(file, "    </IconStyle>")
+		fmt.Fprintln(file, "  </Style>")
 	}
 
 	// Create a folder for each ID
 	idCount := 0
-	for id, group := range groups {
+	for _, id := range sortedIDs(groups) {
+		group := groups[id]
+
 		// Update progress bar
 		_ = bar.Add(1)
 
 		// Sort by timestamp to ensure correct order
-		sort.Slice(group, func(i, j int) bool {
-			return group[i].Timestamp.Before(group[j].Timestamp)
-		})
+		sortByTime(group)
 
 		// Generate a color based on the ID
-		colorIndex := idCount % len(colors)
-		color := colors[colorIndex]
+		color := kmlTrackColors[idCount%len(kmlTrackColors)]
 		idCount++
 
 		// Create a unique style for this ID
@@ -96,68 +107,327 @@ func writeOutputKML(filename string, records []Record) error {
 
 		// Create a folder for this ID
 		fmt.Fprintf(file, "  <Folder>\n")
-		fmt.Fprintf(file, "    <name>Device %s</name>\n", id)
+		fmt.Fprintf(file, "    <name>Device %s</name>\n", html.EscapeString(deviceLabel(id, config)))
 
 		// Create a placemark for the trajectory
 		fmt.Fprintln(file, "    <Placemark>")
-		fmt.Fprintf(file, "      <name>Trajectory of Device %s</name>\n", id)
+		fmt.Fprintf(file, "      <name>Trajectory of Device %s</name>\n", html.EscapeString(deviceLabel(id, config)))
 		fmt.Fprintln(file, "      <description><![CDATA[")
+		if md := config.metadata; md != nil {
+			for i, name := range md.columns {
+				fmt.Fprintf(file, "%s: %s<br>\n", html.EscapeString(name), html.EscapeString(md.value(id, i)))
+			}
+		}
 		fmt.Fprintf(file, "Number of points: %d<br>\n", len(group))
-		fmt.Fprintf(file, "Start time: %s<br>\n", group[0].Timestamp.Format(time.RFC3339))
-		fmt.Fprintf(file, "End time: %s<br>\n", group[len(group)-1].Timestamp.Format(time.RFC3339))
+		fmt.Fprintf(file, "Start time: %s<br>\n", group[0].Timestamp.Format(outputTimeLayout))
+		fmt.Fprintf(file, "End time: %s<br>\n", group[len(group)-1].Timestamp.Format(outputTimeLayout))
 		fmt.Fprintln(file, "      ]]></description>")
 		fmt.Fprintf(file, "      <styleUrl>#%s</styleUrl>\n", styleID)
 		fmt.Fprintln(file, "      <LineString>")
 		fmt.Fprintln(file, "        <extrude>1</extrude>")
 		fmt.Fprintln(file, "        <tessellate>1</tessellate>")
-		fmt.Fprintln(file, "        <altitudeMode>clampToGround</altitudeMode>")
+		fmt.Fprintf(file, "        <altitudeMode>%s</altitudeMode>\n", kmlAltitudeMode(config))
 		fmt.Fprintln(file, "        <coordinates>")
 
 		// Add all coordinates for the trajectory
-		for _, record := range group {
-			fmt.Fprintf(file, "          %f,%f,0\n", record.Longitude, record.Latitude)
+		heights := kmlHeights(group, config)
+		for i, record := range group {
+			fmt.Fprintf(file, "          %s\n", kmlCoordinates(&record, heights[i], coord))
 		}
 
 		fmt.Fprintln(file, "        </coordinates>")
 		fmt.Fprintln(file, "      </LineString>")
 		fmt.Fprintln(file, "    </Placemark>")
 
-		// Create individual placemarks for each point with detailed information
-		for i, record := range group {
+		// Mark where the trajectory starts and ends
+		for _, marker := range []struct {
+			name   string
+			style  string
+			record Record
+			height float64
+		}{
+			{"Start", "startStyle", group[0], heights[0]},
+			{"End", "endStyle", group[len(group)-1], heights[len(group)-1]},
+		} {
 			fmt.Fprintln(file, "    <Placemark>")
-			fmt.Fprintf(file, "      <name>Point %d (Device %s)</name>\n", i+1, id)
-			fmt.Fprintln(file, "      <description><![CDATA[")
-			fmt.Fprintf(file, "ID: %s<br>\n", record.ID)
-			fmt.Fprintf(file, "Latitude: %f<br>\n", record.Latitude)
-			fmt.Fprintf(file, "Longitude: %f<br>\n", record.Longitude)
-			fmt.Fprintf(file, "Timestamp: %s<br>\n", record.Timestamp.Format(time.RFC3339))
-			fmt.Fprintf(file, "Original Row: %d<br>\n", record.OriginalRow)
-			fmt.Fprintf(file, "Previous Row: %d<br>\n", record.PreviousRow)
-			if record.PreviousRow > 0 {
-				fmt.Fprintf(file, "Previous Latitude: %f<br>\n", record.PrevLatitude)
-				fmt.Fprintf(file, "Previous Longitude: %f<br>\n", record.PrevLongitude)
-				fmt.Fprintf(file, "Previous Timestamp: %s<br>\n", record.PrevTimestamp.Format(time.RFC3339))
-				fmt.Fprintf(file, "Time Difference: %.2f seconds<br>\n", record.TimeDiff)
-				fmt.Fprintf(file, "Distance: %.6f km<br>\n", record.Distance)
-				fmt.Fprintf(file, "Speed: %.2f km/h<br>\n", record.Speed)
-			}
-			fmt.Fprintln(file, "      ]]></description>")
-			fmt.Fprintf(file, "      <styleUrl>#%s</styleUrl>\n", styleID)
-			fmt.Fprintln(file, "      <Point>")
-			fmt.Fprintln(file, "        <coordinates>")
-			fmt.Fprintf(file, "          %f,%f,0\n", record.Longitude, record.Latitude)
-			fmt.Fprintln(file, "        </coordinates>")
-			fmt.Fprintln(file, "      </Point>")
+			fmt.Fprintf(file, "      <name>%s (Device %s)</name>\n", marker.name, id)
+			fmt.Fprintf(file, "      <description>%s</description>\n", marker.record.Timestamp.Format(outputTimeLayout))
+			fmt.Fprintf(file, "      <styleUrl>#%s</styleUrl>\n", marker.style)
+			fmt.Fprintf(file, "      <Point>%s<coordinates>%s</coordinates></Point>\n", kmlPointMode(config), kmlCoordinates(&marker.record, marker.height, coord))
 			fmt.Fprintln(file, "    </Placemark>")
 		}
 
+		// Arrows along the track, turned to the direction of travel
+		if every := config.Output.KMLArrowEvery; every > 0 {
+			fmt.Fprintln(file, "    <Folder>")
+			fmt.Fprintln(file, "      <name>Direction</name>")
+			for i := every; i < len(group); i += every {
+				record := group[i]
+				if record.PreviousRow == 0 || record.Distance == 0 {
+					continue // no direction without movement from a previous point
+				}
+				fmt.Fprintln(file, "      <Placemark>")
+				fmt.Fprintf(file, "        <Style><IconStyle><heading>%.0f</heading><Icon><href>%s</href></Icon></IconStyle></Style>\n", record.Bearing, kmlArrowIcon)
+				fmt.Fprintf(file, "        <Point>%s<coordinates>%s</coordinates></Point>\n", kmlPointMode(config), kmlCoordinates(&record, heights[i], coord))
+				fmt.Fprintln(file, "      </Placemark>")
+			}
+			fmt.Fprintln(file, "    </Folder>")
+		}
+
+		// Create individual placemarks for each point with detailed information
+		if config.Output.KMLFolders == "date" {
+			loc, _ := reportLocation(config)
+			for _, day := range kmlDayFolders(group, loc) {
+				fmt.Fprintln(file, "    <Folder>")
+				fmt.Fprintf(file, "      <name>%s</name>\n", day.name)
+				for _, sub := range day.folders {
+					indent := ""
+					if sub.name != "" {
+						fmt.Fprintln(file, "      <Folder>")
+						fmt.Fprintf(file, "        <name>%s</name>\n", sub.name)
+						indent = "  "
+					}
+					for _, i := range sub.points {
+						writePointPlacemark(file, "  "+indent, i+1, &group[i], heights[i], styleID, coord, config)
+					}
+					if sub.name != "" {
+						fmt.Fprintln(file, "      </Folder>")
+					}
+				}
+				fmt.Fprintln(file, "    </Folder>")
+			}
+		} else {
+			for i := range group {
+				writePointPlacemark(file, "", i+1, &group[i], heights[i], styleID, coord, config)
+			}
+		}
+
 		fmt.Fprintln(file, "  </Folder>")
 	}
 
+	if config.Output.KMLFilteredLayer {
+		writeFilteredFolder(file, records, config, coord)
+	}
+
 	// Close XML document
 	fmt.Fprintln(file, "</Document>")
 	fmt.Fprintln(file, "</kml>")
 
-	fmt.Println() // Add newline after progress bar
+	bar.Finish()
 	return nil
 }
+
+// writeFilteredFolder adds a folder with the points the filters left out, drawn as red warning
+// icons with the reason in their description. A per-device file only lists that device's points.
+func writeFilteredFolder(w io.Writer, records []Record, config *Config, coord func(float64) string) {
+	ids := make(map[string]bool)
+	for i := range records {
+		ids[records[i].ID] = true
+	}
+
+	fmt.Fprintln(w, "  <Style id=\"filteredStyle\">")
+	fmt.Fprintln(w, "    <IconStyle>")
+	fmt.Fprintln(w, "      <color>ff0000ff</color>") // Red
+	fmt.Fprintln(w, "      <scale>0.8</scale>")
+	fmt.Fprintln(w, "      <Icon><href>http://maps.google.com/mapfiles/kml/shapes/caution.png</href></Icon>")
+	fmt.Fprintln(w, "    </IconStyle>")
+	fmt.Fprintln(w, "  </Style>")
+	fmt.Fprintln(w, "  <Folder>")
+	fmt.Fprintln(w, "    <name>Filtered points</name>")
+	fmt.Fprintln(w, "    <visibility>0</visibility>")
+	for _, point := range config.discarded {
+		if config.Output.SplitByDevice && !ids[point.ID] {
+			continue
+		}
+		fmt.Fprintln(w, "    <Placemark>")
+		fmt.Fprintf(w, "      <name>Row %d (Device %s)</name>\n", point.OriginalRow, point.ID)
+		fmt.Fprintln(w, "      <visibility>0</visibility>")
+		fmt.Fprintln(w, "      <description><![CDATA[")
+		fmt.Fprintf(w, "Filtered: %s<br>\n", point.Reason)
+		fmt.Fprintf(w, "ID: %s<br>\n", point.ID)
+		fmt.Fprintf(w, "Timestamp: %s<br>\n", point.Timestamp.Format(outputTimeLayout))
+		fmt.Fprintf(w, "Original Row: %d<br>\n", point.OriginalRow)
+		fmt.Fprintln(w, "      ]]></description>")
+		fmt.Fprintln(w, "      <styleUrl>#filteredStyle</styleUrl>")
+		fmt.Fprintln(w, "      <Point>")
+		fmt.Fprintln(w, "        <coordinates>")
+		fmt.Fprintf(w, "          %s,%s,0\n", coord(point.Longitude), coord(point.Latitude))
+		fmt.Fprintln(w, "        </coordinates>")
+		fmt.Fprintln(w, "      </Point>")
+		fmt.Fprintln(w, "    </Placemark>")
+	}
+	fmt.Fprintln(w, "  </Folder>")
+}
+
+// checkKMLFolders validates output.kml_folders
+func checkKMLFolders(config *Config) error {
+	switch config.Output.KMLFolders {
+	case "", "device", "date":
+		return nil
+	}
+	return fmt.Errorf("unknown output.kml_folders %q (use device or date)", config.Output.KMLFolders)
+}
+
+// checkNetworkLink makes sure there is a KML output for the network link to load
+func checkNetworkLink(config *Config, formats []outputFormat) error {
+	if config.Output.KMLRefreshSeconds < 0 {
+		return fmt.Errorf("output.kml_refresh_seconds must not be negative")
+	}
+	for _, format := range formats {
+		if format.Name == "kml" {
+			return nil
+		}
+	}
+	return fmt.Errorf("output.kml_refresh_seconds requires the kml output format")
+}
+
+// networkLinkFilename returns the path of the network link, <basename>_live.kml next to the outputs
+func networkLinkFilename(inputFile string, config *Config) string {
+	return strings.TrimSuffix(reportFilename(inputFile, "live", config), ".csv") + ".kml"
+}
+
+// writeNetworkLink writes a KML file with a NetworkLink to each of the KML outputs that
+// Google Earth reloads every refresh seconds. The links are relative to linkFile, so the
+// outputs can be moved or shared together with it.
+func writeNetworkLink(filename, linkFile string, targets []string, refresh int) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create network link: %w", err)
+	}
+	defer file.Close()
+
+	fmt.Fprintln(file, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>")
+	fmt.Fprintln(file, "<kml xmlns=\"http://www.opengis.net/kml/2.2\">")
+	fmt.Fprintln(file, "<Document>")
+	fmt.Fprintln(file, "  <name>GPS Trajectories (live)</name>")
+	for _, target := range targets {
+		href, err := filepath.Rel(filepath.Dir(linkFile), target)
+		if err != nil {
+			href = target
+		}
+		fmt.Fprintln(file, "  <NetworkLink>")
+		fmt.Fprintf(file, "    <name>%s</name>\n", html.EscapeString(filepath.Base(target)))
+		fmt.Fprintln(file, "    <refreshVisibility>0</refreshVisibility>")
+		fmt.Fprintln(file, "    <Link>")
+		fmt.Fprintf(file, "      <href>%s</href>\n", html.EscapeString(filepath.ToSlash(href)))
+		fmt.Fprintln(file, "      <refreshMode>onInterval</refreshMode>")
+		fmt.Fprintf(file, "      <refreshInterval>%d</refreshInterval>\n", refresh)
+		fmt.Fprintln(file, "    </Link>")
+		fmt.Fprintln(file, "  </NetworkLink>")
+	}
+	fmt.Fprintln(file, "</Document>")
+	fmt.Fprintln(file, "</kml>")
+	return nil
+}
+
+// writePointPlacemark writes the placemark of the nth point of a device, with its details
+// in the description, at the given height; indent is added in front of the usual indentation
+func writePointPlacemark(w io.Writer, indent string, n int, record *Record, height float64, styleID string, coord func(float64) string, config *Config) {
+	fmt.Fprintln(w, indent+"    <Placemark>")
+	fmt.Fprintf(w, indent+"      <name>Point %d (Device %s)</name>\n", n, record.ID)
+	fmt.Fprintln(w, indent+"      <description><![CDATA[")
+	fmt.Fprintf(w, "ID: %s<br>\n", record.ID)
+	fmt.Fprintf(w, "Latitude: %s<br>\n", coord(record.Latitude))
+	fmt.Fprintf(w, "Longitude: %s<br>\n", coord(record.Longitude))
+	fmt.Fprintf(w, "Timestamp: %s<br>\n", record.Timestamp.Format(outputTimeLayout))
+	fmt.Fprintf(w, "Original Row: %d<br>\n", record.OriginalRow)
+	fmt.Fprintf(w, "Previous Row: %d<br>\n", record.PreviousRow)
+	if record.PreviousRow > 0 {
+		fmt.Fprintf(w, "Previous Latitude: %s<br>\n", coord(record.PrevLatitude))
+		fmt.Fprintf(w, "Previous Longitude: %s<br>\n", coord(record.PrevLongitude))
+		fmt.Fprintf(w, "Previous Timestamp: %s<br>\n", record.PrevTimestamp.Format(outputTimeLayout))
+		fmt.Fprintf(w, "Time Difference: %.2f seconds<br>\n", record.TimeDiff)
+		fmt.Fprintf(w, "Distance: %s km<br>\n", strconv.FormatFloat(record.Distance, 'f', config.Output.DistancePrecision, 64))
+		if config.Output.Units == "aviation" {
+			fmt.Fprintf(w, "Speed: %.1f kt<br>\n", record.Speed/kmhPerKnot)
+		} else {
+			fmt.Fprintf(w, "Speed: %.2f km/h<br>\n", record.Speed)
+		}
+	}
+	if record.HasAltitude && config.Output.Units == "aviation" {
+		fmt.Fprintf(w, "Altitude: %.0f ft<br>\n", record.Altitude*feetPerMeter)
+		if record.HasVerticalSpeed {
+			fmt.Fprintf(w, "Vertical Speed: %.0f ft/min<br>\n", record.VerticalSpeed*feetPerMeter*60)
+		}
+	}
+	if record.Event != "" {
+		fmt.Fprintf(w, "Event: %s (%.2f m/s²)<br>\n", record.Event, record.EventMagnitude)
+	}
+	fmt.Fprintln(w, indent+"      ]]></description>")
+	if record.Event != "" {
+		fmt.Fprintln(w, indent+"      <styleUrl>#eventStyle</styleUrl>")
+	} else {
+		fmt.Fprintf(w, indent+"      <styleUrl>#%s</styleUrl>\n", styleID)
+	}
+	fmt.Fprintln(w, indent+"      <Point>")
+	if mode := kmlPointMode(config); mode != "" {
+		fmt.Fprintln(w, indent+"        "+mode)
+	}
+	fmt.Fprintln(w, indent+"        <coordinates>")
+	fmt.Fprintf(w, indent+"          %s\n", kmlCoordinates(record, height, coord))
+	fmt.Fprintln(w, indent+"        </coordinates>")
+	fmt.Fprintln(w, indent+"      </Point>")
+	fmt.Fprintln(w, indent+"    </Placemark>")
+}
+
+// kmlFolder is a folder of point placemarks, given by their index in the device's group
+type kmlFolder struct {
+	name    string
+	points  []int
+	folders []*kmlFolder
+}
+
+// kmlDayFolders sorts the points of a time-sorted group into one folder per day in loc, each
+// holding a folder per trip and one for the stopped points. A trip is filed under the day it
+// starts on. Without trip segmentation, the points sit directly in an unnamed subfolder.
+func kmlDayFolders(group []Record, loc *time.Location) []*kmlFolder {
+	var days []*kmlFolder
+	byDay := make(map[string]*kmlFolder)
+	tripDay := make(map[int]string)
+	trips := hasTrips(group)
+	for i := range group {
+		r := &group[i]
+		day := r.Timestamp.In(loc).Format("2006-01-02")
+		sub := ""
+		if r.Trip > 0 {
+			if start, ok := tripDay[r.Trip]; ok {
+				day = start
+			} else {
+				tripDay[r.Trip] = day
+			}
+			sub = fmt.Sprintf("Trip %d", r.Trip)
+		} else if trips {
+			sub = "Stopped"
+		}
+
+		folder, ok := byDay[day]
+		if !ok {
+			folder = &kmlFolder{name: day}
+			byDay[day] = folder
+			days = append(days, folder)
+		}
+		var target *kmlFolder
+		for _, f := range folder.folders {
+			if f.name == sub {
+				target = f
+				break
+			}
+		}
+		if target == nil {
+			target = &kmlFolder{name: sub}
+			folder.folders = append(folder.folders, target)
+		}
+		target.points = append(target.points, i)
+	}
+	return days
+}
+
+// hasTrips reports whether any point of the group belongs to a trip
+func hasTrips(group []Record) bool {
+	for i := range group {
+		if group[i].Trip > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// KML region settings
+const (
+	defaultKMLRegionMaxPoints = 5000
+	kmlRegionMinPixels        = 128 // a region loads once its tile covers this many pixels
+	kmlRegionPixels           = 256 // cells per tile side when a region draws a simplified track
+)
+
+// kmlTrackColors are the track colors, given to the devices in turn
+var kmlTrackColors = []string{
+	"ff0000ff", // Red
+	"ff00ff00", // Green
+	"ffff0000", // Blue
+	"ff00ffff", // Yellow
+	"ffff00ff", // Magenta
+}
+
+// checkKMLRegions validates output.kml_region_max_points
+func checkKMLRegions(config *Config) error {
+	if config.Output.KMLRegionMaxPoints < 0 {
+		return fmt.Errorf("output.kml_region_max_points must not be negative")
+	}
+	return nil
+}
+
+// kmlRegionsDirectory returns the path of the KML regions, <basename>_kml_regions next to the outputs
+func kmlRegionsDirectory(inputFile string, config *Config) string {
+	return strings.TrimSuffix(reportFilename(inputFile, "kml_regions", config), ".csv")
+}
+
+// regionPoint is a point of a track: the index of its line and its index along the line
+type regionPoint struct {
+	line, index int
+}
+
+// kmlRegionWriter writes the tiles of a KML region tree
+type kmlRegionWriter struct {
+	dir       string
+	lines     []tileLine
+	styles    map[string]string // track color by device ID
+	maxPoints int
+	coord     func(float64) string
+	config    *Config
+	bar       ProgressReporter
+	tiles     int
+}
+
+// writeKMLRegions writes the tracks as a tree of KML files in the web mercator tile layout,
+// {z}/{x}/{y}.kml, with doc.kml at the top to open in Google Earth. Each tile holds the
+// tracks within it while it has no more than the maximum points, and otherwise a simplified
+// track and links to its four quarters, which Google Earth only loads when the view is
+// zoomed in on them. Like the vector tiles, the directory is replaced whole.
+func writeKMLRegions(dir string, records []Record, config *Config) (string, int, error) {
+	dir, err := resolveOutputPath(dir, config)
+	if err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".*.tmp")
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to create KML regions directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	_ = os.Chmod(tmp, 0755)
+
+	w := &kmlRegionWriter{
+		dir:       tmp,
+		lines:     tileLines(records),
+		styles:    make(map[string]string),
+		maxPoints: config.Output.KMLRegionMaxPoints,
+		config:    config,
+	}
+	if w.maxPoints == 0 {
+		w.maxPoints = defaultKMLRegionMaxPoints
+	}
+	w.coord = func(v float64) string {
+		return strconv.FormatFloat(v, 'f', config.Output.CoordinatePrecision, 64)
+	}
+	var points []regionPoint
+	for l := range w.lines {
+		line := &w.lines[l]
+		if _, ok := w.styles[line.ID]; !ok {
+			w.styles[line.ID] = kmlTrackColors[len(w.styles)%len(kmlTrackColors)]
+		}
+		for i := range line.X {
+			points = append(points, regionPoint{l, i})
+		}
+	}
+
+	w.bar = newProgress("Writing KML regions", len(points))
+	if len(points) > 0 {
+		if err := w.writeTile(0, 0, 0, points); err != nil {
+			return "", 0, err
+		}
+	}
+	w.bar.Finish()
+	if err := w.writeRoot(filepath.Join(tmp, "doc.kml"), len(points) > 0); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", 0, fmt.Errorf("unable to replace %s: %w", dir, err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", 0, fmt.Errorf("unable to move KML regions directory into place: %w", err)
+	}
+	config.manifest.add(filepath.Join(dir, "doc.kml"), "kml_regions", w.tiles)
+	return dir, w.tiles, nil
+}
+
+// writeRoot writes doc.kml, which links to the tile covering the whole world
+func (w *kmlRegionWriter) writeRoot(filename string, linked bool) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create KML regions file: %w", err)
+	}
+	defer file.Close()
+
+	fmt.Fprintln(file, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>")
+	fmt.Fprintln(file, "<kml xmlns=\"http://www.opengis.net/kml/2.2\">")
+	fmt.Fprintln(file, "<Document>")
+	fmt.Fprintln(file, "  <name>GPS Trajectories</name>")
+	fmt.Fprintln(file, "  <description>GPS data processed by GPS Processor, loaded region by region</description>")
+	if linked {
+		writeRegionLink(file, 0, 0, 0, "0/0/0.kml")
+	}
+	fmt.Fprintln(file, "</Document>")
+	fmt.Fprintln(file, "</kml>")
+	return nil
+}
+
+// writeTile writes the tile z/x/y.kml with the given points, in track order, and the tiles
+// below it that have points
+func (w *kmlRegionWriter) writeTile(z, x, y int, points []regionPoint) error {
+	split := len(points) > w.maxPoints && z < maxTileZoom
+	var quarters [4][]regionPoint
+	if split {
+		n := float64(int(1) << (z + 1))
+		for _, p := range points {
+			line := &w.lines[p.line]
+			qx := int(math.Min(line.X[p.index]*n, n-1)) - 2*x
+			qy := int(math.Min(line.Y[p.index]*n, n-1)) - 2*y
+			// Points on the edge of the tile may round into the next one
+			qx, qy = max(0, min(1, qx)), max(0, min(1, qy))
+			quarters[qy*2+qx] = append(quarters[qy*2+qx], p)
+		}
+	}
+
+	tileDir := filepath.Join(w.dir, strconv.Itoa(z), strconv.Itoa(x))
+	if err := os.MkdirAll(tileDir, 0755); err != nil {
+		return fmt.Errorf("unable to create KML regions directory: %w", err)
+	}
+	file, err := os.Create(filepath.Join(tileDir, strconv.Itoa(y)+".kml"))
+	if err != nil {
+		return fmt.Errorf("unable to create KML region: %w", err)
+	}
+	defer file.Close()
+
+	fmt.Fprintln(file, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>")
+	fmt.Fprintln(file, "<kml xmlns=\"http://www.opengis.net/kml/2.2\">")
+	fmt.Fprintln(file, "<Document>")
+	fmt.Fprintf(file, "  <name>%d/%d/%d</name>\n", z, x, y)
+	for _, id := range w.tileDevices(points) {
+		fmt.Fprintf(file, "  <Style id=\"style_%s\">\n", html.EscapeString(id))
+		fmt.Fprintf(file, "    <LineStyle><color>%s</color><width>4</width></LineStyle>\n", w.styles[id])
+		fmt.Fprintln(file, "  </Style>")
+	}
+
+	// The tracks of a split tile give way to its quarters as they load
+	maxPixels := -1
+	if split {
+		maxPixels = kmlRegionMinPixels * 2
+	}
+	fmt.Fprintln(file, "  <Folder>")
+	fmt.Fprintln(file, "    <name>Tracks</name>")
+	writeRegion(file, "    ", z, x, y, maxPixels)
+	w.writeTracks(file, z, points, split)
+	fmt.Fprintln(file, "  </Folder>")
+
+	for q, quarter := range quarters {
+		if len(quarter) == 0 {
+			continue
+		}
+		qx, qy := 2*x+q%2, 2*y+q/2
+		writeRegionLink(file, z+1, qx, qy, fmt.Sprintf("../../%d/%d/%d.kml", z+1, qx, qy))
+	}
+	fmt.Fprintln(file, "</Document>")
+	fmt.Fprintln(file, "</kml>")
+	w.tiles++
+
+	if !split {
+		_ = w.bar.Add(len(points))
+		return nil
+	}
+	for q, quarter := range quarters {
+		if len(quarter) == 0 {
+			continue
+		}
+		if err := w.writeTile(z+1, 2*x+q%2, 2*y+q/2, quarter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tileDevices returns the IDs of the devices with points in the tile. The lines, and so the
+// points, are in ID order.
+func (w *kmlRegionWriter) tileDevices(points []regionPoint) []string {
+	var ids []string
+	for _, p := range points {
+		if id := w.lines[p.line].ID; len(ids) == 0 || ids[len(ids)-1] != id {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// writeTracks writes a placemark per run of consecutive points of a track within the tile.
+// Each run starts from the point before it, outside the tile, so the track continues across
+// tile edges. Simplified tracks keep one point per cell of a 256 by 256 grid over the tile.
+func (w *kmlRegionWriter) writeTracks(out io.Writer, z int, points []regionPoint, simplify bool) {
+	scale := float64(int(1)<<z) * kmlRegionPixels
+	for start := 0; start < len(points); {
+		end := start + 1
+		for end < len(points) && points[end].line == points[start].line && points[end].index == points[end-1].index+1 {
+			end++
+		}
+		line := &w.lines[points[start].line]
+		first, last := points[start].index, points[end-1].index
+		if first > 0 {
+			first--
+		}
+
+		var coords []string
+		cellX, cellY := -1, -1
+		for i := first; i <= last; i++ {
+			if simplify && i != first && i != last {
+				cx, cy := int(line.X[i]*scale), int(line.Y[i]*scale)
+				if cx == cellX && cy == cellY {
+					continue
+				}
+				cellX, cellY = cx, cy
+			}
+			lat, lon := unmercator(line.X[i], line.Y[i])
+			coords = append(coords, w.coord(lon)+","+w.coord(lat)+",0")
+		}
+		start = end
+		if len(coords) < 2 {
+			continue
+		}
+
+		name := "Device " + deviceLabel(line.ID, w.config)
+		if line.Trip > 0 {
+			name += fmt.Sprintf(", trip %d", line.Trip)
+		}
+		fmt.Fprintln(out, "    <Placemark>")
+		fmt.Fprintf(out, "      <name>%s</name>\n", html.EscapeString(name))
+		fmt.Fprintf(out, "      <description>%s to %s</description>\n",
+			line.Start.Format(outputTimeLayout), line.End.Format(outputTimeLayout))
+		fmt.Fprintf(out, "      <styleUrl>#style_%s</styleUrl>\n", html.EscapeString(line.ID))
+		fmt.Fprintln(out, "      <LineString>")
+		fmt.Fprintln(out, "        <tessellate>1</tessellate>")
+		fmt.Fprintf(out, "        <coordinates>%s</coordinates>\n", strings.Join(coords, " "))
+		fmt.Fprintln(out, "      </LineString>")
+		fmt.Fprintln(out, "    </Placemark>")
+	}
+}
+
+// writeRegionLink writes a NetworkLink that loads href once the tile z/x/y is in view and
+// large enough
+func writeRegionLink(w io.Writer, z, x, y int, href string) {
+	fmt.Fprintln(w, "  <NetworkLink>")
+	fmt.Fprintf(w, "    <name>%d/%d/%d</name>\n", z, x, y)
+	writeRegion(w, "    ", z, x, y, -1)
+	fmt.Fprintln(w, "    <Link>")
+	fmt.Fprintf(w, "      <href>%s</href>\n", href)
+	fmt.Fprintln(w, "      <viewRefreshMode>onRegion</viewRefreshMode>")
+	fmt.Fprintln(w, "    </Link>")
+	fmt.Fprintln(w, "  </NetworkLink>")
+}
+
+// writeRegion writes the Region of the tile z/x/y, active from kmlRegionMinPixels up to
+// maxPixels (-1 = no limit). The whole world is always active.
+func writeRegion(w io.Writer, indent string, z, x, y, maxPixels int) {
+	n := float64(int(1) << z)
+	north, west := unmercator(float64(x)/n, float64(y)/n)
+	south, east := unmercator(float64(x+1)/n, float64(y+1)/n)
+	minPixels := kmlRegionMinPixels
+	if z == 0 {
+		minPixels = 0
+	}
+	fmt.Fprintln(w, indent+"<Region>")
+	fmt.Fprintf(w, indent+"  <LatLonAltBox><north>%.6f</north><south>%.6f</south><east>%.6f</east><west>%.6f</west></LatLonAltBox>\n",
+		north, south, east, west)
+	fmt.Fprintf(w, indent+"  <Lod><minLodPixels>%d</minLodPixels><maxLodPixels>%d</maxLodPixels></Lod>\n", minPixels, maxPixels)
+	fmt.Fprintln(w, indent+"</Region>")
+}
+
+// unmercator returns the position of web mercator coordinates from 0 to 1
+func unmercator(x, y float64) (float64, float64) {
+	return math.Atan(math.Sinh(math.Pi*(1-2*y))) * 180 / math.Pi, x*360 - 180
+}
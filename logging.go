@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// logLevel is the severity of a log message
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+// leveledLogger writes status messages, warnings and errors to the console and, with
+// --log-file, to a log file. On the console, info messages go to stdout and warnings and
+// errors to stderr as plain text, unless --log-format asks for timestamped log lines.
+type leveledLogger struct {
+	stdout   io.Writer
+	stderr   io.Writer
+	level    logLevel // lowest level written; debug with --verbose
+	format   string   // "" for plain console messages, "text" or "json" for log lines on stderr
+	file     io.WriteCloser
+	warnings []string // warnings so far, for the summary and the run report
+}
+
+// logger is the process-wide logger, configured from the command line in main
+var logger = &leveledLogger{stdout: os.Stdout, stderr: os.Stderr, level: levelInfo}
+
+// openFile starts copying all messages at the logger's level to a log file, appending to it
+func (l *leveledLogger) openFile(filename string) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open log file: %w", err)
+	}
+	l.file = file
+	return nil
+}
+
+// close closes the log file, if any
+func (l *leveledLogger) close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *leveledLogger) log(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := localize(format, args...)
+	if level == levelWarn {
+		// The run report lists warnings in English, like its other fields
+		l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+	}
+	now := time.Now()
+
+	if l.file != nil && msg != "" {
+		fmt.Fprintf(l.file, "%s %-5s %s\n", now.Format(time.RFC3339), strings.ToUpper(levelNames[level]), msg)
+	}
+
+	switch l.format {
+	case "text":
+		if msg != "" {
+			fmt.Fprintf(l.stderr, "%s %s msg=%q\n", now.Format(time.RFC3339), levelNames[level], msg)
+		}
+	case "json":
+		if msg != "" {
+			data, _ := json.Marshal(map[string]string{
+				"time":  now.Format(time.RFC3339),
+				"level": levelNames[level],
+				"msg":   msg,
+			})
+			fmt.Fprintln(l.stderr, string(data))
+		}
+	default:
+		switch level {
+		case levelDebug:
+			fmt.Fprintf(l.stdout, "[debug] %s\n", msg)
+		case levelInfo:
+			fmt.Fprintln(l.stdout, msg)
+		case levelWarn:
+			// Start on a fresh line if a progress bar is being drawn, so the warning stands out
+			if barActive {
+				fmt.Fprintln(l.stderr)
+			}
+			fmt.Fprintln(l.stderr, localize("Warning: %s", msg))
+		case levelError:
+			if barActive {
+				fmt.Fprintln(l.stderr)
+			}
+			fmt.Fprintln(l.stderr, msg)
+		}
+	}
+}
+
+// logDebug writes a diagnostic message, shown only with --verbose
+func logDebug(format string, args ...interface{}) { logger.log(levelDebug, format, args...) }
+
+// logInfo writes a status message
+func logInfo(format string, args ...interface{}) { logger.log(levelInfo, format, args...) }
+
+// logWarn writes a warning; warnings are counted and listed in the run report
+func logWarn(format string, args ...interface{}) { logger.log(levelWarn, format, args...) }
+
+// logError writes an error message
+func logError(format string, args ...interface{}) { logger.log(levelError, format, args...) }
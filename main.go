@@ -2,18 +2,20 @@ package main
 
 import (
 	"bufio"
-	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
 	"gopkg.in/yaml.v3"
 	"gps-processor/haversine"
+	"gps-processor/projection"
 )
 
 // Config represents the application configuration
@@ -23,65 +25,421 @@ type Config struct {
 		Latitude  string `yaml:"latitude"`
 		Longitude string `yaml:"longitude"`
 		Timestamp string `yaml:"timestamp"`
+		Altitude  string `yaml:"altitude"`   // Optional altitude column in meters, for climb statistics
+		Speed     string `yaml:"speed"`      // Optional speed column measured by the device, e.g. from OBD (see parameters.speed_source)
+		SpeedUnit string `yaml:"speed_unit"` // Unit of the speed column: kmh (default), mph, knots or m/s
+
+		Date            string `yaml:"date"`             // Date column, for inputs with separate date and time columns (used instead of timestamp)
+		Time            string `yaml:"time"`             // Time column, set together with date
+		TimestampFormat string `yaml:"timestamp_format"` // Format of timestamps, e.g. DD/MM/YYYY HH:mm:ss (default: RFC3339, or YYYY-MM-DD HH:mm:ss with date and time)
+		Timezone        string `yaml:"timezone"`         // Time zone of timestamps without an offset, e.g. Europe/Amsterdam (default: UTC)
+
+		AutoDetect string `yaml:"auto_detect"` // Detect columns when the mapping doesn't match: off, prompt or apply
+		CRS        string `yaml:"crs"`         // Coordinate system of the input, e.g. EPSG:32633 (default: EPSG:4326, WGS84)
+		Encoding   string `yaml:"encoding"`    // Character encoding of CSV input: auto (default), utf-8, utf-16 or windows-1252
+
+		CoordinateFormat   string `yaml:"coordinate_format"`   // How coordinates are written: decimal (default) or dms, e.g. 40°26'46"N
+		DecimalSeparator   string `yaml:"decimal_separator"`   // Decimal separator of coordinates and altitudes: . (default) or ,
+		ThousandsSeparator string `yaml:"thousands_separator"` // Digit group separator to ignore in numbers, e.g. , or ' (default: none)
+		InvalidRows        string `yaml:"invalid_rows"`        // Rows that cannot be parsed: fail (default) stops the run, skip leaves them out with a warning
+		RaggedRows         string `yaml:"ragged_rows"`         // CSV rows with more or fewer fields than the header: fail (default), pad, truncate or reject
+		MinYear            int    `yaml:"min_year"`            // Timestamps before this year are invalid rows (0 = no limit)
+		MaxClockSkew       string `yaml:"max_clock_skew"`      // Timestamps further in the future than this, e.g. 5m, are invalid rows (default: not checked)
+
+		IDColumns   []string `yaml:"id_columns"`   // Build the device ID from these columns, e.g. [fleet, unit], instead of the id column
+		IDSeparator string   `yaml:"id_separator"` // Joins the id_columns values (default: -)
+
+		IDRules struct {
+			Trim          bool            `yaml:"trim"`           // Remove spaces around IDs
+			StripPrefixes []string        `yaml:"strip_prefixes"` // Remove the first of these prefixes an ID starts with, e.g. [IMEI:, imei-]
+			Replace       []IDReplacement `yaml:"replace"`        // Regular expression replacements, applied in turn
+			Case          string          `yaml:"case"`           // upper or lower (default: unchanged)
+		} `yaml:"id_rules"` // Rewrite device IDs as they are read, so differently written IDs of one device form one group
 	} `yaml:"columns"`
 	Parameters struct {
-		FilterAboveKph float64 `yaml:"filter_above_kph"`
+		FilterAboveKph float64  `yaml:"filter_above_kph"`
+		Filter         string   `yaml:"filter"`            // Only output records for which this expression is true, e.g. speed_kmh > 1 && id != "TEST"
+		MinPointsPerID int      `yaml:"min_points_per_id"` // Drop devices with fewer input points than this
+		IncludeIDs     []string `yaml:"include_ids"`       // Only process these device IDs
+		ExcludeIDs     []string `yaml:"exclude_ids"`       // Never process these device IDs
+		IDPattern      string   `yaml:"id_pattern"`        // Only process device IDs matching this regular expression
+		DistanceMethod string   `yaml:"distance_method"`   // How distances are calculated: haversine (default), fast, equirectangular or geodesic
+		Distance3D     bool     `yaml:"distance_3d"`       // Include the change of altitude in segment distances, for drone and aviation tracks (requires columns.altitude)
+		SpeedWindow    string   `yaml:"speed_window"`      // Also compute speed over a rolling window of N points (e.g. 5) or a duration (e.g. 30s)
+		SpeedSource    string   `yaml:"speed_source"`      // Speed used for speed_kmh: computed (default) from positions, source from columns.speed, or both to add source_speed_kmh
+
+		OutlierFilter    string  `yaml:"outlier_filter"`     // Hampel filter for position spikes: off (default), flag or remove
+		OutlierWindow    int     `yaml:"outlier_window"`     // Points on each side compared with each point (default: 3)
+		OutlierThreshold float64 `yaml:"outlier_threshold"`  // Deviation from the window median, in scaled MADs (default: 3)
+		OutlierMinMeters float64 `yaml:"outlier_min_meters"` // Deviations below this are never outliers (default: 20)
+
+		TimeJumps           string    `yaml:"time_jumps"`             // Timestamps going back in input order: off (default), report or correct
+		TimeJumpMinSeconds  float64   `yaml:"time_jump_min_seconds"`  // Smaller steps back are not reported (default: 0)
+		TimeJumpOffsetsDays []float64 `yaml:"time_jump_offsets_days"` // Known clock offsets undone by correct (default: [7168], the GPS week rollover)
+		TimeJumpToleranceS  float64   `yaml:"time_jump_tolerance_s"`  // Seconds a jump may differ from a known offset (default: 3600)
+		GPSWeekRollover     bool      `yaml:"gps_week_rollover"`      // Move timestamps 1024 weeks forward when they are before gps_rollover_before
+		GPSRolloverBefore   string    `yaml:"gps_rollover_before"`    // Earliest plausible date, YYYY-MM-DD (default: 1024 weeks before now)
+
+		DuplicateTimestamps string `yaml:"duplicate_timestamps"` // Points of a device at the same time: keep (default), first, last, average or reject
+
+		StitchWith          string   `yaml:"stitch_with"`            // Previous file of the same devices, e.g. yesterday's; each device's first point is measured from its last point there
+		StitchMaxGapMinutes float64  `yaml:"stitch_max_gap_minutes"` // Only stitch when the points are at most this far apart (default: 0, any gap)
+		IncrementalFrom     string   `yaml:"incremental_from"`       // CSV output of the previous run: skip the input points it covers and continue each device from its last point there
+		MergeWith           []string `yaml:"merge_with"`             // More input files of the same devices, merged with the input; points at a time an earlier file already has are dropped
+
+		DeviceThresholds map[string]DeviceThresholds `yaml:"device_thresholds"` // Per-device filter_above_kph, outlier_threshold and outlier_min_meters, keyed by device ID or pattern such as drone-*
+
+		SimplifyEpsilonM float64 `yaml:"simplify_epsilon_m"` // Flag the points kept by Ramer–Douglas–Peucker simplification at this tolerance in meters (0 = off)
+
+		ReferencePoints []ReferencePoint `yaml:"reference_points"` // Named locations; adds a dist_<name>_km column per point
+
+		RouteFiles      map[string]string `yaml:"route_files"`       // Planned route (GPX or GeoJSON line) per device ID
+		RouteDir        string            `yaml:"route_dir"`         // Directory of planned routes named <id>.gpx or <id>.geojson
+		RouteDeviationM float64           `yaml:"route_deviation_m"` // Distance from the planned route that counts as a deviation (default: 100)
+
+		ProximityM          float64 `yaml:"proximity_m"`           // Report encounters of devices within this many meters of each other (0 = off)
+		ProximityMinSeconds float64 `yaml:"proximity_min_seconds"` // Shortest encounter to report, in seconds
+		ProximityToleranceS float64 `yaml:"proximity_tolerance_s"` // Fixes this many seconds apart count as simultaneous (default: 30)
+
+		TripStopMinutes float64 `yaml:"trip_stop_minutes"`  // Staying put or not reporting this long ends a trip; adds a trip column (0 = no trips)
+		TripStopRadiusM float64 `yaml:"trip_stop_radius_m"` // Movement within this radius counts as staying put (default: 50)
+		ZonesFile       string  `yaml:"zones_file"`         // GeoJSON file of named zone polygons
+
+		HarshBrakeMps2  float64 `yaml:"harsh_brake_mps2"`  // Deceleration that counts as harsh braking, in m/s² (0 = off)
+		HarshAccelMps2  float64 `yaml:"harsh_accel_mps2"`  // Acceleration that counts as harsh acceleration, in m/s² (0 = off)
+		HarshCornerMps2 float64 `yaml:"harsh_corner_mps2"` // Sideways acceleration that counts as harsh cornering, in m/s² (0 = off)
+		SpeedingKmh     float64 `yaml:"speeding_kmh"`      // Speed that counts as speeding in behavior scores (0 = not scored)
+		ScorePenalty    float64 `yaml:"score_penalty"`     // Behavior score points deducted per event per 100 km (default: 10)
+
+		SpeedDiscrepancyKmh        float64 `yaml:"speed_discrepancy_kmh"`         // Difference between source and computed speed that output.speed_discrepancies reports (default: 10)
+		SpeedDiscrepancyMinSeconds float64 `yaml:"speed_discrepancy_min_seconds"` // Shortest discrepancy to report, in seconds
+
+		AnomalyFrozenPoints   int     `yaml:"anomaly_frozen_points"`   // Points in a row at identical coordinates that output.anomalies reports (default: 10)
+		AnomalyStraightPoints int     `yaml:"anomaly_straight_points"` // Points in a row on a straight line at constant speed that output.anomalies reports (default: 20)
+		AnomalyJumpKmh        float64 `yaml:"anomaly_jump_kmh"`        // Speed of a jump of over 10 km that output.anomalies reports as a teleport (default: 1000)
+
+		ReportTimezone string `yaml:"report_timezone"` // IANA time zone for the day and week boundaries of rollups (default: UTC)
+
+		TempDir string `yaml:"temp_dir"` // Directory for temporary files (default: system temp directory)
+
+		CheckpointInterval int    `yaml:"checkpoint_interval"` // Save progress every this many input rows so --resume can continue (0 = off)
+		CheckpointDir      string `yaml:"checkpoint_dir"`      // Directory for checkpoint files (default: <basename>.checkpoint next to the outputs)
 	} `yaml:"parameters"`
+	Output struct {
+		Directory string   `yaml:"directory"` // Directory for output files (default: next to the input file)
+		Filename  string   `yaml:"filename"`  // Filename template with {basename}, {date} and {format} placeholders
+		Formats   []string `yaml:"formats"`   // Output formats to write: csv, kml, xlsx, geojsonseq, ndjson (default: csv, kml)
+		Excel     bool     `yaml:"excel"`     // Also write an Excel workbook with records and summary sheets
+		Columns   []string `yaml:"columns"`   // Output columns in order (default: the standard 12 columns)
+
+		PassthroughColumns bool   `yaml:"passthrough_columns"` // Carry unmapped input columns through to the output
+		SplitByDevice      bool   `yaml:"split_by_device"`     // Write one output file per device ID
+		Order              string `yaml:"order"`               // Record order in outputs: id_time (default) or original_row
+		IfExists           string `yaml:"if_exists"`           // When an output file exists: overwrite (default), error, prompt or suffix
+		Manifest           bool   `yaml:"manifest"`            // Write <basename>_manifest.json with the row count and SHA-256 of each output file
+
+		CoordinatePrecision int `yaml:"coordinate_precision"` // Decimals for latitude/longitude values (default: 6, -1 = as many as needed)
+		DistancePrecision   int `yaml:"distance_precision"`   // Decimals for distances (default: 6, -1 = as many as needed)
+		SpeedPrecision      int `yaml:"speed_precision"`      // Decimals for speeds (default: 6, -1 = as many as needed)
+		ProjectedPrecision  int `yaml:"projected_precision"`  // Decimals for easting/northing in meters (default: 3)
+
+		CRS string `yaml:"crs"` // Projected coordinate system for easting/northing columns, e.g. EPSG:32633
+
+		GeohashPrecision int    `yaml:"geohash_precision"` // Add a geohash column with this many characters (1-12, 0 = off)
+		H3Resolutions    []int  `yaml:"h3_resolutions"`    // Add an h3_r<N> column with the H3 cell index for each resolution (0-15)
+		DayNight         bool   `yaml:"day_night"`         // Add a day_night column from the sun's position, and night distance to rollups
+		Geometry         string `yaml:"geometry"`          // Add a geometry column with each point, and each trip's line in the trip summary: wkt or wkb (hex)
+
+		DerivedColumns []DerivedColumn `yaml:"derived_columns"` // Add columns computed with expressions from the others, e.g. {name: speed_ms, expr: speed_kmh / 3.6}
+
+		ODMatrix           bool `yaml:"od_matrix"`            // Write a trip origin-destination matrix (requires parameters.trip_stop_minutes)
+		ODGeohashPrecision int  `yaml:"od_geohash_precision"` // Geohash length of OD matrix cells when no zones file is set (default: 5)
+
+		Rollups            []string `yaml:"rollups"`               // Write per-device totals per period: daily, weekly
+		KMLFilteredLayer   bool     `yaml:"kml_filtered_layer"`    // Add a KML folder with the points the filters left out, to audit them
+		KMLArrowEvery      int      `yaml:"kml_arrow_every"`       // Draw a direction arrow on every Nth point of each KML track (0 = off)
+		KMLFolders         string   `yaml:"kml_folders"`           // Folders for the KML points within each device: device (default, one flat folder) or date
+		KMLAltitude        string   `yaml:"kml_altitude"`          // Altitude of the KML tracks and points: clamp (default, on the ground) or absolute (at their altitude)
+		Units              string   `yaml:"units"`                 // Units of the default output columns: metric (default) or aviation (knots, feet and vertical speed in ft/min)
+		KMLRefreshSeconds  int      `yaml:"kml_refresh_seconds"`   // Also write <basename>_live.kml, which Google Earth reloads every N seconds (0 = off)
+		KMLRegions         bool     `yaml:"kml_regions"`           // Write the tracks as KML regions to <basename>_kml_regions/doc.kml, which Google Earth loads tile by tile as the view zooms in
+		KMLRegionMaxPoints int      `yaml:"kml_region_max_points"` // Points a KML region draws in full before it is split into four (default: 5000)
+		Plot               string   `yaml:"plot"`                  // Draw the trajectories to <basename>_plot.svg or .png for a quick look: svg or png (default: off)
+		PlotColor          string   `yaml:"plot_color"`            // Color the plot by device (default) or speed
+		PlotWidth          int      `yaml:"plot_width"`            // Width of the plot in pixels (default: 1000; the height is 3/4 of it)
+		Charts             bool     `yaml:"charts"`                // Write a speed and elevation over time chart per device to <basename>_charts/<ID>.svg
+		VectorTiles        bool     `yaml:"vector_tiles"`          // Write the trajectories as vector tiles to <basename>_tiles/{z}/{x}/{y}.pbf
+		TileMinZoom        int      `yaml:"tile_min_zoom"`         // Lowest zoom level of the vector tiles (default: 0)
+		TileMaxZoom        int      `yaml:"tile_max_zoom"`         // Highest zoom level of the vector tiles (default: 14)
+		TileFormat         string   `yaml:"tile_format"`           // Container of the vector tiles: directory (default, <basename>_tiles/{z}/{x}/{y}.pbf) or mbtiles (<basename>_tiles.mbtiles)
+		TripSummary        bool     `yaml:"trip_summary"`          // Write one row per trip with distance, duration and, with altitude, climb (requires parameters.trip_stop_minutes)
+		BehaviorScores     bool     `yaml:"behavior_scores"`       // Write a per-device daily driver behavior score from speeding and driving events
+		SpeedDiscrepancies bool     `yaml:"speed_discrepancies"`   // Write <basename>_speed_discrepancies.csv with the stretches where columns.speed and the computed speed differ
+		Anomalies          bool     `yaml:"anomalies"`             // Detect frozen positions, straight lines at constant speed and teleports, adding an anomaly column and writing <basename>_anomalies.csv
+		HTMLReport         bool     `yaml:"html_report"`           // Write <basename>_report.html with the summary, record audit, map and per-device charts in one self-contained page
+		UpdatedDevices     bool     `yaml:"updated_devices"`       // Write <basename>_updated_devices.csv listing the devices with output records, e.g. the ones with new data in an incremental run
+	} `yaml:"output"`
+	Stream struct {
+		State            string   `yaml:"state"`              // Where the stream subcommand keeps each device's last fix: memory (default) or redis
+		RedisURL         string   `yaml:"redis_url"`          // redis://[user:password@]host:port[/db], or rediss:// for TLS
+		RedisKeyPrefix   string   `yaml:"redis_key_prefix"`   // Prefix of the per-device keys (default: gps-processor:last:)
+		RedisTTLHours    float64  `yaml:"redis_ttl_hours"`    // Forget a device's last fix this long after it was saved (0 = keep)
+		KafkaBrokers     []string `yaml:"kafka_brokers"`      // Consume fixes from and publish them to Kafka instead of stdin and stdout when set
+		KafkaInputTopic  string   `yaml:"kafka_input_topic"`  // Topic of the fixes to enrich
+		KafkaOutputTopic string   `yaml:"kafka_output_topic"` // Topic the enriched fixes are published to, with their input keys
+		KafkaGroup       string   `yaml:"kafka_group"`        // Consumer group whose offsets are committed once fixes are published (default: gps-processor)
+		KafkaBatchSize   int      `yaml:"kafka_batch_size"`   // Fixes published and committed together (default: 100)
+		KafkaTLS         bool     `yaml:"kafka_tls"`          // Connect to the brokers over TLS
+		KafkaUsername    string   `yaml:"kafka_username"`     // SASL PLAIN user, if the brokers require authentication
+		KafkaPassword    string   `yaml:"kafka_password"`     // SASL PLAIN password; better given as GPSPROC_STREAM_KAFKA_PASSWORD
+	} `yaml:"stream"`
+	BigQuery struct {
+		Project          string `yaml:"project"`           // Google Cloud project of the table
+		Dataset          string `yaml:"dataset"`           // Dataset of the table
+		Table            string `yaml:"table"`             // Load the ndjson output into this table when set (created if missing)
+		Credentials      string `yaml:"credentials"`       // Service account key file (default: $GOOGLE_APPLICATION_CREDENTIALS)
+		WriteDisposition string `yaml:"write_disposition"` // append (default) or truncate to replace the table's rows
+	} `yaml:"bigquery"`
+	Privacy struct {
+		IDs                string           `yaml:"ids"`                 // Replace device IDs in the outputs: hash (salted) or sequential (empty = keep)
+		Salt               string           `yaml:"salt"`                // Secret key of hashed IDs and time shifts; keep it out of shared configs (e.g. GPSPROC_PRIVACY_SALT)
+		MappingFile        string           `yaml:"mapping_file"`        // Write the original and replaced IDs to this CSV file
+		CoordinateDecimals int              `yaml:"coordinate_decimals"` // Truncate coordinates to this many decimals (0 = unchanged)
+		HomeLocations      []ReferencePoint `yaml:"home_locations"`      // Remove the points near these locations before processing
+		HomeRadiusM        float64          `yaml:"home_radius_m"`       // Distance from a home location within which points are removed (default: 200)
+
+		SensitiveZones     []SensitiveZone `yaml:"sensitive_zones"`      // Areas such as homes and workplaces whose points are removed or fuzzed
+		SensitiveZonesFile string          `yaml:"sensitive_zones_file"` // GeoJSON file of more sensitive zone polygons
+		SensitiveAction    string          `yaml:"sensitive_action"`     // What happens to the points inside: remove (default) or fuzz
+		SensitiveFuzzM     float64         `yaml:"sensitive_fuzz_m"`     // fuzz: move the points to a random spot within this distance of the zone center
+
+		TimeShiftDays      float64 `yaml:"time_shift_days"`       // Shift each device's timestamps by a random offset of up to this many days either way (0 = off)
+		TimeShiftWholeDays bool    `yaml:"time_shift_whole_days"` // Shift by whole days only, keeping the time of day
+	} `yaml:"privacy"`
+	Notify struct {
+		WebhookURL string `yaml:"webhook_url"` // POST the run report to this URL when the run completes or fails
+		Format     string `yaml:"format"`      // json (the run report) or slack (default: slack for hooks.slack.com URLs, else json)
+		On         string `yaml:"on"`          // always (default) or failure
+	} `yaml:"notify"`
+	Alerts struct {
+		Rules      []AlertRule `yaml:"rules"`       // Conditions that raise an alert, e.g. long stops or speeding
+		WebhookURL string      `yaml:"webhook_url"` // POST each alert as JSON to this URL
+	} `yaml:"alerts"`
+	Energy struct {
+		Fuel              string  `yaml:"fuel"`               // Estimate consumption for diesel, gasoline or electric vehicles (empty = off)
+		MassKg            float64 `yaml:"mass_kg"`            // Vehicle mass including load (default: 1500)
+		DragAreaM2        float64 `yaml:"drag_area_m2"`       // Drag coefficient times frontal area (default: 0.7)
+		RollingResistance float64 `yaml:"rolling_resistance"` // Rolling resistance coefficient (default: 0.01)
+		Efficiency        float64 `yaml:"efficiency"`         // Share of the energy drawn that reaches the wheels (default: 0.3, electric 0.85)
+		AuxiliaryKW       float64 `yaml:"auxiliary_kw"`       // Power drawn by auxiliaries while moving, in kW
+		Regeneration      float64 `yaml:"regeneration"`       // Electric only: share of braking energy recovered
+	} `yaml:"energy"`
+	Emissions struct {
+		Factors      map[string]float64 `yaml:"factors"`       // kg of CO2 per km for each device class; writes CO2 estimates per day and trip
+		Classes      map[string]string  `yaml:"classes"`       // Device class by device ID
+		DefaultClass string             `yaml:"default_class"` // Class of devices not listed in classes
+	} `yaml:"emissions"`
+	Metadata struct {
+		File         string   `yaml:"file"`          // CSV of device details, such as vehicle type, driver and department, joined into the outputs
+		IDColumn     string   `yaml:"id_column"`     // Device ID column of the file (default: ID)
+		Columns      []string `yaml:"columns"`       // Columns added to the outputs (default: all but the ID)
+		LabelColumns []string `yaml:"label_columns"` // Columns shown after the device ID in KML names, e.g. [driver]
+	} `yaml:"metadata"`
+	Pipeline struct {
+		AfterRead    []string `yaml:"after_read"`    // Stages run on the records as read, before grouping
+		AfterCompute []string `yaml:"after_compute"` // Stages run once distances, speeds and trips are computed
+		AfterFilter  []string `yaml:"after_filter"`  // Stages run on the filtered records, before the outputs are written
+
+		Command []string `yaml:"command"` // Program and arguments for the external_command stage, e.g. [python3, enrich.py]
+	} `yaml:"pipeline"`
+
+	// Profiles holds named partial configurations, selected with --profile and applied on top
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+
+	// passthroughColumns holds the names of the unmapped input columns, set when the input header is read
+	passthroughColumns []string
+	// runTime is the start of the run, used to name outputs under output.if_exists: suffix
+	runTime time.Time
+	// overwriteApproved holds the existing outputs the user agreed to replace at a prompt
+	overwriteApproved map[string]bool
+	// manifest collects the files written when output.manifest is set
+	manifest *outputManifest
+	// discarded holds the records the filters left out, for output.kml_filtered_layer
+	discarded []discardedPoint
+	// invalidRows counts the input rows skipped under columns.invalid_rows: skip
+	invalidRows int
+	// raggedRows counts the input rows padded or cut to the header width, and those left out,
+	// under columns.ragged_rows
+	raggedRows struct{ fitted, rejected int }
+	// metadata holds the device details of metadata.file, or nil
+	metadata *deviceMetadata
+	// duplicatePoints counts the points merged under parameters.duplicate_timestamps
+	duplicatePoints int
+	// stitchPoints holds the last point of each device in parameters.stitch_with or
+	// parameters.incremental_from
+	stitchPoints map[string]Record
+	// sharedFileNames holds the file names of device IDs that clash once made safe for
+	// filenames, so each clash is warned about once
+	sharedFileNames map[string]bool
+	// inputFiles holds the input file followed by parameters.merge_with, which
+	// Record.SourceFile indexes
+	inputFiles []string
+}
+
+// discardedPoint is a record left out of the outputs and the reason it was
+type discardedPoint struct {
+	Record
+	Reason string
+}
+
+// ReferencePoint is a named location, such as a depot, that distances are reported to
+type ReferencePoint struct {
+	Name      string  `yaml:"name"`
+	Latitude  float64 `yaml:"latitude"`
+	Longitude float64 `yaml:"longitude"`
 }
 
 // Record represents a single GPS data point
 type Record struct {
-	ID            string
-	Latitude      float64
-	Longitude     float64
-	Timestamp     time.Time
-	OriginalRow   int
-	TimeDiff      float64   // time difference in seconds
-	Distance      float64   // distance in kilometers
-	Speed         float64   // speed in kilometers per hour
-	PreviousRow   int       // reference to previous row
-	PrevLatitude  float64   // latitude of previous point
-	PrevLongitude float64   // longitude of previous point
-	PrevTimestamp time.Time // timestamp of previous point
+	ID               string
+	Latitude         float64
+	Longitude        float64
+	Timestamp        time.Time
+	Altitude         float64 // meters, when HasAltitude is set
+	HasAltitude      bool
+	OriginalRow      int
+	SourceFile       int     // index in Config.inputFiles of the file the point was read from, 0 for the input
+	TimeDiff         float64 // time difference in seconds
+	Distance         float64 // distance in kilometers
+	Speed            float64 // speed in kilometers per hour
+	SourceSpeed      float64 // speed from columns.speed in kilometers per hour, when HasSourceSpeed is set
+	HasSourceSpeed   bool
+	VerticalSpeed    float64 // meters per second from the previous point, when HasVerticalSpeed is set
+	HasVerticalSpeed bool
+	WindowSpeed      float64   // speed over the configured speed window in kilometers per hour
+	Outlier          bool      // flagged as a position outlier; not used as a previous point
+	Simplified       bool      // kept by trajectory simplification (parameters.simplify_epsilon_m)
+	RouteDistance    float64   // distance from the planned route in meters, -1 when the device has no route
+	OffRoute         bool      // farther from the planned route than parameters.route_deviation_m
+	Trip             int       // trip number within the device, 0 when stopped (parameters.trip_stop_minutes)
+	Event            string    // driving event at this point, such as harsh_brake, or empty
+	Anomaly          string    // trajectory anomaly this point is part of, such as teleport, or empty (output.anomalies)
+	EventMagnitude   float64   // strength of the driving event in m/s²
+	Energy           float64   // estimated energy used over the segment in kWh (energy.fuel)
+	Bearing          float64   // initial bearing from the previous point in degrees
+	PreviousRow      int       // reference to previous row
+	PrevLatitude     float64   // latitude of previous point
+	PrevLongitude    float64   // longitude of previous point
+	PrevTimestamp    time.Time // timestamp of previous point
+	Passthrough      []string  // unmapped input values, in the order of Config.passthroughColumns
+	Easting          float64   // x coordinate in output.crs, in meters
+	Northing         float64   // y coordinate in output.crs, in meters
 }
 
 // displayHelp shows usage information and command line options
 func displayHelp() {
-	fmt.Println("GPS Data Processor - A tool for processing and analyzing GPS trajectory data")
-	fmt.Println("\nUsage:")
-	fmt.Println("  go run main.go [input_file] [filter_speed] [config_file]")
-	fmt.Println("  go run main.go [input_file] [config_file]")
-	fmt.Println("  go run main.go -h | --help")
-	fmt.Println("Arguments:")
-	fmt.Println("  input_file      Path to the input CSV file (default: sample.csv)")
-	fmt.Println("  filter_speed    Minimum speed threshold in km/h (default: 1.0)")
-	fmt.Println("  config_file     Path to configuration YAML file (default: config.yaml)")
-
-	fmt.Println("\nOptions:")
-	fmt.Println("  -h, --help      Show this help message and exit")
-
-	fmt.Println("\nInput File Format:")
-	fmt.Println("  - CSV file with header row containing column names")
-	fmt.Println("  - Required columns: ID, latitude, longitude, timestamp")
-	fmt.Println("  - Timestamps must be in RFC3339 format (e.g., 2023-03-01T12:00:00Z)")
-
-	fmt.Println("\nConfiguration File:")
-	fmt.Println("  - YAML format with column mappings and processing parameters")
-	fmt.Println("  - Custom column names can be specified for different CSV formats")
-	fmt.Println("  - A default config.yaml is created automatically if none exists")
-	fmt.Println("  - If no YAML file exists, one will be created and processing will halt for review")
-	fmt.Println("  - If a single CSV and YAML file exist in the directory, they will be used automatically")
-
-	fmt.Println("\nOutput Files:")
-	fmt.Println("  - CSV file with calculated distances, speeds, and time differences")
-	fmt.Println("  - KML file for visualization in mapping applications")
-
-	fmt.Println("\nExamples:")
-	fmt.Println("  go run main.go                                  # Auto-detect CSV and YAML files if only one of each exists")
-	fmt.Println("  go run main.go sample.csv                       # Process with default settings")
-	fmt.Println("  go run main.go gps_data.csv 3.5                 # Set speed threshold to 3.5 km/h")
-	fmt.Println("  go run main.go tracking.csv my_config.yaml      # Use custom configuration file")
-	fmt.Println("  go run main.go data.csv 2.0 custom_config.yaml  # Set both speed and config file")
+	printHelp("GPS Data Processor - A tool for processing and analyzing GPS trajectory data")
+	printHelp("\nUsage:")
+	printHelp("  go run main.go [input_file] [filter_speed] [config_file]")
+	printHelp("  go run main.go [input_file] [config_file]")
+	printHelp("  go run main.go [options] [input_file] [config_file]")
+	printHelp("  go run main.go -h | --help")
+	printHelp("  go run main.go init [sample_file] [--output config.yaml]")
+	printHelp("  go run main.go stream [config_file] < fixes.jsonl > enriched.jsonl")
+	printHelp("  go run main.go generate [config_file] [--devices N] [--points M] [--output synthetic.csv]")
+	printHelp("  go run main.go bench [config_file] [--records N] [--devices N] [--runs N]")
+	printHelp("Arguments:")
+	printHelp("  input_file      Path to the input CSV or Excel (.xlsx) file (default: sample.csv)")
+	printHelp("  filter_speed    Minimum speed threshold in km/h (default: 1.0)")
+	printHelp("  config_file     Path to configuration YAML file (default: config.yaml)")
+
+	printHelp("\nSubcommands:")
+	printHelp("  init            Inspect a sample file and interactively write a tailored config.yaml")
+	printHelp("  stream          Enrich JSON-line fixes as they arrive, from stdin to stdout or between Kafka topics")
+	printHelp("  generate        Write synthetic GPS tracks for trying out configs without real data")
+	printHelp("  bench           Time each pipeline step on generated data, optionally with pprof profiles")
+
+	printHelp("\nOptions:")
+	printHelp("  -h, --help      Show this help message and exit")
+	printHelp("  --format LIST   Output formats to write: csv, kml, xlsx, geojsonseq, ndjson (repeatable or comma-separated)")
+	printHelp("  --id LIST       Only process these device IDs (repeatable or comma-separated)")
+	printHelp("  --quiet         Disable progress bars")
+	printHelp("  --log-format F  Replace progress bars and messages with timestamped log lines on stderr: text or json")
+	printHelp("  --verbose       Also show debug messages")
+	printHelp("  --log-file FILE Append all log messages, with timestamps and levels, to FILE")
+	printHelp("  --report FILE   Write a machine-readable JSON run report to FILE")
+	printHelp("  --profile NAME  Apply a named profile from the config file, or the built-in aviation profile")
+	printHelp("  --set PATH=VAL  Override a config value, e.g. --set parameters.filter_above_kph=2.5 (repeatable)")
+	printHelp("  --validate      Check the config and the first rows of input, then exit without processing")
+	printHelp("  --validate-rows N  Number of input rows to check with --validate (default: 100)")
+	printHelp("  --resume        Continue an interrupted run from its checkpoint")
+	printHelp("  --if-exists P   When an output file exists: overwrite (default), error, prompt, or suffix (add a timestamp)")
+	printHelp("  --no-clobber    Same as --if-exists error")
+	printHelp("  --overwrite     Same as --if-exists overwrite")
+	printHelp("  --cpu-profile FILE  Write a pprof CPU profile of the run to FILE")
+	printHelp("  --mem-profile FILE  Write a pprof heap profile at the end of the run to FILE")
+	printHelp("  --max-memory SIZE  Keep record buffers within SIZE, e.g. 8GB, spilling devices to temp_dir when needed")
+	printHelp("  --compare FILE  Compare the processed records with an expected CSV output instead of writing outputs")
+	printHelp("  --compare-tolerance X      Absolute difference allowed between numbers with --compare (default: 1e-06)")
+	printHelp("  --compare-rel-tolerance X  Relative difference allowed between numbers with --compare (default: 0)")
+	printHelp("  --lang LANG     Language of the console messages: en or es (default: from LC_ALL, LC_MESSAGES or LANG)")
+
+	printHelp("\nInput File Format:")
+	printHelp("  - CSV file with header row containing column names")
+	printHelp("  - Excel workbooks (.xlsx) are also accepted; the first sheet is read")
+	printHelp("  - Required columns: ID, latitude, longitude, timestamp")
+	printHelp("  - Timestamps must be in RFC3339 format (e.g., 2023-03-01T12:00:00Z)")
+
+	printHelp("\nConfiguration File:")
+	printHelp("  - YAML format with column mappings and processing parameters")
+	printHelp("  - Custom column names can be specified for different CSV formats")
+	printHelp("  - A default config.yaml is created automatically if none exists")
+	printHelp("  - If no YAML file exists, one will be created and processing will halt for review")
+	printHelp("  - If a single CSV and YAML file exist in the directory, they will be used automatically")
+	printHelp("  - Any value can be overridden with GPSPROC_* environment variables or --set")
+	printHelp("  - Precedence: defaults < config file < --profile < environment < --set < --format/--id")
+
+	printHelp("\nOutput Files:")
+	printHelp("  - Formats are chosen with output.formats in the config or --format (default: csv, kml)")
+	printHelp("  - CSV file with calculated distances, speeds, and time differences")
+	printHelp("  - KML file for visualization in mapping applications")
+	printHelp("  - Excel workbook with records and per-device summary sheets (xlsx format)")
+	printHelp("  - Backwards time jump report (<input>_time_jumps.csv) when time_jumps is set")
+	printHelp("  - Route deviation report (<input>_deviations.csv) when planned routes are configured")
+	printHelp("  - Device encounter report (<input>_encounters.csv) when proximity_m is set")
+	printHelp("  - Driving events report (<input>_events.csv) when a harsh_*_mps2 threshold is set")
+	printHelp("  - Per-device daily driver behavior scores (<input>_scores.csv) when behavior_scores is set")
+	printHelp("  - Source and computed speed discrepancies (<input>_speed_discrepancies.csv) when speed_discrepancies is set")
+	printHelp("  - Frozen position, straight line and teleport anomalies per device (<input>_anomalies.csv) when anomalies is set")
+	printHelp("  - Fuel or energy estimates per day and trip (<input>_energy_daily.csv, <input>_energy_trips.csv) when energy.fuel is set")
+	printHelp("  - CO2 estimates per day and trip (<input>_co2_daily.csv, <input>_co2_trips.csv) when emissions.factors is set")
+	printHelp("  - Trip summary with climb and descent (<input>_trips.csv) when trip_summary is set")
+	printHelp("  - Trip origin-destination matrix (<input>_od_matrix.csv) when od_matrix is set")
+	printHelp("  - Alert report (<input>_alerts.csv) when alert rules are configured")
+	printHelp("  - KML network link (<input>_live.kml) that reloads the KML output when kml_refresh_seconds is set")
+	printHelp("  - KML regions of the tracks (<input>_kml_regions/doc.kml), loaded as Google Earth zooms in, when kml_regions is set")
+	printHelp("  - Plot of the trajectories (<input>_plot.svg or .png) when plot is set")
+	printHelp("  - Speed and elevation charts per device (<input>_charts/<ID>.svg) when charts is set")
+	printHelp("  - HTML report with summary, record audit, map and charts (<input>_report.html) when html_report is set")
+	printHelp("  - Vector tiles of the trajectories (<input>_tiles/{z}/{x}/{y}.pbf, or <input>_tiles.mbtiles with tile_format mbtiles) when vector_tiles is set")
+	printHelp("  - BigQuery schema (<input>_schema.json) for the ndjson output, which is loaded into bigquery.table when set")
+	printHelp("  - Output manifest (<input>_manifest.json) with row counts and SHA-256 checksums when manifest is set")
+	printHelp("  - Updated devices list (<input>_updated_devices.csv) when updated_devices is set")
+	printHelp("  - Per-device daily or weekly totals (<input>_rollup_daily.csv, <input>_rollup_weekly.csv) when rollups are set")
+
+	printHelp("\nExit Codes:")
+	printHelp("  0 success, 1 unexpected error, 2 invalid arguments, 3 default config created,")
+	printHelp("  4 invalid configuration, 5 input error, 6 no records after filtering, 7 output error,")
+	printHelp("  8 output differs from the --compare file")
+
+	printHelp("\nExamples:")
+	printHelp("  go run main.go                                  # Auto-detect CSV and YAML files if only one of each exists")
+	printHelp("  go run main.go sample.csv                       # Process with default settings")
+	printHelp("  go run main.go gps_data.csv 3.5                 # Set speed threshold to 3.5 km/h")
+	printHelp("  go run main.go tracking.csv my_config.yaml      # Use custom configuration file")
+	printHelp("  go run main.go data.csv 2.0 custom_config.yaml  # Set both speed and config file")
+	printHelp("  go run main.go data.csv --format csv            # Write only the CSV output")
+	printHelp("  go run main.go fleet.csv --id truck42           # Process a single device")
 }
 
 // findSingleFileByExtension finds a single file with the given extension in the current directory
@@ -91,7 +449,7 @@ func displayHelp() {
 func findSingleFileByExtension(extension string) string {
 	files, err := os.ReadDir(".")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Unable to read directory: %v\n", err)
+		logWarn("Unable to read directory: %v", err)
 		return ""
 	}
 
@@ -125,26 +483,103 @@ func main() {
 	config.Columns.Longitude = "longitude"
 	config.Columns.Timestamp = "timestamp"
 	config.Parameters.FilterAboveKph = 1.0
+	config.Output.CoordinatePrecision = defaultPrecision
+	config.Output.DistancePrecision = defaultPrecision
+	config.Output.SpeedPrecision = defaultPrecision
+	config.Output.ProjectedPrecision = defaultProjectedPrecision
+	config.Parameters.TripStopRadiusM = defaultTripStopRadiusM
+	config.Output.ODGeohashPrecision = defaultODGeohashPrecision
+	config.Privacy.HomeRadiusM = defaultHomeRadiusM
+
+	// Console messages follow the locale unless --lang chooses another language
+	languageFromEnvironment()
+
+	// Subcommands have their own flags and replace the normal processing run
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		os.Exit(runInit(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stream" {
+		os.Exit(runStream(os.Args[2:], &config))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		os.Exit(runGenerate(os.Args[2:], &config))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:], &config))
+	}
 
-	// Check for help flag
-	args := os.Args[1:]
-	if len(args) > 0 && (args[0] == "-h" || args[0] == "--help") {
-		displayHelp()
+	// Parse command line flags; positional arguments may be mixed with flags
+	var formats, ids stringList
+	var overrides repeatedString
+	fs := flag.NewFlagSet("gps-processor", flag.ContinueOnError)
+	fs.Usage = displayHelp
+	fs.Var(&formats, "format", "output format to write (csv, kml, xlsx, geojsonseq, ndjson); may be repeated or comma-separated")
+	fs.Var(&ids, "id", "only process this device ID; may be repeated or comma-separated")
+	fs.Var(&overrides, "set", "override a config value, e.g. parameters.filter_above_kph=2.5; may be repeated")
+	profile := fs.String("profile", "", "apply the named profile from the config file")
+	quiet := fs.Bool("quiet", false, "disable progress reporting")
+	logFormat := fs.String("log-format", "", "replace progress bars with periodic log lines: text or json")
+	verbose := fs.Bool("verbose", false, "also show debug messages")
+	logFile := fs.String("log-file", "", "append all log messages to this file")
+	reportFile := fs.String("report", "", "write a JSON run report to this file")
+	validate := fs.Bool("validate", false, "check the config and the first rows of input, then exit")
+	validateRows := fs.Int("validate-rows", 100, "number of input rows to check with --validate")
+	resume := fs.Bool("resume", false, "continue an interrupted run from its checkpoint")
+	noClobber := fs.Bool("no-clobber", false, "fail instead of replacing existing output files (output.if_exists=error)")
+	overwrite := fs.Bool("overwrite", false, "replace existing output files (output.if_exists=overwrite)")
+	ifExists := fs.String("if-exists", "", "what to do when an output file exists: overwrite, error, prompt or suffix")
+	cpuProfile := fs.String("cpu-profile", "", "write a pprof CPU profile of the run to this file")
+	memProfile := fs.String("mem-profile", "", "write a pprof heap profile at the end of the run to this file")
+	maxMemory := fs.String("max-memory", "", "keep record buffers within this size, e.g. 8GB, spilling devices to temporary files")
+	compareFile := fs.String("compare", "", "compare the processed records with this expected CSV output instead of writing outputs")
+	compareTol := fs.Float64("compare-tolerance", defaultCompareTolerance, "absolute difference allowed between numbers with --compare")
+	compareRelTol := fs.Float64("compare-rel-tolerance", 0, "relative difference allowed between numbers with --compare, e.g. 0.001")
+	fs.Func("lang", "language of the console messages: en or es (default: from LC_ALL, LC_MESSAGES or LANG)", setLanguage)
+	args, err := parseArgs(fs, os.Args[1:])
+	if err == flag.ErrHelp {
 		return
 	}
+	if err != nil {
+		os.Exit(exitUsage)
+	}
+	report := newRunReport(*reportFile)
+	if report.profile, err = startProfiles(*cpuProfile, *memProfile); err != nil {
+		report.fail(exitUsage, "Error: %v", err)
+	}
+	switch {
+	case *quiet:
+		progressMode = "none"
+	case *logFormat == "text" || *logFormat == "json":
+		progressMode = *logFormat
+	case *logFormat != "":
+		report.fail(exitUsage, "Error: unknown log format %q (supported: text, json)", *logFormat)
+	}
+	if *logFormat == "text" || *logFormat == "json" {
+		logger.format = *logFormat
+	}
+	if *verbose {
+		logger.level = levelDebug
+	}
+	if *logFile != "" {
+		if err := logger.openFile(*logFile); err != nil {
+			report.fail(exitUsage, "Error: %v", err)
+		}
+	}
 
 	// Check for and create default config file if it doesn't exist
 	defaultConfigFile := "config.yaml"
 	if _, err := os.Stat(defaultConfigFile); os.IsNotExist(err) {
-		fmt.Println("No configuration file found. Creating default config.yaml...")
+		logInfo("No configuration file found. Creating default config.yaml...")
 		if err := createDefaultConfigFile(defaultConfigFile); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Failed to create default config file: %v\n", err)
+			logWarn("Failed to create default config file: %v", err)
 		} else {
-			fmt.Println("\n✓ A new config.yaml file has been created.")
-			fmt.Println("⚠ Please review the configuration file before running the tool again.")
-			fmt.Println("ℹ You can customize column names and processing parameters as needed.")
-			fmt.Println("ℹ Run the tool again after reviewing the configuration.")
-			return
+			logInfo("")
+			logInfo("✓ A new config.yaml file has been created.")
+			logInfo("⚠ Please review the configuration file before running the tool again.")
+			logInfo("ℹ You can customize column names and processing parameters as needed.")
+			logInfo("ℹ Or run 'gps-processor init' to create a config tailored to your data.")
+			logInfo("ℹ Run the tool again after reviewing the configuration.")
+			report.exit(exitConfigCreated)
 		}
 	}
 
@@ -158,9 +593,13 @@ func main() {
 	} else {
 		// Auto-detect input file if not specified
 		singleCSV := findSingleFileByExtension(".csv")
+		singleXLSX := findSingleFileByExtension(".xlsx")
 		if singleCSV != "" {
 			inputFile = singleCSV
-			fmt.Printf("Found single CSV file: %s (using as input)\n", singleCSV)
+			logInfo("Found single CSV file: %s (using as input)", singleCSV)
+		} else if singleXLSX != "" {
+			inputFile = singleXLSX
+			logInfo("Found single Excel file: %s (using as input)", singleXLSX)
 		} else {
 			inputFile = "sample.csv" // Default to sample.csv if no argument provided
 		}
@@ -188,10 +627,10 @@ func main() {
 	if configFile != "" {
 		// Load the specified config file
 		if err := loadConfig(configFile, &config); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Error loading config file: %v\n", err)
-			fmt.Fprintf(os.Stderr, "Using default or command line configuration.\n")
+			logWarn("Error loading config file: %v; using default or command line configuration", err)
 		} else {
-			fmt.Printf("Configuration loaded from: %s\n", configFile)
+			logInfo("Configuration loaded from: %s", configFile)
+			report.ConfigFile = configFile
 		}
 	} else {
 		// Try to find a YAML config file to use
@@ -199,102 +638,977 @@ func main() {
 		// First try config.yaml
 		defaultConfigFile := "config.yaml"
 		if _, err := os.Stat(defaultConfigFile); err == nil {
-			fmt.Println("Found config.yaml in current directory...")
+			logInfo("Found config.yaml in current directory...")
 			if err := loadConfig(defaultConfigFile, &config); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: Error loading config.yaml: %v\n", err)
-				fmt.Fprintf(os.Stderr, "Using default or command line configuration.\n")
+				logWarn("Error loading config.yaml: %v; using default or command line configuration", err)
 			} else {
-				fmt.Printf("Configuration loaded from: %s\n", defaultConfigFile)
+				logInfo("Configuration loaded from: %s", defaultConfigFile)
+				report.ConfigFile = defaultConfigFile
 			}
 		} else {
 			// Look for a single YAML file if config.yaml doesn't exist
 			singleYAML := findSingleFileByExtension(".yaml")
 			if singleYAML != "" && singleYAML != defaultConfigFile {
-				fmt.Printf("Found single YAML file: %s (using as configuration)\n", singleYAML)
+				logInfo("Found single YAML file: %s (using as configuration)", singleYAML)
 				if err := loadConfig(singleYAML, &config); err != nil {
-					fmt.Fprintf(os.Stderr, "Warning: Error loading %s: %v\n", singleYAML, err)
-					fmt.Fprintf(os.Stderr, "Using default configuration.\n")
+					logWarn("Error loading %s: %v; using default configuration", singleYAML, err)
 				} else {
-					fmt.Printf("Configuration loaded from: %s\n", singleYAML)
+					logInfo("Configuration loaded from: %s", singleYAML)
+					report.ConfigFile = singleYAML
 				}
 			} else {
 				// Also check for .yml extension
 				singleYML := findSingleFileByExtension(".yml")
 				if singleYML != "" {
-					fmt.Printf("Found single YML file: %s (using as configuration)\n", singleYML)
+					logInfo("Found single YML file: %s (using as configuration)", singleYML)
 					if err := loadConfig(singleYML, &config); err != nil {
-						fmt.Fprintf(os.Stderr, "Warning: Error loading %s: %v\n", singleYML, err)
-						fmt.Fprintf(os.Stderr, "Using default configuration.\n")
+						logWarn("Error loading %s: %v; using default configuration", singleYML, err)
 					} else {
-						fmt.Printf("Configuration loaded from: %s\n", singleYML)
+						logInfo("Configuration loaded from: %s", singleYML)
+						report.ConfigFile = singleYML
 					}
 				}
 			}
 		}
 	}
 
+	// A selected profile overrides the base values of the config file
+	if *profile != "" {
+		if err := applyProfile(&config, *profile); err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+		logInfo("Using configuration profile: %s", *profile)
+	}
+
+	// Environment variables override the config file, and --set overrides both
+	applied, err := applyEnvOverrides(&config)
+	if err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	for _, name := range applied {
+		logInfo("Configuration override from environment: %s", name)
+	}
+	if err := applySetOverrides(&config, overrides); err != nil {
+		report.fail(exitUsage, "Error: %v", err)
+	}
+
+	// From here on, the end of the run is announced to the notification webhook
+	if report.notify, err = newNotifier(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+
+	// The overwrite policy given on the command line takes precedence over the config file
+	if (*noClobber && *overwrite) || ((*noClobber || *overwrite) && *ifExists != "") {
+		report.fail(exitUsage, "Error: only one of --no-clobber, --overwrite and --if-exists can be given")
+	}
+	switch {
+	case *noClobber:
+		config.Output.IfExists = "error"
+	case *overwrite:
+		config.Output.IfExists = "overwrite"
+	case *ifExists != "":
+		config.Output.IfExists = *ifExists
+	}
+	if err := checkIfExists(&config); err != nil {
+		report.fail(exitUsage, "Error: %v", err)
+	}
+
+	// A memory budget also becomes the garbage collector's soft limit
+	var memoryBudget int64
+	if *maxMemory != "" {
+		if memoryBudget, err = parseByteSize(*maxMemory); err != nil {
+			report.fail(exitUsage, "Error: --max-memory: %v", err)
+		}
+		debug.SetMemoryLimit(memoryBudget)
+	}
+
+	// Device IDs given on the command line replace the configured include list
+	if len(ids) > 0 {
+		config.Parameters.IncludeIDs = ids
+	}
+
+	// Output formats given on the command line take precedence over the config file
+	if len(formats) > 0 {
+		config.Output.Formats = formats
+	}
+	selectedFormats, err := selectedOutputFormats(&config)
+	if err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if _, err := projection.Parse(config.Columns.CRS); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if _, err := outputProjection(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if _, err := selectedDistance(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if config.Parameters.Distance3D && config.Columns.Altitude == "" {
+		report.fail(exitConfigError, "Error: parameters.distance_3d requires an altitude column; set columns.altitude")
+	}
+	if _, err := parseSpeedWindow(config.Parameters.SpeedWindow); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if _, err := newOutlierFilter(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkRollups(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkKMLFolders(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if config.Output.KMLRefreshSeconds != 0 {
+		if err := checkNetworkLink(&config, selectedFormats); err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+	}
+	if err := checkBigQuery(&config, selectedFormats); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkGeometry(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkCoordinateFormat(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkTimestampColumns(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkTimeJumps(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkStitching(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkMerge(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkDeviceThresholds(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if _, err := newIDNormalizer(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkEncoding(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkSourceSpeed(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkUnits(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if config.Output.SpeedDiscrepancies && config.Columns.Speed == "" {
+		report.fail(exitConfigError, "Error: output.speed_discrepancies requires a speed column; set columns.speed")
+	}
+	if mode := config.Columns.InvalidRows; mode != "" && mode != "fail" && mode != "skip" {
+		report.fail(exitConfigError, "Error: unknown columns.invalid_rows %q (use fail or skip)", mode)
+	}
+	switch mode := config.Columns.RaggedRows; mode {
+	case "", "fail", "pad", "truncate", "reject":
+	default:
+		report.fail(exitConfigError, "Error: unknown columns.ragged_rows %q (use fail, pad, truncate or reject)", mode)
+	}
+	if err := checkPrivacy(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	sensitiveZones, err := loadSensitiveZones(&config)
+	if err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := loadMetadata(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkKMLRegions(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkPlot(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if config.Output.VectorTiles {
+		if err := checkVectorTiles(&config); err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+	}
+	if config.Output.TripSummary && config.Parameters.TripStopMinutes <= 0 {
+		report.fail(exitConfigError, "Error: output.trip_summary requires trip segmentation; set parameters.trip_stop_minutes")
+	}
+	if config.Output.ODMatrix {
+		if err := checkODMatrix(&config); err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+	}
+	var zones *zoneSet
+	if config.Parameters.ZonesFile != "" {
+		if zones, err = loadZones(config.Parameters.ZonesFile); err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+	}
+	if err := checkAlerts(&config, zones); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkPipeline(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkDrivingEvents(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if _, err := newAnomalySettings(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if config.Output.BehaviorScores {
+		if err := checkBehaviorScores(&config); err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+	}
+	if err := checkEnergy(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkEmissions(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	if err := checkOutputFilename(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	report.InputFile = inputFile
+	config.inputFiles = append([]string{inputFile}, config.Parameters.MergeWith...)
+
+	// Propose a column mapping from the input when the configured one doesn't match
+	if err := autoDetectColumns(inputFile, &config); err != nil {
+		var cfgErr *configError
+		if errors.As(err, &cfgErr) {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+		report.fail(exitInputError, "Error reading input: %v", err)
+	}
+
 	// Use the configuration
 	filterAboveKph := config.Parameters.FilterAboveKph
 
-	fmt.Printf("=== GPS Data Processor ===\n")
-	fmt.Printf("Input file: %s\n", inputFile)
-	fmt.Printf("Column mappings: ID='%s', Lat='%s', Lon='%s', Time='%s'\n",
-		config.Columns.ID, config.Columns.Latitude, config.Columns.Longitude, config.Columns.Timestamp)
-	fmt.Printf("Speed filter threshold: %.1f km/h\n\n", filterAboveKph)
+	logInfo("=== GPS Data Processor ===")
+	logInfo("Input file: %s", inputFile)
+	logInfo("Column mappings: ID='%s', Lat='%s', Lon='%s', Time='%s'",
+		idColumnName(&config), config.Columns.Latitude, config.Columns.Longitude, timestampColumnName(&config))
+	logInfo("Speed filter threshold: %.1f km/h", filterAboveKph)
+	logInfo("")
 
 	// Start timer to track overall processing time
 	startTime := time.Now()
 
+	// In validate mode, check the config against a sample of the input and stop
+	if *validate {
+		report.step("validate")
+		if err := validateInput(inputFile, &config, selectedFormats, *validateRows, startTime); err != nil {
+			var cfgErr *configError
+			if errors.As(err, &cfgErr) {
+				report.fail(exitConfigError, "Validation failed: %v", err)
+			}
+			report.fail(exitInputError, "Validation failed: %v", err)
+		}
+		report.exit(exitOK)
+	}
+
+	// Checkpoints let an interrupted run continue with --resume
+	cp, err := openCheckpoint(inputFile, &config, *resume)
+	if err != nil {
+		report.fail(exitInputError, "Error: %v", err)
+	}
+
+	// Settle existing single-file outputs before processing, so a refusal or a prompt
+	// does not come only after a long run
+	config.runTime = startTime
+	if !config.Output.SplitByDevice && (config.Output.IfExists == "error" || config.Output.IfExists == "prompt") {
+		for _, format := range selectedFormats {
+			if _, done := cp.outputDone(format.Name); done {
+				continue
+			}
+			if _, err := resolveOutputPath(getOutputFilename(inputFile, format.Name, "", &config, startTime), &config); err != nil {
+				report.fail(exitOutputError, "Error: %v", err)
+			}
+		}
+	}
+
+	// The previous file only provides each device's last point, so it is read first and the
+	// input's passthrough columns are the ones that stay
+	switch {
+	case config.Parameters.StitchWith != "":
+		logInfo("Reading the file to stitch to: %s", config.Parameters.StitchWith)
+		if config.stitchPoints, err = loadStitchPoints(&config); err != nil {
+			report.fail(exitInputError, "Error: %v", err)
+		}
+		logInfo("Found the last points of %d devices", len(config.stitchPoints))
+	case config.Parameters.IncrementalFrom != "":
+		logInfo("Reading the previous output: %s", config.Parameters.IncrementalFrom)
+		if config.stitchPoints, err = loadIncrementalState(&config); err != nil {
+			report.fail(exitInputError, "Error: %v", err)
+		}
+		logInfo("Found the last points of %d devices", len(config.stitchPoints))
+	}
+
 	// Read and process the CSV file
-	fmt.Println("Step 1: Reading input CSV file...")
-	records, err := readCSV(inputFile, &config)
+	logInfo("Step 1: Reading input file...")
+	report.step("read")
+	records, err := readInput(inputFile, &config, cp)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading CSV: %v\n", err)
-		os.Exit(1)
+		report.fail(exitInputError, "Error reading input: %v", err)
+	}
+	if len(config.Parameters.MergeWith) > 0 {
+		var duplicates int
+		if records, duplicates, err = readMergedInputs(records, &config); err != nil {
+			report.fail(exitInputError, "Error reading input: %v", err)
+		}
+		logInfo("Merged %d files: dropped %d points at times an earlier file already has", len(config.inputFiles), duplicates)
+		report.Counts["merge_duplicates"] = duplicates
+	}
+	// Points dropped while merging files were read all the same
+	report.Counts["input_records"] = len(records) + report.Counts["merge_duplicates"]
+	if config.invalidRows > 0 {
+		report.Counts["invalid_rows"] = config.invalidRows
+	}
+	if config.raggedRows.fitted > 0 {
+		report.Counts["ragged_rows_fitted"] = config.raggedRows.fitted
+	}
+	if config.raggedRows.rejected > 0 {
+		report.Counts["ragged_rows_rejected"] = config.raggedRows.rejected
+	}
+	if config.Parameters.GPSWeekRollover {
+		corrected, err := correctGPSRollover(records, &config)
+		if err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+		logInfo("GPS week rollover: moved %d timestamps forward by 1024 weeks", corrected)
+		report.Counts["gps_rollover_corrected"] = corrected
+	}
+	// Implausible dates are checked after the rollover correction, which may make them plausible
+	var implausible int
+	if records, implausible, err = checkTimestampBounds(records, &config); err != nil {
+		report.fail(exitInputError, "Error reading input: %v", err)
+	}
+	if implausible > 0 {
+		report.Counts["implausible_timestamps"] = implausible
+	}
+	if config.Parameters.IncrementalFrom != "" {
+		var skipped int
+		records, skipped = skipProcessed(records, config.stitchPoints)
+		logInfo("Incremental run: skipped %d points already in %s", skipped, config.Parameters.IncrementalFrom)
+		report.Counts["already_processed"] = skipped
+	}
+	// Daily files often overlap; the points the previous file already holds are left out, so
+	// they are neither counted twice nor keep the device from being stitched
+	if config.Parameters.StitchWith != "" {
+		var skipped int
+		records, skipped = skipProcessed(records, config.stitchPoints)
+		if skipped > 0 {
+			logInfo("Stitching: skipped %d points that overlap %s", skipped, config.Parameters.StitchWith)
+			report.Counts["stitch_overlap"] = skipped
+		}
 	}
+	if len(config.Privacy.HomeLocations) > 0 {
+		var removed int
+		records, removed = removeHomePoints(records, &config)
+		logInfo("Privacy: removed %d points within %.0f m of a home location", removed, config.Privacy.HomeRadiusM)
+		report.Counts["home_points_removed"] = removed
+	}
+	if sensitiveZones != nil {
+		var removed, fuzzed int
+		records, removed, fuzzed = cloakSensitiveZones(records, sensitiveZones, &config)
+		if config.Privacy.SensitiveAction == "fuzz" {
+			logInfo("Privacy: fuzzed %d points inside sensitive zones", fuzzed)
+			report.Counts["sensitive_points_fuzzed"] = fuzzed
+		} else {
+			logInfo("Privacy: removed %d points inside sensitive zones", removed)
+			report.Counts["sensitive_points_removed"] = removed
+		}
+	}
+	if config.Privacy.TimeShiftDays > 0 {
+		devices := shiftTimestamps(records, &config)
+		logInfo("Privacy: shifted the timestamps of %d devices by up to %g days", devices, config.Privacy.TimeShiftDays)
+	}
+	// Clock jumps are only visible in input order, before the points are sorted by time
+	var timeJumps []timeJump
+	if mode := config.Parameters.TimeJumps; mode == "report" || mode == "correct" {
+		timeJumps = findTimeJumps(records, &config)
+		logInfo("Found %d backwards time jumps", len(timeJumps))
+	}
+	if records, err = runStages(config.Pipeline.AfterRead, records, &config); err != nil {
+		report.fail(exitError, "Error in pipeline: %v", err)
+	}
+	inputRecords := len(records)
 
-	// Group by ID
-	fmt.Println("Step 2: Grouping records by ID...")
-	groupedRecords := groupByID(records)
-	fmt.Printf("Found %d unique device IDs\n\n", len(groupedRecords))
+	// Check the output columns now that the input header (and any passthrough columns) is known
+	if _, err := selectedColumns(&config); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+	expressionFilter, err := NewRecordFilter(&config)
+	if err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
 
-	// Calculate time differences and distances
-	fmt.Println("Step 3: Calculating time differences and distances...")
-	processedRecords := processGroups(groupedRecords)
+	// With a memory budget, spill the records to per-device partitions when grouping them
+	// all at once would not fit
+	var partitions *partitionSet
+	if memoryBudget > 0 {
+		if partitions, err = spillPartitions(records, memoryBudget, config.Parameters.TempDir); err != nil {
+			report.fail(exitError, "Error: %v", err)
+		}
+		if partitions != nil {
+			logInfo("Spilled %d records to %d partitions to stay within %s", len(records), len(partitions.runs), formatByteSize(memoryBudget))
+		}
+	}
+
+	var processedRecords []Record
+	if partitions != nil {
+		// Group and process one partition at a time
+		logInfo("Steps 2-3: Grouping records by ID and calculating time differences and distances...")
+		report.step("compute")
+		var devices, dropped int
+		processedRecords, devices, dropped, err = processPartitions(partitions, &config)
+		if err != nil {
+			report.fail(exitError, "Error processing records: %v", err)
+		}
+		logInfo("Found %d unique device IDs", devices+dropped)
+		if config.Parameters.MinPointsPerID > 0 {
+			logInfo("Dropped %d device IDs with fewer than %d points", dropped, config.Parameters.MinPointsPerID)
+			report.Counts["devices_dropped"] = dropped
+		}
+		report.Counts["devices"] = devices
+	} else {
+		// Group by ID
+		logInfo("Step 2: Grouping records by ID...")
+		report.step("group")
+		groupedRecords := groupByID(records)
+		logInfo("Found %d unique device IDs", len(groupedRecords))
+		if config.Parameters.MinPointsPerID > 0 {
+			dropped := dropSmallGroups(groupedRecords, config.Parameters.MinPointsPerID)
+			logInfo("Dropped %d device IDs with fewer than %d points", dropped, config.Parameters.MinPointsPerID)
+			report.Counts["devices_dropped"] = dropped
+		}
+		report.Counts["devices"] = len(groupedRecords)
+		logInfo("")
+
+		// Calculate time differences and distances
+		logInfo("Step 3: Calculating time differences and distances...")
+		report.step("compute")
+		if processedRecords, err = processGroups(groupedRecords, &config); err != nil {
+			report.fail(exitError, "Error processing records: %v", err)
+		}
+	}
+	if config.duplicatePoints > 0 {
+		report.Counts["duplicate_points_merged"] = config.duplicatePoints
+	}
+	if memoryBudget > 0 {
+		// The outputs are written from the processed records, so they must fit regardless
+		if size := recordsSize(processedRecords); size > memoryBudget/2 {
+			logWarn("The processed records take about %s, more than half of --max-memory %s; writing the outputs may exceed it",
+				formatByteSize(size), formatByteSize(memoryBudget))
+		}
+	}
+	// Pseudonymize before any stage or output sees the records, and the time jumps found
+	// while reading, which are reported by device ID
+	if config.Privacy.IDs != "" || config.Privacy.CoordinateDecimals > 0 {
+		mapping := applyPrivacy(processedRecords, &config)
+		if config.Privacy.IDs != "" {
+			logInfo("Privacy: replaced %d device IDs (%s)", len(mapping), config.Privacy.IDs)
+			timeJumps = pseudonymizeTimeJumps(timeJumps, mapping)
+		}
+		if config.Privacy.MappingFile != "" {
+			if err := writeIDMapping(config.Privacy.MappingFile, mapping); err != nil {
+				report.fail(exitOutputError, "Error: %v", err)
+			}
+			logInfo("ID mapping written to %s; keep it private", config.Privacy.MappingFile)
+		}
+	}
+	if processedRecords, err = runStages(config.Pipeline.AfterCompute, processedRecords, &config); err != nil {
+		report.fail(exitError, "Error in pipeline: %v", err)
+	}
+	report.Counts["processed_records"] = len(processedRecords)
 
 	// Filter out records with previous_row = 0 and apply speed filter
-	fmt.Println("Step 4: Filtering records...")
-	filteredRecords := filterRecords(processedRecords, filterAboveKph)
-	fmt.Printf("Filtered from %d to %d records\n\n", len(processedRecords), len(filteredRecords))
+	logInfo("Step 4: Filtering records...")
+	report.step("filter")
+	thresholds := NewThresholdSet(&config)
+	filteredRecords, filtered := filterRecords(processedRecords, thresholds, expressionFilter)
+	report.Counts["first_points_removed"] = filtered.FirstPoints
+	if thresholds.filterAboveKph > 0 || len(thresholds.byID) > 0 {
+		report.Counts["speed_filtered"] = filtered.Speed
+	}
+	if expressionFilter != nil {
+		report.Counts["expression_filtered"] = filtered.Expression
+	}
+	if config.Output.KMLFilteredLayer {
+		for i := range processedRecords {
+			if reason := filterReason(&processedRecords[i], thresholds.speedThreshold(processedRecords[i].ID), expressionFilter); reason != "" {
+				config.discarded = append(config.discarded, discardedPoint{processedRecords[i], reason})
+			}
+		}
+	}
+	if filteredRecords, err = runStages(config.Pipeline.AfterFilter, filteredRecords, &config); err != nil {
+		report.fail(exitError, "Error in pipeline: %v", err)
+	}
+	logInfo("Filtered from %d to %d records", len(processedRecords), len(filteredRecords))
+	logInfo("")
+	report.Counts["output_records"] = len(filteredRecords)
+
+	// Put the records in a stable order so repeated runs produce identical outputs
+	report.step("sort")
+	if err := sortRecords(filteredRecords, config.Output.Order); err != nil {
+		report.fail(exitConfigError, "Error: %v", err)
+	}
+
+	// In compare mode, check the records against the expected output and stop
+	if *compareFile != "" {
+		report.step("compare")
+		columns, err := selectedColumns(&config)
+		if err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+		result, err := compareOutput(filteredRecords, columns, *compareFile, compareTolerance{*compareTol, *compareRelTol})
+		if err != nil {
+			report.fail(exitInputError, "Error: %v", err)
+		}
+		result.print(os.Stdout)
+		if !result.matches() {
+			report.exit(exitCompareFailed)
+		}
+		report.exit(exitOK)
+	}
+
+	// Make sure the configured output directory exists
+	if config.Output.Directory != "" {
+		if err := os.MkdirAll(config.Output.Directory, 0755); err != nil {
+			report.fail(exitOutputError, "Error creating output directory: %v", err)
+		}
+	}
+
+	// Write each selected output format
+	report.step("write")
+	if config.Output.Manifest {
+		config.manifest = &outputManifest{InputFile: inputFile, Created: startTime}
+	}
+	outputFiles := make([][]string, len(selectedFormats))
+	for i, format := range selectedFormats {
+		if files, ok := cp.outputDone(format.Name); ok {
+			logInfo("Step %d: Output %s already written before the interruption, skipping", i+5, format.Label)
+			outputFiles[i] = files
+			report.Outputs[format.Name] = files
+			// Row counts per file are only known for a single file
+			rows := -1
+			if len(files) == 1 {
+				rows = len(filteredRecords)
+			}
+			for _, file := range files {
+				config.manifest.add(file, format.Name, rows)
+			}
+			continue
+		}
+		logInfo("Step %d: Writing output %s file...", i+5, format.Label)
+		outputFiles[i], err = writeOutputFormat(format, inputFile, filteredRecords, &config, startTime)
+		report.Outputs[format.Name] = outputFiles[i]
+		if err != nil {
+			report.fail(exitOutputError, "Error writing output %s: %v", format.Label, err)
+		}
+		if err := cp.markOutput(format.Name, outputFiles[i]); err != nil {
+			report.fail(exitOutputError, "Error: %v", err)
+		}
+	}
+
+	// Describe the ndjson columns for BigQuery, and load the files when a table is set
+	var ndjsonFiles []string
+	for i, format := range selectedFormats {
+		if format.Name == "ndjson" {
+			ndjsonFiles = outputFiles[i]
+		}
+	}
+	var bigQueryFields []bigQueryField
+	if ndjsonFiles != nil {
+		bigQueryFields, err = bigQuerySchema(&config)
+		if err != nil {
+			report.fail(exitConfigError, "Error: %v", err)
+		}
+		filename := schemaFilename(inputFile, &config)
+		logInfo("Writing BigQuery schema...")
+		filename, err := writeAtomic(filename, "schema", len(bigQueryFields), &config, func(tmp string) error {
+			return writeBigQuerySchema(tmp, bigQueryFields)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing BigQuery schema: %v", err)
+		}
+		report.Outputs["schema"] = []string{filename}
+	}
+
+	// Link the KML outputs for Google Earth to reload as later runs replace them
+	if config.Output.KMLRefreshSeconds > 0 {
+		var kmlFiles []string
+		for i, format := range selectedFormats {
+			if format.Name == "kml" {
+				kmlFiles = outputFiles[i]
+			}
+		}
+		filename := networkLinkFilename(inputFile, &config)
+		logInfo("Writing KML network link (refresh every %d seconds)...", config.Output.KMLRefreshSeconds)
+		filename, err := writeAtomic(filename, "kml_live", len(kmlFiles), &config, func(tmp string) error {
+			return writeNetworkLink(tmp, filename, kmlFiles, config.Output.KMLRefreshSeconds)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing KML network link: %v", err)
+		}
+		report.Outputs["kml_live"] = []string{filename}
+	}
+
+	// Split the tracks into KML regions that Google Earth loads on demand
+	if config.Output.KMLRegions {
+		dir := kmlRegionsDirectory(inputFile, &config)
+		logInfo("Writing KML regions...")
+		dir, tiles, err := writeKMLRegions(dir, filteredRecords, &config)
+		if err != nil {
+			report.fail(exitOutputError, "Error writing KML regions: %v", err)
+		}
+		report.Outputs["kml_regions"] = []string{dir}
+		report.Counts["kml_regions"] = tiles
+	}
+
+	// Draw a quick-look figure of the trajectories
+	if config.Output.Plot != "" {
+		filename := plotFilename(inputFile, &config)
+		logInfo("Writing %s plot...", strings.ToUpper(config.Output.Plot))
+		filename, err := writeAtomic(filename, "plot", len(filteredRecords), &config, func(tmp string) error {
+			return writePlot(tmp, filteredRecords, &config)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing plot: %v", err)
+		}
+		report.Outputs["plot"] = []string{filename}
+	}
+
+	// Chart each device's speed and elevation over time
+	if config.Output.Charts {
+		dir := chartsDirectory(inputFile, &config)
+		logInfo("Writing charts...")
+		dir, charts, err := writeCharts(dir, filteredRecords, &config)
+		if err != nil {
+			report.fail(exitOutputError, "Error writing charts: %v", err)
+		}
+		report.Outputs["charts"] = []string{dir}
+		report.Counts["charts"] = charts
+	}
+
+	// Cut the trajectories into vector tiles for web maps
+	if config.Output.VectorTiles {
+		minZoom, maxZoom := tileZooms(&config)
+		logInfo("Writing vector tiles (zoom %d to %d)...", minZoom, maxZoom)
+		var path string
+		var tiles int
+		var err error
+		if config.Output.TileFormat == "mbtiles" {
+			path, tiles, err = writeMBTiles(mbtilesFilename(inputFile, &config), filteredRecords, &config)
+		} else {
+			path, tiles, err = writeVectorTiles(tilesDirectory(inputFile, &config), filteredRecords, &config)
+		}
+		if err != nil {
+			report.fail(exitOutputError, "Error writing vector tiles: %v", err)
+		}
+		report.Outputs["vector_tiles"] = []string{path}
+		report.Counts["tiles"] = tiles
+	}
+
+	// Report the timestamps that went back in input order
+	if mode := config.Parameters.TimeJumps; mode == "report" || mode == "correct" {
+		filename := reportFilename(inputFile, "time_jumps", &config)
+		logInfo("Writing time jump report (%d jumps)...", len(timeJumps))
+		filename, err := writeAtomic(filename, "time_jumps", len(timeJumps), &config, func(tmp string) error {
+			return writeTimeJumpReport(tmp, timeJumps)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing time jump report: %v", err)
+		}
+		report.Outputs["time_jumps"] = []string{filename}
+		report.Counts["time_jumps"] = len(timeJumps)
+	}
+
+	// List the devices with new records, for downstream syncs
+	if config.Output.UpdatedDevices {
+		devices := updatedDevices(filteredRecords)
+		filename := reportFilename(inputFile, "updated_devices", &config)
+		logInfo("Writing updated devices list (%d devices)...", len(devices))
+		filename, err := writeAtomic(filename, "updated_devices", len(devices), &config, func(tmp string) error {
+			return writeUpdatedDevices(tmp, devices)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing updated devices list: %v", err)
+		}
+		report.Outputs["updated_devices"] = []string{filename}
+		report.Counts["updated_devices"] = len(devices)
+	}
+
+	// Report deviations from the planned routes
+	if newRouteSet(&config) != nil {
+		deviations := findDeviations(processedRecords)
+		filename := reportFilename(inputFile, "deviations", &config)
+		logInfo("Writing route deviation report (%d deviations)...", len(deviations))
+		filename, err := writeAtomic(filename, "deviations", len(deviations), &config, func(tmp string) error {
+			return writeDeviationReport(tmp, deviations)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing deviation report: %v", err)
+		}
+		report.Outputs["deviations"] = []string{filename}
+		report.Counts["route_deviations"] = len(deviations)
+	}
+
+	// Report devices that were close to each other
+	if config.Parameters.ProximityM > 0 {
+		tolerance := config.Parameters.ProximityToleranceS
+		if tolerance <= 0 {
+			tolerance = defaultProximityToleranceS
+		}
+		encounters := findEncounters(processedRecords, config.Parameters.ProximityM, config.Parameters.ProximityMinSeconds, tolerance)
+		filename := reportFilename(inputFile, "encounters", &config)
+		logInfo("Writing encounter report (%d encounters)...", len(encounters))
+		filename, err := writeAtomic(filename, "encounters", len(encounters), &config, func(tmp string) error {
+			return writeEncounterReport(tmp, encounters)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing encounter report: %v", err)
+		}
+		report.Outputs["encounters"] = []string{filename}
+		report.Counts["encounters"] = len(encounters)
+	}
+
+	// Report harsh braking, acceleration and cornering
+	if drivingEventsEnabled(&config) {
+		events := collectDrivingEvents(processedRecords)
+		filename := reportFilename(inputFile, "events", &config)
+		logInfo("Writing driving events report (%d events)...", len(events))
+		filename, err := writeAtomic(filename, "events", len(events), &config, func(tmp string) error {
+			return writeDrivingEvents(tmp, events)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing driving events report: %v", err)
+		}
+		report.Outputs["events"] = []string{filename}
+		report.Counts["driving_events"] = len(events)
+	}
+
+	// Report trajectories no real receiver would produce
+	if config.Output.Anomalies {
+		anomalies := collectAnomalies(processedRecords)
+		filename := reportFilename(inputFile, "anomalies", &config)
+		logInfo("Writing anomaly report (%d anomalies)...", len(anomalies))
+		filename, err := writeAtomic(filename, "anomalies", len(anomalies), &config, func(tmp string) error {
+			return writeAnomalyReport(tmp, anomalies)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing anomaly report: %v", err)
+		}
+		report.Outputs["anomalies"] = []string{filename}
+		report.Counts["anomalies"] = len(anomalies)
+	}
+
+	// Report where the device's own speed disagrees with the computed one
+	if config.Output.SpeedDiscrepancies {
+		discrepancies := findSpeedDiscrepancies(processedRecords, &config)
+		filename := reportFilename(inputFile, "speed_discrepancies", &config)
+		logInfo("Writing speed discrepancy report (%d discrepancies)...", len(discrepancies))
+		filename, err := writeAtomic(filename, "speed_discrepancies", len(discrepancies), &config, func(tmp string) error {
+			return writeSpeedDiscrepancies(tmp, discrepancies)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing speed discrepancy report: %v", err)
+		}
+		report.Outputs["speed_discrepancies"] = []string{filename}
+		report.Counts["speed_discrepancies"] = len(discrepancies)
+	}
+
+	// Summarize each trip
+	if config.Output.TripSummary {
+		trips := collectTrips(processedRecords)
+		filename := reportFilename(inputFile, "trips", &config)
+		logInfo("Writing trip summary (%d trips)...", len(trips))
+		filename, err := writeAtomic(filename, "trips", len(trips), &config, func(tmp string) error {
+			return writeTripSummary(tmp, trips, &config)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing trip summary: %v", err)
+		}
+		report.Outputs["trips"] = []string{filename}
+		report.Counts["trips"] = len(trips)
+	}
+
+	// Aggregate trips by origin and destination
+	if config.Output.ODMatrix {
+		pairs := odMatrix(collectTrips(processedRecords), zones, config.Output.ODGeohashPrecision)
+		filename := reportFilename(inputFile, "od_matrix", &config)
+		logInfo("Writing OD matrix (%d origin-destination pairs)...", len(pairs))
+		filename, err := writeAtomic(filename, "od_matrix", len(pairs), &config, func(tmp string) error {
+			return writeODMatrix(tmp, pairs)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing OD matrix: %v", err)
+		}
+		report.Outputs["od_matrix"] = []string{filename}
+		report.Counts["od_pairs"] = len(pairs)
+	}
+
+	// Raise alerts for the configured conditions
+	if len(config.Alerts.Rules) > 0 {
+		alerts := evaluateAlerts(processedRecords, &config, zones)
+		filename := reportFilename(inputFile, "alerts", &config)
+		logInfo("Writing alert report (%d alerts)...", len(alerts))
+		filename, err := writeAtomic(filename, "alerts", len(alerts), &config, func(tmp string) error {
+			return writeAlertReport(tmp, alerts)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing alert report: %v", err)
+		}
+		report.Outputs["alerts"] = []string{filename}
+		report.Counts["alerts"] = len(alerts)
+		if config.Alerts.WebhookURL != "" && len(alerts) > 0 {
+			logInfo("Posting %d alerts to webhook...", len(alerts))
+			report.Counts["webhook_failures"] = postAlerts(config.Alerts.WebhookURL, alerts)
+		}
+	}
+
+	// Per-device totals per day or week
+	loc, _ := reportLocation(&config)
+	for _, name := range config.Output.Rollups {
+		name = strings.ToLower(name)
+		rows := rollup(filteredRecords, rollupPeriods[name], loc, config.Output.DayNight)
+		filename := reportFilename(inputFile, "rollup_"+name, &config)
+		logInfo("Writing %s rollup (%d rows)...", name, len(rows))
+		filename, err := writeAtomic(filename, "rollup_"+name, len(rows), &config, func(tmp string) error {
+			return writeRollup(tmp, rows, &config)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing %s rollup: %v", name, err)
+		}
+		report.Outputs["rollup_"+name] = []string{filename}
+	}
+
+	// Score each device's driving per day
+	if config.Output.BehaviorScores {
+		scores := scoreBehavior(processedRecords, &config, loc)
+		filename := reportFilename(inputFile, "scores", &config)
+		logInfo("Writing driver behavior scores (%d rows)...", len(scores))
+		filename, err := writeAtomic(filename, "scores", len(scores), &config, func(tmp string) error {
+			return writeBehaviorScores(tmp, scores, &config)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing driver behavior scores: %v", err)
+		}
+		report.Outputs["scores"] = []string{filename}
+	}
+
+	// Estimate fuel or energy use per trip and per day
+	if config.Energy.Fuel != "" {
+		for _, byDay := range []bool{true, false} {
+			var rows []energyRow
+			name := "energy_daily"
+			if byDay {
+				rows = energyByDay(processedRecords, loc)
+			} else if config.Parameters.TripStopMinutes > 0 {
+				name, rows = "energy_trips", energyByTrip(processedRecords)
+			} else {
+				continue // per-trip estimates need trip segmentation
+			}
+			filename := reportFilename(inputFile, name, &config)
+			logInfo("Writing energy estimates %s (%d rows)...", filepath.Base(filename), len(rows))
+			filename, err := writeAtomic(filename, name, len(rows), &config, func(tmp string) error {
+				return writeEnergyReport(tmp, rows, byDay, &config)
+			})
+			if err != nil {
+				report.fail(exitOutputError, "Error writing energy estimates: %v", err)
+			}
+			report.Outputs[name] = []string{filename}
+		}
+	}
 
-	// Output to CSV file
-	csvOutputFile := getOutputFilename(inputFile, "csv")
-	fmt.Println("Step 5: Writing output CSV file...")
-	if err := writeOutputCSV(csvOutputFile, filteredRecords); err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing output CSV: %v\n", err)
-		os.Exit(1)
+	// Estimate CO2 emissions per day and trip from distance and device class
+	if len(config.Emissions.Factors) > 0 {
+		for _, byDay := range []bool{true, false} {
+			var rows []energyRow
+			name := "co2_daily"
+			if byDay {
+				rows = energyByDay(processedRecords, loc)
+			} else if config.Parameters.TripStopMinutes > 0 {
+				name, rows = "co2_trips", energyByTrip(processedRecords)
+			} else {
+				continue // per-trip estimates need trip segmentation
+			}
+			filename := reportFilename(inputFile, name, &config)
+			logInfo("Writing CO2 estimates %s (%d rows)...", filepath.Base(filename), len(rows))
+			filename, err := writeAtomic(filename, name, len(rows), &config, func(tmp string) error {
+				return writeEmissionsReport(tmp, rows, byDay, &config)
+			})
+			if err != nil {
+				report.fail(exitOutputError, "Error writing CO2 estimates: %v", err)
+			}
+			report.Outputs[name] = []string{filename}
+		}
 	}
 
-	// Output to KML file
-	kmlOutputFile := getOutputFilename(inputFile, "kml")
-	fmt.Println("Step 6: Writing output KML file...")
-	if err := writeOutputKML(kmlOutputFile, filteredRecords); err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing output KML: %v\n", err)
-		os.Exit(1)
+	// Load the ndjson output last, so a failed load keeps the checkpoint for --resume
+	if config.BigQuery.Table != "" {
+		rows, err := loadBigQuery(ndjsonFiles, bigQueryFields, &config)
+		if err != nil {
+			report.fail(exitOutputError, "Error loading into BigQuery: %v", err)
+		}
+		logInfo("Loaded %d rows into BigQuery", rows)
+		report.Counts["bigquery_rows"] = rows
+	}
+	// Put the summary, audit, map and charts in one page for analysts
+	if config.Output.HTMLReport {
+		filename := htmlReportFilename(inputFile, &config)
+		logInfo("Writing HTML report...")
+		filename, err := writeAtomic(filename, "html_report", len(filteredRecords), &config, func(tmp string) error {
+			return writeHTMLReport(tmp, inputFile, filteredRecords, report.Counts, &config)
+		})
+		if err != nil {
+			report.fail(exitOutputError, "Error writing HTML report: %v", err)
+		}
+		report.Outputs["html_report"] = []string{filename}
 	}
 
+	// List every file written, with checksums, for downstream integrity checks. This comes
+	// after every other output, so the manifest lists them all.
+	if config.manifest != nil {
+		filename := manifestFilename(inputFile, &config)
+		logInfo("Writing output manifest (%d files)...", len(config.manifest.Files))
+		if err := config.manifest.write(filename); err != nil {
+			report.fail(exitOutputError, "Error writing output manifest: %v", err)
+		}
+		report.Outputs["manifest"] = []string{filename}
+	}
+	cp.remove()
+
 	// Print summary
 	duration := time.Since(startTime).Seconds()
-	fmt.Printf("\n=== Processing Summary ===\n")
-	fmt.Printf("Total input records: %d\n", len(records))
-	fmt.Printf("Records after filtering: %d\n", len(filteredRecords))
-	fmt.Printf("Column mappings: ID='%s', Lat='%s', Lon='%s', Time='%s'\n",
-		config.Columns.ID, config.Columns.Latitude, config.Columns.Longitude, config.Columns.Timestamp)
-	fmt.Printf("Speed filter threshold: %.1f km/h\n", filterAboveKph)
-	fmt.Printf("Processing time: %.2f seconds\n", duration)
-	fmt.Printf("CSV output file: %s\n", csvOutputFile)
-	fmt.Printf("KML output file: %s\n", kmlOutputFile)
-	fmt.Printf("=========================\n")
+	logInfo("")
+	logInfo("=== Processing Summary ===")
+	logInfo("Total input records: %d", inputRecords)
+	logInfo("Records after filtering: %d", len(filteredRecords))
+	logInfo("Column mappings: ID='%s', Lat='%s', Lon='%s', Time='%s'",
+		idColumnName(&config), config.Columns.Latitude, config.Columns.Longitude, timestampColumnName(&config))
+	logInfo("Speed filter threshold: %.1f km/h", filterAboveKph)
+	logInfo("Processing time: %.2f seconds", duration)
+	if len(logger.warnings) > 0 {
+		logInfo("Warnings: %d (listed above)", len(logger.warnings))
+	}
+	for i, format := range selectedFormats {
+		if config.Output.SplitByDevice {
+			logInfo("%s output files: %d (one per device)", format.Label, len(outputFiles[i]))
+		} else {
+			logInfo("%s output file: %s", format.Label, outputFiles[i][0])
+		}
+	}
+	logInfo("=========================")
+
+	if len(filteredRecords) == 0 {
+		logWarn("No records remained after filtering")
+		report.exit(exitNoRecords)
+	}
+	report.write(exitOK)
 }
 
 // loadConfig loads the configuration from a YAML file
@@ -312,6 +1626,46 @@ func loadConfig(filename string, config *Config) error {
 	return nil
 }
 
+// builtinProfiles are the profiles available without defining them in the config file. A
+// profile of the same name in the config file replaces the built-in one.
+var builtinProfiles = map[string]string{
+	// ADS-B and other aircraft tracks: knots, feet and vertical speed, drawn at altitude
+	"aviation": "output:\n  units: aviation\n  kml_altitude: absolute\n",
+}
+
+// applyProfile overlays the named profile from the config file, or a built-in profile, onto
+// the configuration. Only the values set in the profile change; everything else keeps its
+// base value.
+func applyProfile(config *Config, name string) error {
+	node, ok := config.Profiles[name]
+	if !ok {
+		builtin, found := builtinProfiles[name]
+		if !found {
+			names := make([]string, 0, len(config.Profiles)+len(builtinProfiles))
+			for profile := range config.Profiles {
+				names = append(names, profile)
+			}
+			for profile := range builtinProfiles {
+				if _, defined := config.Profiles[profile]; !defined {
+					names = append(names, profile)
+				}
+			}
+			sort.Strings(names)
+			return fmt.Errorf("profile %q not found (available: %s)", name, strings.Join(names, ", "))
+		}
+		if err := yaml.Unmarshal([]byte(builtin), &node); err != nil {
+			return fmt.Errorf("unable to parse profile %q: %w", name, err)
+		}
+	}
+
+	profiles := config.Profiles
+	if err := node.Decode(config); err != nil {
+		return fmt.Errorf("unable to parse profile %q: %w", name, err)
+	}
+	config.Profiles = profiles
+	return nil
+}
+
 // createDefaultConfigFile creates a default configuration file with comments
 func createDefaultConfigFile(filename string) error {
 	defaultConfig := `# GPS Processor Configuration
@@ -332,355 +1686,507 @@ parameters:
 		return fmt.Errorf("unable to create default config file: %w", err)
 	}
 
-	fmt.Printf("Created default configuration file: %s\n", filename)
+	logInfo("Created default configuration file: %s", filename)
 	return nil
 }
 
-// readCSV reads and parses the CSV file
-func readCSV(filename string, config *Config) ([]Record, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open file: %w", err)
+// groupByID groups records by ID
+func groupByID(records []Record) map[string][]Record {
+	groups := make(map[string][]Record)
+	for _, record := range records {
+		groups[record.ID] = append(groups[record.ID], record)
 	}
-	defer file.Close()
+	return groups
+}
 
-	// Count lines to set up the progress bar
-	lineCount, err := countLines(filename)
-	if err != nil {
-		return nil, fmt.Errorf("error counting lines: %w", err)
-	}
-
-	// Create progress bar for reading CSV
-	bar := progressbar.NewOptions(
-		lineCount-1, // Subtract 1 for header
-		progressbar.OptionSetDescription("Reading CSV"),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "=",
-			SaucerHead:    ">",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}),
-	)
-
-	reader := csv.NewReader(file)
-
-	// Read the header
-	header, err := reader.Read()
-	if err != nil {
-		return nil, fmt.Errorf("error reading header: %w", err)
+// sortedIDs returns the group IDs in ascending order so groups are visited deterministically
+func sortedIDs(groups map[string][]Record) []string {
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
+	return ids
+}
 
-	// Find column indices based on configuration
-	idIdx, latIdx, lonIdx, timestampIdx := -1, -1, -1, -1
-	for i, col := range header {
-		switch col {
-		case config.Columns.ID:
-			idIdx = i
-		case config.Columns.Latitude:
-			latIdx = i
-		case config.Columns.Longitude:
-			lonIdx = i
-		case config.Columns.Timestamp:
-			timestampIdx = i
-		}
+// recordLess orders records by timestamp, then by original row for identical timestamps
+func recordLess(a, b *Record) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
 	}
+	return a.OriginalRow < b.OriginalRow
+}
 
-	// Validate all required columns exist
-	if idIdx == -1 || latIdx == -1 || lonIdx == -1 || timestampIdx == -1 {
-		return nil, fmt.Errorf("missing required columns (%s, %s, %s, %s)",
-			config.Columns.ID, config.Columns.Latitude, config.Columns.Longitude, config.Columns.Timestamp)
+// sortByTime sorts records by timestamp, keeping input order for identical timestamps.
+// Groups merged from sorted runs are already in order and are left as they are.
+func sortByTime(records []Record) {
+	less := func(i, j int) bool { return recordLess(&records[i], &records[j]) }
+	if sort.SliceIsSorted(records, less) {
+		return
 	}
+	sort.SliceStable(records, less)
+}
 
-	var records []Record
-	rowNumber := 1 // Starting from 1 to account for header
-
-	// Read the rest of the rows
-	for {
-		row, err := reader.Read()
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
+// sortRecords applies the configured output order to the records
+func sortRecords(records []Record, order string) error {
+	switch order {
+	case "", "id_time":
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].ID != records[j].ID {
+				return records[i].ID < records[j].ID
+			}
+			if !records[i].Timestamp.Equal(records[j].Timestamp) {
+				return records[i].Timestamp.Before(records[j].Timestamp)
+			}
+			return records[i].OriginalRow < records[j].OriginalRow
+		})
+	case "original_row":
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].SourceFile != records[j].SourceFile {
+				return records[i].SourceFile < records[j].SourceFile
 			}
-			return nil, fmt.Errorf("error reading row: %w", err)
+			return records[i].OriginalRow < records[j].OriginalRow
+		})
+	default:
+		return fmt.Errorf("unknown output order %q (supported: id_time, original_row)", order)
+	}
+	return nil
+}
+
+// dropSmallGroups removes groups with fewer than minPoints records and returns how many were removed
+func dropSmallGroups(groups map[string][]Record, minPoints int) int {
+	dropped := 0
+	for id, group := range groups {
+		if len(group) < minPoints {
+			delete(groups, id)
+			dropped++
 		}
-		rowNumber++
+	}
+	return dropped
+}
 
-		// Update progress bar
-		_ = bar.Add(1)
+// processGroups sorts each group by timestamp and calculates time differences and distances
+func processGroups(groups map[string][]Record, config *Config) ([]Record, error) {
+	var processedRecords []Record
 
-		// Parse latitude and longitude
-		lat, err := strconv.ParseFloat(row[latIdx], 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid latitude at row %d: %w", rowNumber, err)
-		}
-		lon, err := strconv.ParseFloat(row[lonIdx], 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid longitude at row %d: %w", rowNumber, err)
-		}
+	// Calculate total number of records to process for the progress bar
+	totalRecords := 0
+	for _, group := range groups {
+		totalRecords += len(group)
+	}
 
-		// Parse timestamp
-		ts, err := time.Parse(time.RFC3339, row[timestampIdx])
+	p, err := NewGroupProcessor(config, newProgress("Processing GPS data", totalRecords))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range sortedIDs(groups) {
+		logDebug("Processing device %s (%d points)", id, len(groups[id]))
+		group, err := p.Process(id, groups[id])
 		if err != nil {
-			return nil, fmt.Errorf("invalid timestamp at row %d: %w", rowNumber, err)
+			return nil, err
 		}
-
-		// Create record
-		records = append(records, Record{
-			ID:          row[idIdx],
-			Latitude:    lat,
-			Longitude:   lon,
-			Timestamp:   ts,
-			OriginalRow: rowNumber,
-		})
+		processedRecords = append(processedRecords, group...)
 	}
+	p.finish()
+	return processedRecords, nil
+}
 
-	fmt.Println() // Add newline after progress bar
-	return records, nil
+// GroupProcessor holds the settings used to process device groups, so groups can be
+// processed as they are loaded rather than all at once. Processing a group has no side
+// effects beyond the group and the processor's own counts, so it can be used without a
+// progress bar (NoProgress) and checked in isolation; finish reports the counts.
+type GroupProcessor struct {
+	config     *Config
+	calc       distanceCalculator
+	proj       projection.Projection
+	window     speedWindow
+	outliers   *outlierFilter
+	duplicates *duplicatePolicy
+	routes     *routeSet
+	vehicle    *vehicleModel
+	anomalies  anomalySettings
+	bar        ProgressReporter
+	stats      GroupStats
 }
 
-// countLines counts the number of lines in a file
-func countLines(filename string) (int, error) {
-	file, err := os.Open(filename)
+// GroupStats counts what processing the groups changed
+type GroupStats struct {
+	DuplicatesMerged int // points merged away under parameters.duplicate_timestamps
+	Outliers         int // position outliers flagged or removed
+	Stitched         int // devices whose first point was measured from parameters.stitch_with
+}
+
+// NewGroupProcessor validates the processing settings. bar is advanced once per record.
+func NewGroupProcessor(config *Config, bar ProgressReporter) (*GroupProcessor, error) {
+	calc, err := selectedDistance(config)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	lineCount := 0
-	for scanner.Scan() {
-		lineCount++
+	// Projected output coordinates, if configured
+	proj, err := outputProjection(config)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := scanner.Err(); err != nil {
-		return 0, err
+	window, err := parseSpeedWindow(config.Parameters.SpeedWindow)
+	if err != nil {
+		return nil, err
 	}
-
-	return lineCount, nil
-}
-
-// groupByID groups records by ID
-func groupByID(records []Record) map[string][]Record {
-	groups := make(map[string][]Record)
-	for _, record := range records {
-		groups[record.ID] = append(groups[record.ID], record)
+	outliers, err := newOutlierFilter(config)
+	if err != nil {
+		return nil, err
 	}
-	return groups
+	duplicates, err := newDuplicatePolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	anomalies, err := newAnomalySettings(config)
+	if err != nil {
+		return nil, err
+	}
+	return &GroupProcessor{
+		config:     config,
+		calc:       calc,
+		proj:       proj,
+		window:     window,
+		outliers:   outliers,
+		duplicates: duplicates,
+		routes:     newRouteSet(config),
+		vehicle:    newVehicleModel(config),
+		anomalies:  anomalies,
+		bar:        bar,
+	}, nil
 }
 
-// processGroups sorts each group by timestamp and calculates time differences and distances
-func processGroups(groups map[string][]Record) []Record {
-	var processedRecords []Record
+// Process sorts one device's group by timestamp and calculates time differences and
+// distances, returning the processed group
+func (p *GroupProcessor) Process(id string, group []Record) ([]Record, error) {
+	config := p.config
 
-	// Calculate total number of records to process for the progress bar
-	totalRecords := 0
-	for _, group := range groups {
-		totalRecords += len(group)
-	}
+	// Sort by timestamp
+	sortByTime(group)
 
-	// Create progress bar for processing
-	bar := progressbar.NewOptions(
-		totalRecords,
-		progressbar.OptionSetDescription("Processing GPS data"),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "=",
-			SaucerHead:    ">",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}),
-	)
+	// Points at the same time would get a zero time difference
+	group, merged, err := p.duplicates.apply(id, group)
+	if err != nil {
+		return nil, err
+	}
+	p.stats.DuplicatesMerged += merged
+	_ = p.bar.Add(merged)
+
+	// Flag or remove position spikes before distances are accumulated
+	group, found := p.outliers.apply(id, group)
+	p.stats.Outliers += found
+	if p.outliers != nil && p.outliers.remove {
+		_ = p.bar.Add(found)
+	}
 
-	for _, group := range groups {
-		// Sort by timestamp
-		sort.Slice(group, func(i, j int) bool {
-			return group[i].Timestamp.Before(group[j].Timestamp)
-		})
+	// Calculate time differences and distances from the previous point that is not an outlier,
+	// starting from the device's last point in the stitched file, if any
+	var prev *Record
+	if point, ok := p.stitchPoint(id, group); ok {
+		prev = &point
+		p.stats.Stitched++
+	}
+	for i := 0; i < len(group); i++ {
+		// Update progress bar
+		_ = p.bar.Add(1)
 
-		// Calculate time differences and distances
-		for i := 0; i < len(group); i++ {
-			// Update progress bar
-			_ = bar.Add(1)
-
-			if i > 0 {
-				// Calculate time difference
-				timeDiff := group[i].Timestamp.Sub(group[i-1].Timestamp).Seconds()
-
-				// Calculate haversine distance
-				distance := haversine.Distance(
-					group[i-1].Latitude, group[i-1].Longitude,
-					group[i].Latitude, group[i].Longitude,
-				)
-
-				group[i].TimeDiff = timeDiff
-				group[i].Distance = distance
-				group[i].PreviousRow = group[i-1].OriginalRow
-
-				// Calculate speed in kilometers per hour
-				// Speed = (distance in km) / (time in hours)
-				// timeDiff is in seconds, so convert to hours by dividing by 3600
-				if timeDiff > 0 {
-					group[i].Speed = distance / (timeDiff / 3600)
-				} else {
-					group[i].Speed = 0
-				}
+		if p.proj != nil {
+			group[i].Easting, group[i].Northing = p.proj.FromWGS84(group[i].Latitude, group[i].Longitude)
+		}
 
-				// Store previous point's data
-				group[i].PrevLatitude = group[i-1].Latitude
-				group[i].PrevLongitude = group[i-1].Longitude
-				group[i].PrevTimestamp = group[i-1].Timestamp
+		if prev != nil {
+			// Calculate time difference
+			timeDiff := group[i].Timestamp.Sub(prev.Timestamp).Seconds()
+
+			// Calculate distance with the configured method
+			distance := p.calc.Distance(prev, &group[i])
+
+			group[i].TimeDiff = timeDiff
+			group[i].Distance = distance
+			group[i].PreviousRow = prev.OriginalRow
+			group[i].Bearing = haversine.Bearing(
+				prev.Latitude, prev.Longitude,
+				group[i].Latitude, group[i].Longitude,
+			)
+
+			// Calculate speed in kilometers per hour
+			// Speed = (distance in km) / (time in hours)
+			// timeDiff is in seconds, so convert to hours by dividing by 3600
+			if timeDiff > 0 {
+				group[i].Speed = distance / (timeDiff / 3600)
 			} else {
-				// First record in the group has no previous point
-				group[i].TimeDiff = 0
-				group[i].Distance = 0
 				group[i].Speed = 0
-				group[i].PreviousRow = 0
-				// Set previous point data to zero values
-				group[i].PrevLatitude = 0
-				group[i].PrevLongitude = 0
-				// Leave PrevTimestamp as zero value (1970-01-01 00:00:00 +0000 UTC)
 			}
-			processedRecords = append(processedRecords, group[i])
+
+			// Climb or descent rate in meters per second, where both points have an altitude
+			group[i].HasVerticalSpeed = timeDiff > 0 && prev.HasAltitude && group[i].HasAltitude
+			if group[i].HasVerticalSpeed {
+				group[i].VerticalSpeed = (group[i].Altitude - prev.Altitude) / timeDiff
+			}
+
+			// Store previous point's data
+			group[i].PrevLatitude = prev.Latitude
+			group[i].PrevLongitude = prev.Longitude
+			group[i].PrevTimestamp = prev.Timestamp
+		} else {
+			// First record in the group has no previous point
+			group[i].TimeDiff = 0
+			group[i].Distance = 0
+			group[i].Speed = 0
+			group[i].PreviousRow = 0
+			// Set previous point data to zero values
+			group[i].PrevLatitude = 0
+			group[i].PrevLongitude = 0
+			// Leave PrevTimestamp as zero value (1970-01-01 00:00:00 +0000 UTC)
+		}
+		// The device's own speed replaces the computed one where the row has it
+		if config.Parameters.SpeedSource == "source" && group[i].HasSourceSpeed {
+			group[i].Speed = group[i].SourceSpeed
+		}
+		if !group[i].Outlier {
+			prev = &group[i]
+		}
+	}
+	p.window.apply(group)
+	if config.Parameters.SimplifyEpsilonM > 0 {
+		simplifyTrack(group, config.Parameters.SimplifyEpsilonM)
+	}
+	if p.routes != nil {
+		route, err := p.routes.route(id)
+		if err != nil {
+			return nil, err
+		}
+		p.routes.applyRoute(group, route)
+	}
+	if config.Parameters.TripStopMinutes > 0 {
+		segmentTrips(group, config.Parameters.TripStopMinutes*60, config.Parameters.TripStopRadiusM)
+	}
+	if drivingEventsEnabled(config) {
+		detectDrivingEvents(group, config)
+	}
+	if config.Output.Anomalies {
+		detectAnomalies(group, p.anomalies)
+	}
+	if p.vehicle != nil {
+		p.vehicle.estimateEnergy(group)
+	}
+	return group, nil
+}
+
+// discardedPoints returns the points merged away as duplicates and, when the KML filtered
+// layer keeps them, the removed position outliers
+func (p *GroupProcessor) discardedPoints() []discardedPoint {
+	var points []discardedPoint
+	if p.duplicates != nil {
+		for _, record := range p.duplicates.removed {
+			points = append(points, discardedPoint{record, "duplicate timestamp"})
+		}
+	}
+	if p.outliers != nil && p.config.Output.KMLFilteredLayer {
+		for _, record := range p.outliers.removed {
+			points = append(points, discardedPoint{record, "position outlier"})
 		}
 	}
+	return points
+}
 
-	fmt.Println() // Add newline after progress bar
-	return processedRecords
+// finish ends the progress bar, reports the position outliers and duplicate timestamps, and
+// keeps the points left out for the KML filtered layer
+func (p *GroupProcessor) finish() {
+	p.bar.Finish()
+	config := p.config
+	config.discarded = append(config.discarded, p.discardedPoints()...)
+	config.duplicatePoints += p.stats.DuplicatesMerged
+	if p.duplicates != nil {
+		logInfo("Duplicate timestamps (%s): merged away %d points", p.duplicates.mode, p.stats.DuplicatesMerged)
+	}
+	if config.stitchPoints != nil {
+		source := config.Parameters.StitchWith
+		if source == "" {
+			source = config.Parameters.IncrementalFrom
+		}
+		logInfo("Stitching: measured the first point of %d devices from their last point in %s", p.stats.Stitched, source)
+	}
+	if p.outliers != nil {
+		action := "Flagged"
+		if p.outliers.remove {
+			action = "Removed"
+		}
+		logInfo("Outlier filter: %s %d position outliers", action, p.stats.Outliers)
+	}
+}
+
+// outputProjection returns the projection for output.crs, or nil when it is not set
+func outputProjection(config *Config) (projection.Projection, error) {
+	if config.Output.CRS == "" {
+		return nil, nil
+	}
+	proj, err := projection.Parse(config.Output.CRS)
+	if err != nil {
+		return nil, fmt.Errorf("output.crs: %w", err)
+	}
+	if proj == nil {
+		return nil, fmt.Errorf("output.crs %q is not a projected coordinate system", config.Output.CRS)
+	}
+	return proj, nil
 }
 
 // filterRecords removes records with previous_row = 0 and optionally filters by speed threshold
-func filterRecords(records []Record, filterAboveKph float64) []Record {
+func filterRecords(records []Record, thresholds *ThresholdSet, filter *RecordFilter) ([]Record, FilterStats) {
 	// Create a progress bar for filtering
-	bar := progressbar.NewOptions(
-		len(records),
-		progressbar.OptionSetDescription("Filtering records"),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "=",
-			SaucerHead:    ">",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}),
-	)
+	bar := newProgress("Filtering records", len(records))
+	filtered, stats := ApplyFilters(records, thresholds, filter, bar)
+	bar.Finish()
+
+	if len(thresholds.byID) > 0 {
+		logInfo("Speed filter applied: Removed %d records with speed below %.1f km/h or their device's threshold",
+			stats.Speed, thresholds.filterAboveKph)
+	} else if thresholds.filterAboveKph > 0 {
+		logInfo("Speed filter applied: Removed %d records with speed below %.1f km/h",
+			stats.Speed, thresholds.filterAboveKph)
+	}
+	if filter != nil {
+		logInfo("Filter expression applied: Removed %d records for which %s is false", stats.Expression, filter.source)
+	}
+	return filtered, stats
+}
 
-	var filtered []Record
-	var speedFilteredCount int
+// FilterStats counts the records the filters left out
+type FilterStats struct {
+	FirstPoints int // with no previous point
+	Speed       int // below the speed threshold
+	Expression  int // failing parameters.filter
+}
 
-	for _, record := range records {
-		// Update progress bar
+// ApplyFilters returns the records filterReason keeps, in order, and counts the others.
+// It has no side effects besides advancing bar once per record.
+func ApplyFilters(records []Record, thresholds *ThresholdSet, filter *RecordFilter, bar ProgressReporter) ([]Record, FilterStats) {
+	var filtered []Record
+	var stats FilterStats
+	for i := range records {
 		_ = bar.Add(1)
 
-		// Only keep records with previous_row not equal to 0
-		if record.PreviousRow != 0 {
-			// Apply speed filtering
-			if record.Speed >= filterAboveKph {
-				filtered = append(filtered, record)
-			} else {
-				speedFilteredCount++
-			}
+		// Only keep records with previous_row not equal to 0, fast enough and passing the filter
+		switch reason := filterReason(&records[i], thresholds.speedThreshold(records[i].ID), filter); {
+		case reason == "":
+			filtered = append(filtered, records[i])
+		case reason == filterExpressionReason:
+			stats.Expression++
+		case records[i].PreviousRow == 0:
+			stats.FirstPoints++
+		default:
+			stats.Speed++
 		}
 	}
+	return filtered, stats
+}
+
+// filterExpressionReason is the reason given for the records parameters.filter leaves out
+const filterExpressionReason = "filter expression is false"
 
-	fmt.Println() // Add newline after progress bar
-	if filterAboveKph > 0 {
-		fmt.Printf("Speed filter applied: Removed %d records with speed below %.1f km/h\n",
-			speedFilteredCount, filterAboveKph)
+// filterReason returns why filterRecords leaves a record out, or "" when it is kept
+func filterReason(record *Record, filterAboveKph float64, filter *RecordFilter) string {
+	if record.PreviousRow == 0 {
+		return "first point, no previous point"
 	}
-	return filtered
+	if record.Speed < filterAboveKph {
+		return fmt.Sprintf("speed %.1f km/h below %.1f km/h", record.Speed, filterAboveKph)
+	}
+	if !filter.keep(record) {
+		return filterExpressionReason
+	}
+	return ""
 }
 
-// getOutputFilename generates the output filename
-func getOutputFilename(inputFile string, format string) string {
+// defaultFilenameTemplate reproduces the historical *_processed.* naming next to the input
+const defaultFilenameTemplate = "{basename}_processed.{format}"
+
+// defaultSplitFilenameTemplate is used for per-device outputs when no template is configured
+const defaultSplitFilenameTemplate = "device_{id}_processed.{format}"
+
+// getOutputFilename generates the output filename from the configured directory and template.
+// Supported placeholders are {basename} (input name without extension), {date} (run date,
+// YYYY-MM-DD), {format} (file extension of the output, e.g. csv or kml) and {id} (device ID,
+// only set when outputs are split per device).
+func getOutputFilename(inputFile string, format string, id string, config *Config, runTime time.Time) string {
 	ext := filepath.Ext(inputFile)
-	baseName := inputFile[:len(inputFile)-len(ext)]
+	baseName := filepath.Base(inputFile[:len(inputFile)-len(ext)])
 
-	if format == "kml" {
-		return baseName + "_processed.kml"
+	template := config.Output.Filename
+	if template == "" {
+		template = defaultFilenameTemplate
+		if config.Output.SplitByDevice {
+			template = defaultSplitFilenameTemplate
+		}
 	}
-
-	// Default to CSV format
-	return baseName + "_processed.csv"
+	name := strings.NewReplacer(
+		"{basename}", baseName,
+		"{date}", runTime.Format("2006-01-02"),
+		"{format}", format,
+		"{id}", sanitizeFilename(id),
+	).Replace(template)
+
+	// Write next to the input file unless an output directory is configured
+	dir := config.Output.Directory
+	if dir == "" {
+		dir = filepath.Dir(inputFile)
+	}
+	return filepath.Join(dir, name)
 }
 
+// csvWriteBufferSize is the size of the buffered writer used for CSV output
+const csvWriteBufferSize = 1 << 20
+
 // writeOutputKML writes the processed records to a KML file for visualization
 // writeOutputKML function is defined in kml.go
-func writeOutputCSV(filename string, records []Record) error {
+func writeOutputCSV(filename string, records []Record, config *Config) error {
+	columns, err := selectedColumns(config)
+	if err != nil {
+		return err
+	}
+
 	file, err := os.Create(filename)
 	if err != nil {
 		return fmt.Errorf("unable to create output file: %w", err)
 	}
 	defer file.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Write header with additional columns for previous point data
-	header := []string{
-		"ID",
-		"latitude",
-		"longitude",
-		"timestamp",
-		"original_row",
-		"previous_row",
-		"prev_latitude",
-		"prev_longitude",
-		"prev_timestamp",
-		"time_diff_seconds",
-		"distance_km",
-		"speed_kmh",
-	}
-	if err := writer.Write(header); err != nil {
+	// Format rows into a reused buffer and write them through a large buffered writer;
+	// per-field string formatting dominated write time on large outputs
+	writer := bufio.NewWriterSize(file, csvWriteBufferSize)
+
+	// Write header with the selected columns
+	var buf []byte
+	for i, name := range columnHeader(columns) {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendCSVField(buf, name)
+	}
+	buf = append(buf, '\n')
+	if _, err := writer.Write(buf); err != nil {
 		return fmt.Errorf("error writing header: %w", err)
 	}
 
 	// Create progress bar for writing CSV
-	bar := progressbar.NewOptions(
-		len(records),
-		progressbar.OptionSetDescription("Writing output CSV"),
-		progressbar.OptionShowCount(),
-		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "=",
-			SaucerHead:    ">",
-			SaucerPadding: " ",
-			BarStart:      "[",
-			BarEnd:        "]",
-		}),
-	)
+	bar := newProgress("Writing output CSV", len(records))
 
 	// Write data
-	for _, record := range records {
-		// Format previous timestamp, handle zero value
-		prevTimestampStr := ""
-		if !record.PrevTimestamp.IsZero() {
-			prevTimestampStr = record.PrevTimestamp.Format(time.RFC3339)
-		}
-
-		row := []string{
-			record.ID,
-			fmt.Sprintf("%f", record.Latitude),
-			fmt.Sprintf("%f", record.Longitude),
-			record.Timestamp.Format(time.RFC3339),
-			fmt.Sprintf("%d", record.OriginalRow),
-			fmt.Sprintf("%d", record.PreviousRow),
-			fmt.Sprintf("%f", record.PrevLatitude),
-			fmt.Sprintf("%f", record.PrevLongitude),
-			prevTimestampStr,
-			fmt.Sprintf("%f", record.TimeDiff),
-			fmt.Sprintf("%f", record.Distance),
-			fmt.Sprintf("%f", record.Speed),
-		}
-		if err := writer.Write(row); err != nil {
+	for i := range records {
+		buf = appendCSVRow(buf[:0], &records[i], columns)
+		if _, err := writer.Write(buf); err != nil {
 			return fmt.Errorf("error writing row: %w", err)
 		}
 
 		// Update progress bar
 		_ = bar.Add(1)
 	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing output file: %w", err)
+	}
 
-	fmt.Println() // Add newline after progress bar
+	bar.Finish()
 	return nil
 }
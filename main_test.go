@@ -0,0 +1,181 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTime returns a timestamp the given number of seconds into the test day
+func testTime(seconds int) time.Time {
+	return time.Date(2024, 1, 1, 0, 0, seconds, 0, time.UTC)
+}
+
+func TestGroupProcessorProcess(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		group     []Record
+		wantRows  []int     // OriginalRow of each processed point, in order
+		wantPrev  []int     // PreviousRow of each processed point
+		wantSpeed []float64 // speed of each processed point in km/h
+	}{
+		{
+			name: "sorted by time",
+			group: []Record{
+				{ID: "a", Latitude: 0.01, Timestamp: testTime(60), OriginalRow: 3},
+				{ID: "a", Latitude: 0, Timestamp: testTime(0), OriginalRow: 2},
+				{ID: "a", Latitude: 0.02, Timestamp: testTime(120), OriginalRow: 4},
+			},
+			wantRows:  []int{2, 3, 4},
+			wantPrev:  []int{0, 2, 3},
+			wantSpeed: []float64{0, 66.7, 66.7},
+		},
+		{
+			name: "zero time difference",
+			group: []Record{
+				{ID: "a", Latitude: 0, Timestamp: testTime(0), OriginalRow: 2},
+				{ID: "a", Latitude: 0.01, Timestamp: testTime(0), OriginalRow: 3},
+			},
+			wantRows:  []int{2, 3},
+			wantPrev:  []int{0, 2},
+			wantSpeed: []float64{0, 0},
+		},
+		{
+			name:      "duplicate timestamps keep the first point",
+			configure: func(c *Config) { c.Parameters.DuplicateTimestamps = "first" },
+			group: []Record{
+				{ID: "a", Latitude: 0, Timestamp: testTime(0), OriginalRow: 2},
+				{ID: "a", Latitude: 0.05, Timestamp: testTime(0), OriginalRow: 3},
+				{ID: "a", Latitude: 0.01, Timestamp: testTime(60), OriginalRow: 4},
+			},
+			wantRows:  []int{2, 4},
+			wantPrev:  []int{0, 2},
+			wantSpeed: []float64{0, 66.7},
+		},
+		{
+			name:      "source speed replaces the computed speed",
+			configure: func(c *Config) { c.Parameters.SpeedSource = "source" },
+			group: []Record{
+				{ID: "a", Latitude: 0, Timestamp: testTime(0), OriginalRow: 2},
+				{ID: "a", Latitude: 0.01, Timestamp: testTime(60), OriginalRow: 3, SourceSpeed: 50, HasSourceSpeed: true},
+				{ID: "a", Latitude: 0.02, Timestamp: testTime(120), OriginalRow: 4},
+			},
+			wantRows:  []int{2, 3, 4},
+			wantPrev:  []int{0, 2, 3},
+			wantSpeed: []float64{0, 50, 66.7},
+		},
+		{
+			name: "continues from the stitched file",
+			configure: func(c *Config) {
+				c.stitchPoints = map[string]Record{"a": {ID: "a", Latitude: 0, Timestamp: testTime(0), OriginalRow: 7}}
+			},
+			group: []Record{
+				{ID: "a", Latitude: 0.01, Timestamp: testTime(60), OriginalRow: 2},
+			},
+			wantRows:  []int{2},
+			wantPrev:  []int{7},
+			wantSpeed: []float64{66.7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			if tt.configure != nil {
+				tt.configure(config)
+			}
+			p, err := NewGroupProcessor(config, NoProgress{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Process("a", tt.group)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.wantRows) {
+				t.Fatalf("got %d points, want %d", len(got), len(tt.wantRows))
+			}
+			for i, record := range got {
+				if record.OriginalRow != tt.wantRows[i] {
+					t.Errorf("point %d: row %d, want %d", i, record.OriginalRow, tt.wantRows[i])
+				}
+				if record.PreviousRow != tt.wantPrev[i] {
+					t.Errorf("point %d: previous row %d, want %d", i, record.PreviousRow, tt.wantPrev[i])
+				}
+				if math.Abs(record.Speed-tt.wantSpeed[i]) > 0.1 {
+					t.Errorf("point %d: speed %.2f km/h, want %.1f km/h", i, record.Speed, tt.wantSpeed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+	records := []Record{
+		{ID: "a", OriginalRow: 2, PreviousRow: 0, Speed: 0},
+		{ID: "a", OriginalRow: 3, PreviousRow: 2, Speed: 0.5},
+		{ID: "a", OriginalRow: 4, PreviousRow: 3, Speed: 5},
+		{ID: "b", OriginalRow: 5, PreviousRow: 0, Speed: 0},
+		{ID: "b", OriginalRow: 6, PreviousRow: 5, Speed: 3},
+		{ID: "b", OriginalRow: 7, PreviousRow: 6, Speed: 40},
+	}
+	twenty := 20.0
+
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantRows  []int
+		wantStats FilterStats
+	}{
+		{
+			name:      "first points only",
+			wantRows:  []int{3, 4, 6, 7},
+			wantStats: FilterStats{FirstPoints: 2},
+		},
+		{
+			name:      "speed threshold",
+			configure: func(c *Config) { c.Parameters.FilterAboveKph = 1 },
+			wantRows:  []int{4, 6, 7},
+			wantStats: FilterStats{FirstPoints: 2, Speed: 1},
+		},
+		{
+			name: "device threshold",
+			configure: func(c *Config) {
+				c.Parameters.FilterAboveKph = 1
+				c.Parameters.DeviceThresholds = map[string]DeviceThresholds{"b": {FilterAboveKph: &twenty}}
+			},
+			wantRows:  []int{4, 7},
+			wantStats: FilterStats{FirstPoints: 2, Speed: 2},
+		},
+		{
+			name:      "filter expression",
+			configure: func(c *Config) { c.Parameters.Filter = `id != "b"` },
+			wantRows:  []int{3, 4},
+			wantStats: FilterStats{FirstPoints: 2, Expression: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			if tt.configure != nil {
+				tt.configure(config)
+			}
+			filter, err := NewRecordFilter(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, stats := ApplyFilters(records, NewThresholdSet(config), filter, NoProgress{})
+			var rows []int
+			for _, record := range got {
+				rows = append(rows, record.OriginalRow)
+			}
+			if !reflect.DeepEqual(rows, tt.wantRows) {
+				t.Errorf("kept rows %v, want %v", rows, tt.wantRows)
+			}
+			if stats != tt.wantStats {
+				t.Errorf("stats %+v, want %+v", stats, tt.wantStats)
+			}
+		})
+	}
+}
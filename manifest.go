@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// outputManifest lists the files written by a run so downstream jobs can verify them before loading
+type outputManifest struct {
+	InputFile string         `json:"input_file"`
+	Created   time.Time      `json:"created"`
+	Files     []manifestFile `json:"files"`
+}
+
+// manifestFile describes one output file
+type manifestFile struct {
+	Path   string `json:"path"` // relative to the manifest's directory
+	Kind   string `json:"kind"` // output format or report name
+	Rows   *int   `json:"rows"` // records or report rows written, null if not known
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+
+	fullPath string
+}
+
+// add records an output file; rows below zero mean the count is not known
+func (m *outputManifest) add(filename, kind string, rows int) {
+	if m == nil {
+		return
+	}
+	entry := manifestFile{Kind: kind, fullPath: filename}
+	if rows >= 0 {
+		entry.Rows = &rows
+	}
+	m.Files = append(m.Files, entry)
+}
+
+// write checksums the recorded files and saves the manifest as JSON
+func (m *outputManifest) write(filename string) error {
+	dir := filepath.Dir(filename)
+	for i := range m.Files {
+		f := &m.Files[i]
+		size, sum, err := fileChecksum(f.fullPath)
+		if err != nil {
+			return fmt.Errorf("unable to checksum %s: %w", f.fullPath, err)
+		}
+		f.Bytes, f.SHA256 = size, sum
+		f.Path = f.fullPath
+		if rel, err := filepath.Rel(dir, f.fullPath); err == nil {
+			f.Path = filepath.ToSlash(rel)
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// fileChecksum returns the size and hex SHA-256 of a file
+func fileChecksum(filename string) (int64, string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// manifestFilename returns the path of the manifest, <basename>_manifest.json next to the outputs
+func manifestFilename(inputFile string, config *Config) string {
+	return strings.TrimSuffix(reportFilename(inputFile, "manifest", config), ".csv") + ".json"
+}
@@ -0,0 +1,484 @@
+// Package mbtiles writes MBTiles 1.3 files, the SQLite container for map tiles, without an
+// SQLite dependency. The database is laid out directly in the SQLite file format, version 3:
+// a metadata table, a tiles table and a unique index on the tile coordinates, each a b-tree
+// built bottom-up once all rows are known. Files are written once and never updated.
+package mbtiles
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// SQLite file layout
+const (
+	pageSize       = 4096
+	headerSize     = 100 // database header at the start of page 1
+	leafHeader     = 8   // b-tree page header of leaf pages
+	interiorHeader = 12  // b-tree page header of interior pages, with the right-most child
+	sqliteVersion  = 3045000
+	applicationID  = 0x4d504258 // "MPBX", which MBTiles files carry as their application ID
+)
+
+// B-tree page types
+const (
+	interiorIndex = 0x02
+	interiorTable = 0x05
+	leafIndex     = 0x0a
+	leafTable     = 0x0d
+)
+
+// Largest cells stored, with their cell pointer, for the worst-case page capacities:
+// table interior cells are a child page and a rowid; index entries hold the zoom, column,
+// row and rowid as integers of at most 1, 3, 3 and 6 bytes behind a 5-byte header.
+const (
+	maxTableInteriorCell = 2 + 4 + 9
+	maxIndexPayload      = 5 + 1 + 3 + 3 + 6
+	maxIndexLeafCell     = 2 + 1 + maxIndexPayload
+	maxIndexInteriorCell = 2 + 4 + 1 + maxIndexPayload
+)
+
+// Schema of the tables and index, as SQLite stores it
+const (
+	metadataSQL = "CREATE TABLE metadata (name text, value text)"
+	tilesSQL    = "CREATE TABLE tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob)"
+	indexSQL    = "CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row)"
+)
+
+// Writer writes an MBTiles file. Tiles are written to the file as they are added; the
+// metadata, the index and the schema when the writer is closed.
+type Writer struct {
+	file     *os.File
+	pages    uint32 // pages allocated, page 1 being kept for the schema
+	metadata [][2]string
+	tiles    tableBuilder
+	index    []indexEntry
+	err      error
+}
+
+// indexEntry is a row of the tile index
+type indexEntry struct {
+	zoom, column, row, rowid int64
+}
+
+// Create creates an MBTiles file, replacing any file of the same name
+func Create(filename string) (*Writer, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{file: file, pages: 1}
+	w.tiles.w = w
+	return w, nil
+}
+
+// SetMetadata adds a row to the metadata table, such as name, format, bounds or json
+func (w *Writer) SetMetadata(name, value string) {
+	w.metadata = append(w.metadata, [2]string{name, value})
+}
+
+// AddTile adds the tile at zoom/x/y in the XYZ scheme of web maps. MBTiles numbers rows
+// from the south, so the row stored is flipped. Each tile must be added once.
+func (w *Writer) AddTile(zoom, x, y int, data []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	row := int64(1)<<zoom - 1 - int64(y)
+	rowid := w.tiles.add(int64(zoom), int64(x), row, data)
+	w.index = append(w.index, indexEntry{int64(zoom), int64(x), row, rowid})
+	return w.err
+}
+
+// Close writes the metadata table, the tile index and the schema, and closes the file
+func (w *Writer) Close() error {
+	defer w.file.Close()
+	if w.err != nil {
+		return w.err
+	}
+	tilesRoot := w.tiles.finish()
+
+	metadata := tableBuilder{w: w}
+	for _, row := range w.metadata {
+		metadata.add(row[0], row[1])
+	}
+	metadataRoot := metadata.finish()
+
+	sort.Slice(w.index, func(i, j int) bool {
+		a, b := w.index[i], w.index[j]
+		if a.zoom != b.zoom {
+			return a.zoom < b.zoom
+		}
+		if a.column != b.column {
+			return a.column < b.column
+		}
+		if a.row != b.row {
+			return a.row < b.row
+		}
+		return a.rowid < b.rowid
+	})
+	indexRoot := w.writeIndex()
+
+	// The schema table is rooted on page 1, after the database header
+	page := make([]byte, pageSize)
+	w.writeHeader(page)
+	schema := [][]byte{
+		record("table", "metadata", "metadata", int64(metadataRoot), metadataSQL),
+		record("table", "tiles", "tiles", int64(tilesRoot), tilesSQL),
+		record("index", "tile_index", "tiles", int64(indexRoot), indexSQL),
+	}
+	var cells [][]byte
+	for i, payload := range schema {
+		cells = append(cells, tableLeafCell(w, int64(i+1), payload))
+	}
+	layoutPage(page, headerSize, leafTable, cells, 0)
+	w.writePage(1, page)
+	if w.err != nil {
+		return w.err
+	}
+	return w.file.Close()
+}
+
+// writeHeader fills in the database header
+func (w *Writer) writeHeader(page []byte) {
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], pageSize)
+	page[18], page[19] = 1, 1                 // legacy journal file format
+	page[21], page[22], page[23] = 64, 32, 32 // payload fractions, fixed by the format
+	binary.BigEndian.PutUint32(page[24:], 1)  // file change counter
+	binary.BigEndian.PutUint32(page[28:], w.pages)
+	binary.BigEndian.PutUint32(page[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(page[44:], 4) // schema format
+	binary.BigEndian.PutUint32(page[56:], 1) // UTF-8 text
+	binary.BigEndian.PutUint32(page[68:], applicationID)
+	binary.BigEndian.PutUint32(page[92:], 1) // change counter the page count is valid for
+	binary.BigEndian.PutUint32(page[96:], sqliteVersion)
+}
+
+// allocate returns the number of a new page
+func (w *Writer) allocate() uint32 {
+	w.pages++
+	return w.pages
+}
+
+// writePage writes a page at its place in the file
+func (w *Writer) writePage(n uint32, page []byte) {
+	if w.err != nil {
+		return
+	}
+	if _, err := w.file.WriteAt(page, int64(n-1)*pageSize); err != nil {
+		w.err = fmt.Errorf("unable to write MBTiles page: %w", err)
+	}
+}
+
+// child is a finished b-tree page and, for table b-trees, the largest rowid under it
+type child struct {
+	page uint32
+	key  int64
+}
+
+// tableBuilder builds a table b-tree from rows added in rowid order. Leaf pages are written
+// as they fill up, so only the pages above them are kept until the end.
+type tableBuilder struct {
+	w      *Writer
+	cells  [][]byte // cells of the leaf being filled
+	used   int      // bytes the leaf header, cells and cell pointers take
+	rowid  int64
+	leaves []child
+}
+
+// add adds a row with the next rowid and returns that rowid
+func (t *tableBuilder) add(values ...interface{}) int64 {
+	t.rowid++
+	cell := tableLeafCell(t.w, t.rowid, record(values...))
+	if t.used == 0 {
+		t.used = leafHeader
+	}
+	if t.used+2+len(cell) > pageSize {
+		t.flush()
+		t.used = leafHeader
+	}
+	t.cells = append(t.cells, cell)
+	t.used += 2 + len(cell)
+	return t.rowid
+}
+
+// flush writes the leaf being filled
+func (t *tableBuilder) flush() {
+	page := make([]byte, pageSize)
+	layoutPage(page, 0, leafTable, t.cells, 0)
+	n := t.w.allocate()
+	t.w.writePage(n, page)
+	last := int64(0)
+	if len(t.cells) > 0 {
+		last = t.lastRowid()
+	}
+	t.leaves = append(t.leaves, child{n, last})
+	t.cells = nil
+}
+
+// lastRowid returns the rowid of the last cell of the leaf being filled
+func (t *tableBuilder) lastRowid() int64 {
+	// The rowid follows the payload size, both varints
+	cell := t.cells[len(t.cells)-1]
+	_, n := readVarint(cell)
+	rowid, _ := readVarint(cell[n:])
+	return int64(rowid)
+}
+
+// finish writes the last leaf and the interior pages above the leaves, and returns the root
+// page. A table without rows is a single empty leaf.
+func (t *tableBuilder) finish() uint32 {
+	if len(t.cells) > 0 || len(t.leaves) == 0 {
+		t.flush()
+	}
+	level := t.leaves
+	perPage := (pageSize - interiorHeader) / maxTableInteriorCell
+	for len(level) > 1 {
+		var parents []child
+		for _, group := range splitEvenly(len(level), (len(level)+perPage-1)/perPage) {
+			children := level[group[0]:group[1]]
+			var cells [][]byte
+			for _, c := range children[:len(children)-1] {
+				cell := binary.BigEndian.AppendUint32(nil, c.page)
+				cells = append(cells, appendVarint(cell, uint64(c.key)))
+			}
+			last := children[len(children)-1]
+			page := make([]byte, pageSize)
+			layoutPage(page, 0, interiorTable, cells, last.page)
+			n := t.w.allocate()
+			t.w.writePage(n, page)
+			parents = append(parents, child{n, last.key})
+		}
+		level = parents
+	}
+	return level[0].page
+}
+
+// writeIndex writes the tile index from its sorted entries and returns the root page. Index
+// b-trees keep each entry once: the entries between two pages of a level move up into the
+// page above as the key that separates them.
+func (w *Writer) writeIndex() uint32 {
+	entries := make([][]byte, len(w.index))
+	for i, e := range w.index {
+		entries[i] = record(e.zoom, e.column, e.row, e.rowid)
+	}
+
+	// Leaves: with L leaves, L-1 entries separate them and the rest are spread evenly
+	perLeaf := (pageSize - leafHeader) / maxIndexLeafCell
+	leaves := (len(entries) + 1 + perLeaf) / (perLeaf + 1)
+	if leaves == 0 {
+		leaves = 1
+	}
+	var children []uint32
+	var separators [][]byte
+	next := 0
+	for _, group := range splitEvenly(len(entries)-(leaves-1), leaves) {
+		var cells [][]byte
+		for range group[1] - group[0] {
+			cells = append(cells, append(appendVarint(nil, uint64(len(entries[next]))), entries[next]...))
+			next++
+		}
+		page := make([]byte, pageSize)
+		layoutPage(page, 0, leafIndex, cells, 0)
+		n := w.allocate()
+		w.writePage(n, page)
+		children = append(children, n)
+		if next < len(entries) {
+			separators = append(separators, entries[next])
+			next++
+		}
+	}
+
+	// Interior levels: each page holds the separators between its own children, and the one
+	// after its last child moves up
+	perPage := (pageSize-interiorHeader)/maxIndexInteriorCell + 1
+	for len(children) > 1 {
+		var parents []uint32
+		var promoted [][]byte
+		for _, group := range splitEvenly(len(children), (len(children)+perPage-1)/perPage) {
+			var cells [][]byte
+			for i := group[0]; i < group[1]-1; i++ {
+				cell := binary.BigEndian.AppendUint32(nil, children[i])
+				cells = append(cells, append(appendVarint(cell, uint64(len(separators[i]))), separators[i]...))
+			}
+			page := make([]byte, pageSize)
+			layoutPage(page, 0, interiorIndex, cells, children[group[1]-1])
+			n := w.allocate()
+			w.writePage(n, page)
+			parents = append(parents, n)
+			if group[1] < len(children) {
+				promoted = append(promoted, separators[group[1]-1])
+			}
+		}
+		children, separators = parents, promoted
+	}
+	return children[0]
+}
+
+// splitEvenly splits n items into the given number of groups, as [start, end) ranges of
+// nearly equal length, so no page of a level is left with a single child while the others
+// are full
+func splitEvenly(n, groups int) [][2]int {
+	ranges := make([][2]int, groups)
+	start := 0
+	for i := range ranges {
+		size := n / groups
+		if i < n%groups {
+			size++
+		}
+		ranges[i] = [2]int{start, start + size}
+		start += size
+	}
+	return ranges
+}
+
+// layoutPage writes a b-tree page at offset in page: its header, the cell pointers after
+// it, and the cells packed at the end of the page
+func layoutPage(page []byte, offset int, kind byte, cells [][]byte, rightChild uint32) {
+	header := leafHeader
+	if kind == interiorIndex || kind == interiorTable {
+		header = interiorHeader
+		binary.BigEndian.PutUint32(page[offset+8:], rightChild)
+	}
+	page[offset] = kind
+	binary.BigEndian.PutUint16(page[offset+3:], uint16(len(cells)))
+	content := pageSize
+	for i, cell := range cells {
+		content -= len(cell)
+		copy(page[content:], cell)
+		binary.BigEndian.PutUint16(page[offset+header+2*i:], uint16(content))
+	}
+	// A content area starting at the end of the page is recorded as 65536, which wraps to 0
+	binary.BigEndian.PutUint16(page[offset+5:], uint16(content))
+}
+
+// tableLeafCell returns the cell of a table row. A payload too large for the page keeps its
+// first part in the cell and the rest in a chain of overflow pages, sized as SQLite expects.
+func tableLeafCell(w *Writer, rowid int64, payload []byte) []byte {
+	cell := appendVarint(nil, uint64(len(payload)))
+	cell = appendVarint(cell, uint64(rowid))
+
+	const usable = pageSize
+	maxLocal := usable - 35
+	if len(payload) <= maxLocal {
+		return append(cell, payload...)
+	}
+	minLocal := (usable-12)*32/255 - 23
+	local := minLocal + (len(payload)-minLocal)%(usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	cell = append(cell, payload[:local]...)
+
+	rest := payload[local:]
+	first := w.pages + 1
+	cell = binary.BigEndian.AppendUint32(cell, first)
+	for len(rest) > 0 {
+		n := w.allocate()
+		page := make([]byte, pageSize)
+		chunk := min(len(rest), usable-4)
+		if len(rest) > chunk {
+			binary.BigEndian.PutUint32(page, n+1)
+		}
+		copy(page[4:], rest[:chunk])
+		rest = rest[chunk:]
+		w.writePage(n, page)
+	}
+	return cell
+}
+
+// record encodes column values, each an int64, a string or a []byte, in the SQLite record
+// format: a header of serial types followed by the values
+func record(values ...interface{}) []byte {
+	var types, body []byte
+	for _, value := range values {
+		switch v := value.(type) {
+		case int64:
+			switch {
+			case v == 0:
+				types = appendVarint(types, 8)
+			case v == 1:
+				types = appendVarint(types, 9)
+			default:
+				serial, size := intSerialType(v)
+				types = appendVarint(types, serial)
+				for i := size - 1; i >= 0; i-- {
+					body = append(body, byte(v>>(8*i)))
+				}
+			}
+		case string:
+			types = appendVarint(types, uint64(len(v))*2+13)
+			body = append(body, v...)
+		case []byte:
+			types = appendVarint(types, uint64(len(v))*2+12)
+			body = append(body, v...)
+		default:
+			panic(fmt.Sprintf("mbtiles: unsupported column value %T", value))
+		}
+	}
+	// The header size counts itself; a size below 128 takes one byte
+	size := uint64(len(types) + 1)
+	if size >= 128 {
+		size++
+	}
+	header := appendVarint(nil, size)
+	return append(append(header, types...), body...)
+}
+
+// intSerialType returns the serial type and byte length of the smallest integer type of v
+func intSerialType(v int64) (uint64, int) {
+	switch {
+	case v >= -1<<7 && v < 1<<7:
+		return 1, 1
+	case v >= -1<<15 && v < 1<<15:
+		return 2, 2
+	case v >= -1<<23 && v < 1<<23:
+		return 3, 3
+	case v >= -1<<31 && v < 1<<31:
+		return 4, 4
+	case v >= -1<<47 && v < 1<<47:
+		return 5, 6
+	}
+	return 6, 8
+}
+
+// appendVarint appends SQLite's big-endian variable-length integer
+func appendVarint(buf []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		for i := 7; i >= 0; i-- {
+			buf = append(buf, byte(v>>(8+7*uint(i)))|0x80)
+		}
+		return append(buf, byte(v))
+	}
+	var groups [8]byte
+	n := 0
+	for {
+		groups[n] = byte(v & 0x7f)
+		n++
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		b := groups[i]
+		if i > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+// readVarint decodes a varint of at most 8 bytes and returns it with its length
+func readVarint(buf []byte) (uint64, int) {
+	var v uint64
+	for i, b := range buf {
+		v = v<<7 | uint64(b&0x7f)
+		if b < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v, len(buf)
+}
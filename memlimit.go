@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// partitionShare is the fraction of the memory budget one spilled partition may take, leaving
+// room for the processed records that accumulate while the partitions are worked through
+const partitionShare = 4
+
+// sortRunShare is the fraction of the memory budget one sorted run of a partition may take
+const sortRunShare = 8
+
+// parseByteSize parses a size such as 512MB, 8GB or 8GiB. Units are binary (1KB = 1024
+// bytes), as in the Go runtime's GOMEMLIMIT; a plain number is a number of bytes.
+func parseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}}
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSuffix(value, unit.suffix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid memory size %q (use e.g. 512MB or 8GB)", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// formatByteSize formats a size for messages, e.g. 1.5 GB
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+}
+
+// recordSize estimates the memory a record takes, including its strings
+func recordSize(r *Record) int64 {
+	size := int64(unsafe.Sizeof(*r)) + int64(len(r.ID)+len(r.Event))
+	for _, value := range r.Passthrough {
+		size += int64(unsafe.Sizeof(value)) + int64(len(value))
+	}
+	return size
+}
+
+// recordsSize estimates the memory a slice of records takes
+func recordsSize(records []Record) int64 {
+	var size int64
+	for i := range records {
+		size += recordSize(&records[i])
+	}
+	return size
+}
+
+// partitionSet is the input records spilled to temporary files in ranges of device IDs, so
+// they can be grouped and processed one partition at a time. Each partition is written as
+// sorted runs, which are merged as the partition is read back.
+type partitionSet struct {
+	runs    [][]string // sorted run files of each partition
+	counts  []int      // records in each partition
+	records int
+}
+
+// spillPartitions writes the records to temporary files in tempDir when they take more than
+// the budget allows, each partition holding consecutive device IDs and at most a share of the
+// budget. It returns nil when the records fit, or when a single partition would hold them all.
+//
+// Within a partition the records are sorted by device ID and time with an external merge
+// sort: they are sorted in runs of at most a sortRunShare of the budget, each written to its
+// own file, so even a device of tens of millions of points is never sorted in memory as a
+// whole.
+func spillPartitions(records []Record, budget int64, tempDir string) (*partitionSet, error) {
+	sizes := make(map[string]int64)
+	var total int64
+	for i := range records {
+		size := recordSize(&records[i])
+		sizes[records[i].ID] += size
+		total += size
+	}
+	// Grouping copies the records, so they fit when two copies do
+	if 2*total <= budget {
+		return nil, nil
+	}
+
+	// Assign consecutive IDs to partitions, so processing the partitions in order keeps the
+	// order of processing all devices at once. A device larger than a partition gets its own.
+	limit := budget / partitionShare
+	ids := make([]string, 0, len(sizes))
+	for id := range sizes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	partition := make(map[string]int, len(ids))
+	n, filled := 0, int64(0)
+	for _, id := range ids {
+		if filled > 0 && filled+sizes[id] > limit {
+			n++
+			filled = 0
+		}
+		partition[id] = n
+		filled += sizes[id]
+	}
+	n++
+	if n == 1 {
+		return nil, nil
+	}
+
+	// Order the records by partition, keeping input order within each, with a counting sort
+	// of their indices
+	p := &partitionSet{runs: make([][]string, n), counts: make([]int, n), records: len(records)}
+	for i := range records {
+		p.counts[partition[records[i].ID]]++
+	}
+	next := make([]int, n)
+	for k := 1; k < n; k++ {
+		next[k] = next[k-1] + p.counts[k-1]
+	}
+	order := make([]int32, len(records))
+	for i := range records {
+		k := partition[records[i].ID]
+		order[next[k]] = int32(i)
+		next[k]++
+	}
+
+	runLimit := budget / sortRunShare
+	var run []Record
+	var runBytes int64
+	start := 0
+	for k := 0; k < n; k++ {
+		for _, i := range order[start : start+p.counts[k]] {
+			run = append(run, records[i])
+			if runBytes += recordSize(&records[i]); runBytes >= runLimit {
+				if err := p.writeRun(k, run, tempDir); err != nil {
+					p.remove()
+					return nil, err
+				}
+				run, runBytes = run[:0], 0
+			}
+		}
+		if len(run) > 0 {
+			if err := p.writeRun(k, run, tempDir); err != nil {
+				p.remove()
+				return nil, err
+			}
+			run, runBytes = run[:0], 0
+		}
+		start += p.counts[k]
+	}
+	return p, nil
+}
+
+// partitionLess orders the records of a partition by device ID, then as recordLess does
+func partitionLess(a, b *Record) bool {
+	if a.ID != b.ID {
+		return a.ID < b.ID
+	}
+	return recordLess(a, b)
+}
+
+// writeRun sorts a run of partition k's records and writes it to a new temporary file
+func (p *partitionSet) writeRun(k int, run []Record, tempDir string) error {
+	sort.SliceStable(run, func(i, j int) bool { return partitionLess(&run[i], &run[j]) })
+	file, err := os.CreateTemp(tempDir, "gps-partition-*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create partition file: %w", err)
+	}
+	p.runs[k] = append(p.runs[k], file.Name())
+	writer := bufio.NewWriter(file)
+	encoder := gob.NewEncoder(writer)
+	for i := range run {
+		if err := encoder.Encode(&run[i]); err != nil {
+			file.Close()
+			return fmt.Errorf("unable to write partition file: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("unable to write partition file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("unable to write partition file: %w", err)
+	}
+	return nil
+}
+
+// runReader is the next record of one sorted run being merged
+type runReader struct {
+	decoder *gob.Decoder
+	head    Record
+}
+
+// runHeap orders the runs being merged by their next record
+type runHeap []*runReader
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return partitionLess(&h[i].head, &h[j].head) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// load reads partition i back into memory, merging its sorted runs, so the records come back
+// sorted by device ID and time
+func (p *partitionSet) load(i int) ([]Record, error) {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	var h runHeap
+	for _, name := range p.runs[i] {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read partition file: %w", err)
+		}
+		files = append(files, file)
+		r := &runReader{decoder: gob.NewDecoder(bufio.NewReader(file))}
+		if err := r.decoder.Decode(&r.head); err == io.EOF {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read partition file: %w", err)
+		}
+		h = append(h, r)
+	}
+	heap.Init(&h)
+
+	records := make([]Record, 0, p.counts[i])
+	for h.Len() > 0 {
+		r := h[0]
+		records = append(records, r.head)
+		// Decoding into a zero record, as gob leaves fields missing from the stream unchanged
+		r.head = Record{}
+		if err := r.decoder.Decode(&r.head); err == io.EOF {
+			heap.Pop(&h)
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read partition file: %w", err)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return records, nil
+}
+
+// remove deletes the partition files
+func (p *partitionSet) remove() {
+	for _, runs := range p.runs {
+		for _, name := range runs {
+			os.Remove(name)
+		}
+	}
+}
+
+// removePartition deletes the files of partition i once it is read
+func (p *partitionSet) removePartition(i int) {
+	for _, name := range p.runs[i] {
+		os.Remove(name)
+	}
+	p.runs[i] = nil
+}
+
+// groupSorted splits records sorted by device ID into one group per device without copying
+// them. Each group's capacity ends with the group, so a group that grows cannot overwrite
+// the next.
+func groupSorted(records []Record) map[string][]Record {
+	groups := make(map[string][]Record)
+	start := 0
+	for i := 1; i <= len(records); i++ {
+		if i == len(records) || records[i].ID != records[start].ID {
+			groups[records[start].ID] = records[start:i:i]
+			start = i
+		}
+	}
+	return groups
+}
+
+// processPartitions groups and processes the partitions one at a time, deleting each file
+// once it is read. It returns the processed records, the number of devices and the number
+// of devices dropped for having fewer than parameters.min_points_per_id points.
+func processPartitions(p *partitionSet, config *Config) ([]Record, int, int, error) {
+	defer p.remove()
+	proc, err := NewGroupProcessor(config, newProgress("Processing GPS data", p.records))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var processedRecords []Record
+	devices, dropped := 0, 0
+	for i := range p.runs {
+		records, err := p.load(i)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		p.removePartition(i)
+
+		groups := groupSorted(records)
+		if config.Parameters.MinPointsPerID > 0 {
+			removed := 0
+			for _, group := range groups {
+				if len(group) < config.Parameters.MinPointsPerID {
+					removed += len(group)
+				}
+			}
+			dropped += dropSmallGroups(groups, config.Parameters.MinPointsPerID)
+			_ = proc.bar.Add(removed)
+		}
+		devices += len(groups)
+		for _, id := range sortedIDs(groups) {
+			logDebug("Processing device %s (%d points)", id, len(groups[id]))
+			group, err := proc.Process(id, groups[id])
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			processedRecords = append(processedRecords, group...)
+			delete(groups, id)
+		}
+	}
+	proc.finish()
+	return processedRecords, devices, dropped, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// shuffledTracks returns the points of several devices in a random input order, with some
+// points sharing a timestamp
+func shuffledTracks(devices, points int) []Record {
+	rng := rand.New(rand.NewSource(1))
+	var records []Record
+	for d := 0; d < devices; d++ {
+		id := string(rune('a' + d))
+		for i := 0; i < points; i++ {
+			records = append(records, Record{ID: id, Latitude: 52 + float64(i)*0.001, Longitude: 4, Timestamp: testTime(i / 3 * 10)})
+		}
+	}
+	rng.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+	for i := range records {
+		records[i].OriginalRow = i + 2
+	}
+	return records
+}
+
+func TestSpillPartitionsExternalSort(t *testing.T) {
+	records := shuffledTracks(5, 300)
+	total := recordsSize(records)
+
+	tests := []struct {
+		name      string
+		budget    int64
+		wantSpill bool
+		wantRuns  bool // some partition is sorted in more than one run
+	}{
+		{name: "fits in memory", budget: 2 * total, wantSpill: false},
+		{name: "partitions in several runs", budget: total, wantSpill: true, wantRuns: true},
+		{name: "tiny runs", budget: total / 20, wantSpill: true, wantRuns: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := spillPartitions(records, tt.budget, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (p != nil) != tt.wantSpill {
+				t.Fatalf("spilled %v, want %v", p != nil, tt.wantSpill)
+			}
+			if p == nil {
+				return
+			}
+			defer p.remove()
+
+			var merged []Record
+			runs := false
+			for i := range p.runs {
+				runs = runs || len(p.runs[i]) > 1
+				partition, err := p.load(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				merged = append(merged, partition...)
+			}
+			if runs != tt.wantRuns {
+				t.Errorf("several runs in a partition %v, want %v", runs, tt.wantRuns)
+			}
+
+			want := append([]Record(nil), records...)
+			if err := sortRecords(want, "id_time"); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(merged, want) {
+				t.Errorf("merged partitions are not sorted by ID and time like the records")
+			}
+		})
+	}
+}
+
+func TestProcessPartitionsMatchesProcessGroups(t *testing.T) {
+	progressMode = "none"
+	records := shuffledTracks(4, 500)
+	config := &Config{}
+	config.Parameters.DuplicateTimestamps = "first"
+
+	p, err := spillPartitions(records, recordsSize(records)/4, t.TempDir())
+	if err != nil || p == nil {
+		t.Fatalf("spillPartitions: %v, %v", p, err)
+	}
+	got, devices, _, err := processPartitions(p, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := processGroups(groupByID(append([]Record(nil), records...)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if devices != 4 {
+		t.Errorf("processed %d devices, want 4", devices)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processing the spilled partitions differs from processing all groups at once")
+	}
+}
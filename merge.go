@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// checkMerge validates parameters.merge_with
+func checkMerge(config *Config) error {
+	seen := make(map[string]bool)
+	for _, name := range config.Parameters.MergeWith {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("merge_with: empty file name")
+		}
+		if seen[name] {
+			return fmt.Errorf("merge_with: %s is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// readMergedInputs reads the files of parameters.merge_with with the input's settings and
+// merges their records with the input's, as mergeRecords does. The files must have the
+// same unmapped columns as the input, so passthrough values line up. It returns the merged
+// records and the number of points dropped as already in an earlier file.
+func readMergedInputs(records []Record, config *Config) ([]Record, int, error) {
+	passthrough := config.passthroughColumns
+	invalid, ragged := config.invalidRows, config.raggedRows
+	for i, name := range config.Parameters.MergeWith {
+		logInfo("Reading file to merge: %s", name)
+		more, err := readInput(name, config, nil)
+		if err != nil {
+			return nil, 0, fmt.Errorf("merge_with %s: %w", name, err)
+		}
+		if strings.Join(config.passthroughColumns, "\x00") != strings.Join(passthrough, "\x00") {
+			return nil, 0, fmt.Errorf("merge_with %s: unmapped columns %v differ from the input's %v",
+				name, config.passthroughColumns, passthrough)
+		}
+		for j := range more {
+			more[j].SourceFile = i + 1
+		}
+		records = append(records, more...)
+		// Each file is counted from zero, so add up the skipped rows of all of them
+		invalid += config.invalidRows
+		ragged.fitted += config.raggedRows.fitted
+		ragged.rejected += config.raggedRows.rejected
+	}
+	config.invalidRows, config.raggedRows = invalid, ragged
+	merged, duplicates := mergeRecords(records)
+	return merged, duplicates, nil
+}
+
+// mergeRecords sorts the records of several files by device ID and time and drops each
+// point whose device already has a point at the same time in an earlier file, so overlapping
+// exports count each point once. Points at the same time within one file are left for
+// parameters.duplicate_timestamps. It returns the merged records and the number dropped.
+func mergeRecords(records []Record) ([]Record, int) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := &records[i], &records[j]
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.SourceFile != b.SourceFile {
+			return a.SourceFile < b.SourceFile
+		}
+		return a.OriginalRow < b.OriginalRow
+	})
+	kept := records[:0]
+	first := 0 // first kept record of the current device and time
+	for i := range records {
+		r := &records[i]
+		if len(kept) > 0 && r.ID == kept[first].ID && r.Timestamp.Equal(kept[first].Timestamp) {
+			if r.SourceFile != kept[first].SourceFile {
+				continue
+			}
+		} else {
+			first = len(kept)
+		}
+		kept = append(kept, *r)
+	}
+	return kept, len(records) - len(kept)
+}
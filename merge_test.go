@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeRecords(t *testing.T) {
+	// point is a record of device id at second ts, read from row of file
+	point := func(id string, ts, file, row int) Record {
+		return Record{ID: id, Timestamp: testTime(ts), SourceFile: file, OriginalRow: row}
+	}
+	tests := []struct {
+		name           string
+		records        []Record
+		want           []Record
+		wantDuplicates int
+	}{
+		{
+			name: "overlapping files",
+			records: []Record{
+				point("a", 60, 0, 2), point("a", 120, 0, 3),
+				point("a", 0, 1, 2), point("a", 60, 1, 3),
+			},
+			want:           []Record{point("a", 0, 1, 2), point("a", 60, 0, 2), point("a", 120, 0, 3)},
+			wantDuplicates: 1,
+		},
+		{
+			name: "earlier file wins whatever the input order",
+			records: []Record{
+				point("a", 60, 2, 2), point("a", 60, 1, 5), point("a", 60, 0, 9),
+			},
+			want:           []Record{point("a", 60, 0, 9)},
+			wantDuplicates: 2,
+		},
+		{
+			name: "same time within a file is left to duplicate_timestamps",
+			records: []Record{
+				point("a", 60, 0, 2), point("a", 60, 0, 3), point("a", 60, 1, 2),
+			},
+			want:           []Record{point("a", 60, 0, 2), point("a", 60, 0, 3)},
+			wantDuplicates: 1,
+		},
+		{
+			name: "devices apart",
+			records: []Record{
+				point("b", 60, 0, 2), point("a", 60, 1, 2), point("b", 0, 1, 3),
+			},
+			want:           []Record{point("a", 60, 1, 2), point("b", 0, 1, 3), point("b", 60, 0, 2)},
+			wantDuplicates: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, duplicates := mergeRecords(tt.records)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merged %+v, want %+v", got, tt.want)
+			}
+			if duplicates != tt.wantDuplicates {
+				t.Errorf("dropped %d points, want %d", duplicates, tt.wantDuplicates)
+			}
+		})
+	}
+}
+
+func TestReadMergedInputs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	day1 := write("day1.csv", "id,lat,lon,time\na,52.0,4.0,2024-01-01T23:00:00Z\na,52.1,4.0,2024-01-01T23:30:00Z\n")
+	day2 := write("day2.csv", "id,lat,lon,time\na,52.1,4.0,2024-01-01T23:30:00Z\na,52.2,4.0,2024-01-02T00:30:00Z\n")
+	extra := write("extra.csv", "id,lat,lon,time,driver\na,52.3,4.0,2024-01-02T01:30:00Z,x\n")
+
+	tests := []struct {
+		name           string
+		mergeWith      []string
+		wantFiles      []int
+		wantDuplicates int
+		wantErr        bool
+	}{
+		{name: "overlap dropped", mergeWith: []string{day1}, wantFiles: []int{1, 0, 0}, wantDuplicates: 1},
+		{name: "different unmapped columns", mergeWith: []string{extra}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			progressMode = "none"
+			config := &Config{}
+			config.Columns.ID, config.Columns.Latitude, config.Columns.Longitude, config.Columns.Timestamp = "id", "lat", "lon", "time"
+			config.Parameters.MergeWith = tt.mergeWith
+			config.Output.PassthroughColumns = true
+			records, err := readInput(day2, config, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			merged, duplicates, err := readMergedInputs(records, config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMergedInputs error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var files []int
+			for _, r := range merged {
+				files = append(files, r.SourceFile)
+			}
+			if !reflect.DeepEqual(files, tt.wantFiles) {
+				t.Errorf("source files %v, want %v", files, tt.wantFiles)
+			}
+			if duplicates != tt.wantDuplicates {
+				t.Errorf("dropped %d points, want %d", duplicates, tt.wantDuplicates)
+			}
+		})
+	}
+}
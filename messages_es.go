@@ -0,0 +1,134 @@
+package main
+
+// spanishMessages translates the help text and the main console messages to Spanish. Keys
+// are the English text exactly as the code writes it; messages without a translation are
+// written in English.
+var spanishMessages = map[string]string{
+	// Help
+	"GPS Data Processor - A tool for processing and analyzing GPS trajectory data": "Procesador de datos GPS - Una herramienta para procesar y analizar trayectorias GPS",
+	"\nUsage:":   "\nUso:",
+	"Arguments:": "Argumentos:",
+	"  input_file      Path to the input CSV or Excel (.xlsx) file (default: sample.csv)": "  input_file      Ruta del archivo de entrada CSV o Excel (.xlsx) (predeterminado: sample.csv)",
+	"  filter_speed    Minimum speed threshold in km/h (default: 1.0)":                    "  filter_speed    Velocidad mínima en km/h (predeterminado: 1.0)",
+	"  config_file     Path to configuration YAML file (default: config.yaml)":            "  config_file     Ruta del archivo de configuración YAML (predeterminado: config.yaml)",
+	"\nSubcommands:": "\nSubcomandos:",
+	"  init            Inspect a sample file and interactively write a tailored config.yaml":                "  init            Examina un archivo de muestra y escribe de forma interactiva un config.yaml adaptado",
+	"  stream          Enrich JSON-line fixes as they arrive, from stdin to stdout or between Kafka topics": "  stream          Enriquece posiciones en líneas JSON a medida que llegan, de stdin a stdout o entre temas de Kafka",
+	"  generate        Write synthetic GPS tracks for trying out configs without real data":                 "  generate        Escribe trayectorias GPS sintéticas para probar configuraciones sin datos reales",
+	"  bench           Time each pipeline step on generated data, optionally with pprof profiles":           "  bench           Mide el tiempo de cada paso con datos generados, opcionalmente con perfiles pprof",
+	"\nOptions:": "\nOpciones:",
+	"  -h, --help      Show this help message and exit":                                                             "  -h, --help      Muestra esta ayuda y termina",
+	"  --format LIST   Output formats to write: csv, kml, xlsx, geojsonseq, ndjson (repeatable or comma-separated)": "  --format LISTA  Formatos de salida: csv, kml, xlsx, geojsonseq, ndjson (repetible o separados por comas)",
+	"  --id LIST       Only process these device IDs (repeatable or comma-separated)":                               "  --id LISTA      Procesa solo estos IDs de dispositivo (repetible o separados por comas)",
+	"  --quiet         Disable progress bars":                                                                       "  --quiet         Desactiva las barras de progreso",
+	"  --log-format F  Replace progress bars and messages with timestamped log lines on stderr: text or json":       "  --log-format F  Sustituye las barras de progreso y los mensajes por líneas de registro con fecha en stderr: text o json",
+	"  --verbose       Also show debug messages":                                                                    "  --verbose       Muestra también los mensajes de depuración",
+	"  --log-file FILE Append all log messages, with timestamps and levels, to FILE":                                "  --log-file ARCH Añade todos los mensajes, con fecha y nivel, a ARCH",
+	"  --report FILE   Write a machine-readable JSON run report to FILE":                                            "  --report ARCH   Escribe un informe JSON de la ejecución en ARCH",
+	"  --profile NAME  Apply a named profile from the config file, or the built-in aviation profile":                "  --profile NOMBRE  Aplica un perfil con nombre del archivo de configuración, o el perfil integrado aviation",
+	"  --set PATH=VAL  Override a config value, e.g. --set parameters.filter_above_kph=2.5 (repeatable)":            "  --set RUTA=VAL  Sustituye un valor de la configuración, p. ej. --set parameters.filter_above_kph=2.5 (repetible)",
+	"  --validate      Check the config and the first rows of input, then exit without processing":                  "  --validate      Comprueba la configuración y las primeras filas de la entrada y termina sin procesar",
+	"  --validate-rows N  Number of input rows to check with --validate (default: 100)":                             "  --validate-rows N  Filas de entrada que comprueba --validate (predeterminado: 100)",
+	"  --resume        Continue an interrupted run from its checkpoint":                                             "  --resume        Continúa una ejecución interrumpida desde su punto de control",
+	"  --if-exists P   When an output file exists: overwrite (default), error, prompt, or suffix (add a timestamp)": "  --if-exists P   Si un archivo de salida existe: overwrite (predeterminado), error, prompt o suffix (añade la fecha)",
+	"  --no-clobber    Same as --if-exists error":                                                                   "  --no-clobber    Igual que --if-exists error",
+	"  --overwrite     Same as --if-exists overwrite":                                                               "  --overwrite     Igual que --if-exists overwrite",
+	"  --cpu-profile FILE  Write a pprof CPU profile of the run to FILE":                                            "  --cpu-profile ARCH  Escribe un perfil de CPU pprof de la ejecución en ARCH",
+	"  --mem-profile FILE  Write a pprof heap profile at the end of the run to FILE":                                "  --mem-profile ARCH  Escribe un perfil de memoria pprof al final de la ejecución en ARCH",
+	"  --max-memory SIZE  Keep record buffers within SIZE, e.g. 8GB, spilling devices to temp_dir when needed":      "  --max-memory TAM  Limita los búferes de registros a TAM, p. ej. 8GB, volcando dispositivos a temp_dir si hace falta",
+	"  --compare FILE  Compare the processed records with an expected CSV output instead of writing outputs":        "  --compare ARCH  Compara los registros procesados con una salida CSV esperada en lugar de escribir salidas",
+	"  --compare-tolerance X      Absolute difference allowed between numbers with --compare (default: 1e-06)":      "  --compare-tolerance X      Diferencia absoluta permitida entre números con --compare (predeterminado: 1e-06)",
+	"  --compare-rel-tolerance X  Relative difference allowed between numbers with --compare (default: 0)":          "  --compare-rel-tolerance X  Diferencia relativa permitida entre números con --compare (predeterminado: 0)",
+	"  --lang LANG     Language of the console messages: en or es (default: from LC_ALL, LC_MESSAGES or LANG)":      "  --lang IDIOMA   Idioma de los mensajes de consola: en o es (predeterminado: según LC_ALL, LC_MESSAGES o LANG)",
+	"\nInput File Format:":                                                                      "\nFormato del archivo de entrada:",
+	"  - CSV file with header row containing column names":                                      "  - Archivo CSV con una fila de encabezado con los nombres de las columnas",
+	"  - Excel workbooks (.xlsx) are also accepted; the first sheet is read":                    "  - También se aceptan libros de Excel (.xlsx); se lee la primera hoja",
+	"  - Required columns: ID, latitude, longitude, timestamp":                                  "  - Columnas obligatorias: ID, latitud, longitud, marca de tiempo",
+	"  - Timestamps must be in RFC3339 format (e.g., 2023-03-01T12:00:00Z)":                     "  - Las marcas de tiempo deben estar en formato RFC3339 (p. ej., 2023-03-01T12:00:00Z)",
+	"\nConfiguration File:":                                                                     "\nArchivo de configuración:",
+	"  - YAML format with column mappings and processing parameters":                            "  - Formato YAML con la asignación de columnas y los parámetros de procesamiento",
+	"  - Custom column names can be specified for different CSV formats":                        "  - Se pueden indicar nombres de columna propios para distintos formatos CSV",
+	"  - A default config.yaml is created automatically if none exists":                         "  - Si no existe, se crea automáticamente un config.yaml predeterminado",
+	"  - If no YAML file exists, one will be created and processing will halt for review":       "  - Si no existe ningún archivo YAML, se crea uno y el procesamiento se detiene para revisarlo",
+	"  - If a single CSV and YAML file exist in the directory, they will be used automatically": "  - Si en el directorio hay un solo archivo CSV y un solo YAML, se usan automáticamente",
+	"  - Any value can be overridden with GPSPROC_* environment variables or --set":             "  - Cualquier valor se puede sustituir con variables de entorno GPSPROC_* o con --set",
+	"  - Precedence: defaults < config file < --profile < environment < --set < --format/--id":  "  - Precedencia: valores predeterminados < archivo de configuración < --profile < entorno < --set < --format/--id",
+	"\nOutput Files:": "\nArchivos de salida:",
+	"  - Formats are chosen with output.formats in the config or --format (default: csv, kml)":                                                         "  - Los formatos se eligen con output.formats en la configuración o con --format (predeterminado: csv, kml)",
+	"  - CSV file with calculated distances, speeds, and time differences":                                                                             "  - Archivo CSV con las distancias, velocidades y diferencias de tiempo calculadas",
+	"  - KML file for visualization in mapping applications":                                                                                           "  - Archivo KML para visualizar en aplicaciones de mapas",
+	"  - Excel workbook with records and per-device summary sheets (xlsx format)":                                                                      "  - Libro de Excel con los registros y hojas de resumen por dispositivo (formato xlsx)",
+	"  - Backwards time jump report (<input>_time_jumps.csv) when time_jumps is set":                                                                   "  - Informe de saltos de tiempo hacia atrás (<input>_time_jumps.csv) si se indica time_jumps",
+	"  - Route deviation report (<input>_deviations.csv) when planned routes are configured":                                                           "  - Informe de desvíos de ruta (<input>_deviations.csv) si hay rutas planificadas",
+	"  - Device encounter report (<input>_encounters.csv) when proximity_m is set":                                                                     "  - Informe de encuentros entre dispositivos (<input>_encounters.csv) si se indica proximity_m",
+	"  - Driving events report (<input>_events.csv) when a harsh_*_mps2 threshold is set":                                                              "  - Informe de eventos de conducción (<input>_events.csv) si se indica un umbral harsh_*_mps2",
+	"  - Per-device daily driver behavior scores (<input>_scores.csv) when behavior_scores is set":                                                     "  - Puntuaciones diarias de conducción por dispositivo (<input>_scores.csv) si se indica behavior_scores",
+	"  - Source and computed speed discrepancies (<input>_speed_discrepancies.csv) when speed_discrepancies is set":                                    "  - Discrepancias entre la velocidad de origen y la calculada (<input>_speed_discrepancies.csv) si se indica speed_discrepancies",
+	"  - Frozen position, straight line and teleport anomalies per device (<input>_anomalies.csv) when anomalies is set":                               "  - Anomalías de posición congelada, línea recta y teletransporte por dispositivo (<input>_anomalies.csv) si se indica anomalies",
+	"  - Fuel or energy estimates per day and trip (<input>_energy_daily.csv, <input>_energy_trips.csv) when energy.fuel is set":                       "  - Estimaciones de combustible o energía por día y viaje (<input>_energy_daily.csv, <input>_energy_trips.csv) si se indica energy.fuel",
+	"  - CO2 estimates per day and trip (<input>_co2_daily.csv, <input>_co2_trips.csv) when emissions.factors is set":                                  "  - Estimaciones de CO2 por día y viaje (<input>_co2_daily.csv, <input>_co2_trips.csv) si se indica emissions.factors",
+	"  - Trip summary with climb and descent (<input>_trips.csv) when trip_summary is set":                                                             "  - Resumen de viajes con ascenso y descenso (<input>_trips.csv) si se indica trip_summary",
+	"  - Trip origin-destination matrix (<input>_od_matrix.csv) when od_matrix is set":                                                                 "  - Matriz origen-destino de los viajes (<input>_od_matrix.csv) si se indica od_matrix",
+	"  - Alert report (<input>_alerts.csv) when alert rules are configured":                                                                            "  - Informe de alertas (<input>_alerts.csv) si hay reglas de alerta",
+	"  - KML network link (<input>_live.kml) that reloads the KML output when kml_refresh_seconds is set":                                              "  - Enlace de red KML (<input>_live.kml) que recarga la salida KML si se indica kml_refresh_seconds",
+	"  - KML regions of the tracks (<input>_kml_regions/doc.kml), loaded as Google Earth zooms in, when kml_regions is set":                            "  - Regiones KML de las trayectorias (<input>_kml_regions/doc.kml), que Google Earth carga al acercarse, si se indica kml_regions",
+	"  - Plot of the trajectories (<input>_plot.svg or .png) when plot is set":                                                                         "  - Gráfico de las trayectorias (<input>_plot.svg o .png) si se indica plot",
+	"  - Speed and elevation charts per device (<input>_charts/<ID>.svg) when charts is set":                                                           "  - Gráficas de velocidad y altitud por dispositivo (<input>_charts/<ID>.svg) si se indica charts",
+	"  - HTML report with summary, record audit, map and charts (<input>_report.html) when html_report is set":                                         "  - Informe HTML con resumen, auditoría de registros, mapa y gráficas (<input>_report.html) si se indica html_report",
+	"  - Vector tiles of the trajectories (<input>_tiles/{z}/{x}/{y}.pbf, or <input>_tiles.mbtiles with tile_format mbtiles) when vector_tiles is set": "  - Teselas vectoriales de las trayectorias (<input>_tiles/{z}/{x}/{y}.pbf, o <input>_tiles.mbtiles con tile_format mbtiles) si se indica vector_tiles",
+	"  - BigQuery schema (<input>_schema.json) for the ndjson output, which is loaded into bigquery.table when set":                                    "  - Esquema de BigQuery (<input>_schema.json) para la salida ndjson, que se carga en bigquery.table si se indica",
+	"  - Output manifest (<input>_manifest.json) with row counts and SHA-256 checksums when manifest is set":                                           "  - Manifiesto de salidas (<input>_manifest.json) con número de filas y sumas SHA-256 si se indica manifest",
+	"  - Updated devices list (<input>_updated_devices.csv) when updated_devices is set":                                                               "  - Lista de dispositivos actualizados (<input>_updated_devices.csv) si se indica updated_devices",
+	"  - Per-device daily or weekly totals (<input>_rollup_daily.csv, <input>_rollup_weekly.csv) when rollups are set":                                 "  - Totales diarios o semanales por dispositivo (<input>_rollup_daily.csv, <input>_rollup_weekly.csv) si se indica rollups",
+	"\nExit Codes:": "\nCódigos de salida:",
+	"  0 success, 1 unexpected error, 2 invalid arguments, 3 default config created,":         "  0 éxito, 1 error inesperado, 2 argumentos no válidos, 3 configuración predeterminada creada,",
+	"  4 invalid configuration, 5 input error, 6 no records after filtering, 7 output error,": "  4 configuración no válida, 5 error de entrada, 6 ningún registro tras el filtrado, 7 error de salida,",
+	"  8 output differs from the --compare file":                                              "  8 la salida difiere del archivo de --compare",
+	"\nExamples:": "\nEjemplos:",
+
+	// Run messages
+	"No configuration file found. Creating default config.yaml...":                                    "No se encontró ningún archivo de configuración. Creando config.yaml predeterminado...",
+	"✓ A new config.yaml file has been created.":                                                      "✓ Se ha creado un nuevo archivo config.yaml.",
+	"⚠ Please review the configuration file before running the tool again.":                           "⚠ Revise el archivo de configuración antes de volver a ejecutar la herramienta.",
+	"ℹ You can customize column names and processing parameters as needed.":                           "ℹ Puede adaptar los nombres de columna y los parámetros de procesamiento según sea necesario.",
+	"ℹ Or run 'gps-processor init' to create a config tailored to your data.":                         "ℹ O ejecute 'gps-processor init' para crear una configuración adaptada a sus datos.",
+	"ℹ Run the tool again after reviewing the configuration.":                                         "ℹ Vuelva a ejecutar la herramienta después de revisar la configuración.",
+	"Using configuration profile: %s":                                                                 "Usando el perfil de configuración: %s",
+	"=== GPS Data Processor ===":                                                                      "=== Procesador de datos GPS ===",
+	"Input file: %s":                                                                                  "Archivo de entrada: %s",
+	"Column mappings: ID='%s', Lat='%s', Lon='%s', Time='%s'":                                         "Columnas: ID='%s', Lat='%s', Lon='%s', Hora='%s'",
+	"Speed filter threshold: %.1f km/h":                                                               "Umbral del filtro de velocidad: %.1f km/h",
+	"Step 1: Reading input file...":                                                                   "Paso 1: Leyendo el archivo de entrada...",
+	"Steps 2-3: Grouping records by ID and calculating time differences and distances...":             "Pasos 2-3: Agrupando los registros por ID y calculando diferencias de tiempo y distancias...",
+	"Step 2: Grouping records by ID...":                                                               "Paso 2: Agrupando los registros por ID...",
+	"Step 3: Calculating time differences and distances...":                                           "Paso 3: Calculando diferencias de tiempo y distancias...",
+	"Step 4: Filtering records...":                                                                    "Paso 4: Filtrando registros...",
+	"Speed filter applied: Removed %d records with speed below %.1f km/h or their device's threshold": "Filtro de velocidad aplicado: se eliminaron %d registros con velocidad inferior a %.1f km/h o al umbral de su dispositivo",
+	"Speed filter applied: Removed %d records with speed below %.1f km/h":                             "Filtro de velocidad aplicado: se eliminaron %d registros con velocidad inferior a %.1f km/h",
+	"Filter expression applied: Removed %d records for which %s is false":                             "Expresión de filtro aplicada: se eliminaron %d registros para los que %s es falso",
+	"Filtered from %d to %d records":                                                                  "Filtrado de %d a %d registros",
+	"Step %d: Output %s already written before the interruption, skipping":                            "Paso %d: La salida %s ya se escribió antes de la interrupción, se omite",
+	"Step %d: Writing output %s file...":                                                              "Paso %d: Escribiendo el archivo de salida %s...",
+	"=== Processing Summary ===":                                                                      "=== Resumen del procesamiento ===",
+	"Total input records: %d":                                                                         "Registros de entrada: %d",
+	"Records after filtering: %d":                                                                     "Registros tras el filtrado: %d",
+	"Processing time: %.2f seconds":                                                                   "Tiempo de procesamiento: %.2f segundos",
+	"Warnings: %d (listed above)":                                                                     "Advertencias: %d (indicadas arriba)",
+	"%s output files: %d (one per device)":                                                            "Archivos de salida %s: %d (uno por dispositivo)",
+	"%s output file: %s":                                                                              "Archivo de salida %s: %s",
+	"No records remained after filtering":                                                             "No quedó ningún registro tras el filtrado",
+	"Warning: %s":                                                                                     "Advertencia: %s",
+
+	// Progress bars
+	"Processing GPS data":       "Procesando datos GPS",
+	"Filtering records":         "Filtrando registros",
+	"Reading Excel":             "Leyendo Excel",
+	"Writing output CSV":        "Escribiendo salida CSV",
+	"Writing output KML":        "Escribiendo salida KML",
+	"Writing output Excel":      "Escribiendo salida Excel",
+	"Writing output GeoJSONSeq": "Escribiendo salida GeoJSONSeq",
+	"Writing output NDJSON":     "Escribiendo salida NDJSON",
+	"Writing KML regions":       "Escribiendo regiones KML",
+	"Writing charts":            "Escribiendo gráficas",
+	"Writing vector tiles":      "Escribiendo teselas vectoriales",
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultMetadataIDColumn is the device ID column of the metadata file when none is configured
+const defaultMetadataIDColumn = "ID"
+
+// deviceMetadata holds the details of each device from metadata.file, such as its vehicle
+// type, driver or department
+type deviceMetadata struct {
+	columns []string            // metadata columns added to the outputs, in order
+	values  map[string][]string // values of the columns by device ID
+	label   []int               // indexes of the columns shown after the device ID in KML names
+}
+
+// loadMetadata reads metadata.file into config.metadata. Devices missing from the file get
+// empty values; devices listed twice are an error, since it is not clear which row applies.
+func loadMetadata(config *Config) error {
+	m := &config.Metadata
+	if m.File == "" {
+		if len(m.Columns) > 0 || len(m.LabelColumns) > 0 {
+			return fmt.Errorf("metadata.columns and metadata.label_columns require metadata.file")
+		}
+		return nil
+	}
+	file, err := os.Open(m.File)
+	if err != nil {
+		return fmt.Errorf("unable to open metadata file: %w", err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return fmt.Errorf("unable to read metadata file %s: %w", m.File, err)
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("metadata file %s is empty", m.File)
+	}
+	header := rows[0]
+	idColumn := m.IDColumn
+	if idColumn == "" {
+		idColumn = defaultMetadataIDColumn
+	}
+	position := make(map[string]int, len(header))
+	for i, name := range header {
+		position[strings.TrimSpace(name)] = i
+	}
+	idIndex, ok := position[idColumn]
+	if !ok {
+		return fmt.Errorf("metadata file %s has no %s column (set metadata.id_column)", m.File, idColumn)
+	}
+
+	// All columns but the ID by default
+	names := m.Columns
+	if len(names) == 0 {
+		for i, name := range header {
+			if i != idIndex {
+				names = append(names, strings.TrimSpace(name))
+			}
+		}
+	}
+	reserved := make(map[string]bool, len(availableColumns))
+	for _, column := range availableColumns {
+		reserved[column.Name] = true
+	}
+	indexes := make([]int, len(names))
+	for i, name := range names {
+		index, ok := position[name]
+		if !ok {
+			return fmt.Errorf("metadata column %q not found in %s", name, m.File)
+		}
+		if reserved[name] {
+			return fmt.Errorf("metadata column %q has the name of an output column", name)
+		}
+		indexes[i] = index
+	}
+
+	md := &deviceMetadata{columns: names, values: make(map[string][]string, len(rows)-1)}
+	for _, name := range m.LabelColumns {
+		found := false
+		for i, column := range names {
+			if column == name {
+				md.label = append(md.label, i)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("metadata.label_columns: %q is not one of the metadata columns", name)
+		}
+	}
+	for n, row := range rows[1:] {
+		id := strings.TrimSpace(row[idIndex])
+		if _, dup := md.values[id]; dup {
+			return fmt.Errorf("device %s is listed twice in metadata file %s (row %d)", id, m.File, n+2)
+		}
+		values := make([]string, len(indexes))
+		for i, index := range indexes {
+			values[i] = strings.TrimSpace(row[index])
+		}
+		md.values[id] = values
+	}
+	config.metadata = md
+	return nil
+}
+
+// value returns a metadata value of a device, or "" when the device is not in the file
+func (md *deviceMetadata) value(id string, column int) string {
+	if values, ok := md.values[id]; ok {
+		return values[column]
+	}
+	return ""
+}
+
+// deviceLabel names a device for people: its ID followed by the non-empty values of
+// metadata.label_columns, e.g. "1234 (Van, J. Smith)"
+func deviceLabel(id string, config *Config) string {
+	md := config.metadata
+	if md == nil || len(md.label) == 0 {
+		return id
+	}
+	var parts []string
+	for _, column := range md.label {
+		if v := md.value(id, column); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	if len(parts) == 0 {
+		return id
+	}
+	return id + " (" + strings.Join(parts, ", ") + ")"
+}
+
+// metadataColumns returns an output column per metadata column
+func metadataColumns(md *deviceMetadata) []outputColumn {
+	columns := make([]outputColumn, len(md.columns))
+	for i, name := range md.columns {
+		i := i
+		columns[i] = outputColumn{Name: name, Value: func(r *Record) string { return md.value(r.ID, i) }}
+	}
+	return columns
+}
+
+// rekey returns the metadata keyed by the new device IDs, for use after the IDs are
+// pseudonymized
+func (md *deviceMetadata) rekey(mapping map[string]string) *deviceMetadata {
+	rekeyed := *md
+	rekeyed.values = make(map[string][]string, len(mapping))
+	for id, name := range mapping {
+		if values, ok := md.values[id]; ok {
+			rekeyed.values[name] = values
+		}
+	}
+	return &rekeyed
+}
@@ -0,0 +1,228 @@
+// Package mvt encodes Mapbox Vector Tiles (version 2.1) with line geometries, enough to serve
+// GPS trajectories to web maps without a protobuf dependency.
+package mvt
+
+import (
+	"math"
+)
+
+// Extent is the number of integer coordinate units across a tile
+const Extent = 4096
+
+// Point is a position in tile coordinates, with (0, 0) at the top-left corner
+type Point struct {
+	X, Y int32
+}
+
+// Tag is a feature property; Value must be a string, an int, an int64 or a float64
+type Tag struct {
+	Key   string
+	Value interface{}
+}
+
+// Feature is a line or multi-line feature of a layer
+type Feature struct {
+	ID    uint64
+	Tags  []Tag
+	Lines [][]Point
+}
+
+// Layer is a named set of features in a tile
+type Layer struct {
+	Name     string
+	Features []Feature
+}
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+)
+
+// Geometry commands and the feature type of lines
+const (
+	commandMoveTo  = 1
+	commandLineTo  = 2
+	typeLineString = 2
+)
+
+// Encode returns the protobuf encoding of a tile holding the given layers. Layers without
+// features and lines with fewer than two distinct points are left out.
+func Encode(layers []Layer) []byte {
+	var tile []byte
+	for i := range layers {
+		if layer := encodeLayer(&layers[i]); layer != nil {
+			tile = appendBytes(tile, 3, layer)
+		}
+	}
+	return tile
+}
+
+// encodeLayer encodes a layer, or returns nil when none of its features has a geometry
+func encodeLayer(layer *Layer) []byte {
+	var keys []string
+	var values []interface{}
+	keyIndex := make(map[string]uint64)
+	valueIndex := make(map[interface{}]uint64)
+
+	var features []byte
+	for i := range layer.Features {
+		f := &layer.Features[i]
+		geometry := encodeGeometry(f.Lines)
+		if geometry == nil {
+			continue
+		}
+		var tags []uint64
+		for _, tag := range f.Tags {
+			value := normalizeValue(tag.Value)
+			if value == nil {
+				continue
+			}
+			k, ok := keyIndex[tag.Key]
+			if !ok {
+				k = uint64(len(keys))
+				keyIndex[tag.Key] = k
+				keys = append(keys, tag.Key)
+			}
+			v, ok := valueIndex[value]
+			if !ok {
+				v = uint64(len(values))
+				valueIndex[value] = v
+				values = append(values, value)
+			}
+			tags = append(tags, k, v)
+		}
+
+		var feature []byte
+		if f.ID != 0 {
+			feature = appendVarintField(feature, 1, f.ID)
+		}
+		if len(tags) > 0 {
+			feature = appendBytes(feature, 2, appendPacked(nil, tags))
+		}
+		feature = appendVarintField(feature, 3, typeLineString)
+		feature = appendBytes(feature, 4, appendPacked(nil, geometry))
+		features = appendBytes(features, 2, feature)
+	}
+	if features == nil {
+		return nil
+	}
+
+	var out []byte
+	out = appendVarintField(out, 15, 2)
+	out = appendBytes(out, 1, []byte(layer.Name))
+	out = append(out, features...)
+	for _, key := range keys {
+		out = appendBytes(out, 3, []byte(key))
+	}
+	for _, value := range values {
+		out = appendBytes(out, 4, encodeValue(value))
+	}
+	return appendVarintField(out, 5, Extent)
+}
+
+// normalizeValue converts a tag value to a comparable type, or returns nil for unsupported ones
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, int64, float64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return nil
+}
+
+// encodeValue encodes a layer value message
+func encodeValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return appendBytes(nil, 1, []byte(v))
+	case float64:
+		out := appendKey(nil, 3, wire64Bit)
+		bits := math.Float64bits(v)
+		for i := 0; i < 8; i++ {
+			out = append(out, byte(bits>>(8*i)))
+		}
+		return out
+	case int64:
+		return appendVarintField(nil, 6, zigzag(v))
+	}
+	return nil
+}
+
+// encodeGeometry encodes lines as MoveTo and LineTo commands with delta-coded coordinates.
+// Repeated points are skipped, and lines left with fewer than two points are dropped.
+func encodeGeometry(lines [][]Point) []uint64 {
+	var geometry []uint64
+	var cursor Point
+	for _, line := range lines {
+		points := make([]Point, 0, len(line))
+		for _, p := range line {
+			if len(points) == 0 || p != points[len(points)-1] {
+				points = append(points, p)
+			}
+		}
+		if len(points) < 2 {
+			continue
+		}
+		geometry = append(geometry, command(commandMoveTo, 1))
+		geometry = appendDelta(geometry, &cursor, points[0])
+		geometry = append(geometry, command(commandLineTo, len(points)-1))
+		for _, p := range points[1:] {
+			geometry = appendDelta(geometry, &cursor, p)
+		}
+	}
+	return geometry
+}
+
+// command returns a command integer
+func command(id, count int) uint64 {
+	return uint64(id&0x7 | count<<3)
+}
+
+// appendDelta appends the zigzag-encoded move from the cursor to p and advances the cursor
+func appendDelta(geometry []uint64, cursor *Point, p Point) []uint64 {
+	geometry = append(geometry, zigzag(int64(p.X-cursor.X)), zigzag(int64(p.Y-cursor.Y)))
+	*cursor = p
+	return geometry
+}
+
+// zigzag maps signed integers to unsigned ones so small magnitudes stay short
+func zigzag(n int64) uint64 {
+	return uint64((n << 1) ^ (n >> 63))
+}
+
+// appendKey appends a protobuf field key
+func appendKey(buf []byte, field, wireType int) []byte {
+	return appendVarint(buf, uint64(field<<3|wireType))
+}
+
+// appendVarint appends a base-128 varint
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// appendVarintField appends a varint field
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	return appendVarint(appendKey(buf, field, wireVarint), v)
+}
+
+// appendBytes appends a length-delimited field
+func appendBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendKey(buf, field, wireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// appendPacked appends the body of a packed repeated varint field
+func appendPacked(buf []byte, values []uint64) []byte {
+	for _, v := range values {
+		buf = appendVarint(buf, v)
+	}
+	return buf
+}
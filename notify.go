@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// notifier posts the run report to a webhook when the run ends
+type notifier struct {
+	url       string
+	slack     bool // post a Slack message instead of the report JSON
+	onFailure bool // only notify when the run fails
+}
+
+// newNotifier builds the notifier from the notify section, or returns nil when no webhook is configured
+func newNotifier(config *Config) (*notifier, error) {
+	n := &config.Notify
+	if n.WebhookURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(n.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid notify.webhook_url %q", n.WebhookURL)
+	}
+
+	result := &notifier{url: n.WebhookURL}
+	switch n.Format {
+	case "":
+		// Slack incoming webhooks only accept their own message format
+		result.slack = u.Host == "hooks.slack.com"
+	case "json":
+	case "slack":
+		result.slack = true
+	default:
+		return nil, fmt.Errorf("unknown notify.format %q (use json or slack)", n.Format)
+	}
+	switch n.On {
+	case "", "always":
+	case "failure":
+		result.onFailure = true
+	default:
+		return nil, fmt.Errorf("unknown notify.on %q (use always or failure)", n.On)
+	}
+	return result, nil
+}
+
+// send posts the finished report. Delivery problems are only warned about, since the run
+// has already ended.
+func (n *notifier) send(r *runReport) {
+	if n == nil || (n.onFailure && r.Status != "failed") {
+		return
+	}
+
+	var body []byte
+	var err error
+	if n.slack {
+		body, err = json.Marshal(map[string]string{"text": slackMessage(r)})
+	} else {
+		body, err = json.Marshal(r)
+	}
+	if err != nil {
+		logWarn("Unable to send notification: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logWarn("Unable to send notification: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logWarn("Notification webhook returned %s", resp.Status)
+		return
+	}
+	logDebug("Notification sent to %s", n.url)
+}
+
+// slackMessage summarizes a run report in one line of Slack text
+func slackMessage(r *runReport) string {
+	input := filepath.Base(r.InputFile)
+	if r.InputFile == "" {
+		input = "(no input)"
+	}
+	var b strings.Builder
+	switch r.Status {
+	case "failed":
+		fmt.Fprintf(&b, ":x: GPS processing of %s failed (exit code %d): %s", input, r.ExitCode, r.Error)
+	case "empty":
+		fmt.Fprintf(&b, ":warning: GPS processing of %s finished with no records after filtering", input)
+	default:
+		fmt.Fprintf(&b, ":white_check_mark: GPS processing of %s finished: %d output records", input, r.Counts["output_records"])
+	}
+	fmt.Fprintf(&b, " in %.1f seconds", r.DurationSeconds)
+	return b.String()
+}
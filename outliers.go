@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Defaults for the Hampel outlier filter
+const (
+	defaultOutlierWindow    = 3    // points on each side of the tested point
+	defaultOutlierThreshold = 3.0  // deviations from the median, in scaled MADs
+	defaultOutlierMinMeters = 20.0 // deviations smaller than this are never outliers
+)
+
+// metersPerDegree is the approximate length of one degree of latitude
+const metersPerDegree = 111320.0
+
+// madScale converts the median absolute deviation to a standard deviation estimate
+const madScale = 1.4826
+
+// outlierFilter detects single-point position spikes with a Hampel filter
+type outlierFilter struct {
+	remove    bool // remove outliers instead of flagging them
+	window    int
+	threshold float64
+	minMeters float64
+	devices   *ThresholdSet // per-device threshold and minMeters
+	removed   []Record      // outliers taken out by remove, in the order found
+}
+
+// newOutlierFilter builds the outlier filter from the configuration.
+// It returns nil when parameters.outlier_filter is off.
+func newOutlierFilter(config *Config) (*outlierFilter, error) {
+	p := &config.Parameters
+	f := &outlierFilter{
+		window:    p.OutlierWindow,
+		threshold: p.OutlierThreshold,
+		minMeters: p.OutlierMinMeters,
+		devices:   NewThresholdSet(config),
+	}
+	switch p.OutlierFilter {
+	case "", "off":
+		return nil, nil
+	case "flag":
+	case "remove":
+		f.remove = true
+	default:
+		return nil, fmt.Errorf("unknown outlier_filter %q (supported: off, flag, remove)", p.OutlierFilter)
+	}
+	if f.window == 0 {
+		f.window = defaultOutlierWindow
+	}
+	if f.threshold == 0 {
+		f.threshold = defaultOutlierThreshold
+	}
+	if f.minMeters == 0 {
+		f.minMeters = defaultOutlierMinMeters
+	}
+	if f.window < 1 || f.threshold < 0 || f.minMeters < 0 {
+		return nil, fmt.Errorf("invalid outlier filter settings (outlier_window must be at least 1, outlier_threshold and outlier_min_meters not negative)")
+	}
+	return f, nil
+}
+
+// apply flags or removes the outliers of a time-sorted group and returns the resulting group
+// and the number of outliers found. A point is an outlier when its latitude or longitude
+// deviates from the median of the surrounding window by more than threshold scaled MADs and
+// by more than minMeters, as configured for the device.
+func (f *outlierFilter) apply(id string, group []Record) ([]Record, int) {
+	if f == nil {
+		return group, 0
+	}
+	threshold, minMeters := f.threshold, f.minMeters
+	if o := f.devices.lookup(id); o != nil {
+		if o.OutlierThreshold != nil {
+			threshold = *o.OutlierThreshold
+		}
+		if o.OutlierMinMeters != nil {
+			minMeters = *o.OutlierMinMeters
+		}
+	}
+
+	outliers := make([]bool, len(group))
+	count := 0
+	lats := make([]float64, 0, 2*f.window+1)
+	lons := make([]float64, 0, 2*f.window+1)
+	for i := range group {
+		lo, hi := max(0, i-f.window), min(len(group), i+f.window+1)
+		lats, lons = lats[:0], lons[:0]
+		for j := lo; j < hi; j++ {
+			lats = append(lats, group[j].Latitude)
+			lons = append(lons, group[j].Longitude)
+		}
+		// Longitude degrees shrink with latitude; scale both axes to meters
+		lonScale := metersPerDegree * math.Cos(group[i].Latitude*math.Pi/180)
+		if isOutlier(group[i].Latitude, lats, metersPerDegree, threshold, minMeters) ||
+			isOutlier(group[i].Longitude, lons, lonScale, threshold, minMeters) {
+			outliers[i] = true
+			count++
+		}
+	}
+
+	if f.remove {
+		kept := group[:0]
+		for i := range group {
+			if !outliers[i] {
+				kept = append(kept, group[i])
+			} else {
+				f.removed = append(f.removed, group[i])
+			}
+		}
+		return kept, count
+	}
+	for i := range group {
+		group[i].Outlier = outliers[i]
+	}
+	return group, count
+}
+
+// isOutlier applies the Hampel test to one coordinate against the window values,
+// with scale converting degrees to meters
+func isOutlier(value float64, window []float64, scale, threshold, minMeters float64) bool {
+	median := medianOf(window)
+	deviations := make([]float64, len(window))
+	for i, v := range window {
+		deviations[i] = math.Abs(v - median)
+	}
+	mad := medianOf(deviations) * madScale * scale
+	deviation := math.Abs(value-median) * scale
+	return deviation > minMeters && deviation > threshold*mad
+}
+
+// medianOf returns the median of the values, reordering them
+func medianOf(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
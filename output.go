@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// outputFormat describes an output file type the processor can generate
+type outputFormat struct {
+	Name  string // format key used in config and on the command line, also the file extension
+	Label string // human-readable name used in console messages
+	Write func(filename string, records []Record, config *Config) error
+}
+
+// outputFormats lists the supported output formats in the order they are written
+var outputFormats = []outputFormat{
+	{Name: "csv", Label: "CSV", Write: writeOutputCSV},
+	{Name: "kml", Label: "KML", Write: writeOutputKML},
+	{Name: "xlsx", Label: "Excel", Write: writeOutputXLSX},
+	{Name: "geojsonseq", Label: "GeoJSONSeq", Write: writeOutputGeoJSONSeq},
+	{Name: "ndjson", Label: "NDJSON", Write: writeOutputNDJSON},
+}
+
+// defaultOutputFormats are written when neither the config nor the command line selects formats
+var defaultOutputFormats = []string{"csv", "kml"}
+
+// selectedOutputFormats resolves the configured format names to output formats.
+// The legacy output.excel setting adds xlsx to whatever else is selected.
+func selectedOutputFormats(config *Config) ([]outputFormat, error) {
+	names := config.Output.Formats
+	if len(names) == 0 {
+		names = defaultOutputFormats
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !isKnownOutputFormat(name) {
+			return nil, fmt.Errorf("unknown output format %q (supported: %s)", name, supportedOutputFormats())
+		}
+		wanted[name] = true
+	}
+	if config.Output.Excel {
+		wanted["xlsx"] = true
+	}
+
+	var selected []outputFormat
+	for _, format := range outputFormats {
+		if wanted[format.Name] {
+			selected = append(selected, format)
+		}
+	}
+	return selected, nil
+}
+
+// isKnownOutputFormat reports whether name is a supported output format
+func isKnownOutputFormat(name string) bool {
+	for _, format := range outputFormats {
+		if format.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedOutputFormats returns a comma-separated list of the supported format names
+func supportedOutputFormats() string {
+	names := make([]string, len(outputFormats))
+	for i, format := range outputFormats {
+		names[i] = format.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// writeOutputFormat writes records in the given format, either to a single file or to one
+// file per device when output.split_by_device is set, and returns the files written
+func writeOutputFormat(format outputFormat, inputFile string, records []Record, config *Config, runTime time.Time) ([]string, error) {
+	if !config.Output.SplitByDevice {
+		filename, err := writeAtomic(getOutputFilename(inputFile, format.Name, "", config, runTime), format.Name, len(records), config, func(tmp string) error {
+			return format.Write(tmp, records, config)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []string{filename}, nil
+	}
+
+	groups := groupByID(records)
+	ids := sortedIDs(groups)
+	names := deviceFileNames(ids, config)
+
+	files := make([]string, 0, len(ids))
+	for _, id := range ids {
+		filename, err := writeAtomic(getOutputFilename(inputFile, format.Name, names[id], config, runTime), format.Name, len(groups[id]), config, func(tmp string) error {
+			return format.Write(tmp, groups[id], config)
+		})
+		if err != nil {
+			return files, fmt.Errorf("device %s: %w", id, err)
+		}
+		files = append(files, filename)
+	}
+	return files, nil
+}
+
+// writeAtomic has write produce the file under a temporary name in the same directory and
+// renames it into place only once it is complete, so a crash or error mid-write never leaves
+// a partial file under the final name. An existing file is handled by output.if_exists; the
+// name actually written is returned. The file is added to the output manifest, if one is kept,
+// as the given kind of output with the given number of rows.
+func writeAtomic(filename, kind string, rows int, config *Config, write func(tmp string) error) (string, error) {
+	filename, err := resolveOutputPath(filename, config)
+	if err != nil {
+		return "", err
+	}
+
+	// Keep the extension last, since some writers choose the file type by it. A bare name has
+	// the directory ".", never "", which would put the temporary file in the system temp
+	// directory, possibly on another filesystem.
+	dir, base := filepath.Dir(filename), filepath.Base(filename)
+	ext := filepath.Ext(base)
+	file, err := os.CreateTemp(dir, "."+strings.TrimSuffix(base, ext)+".*.tmp"+ext)
+	if err != nil {
+		return "", fmt.Errorf("unable to create output file: %w", err)
+	}
+	tmp := file.Name()
+	file.Close()
+	// Temporary files are private by default; outputs are meant to be shared like before
+	_ = os.Chmod(tmp, 0644)
+
+	if err := write(tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("unable to move output file into place: %w", err)
+	}
+	config.manifest.add(filename, kind, rows)
+	return filename, nil
+}
+
+// checkOutputFilename validates output.filename: per-device files need {id} in their name
+func checkOutputFilename(config *Config) error {
+	if config.Output.SplitByDevice && config.Output.Filename != "" && !strings.Contains(config.Output.Filename, "{id}") {
+		return fmt.Errorf("output.filename must contain {id} when output.split_by_device is set")
+	}
+	return nil
+}
+
+// ifExistsPolicies are the values of output.if_exists
+var ifExistsPolicies = []string{"overwrite", "error", "prompt", "suffix"}
+
+// checkIfExists validates output.if_exists
+func checkIfExists(config *Config) error {
+	if config.Output.IfExists == "" {
+		return nil
+	}
+	for _, policy := range ifExistsPolicies {
+		if config.Output.IfExists == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output.if_exists %q (use %s)", config.Output.IfExists, strings.Join(ifExistsPolicies, ", "))
+}
+
+// resolveOutputPath applies output.if_exists to an output file that already exists. It returns
+// the name to write to: the same name when the file may be replaced, or a name with the run's
+// timestamp added under the suffix policy. Overwrites confirmed at a prompt are remembered.
+func resolveOutputPath(filename string, config *Config) (string, error) {
+	if _, err := os.Stat(filename); err != nil || config.overwriteApproved[filename] {
+		return filename, nil
+	}
+
+	switch config.Output.IfExists {
+	case "error":
+		return "", fmt.Errorf("%s already exists (remove it, use --overwrite, or set output.if_exists)", filename)
+	case "prompt":
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return "", fmt.Errorf("%s already exists and overwriting cannot be confirmed without a terminal (set output.if_exists)", filename)
+		}
+		fmt.Printf("%s already exists. Overwrite it? [y/N] ", filename)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			return "", fmt.Errorf("%s already exists and was not overwritten", filename)
+		}
+		if config.overwriteApproved == nil {
+			config.overwriteApproved = make(map[string]bool)
+		}
+		config.overwriteApproved[filename] = true
+		return filename, nil
+	case "suffix":
+		ext := filepath.Ext(filename)
+		stem := strings.TrimSuffix(filename, ext) + "_" + config.runTime.Format("20060102-150405")
+		candidate := stem + ext
+		for n := 2; ; n++ {
+			if _, err := os.Stat(candidate); err != nil {
+				return candidate, nil
+			}
+			candidate = fmt.Sprintf("%s_%d%s", stem, n, ext)
+		}
+	}
+	return filename, nil
+}
+
+// reportFilename returns the path of an additional report such as <basename>_deviations.csv,
+// written next to the other outputs
+func reportFilename(inputFile string, name string, config *Config) string {
+	ext := filepath.Ext(inputFile)
+	baseName := filepath.Base(inputFile[:len(inputFile)-len(ext)])
+	dir := config.Output.Directory
+	if dir == "" {
+		dir = filepath.Dir(inputFile)
+	}
+	return filepath.Join(dir, baseName+"_"+name+".csv")
+}
+
+// deviceFileNames returns the name used for each device ID in per-device filenames. IDs
+// that only differ in characters unsafe in filenames, or in case, which many filesystems
+// ignore, would share a file and overwrite each other; they get a short hash of the ID
+// added to tell them apart, with a warning.
+func deviceFileNames(ids []string, config *Config) map[string]string {
+	byName := make(map[string][]string, len(ids))
+	for _, id := range ids {
+		key := strings.ToLower(sanitizeFilename(id))
+		byName[key] = append(byName[key], id)
+	}
+	keys := make([]string, 0, len(byName))
+	for key := range byName {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	names := make(map[string]string, len(ids))
+	for _, key := range keys {
+		shared := byName[key]
+		if len(shared) == 1 {
+			names[shared[0]] = sanitizeFilename(shared[0])
+			continue
+		}
+		sort.Strings(shared)
+		if !config.sharedFileNames[key] {
+			if config.sharedFileNames == nil {
+				config.sharedFileNames = make(map[string]bool)
+			}
+			config.sharedFileNames[key] = true
+			logWarn("Devices %s share the file name %q; a hash of the ID is added to each", strings.Join(shared, ", "), key)
+		}
+		for _, id := range shared {
+			sum := sha256.Sum256([]byte(id))
+			names[id] = sanitizeFilename(id) + "_" + hex.EncodeToString(sum[:4])
+		}
+	}
+	return names
+}
+
+// sanitizeFilename replaces characters that are unsafe in filenames so device IDs can be used in paths
+func sanitizeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		if r < 32 {
+			return '_'
+		}
+		return r
+	}, name)
+}
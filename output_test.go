@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestCheckOutputFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		split    bool
+		filename string
+		wantErr  bool
+	}{
+		{name: "default name", split: true},
+		{name: "name with the device ID", split: true, filename: "{basename}_{id}.{format}"},
+		{name: "name without the device ID", split: true, filename: "{basename}.{format}", wantErr: true},
+		{name: "single file", filename: "{basename}.{format}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{}
+			config.Output.SplitByDevice, config.Output.Filename = tt.split, tt.filename
+			if err := checkOutputFilename(config); (err != nil) != tt.wantErr {
+				t.Errorf("checkOutputFilename() = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of environment variables that override config values
+const envPrefix = "GPSPROC_"
+
+// configSetting is a single overridable config value, addressed by its YAML path
+type configSetting struct {
+	Path  string        // dotted YAML path, e.g. parameters.filter_above_kph
+	Value reflect.Value // settable field inside the Config
+}
+
+// configSettings lists every leaf setting of the configuration by YAML path
+func configSettings(config *Config) []configSetting {
+	var settings []configSetting
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if !field.IsExported() || tag == "" || tag == "-" {
+				continue
+			}
+			// Profiles are selected with --profile rather than overridden value by value
+			if prefix == "" && tag == "profiles" {
+				continue
+			}
+			path := tag
+			if prefix != "" {
+				path = prefix + "." + tag
+			}
+			if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path)
+				continue
+			}
+			settings = append(settings, configSetting{Path: path, Value: v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(config).Elem(), "")
+	return settings
+}
+
+// setConfigValue sets the config value at the dotted YAML path, parsing value as YAML.
+// Lists may also be given as plain comma-separated values.
+func setConfigValue(config *Config, path string, value string) error {
+	for _, setting := range configSettings(config) {
+		if setting.Path != path {
+			continue
+		}
+		target := reflect.New(setting.Value.Type())
+		err := yaml.Unmarshal([]byte(value), target.Interface())
+		if err != nil && setting.Value.Kind() == reflect.Slice && setting.Value.Type().Elem().Kind() == reflect.String {
+			var list stringList
+			_ = list.Set(value)
+			target.Elem().Set(reflect.ValueOf([]string(list)))
+			err = nil
+		} else if err != nil && setting.Value.Kind() == reflect.Slice {
+			err = yaml.Unmarshal([]byte("["+value+"]"), target.Interface())
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, path, err)
+		}
+		setting.Value.Set(target.Elem())
+		return nil
+	}
+	return fmt.Errorf("unknown config setting %q", path)
+}
+
+// envNames returns the environment variable names for each setting path. Every setting can
+// be addressed as GPSPROC_<SECTION>_<KEY>; settings whose key is unique across sections can
+// also use the short form GPSPROC_<KEY>.
+func envNames(settings []configSetting) map[string][]string {
+	keyCount := make(map[string]int)
+	for _, setting := range settings {
+		keyCount[setting.Path[strings.LastIndex(setting.Path, ".")+1:]]++
+	}
+
+	names := make(map[string][]string)
+	for _, setting := range settings {
+		full := envPrefix + strings.ToUpper(strings.ReplaceAll(setting.Path, ".", "_"))
+		names[setting.Path] = append(names[setting.Path], full)
+		key := setting.Path[strings.LastIndex(setting.Path, ".")+1:]
+		if short := envPrefix + strings.ToUpper(key); keyCount[key] == 1 && short != full {
+			names[setting.Path] = append(names[setting.Path], short)
+		}
+	}
+	return names
+}
+
+// applyEnvOverrides applies GPSPROC_* environment variables to the config
+// and returns the names of the variables that were applied
+func applyEnvOverrides(config *Config) ([]string, error) {
+	settings := configSettings(config)
+	names := envNames(settings)
+
+	known := make(map[string]bool)
+	var applied []string
+	for _, setting := range settings {
+		for _, name := range names[setting.Path] {
+			known[name] = true
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			if err := setConfigValue(config, setting.Path, value); err != nil {
+				return applied, fmt.Errorf("%s: %w", name, err)
+			}
+			applied = append(applied, name)
+		}
+	}
+
+	// Catch typos in variable names, which would otherwise be silently ignored
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, envPrefix) && !known[name] {
+			logWarn("Unknown configuration environment variable %s", name)
+		}
+	}
+	sort.Strings(applied)
+	return applied, nil
+}
+
+// applySetOverrides applies --set path=value overrides to the config
+func applySetOverrides(config *Config, overrides []string) error {
+	for _, override := range overrides {
+		path, value, ok := strings.Cut(override, "=")
+		if !ok {
+			return fmt.Errorf("invalid --set %q (expected path=value)", override)
+		}
+		if err := setConfigValue(config, strings.TrimSpace(path), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Plot settings
+const (
+	defaultPlotWidth    = 1000
+	plotMargin          = 40           // pixels around the tracks
+	plotLegendRows      = 10           // devices listed in the legend
+	earthCircumference  = 40075016.686 // meters around the equator, for the scale bar
+	plotSpeedPercentile = 0.95         // speed at the top of the color scale, so spikes do not wash it out
+)
+
+// plotDeviceColors are the track colors of the plot, given to the devices in turn
+var plotDeviceColors = []color.RGBA{
+	{31, 119, 180, 255},
+	{255, 127, 14, 255},
+	{44, 160, 44, 255},
+	{214, 39, 40, 255},
+	{148, 103, 189, 255},
+	{140, 86, 75, 255},
+	{227, 119, 194, 255},
+	{127, 127, 127, 255},
+	{188, 189, 34, 255},
+	{23, 190, 207, 255},
+}
+
+// checkPlot validates output.plot, output.plot_color and output.plot_width
+func checkPlot(config *Config) error {
+	switch config.Output.Plot {
+	case "", "svg", "png":
+	default:
+		return fmt.Errorf("unknown output.plot %q (use svg or png)", config.Output.Plot)
+	}
+	switch config.Output.PlotColor {
+	case "", "device", "speed":
+	default:
+		return fmt.Errorf("unknown output.plot_color %q (use device or speed)", config.Output.PlotColor)
+	}
+	if w := config.Output.PlotWidth; w != 0 && (w < 200 || w > 10000) {
+		return fmt.Errorf("output.plot_width must be between 200 and 10000 pixels")
+	}
+	return nil
+}
+
+// plotFilename returns the path of the plot, <basename>_plot.svg or .png next to the outputs
+func plotFilename(inputFile string, config *Config) string {
+	return strings.TrimSuffix(reportFilename(inputFile, "plot", config), ".csv") + "." + config.Output.Plot
+}
+
+// plotCanvas is what the plot is drawn on: an SVG document or a PNG image
+type plotCanvas interface {
+	polyline(x, y []float64, c color.RGBA, width float64)
+	rect(x, y, w, h float64, c color.RGBA)
+	text(x, y float64, s string, c color.RGBA)
+}
+
+// plotTrack is one device's time-sorted track in plot pixels, with the speed at each point
+type plotTrack struct {
+	ID    string
+	X, Y  []float64
+	Speed []float64
+}
+
+// writePlot draws the trajectories, colored by device or by speed, with a legend and a scale
+// bar, as an SVG or PNG quick-look figure. Outliers are left out.
+func writePlot(filename string, records []Record, config *Config) error {
+	width := config.Output.PlotWidth
+	if width == 0 {
+		width = defaultPlotWidth
+	}
+	if config.Output.Plot == "png" {
+		img := newPNGCanvas(width, width*3/4)
+		drawPlot(img, records, width, config)
+		file, err := os.Create(filename)
+		if err != nil {
+			return fmt.Errorf("unable to create plot: %w", err)
+		}
+		defer file.Close()
+		return png.Encode(file, img.img)
+	}
+	if err := os.WriteFile(filename, []byte(plotSVG(records, width, config)), 0644); err != nil {
+		return fmt.Errorf("unable to write plot: %w", err)
+	}
+	return nil
+}
+
+// plotSVG returns the plot as an SVG document
+func plotSVG(records []Record, width int, config *Config) string {
+	var svg svgCanvas
+	drawPlot(&svg, records, width, config)
+	height := width * 3 / 4
+	var b strings.Builder
+	fmt.Fprintf(&b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" font-family=\"sans-serif\" font-size=\"12\">\n", width, height, width, height)
+	b.WriteString(svg.body.String())
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// drawPlot draws the plot, width pixels wide and 3/4 of that high, on the canvas
+func drawPlot(canvas plotCanvas, records []Record, width int, config *Config) {
+	height := width * 3 / 4
+	tracks, metersPerPixel := plotTracks(records, width, height)
+	canvas.rect(0, 0, float64(width), float64(height), color.RGBA{255, 255, 255, 255})
+
+	black := color.RGBA{0, 0, 0, 255}
+	if config.Output.PlotColor == "speed" {
+		top := plotSpeedScale(tracks)
+		for _, t := range tracks {
+			for i := 1; i < len(t.X); i++ {
+				canvas.polyline(t.X[i-1:i+1], t.Y[i-1:i+1], speedColor(t.Speed[i]/top), 2)
+			}
+		}
+		// Color ramp from 0 to the top speed
+		for i := 0; i < 100; i++ {
+			canvas.rect(float64(width-plotMargin-100+i), 20, 1, 10, speedColor(float64(i)/99))
+		}
+		canvas.text(float64(width-plotMargin-100), 45, "0", black)
+		canvas.text(float64(width-plotMargin-60), 45, fmt.Sprintf("%.0f km/h", top), black)
+	} else {
+		for i, t := range tracks {
+			canvas.polyline(t.X, t.Y, plotDeviceColors[i%len(plotDeviceColors)], 2)
+		}
+		for i, t := range tracks {
+			y := float64(20 + 16*i)
+			if i == plotLegendRows {
+				canvas.text(float64(width-plotMargin-120), y+9, fmt.Sprintf("+%d more", len(tracks)-i), black)
+				break
+			}
+			canvas.rect(float64(width-plotMargin-120), y, 10, 10, plotDeviceColors[i%len(plotDeviceColors)])
+			canvas.text(float64(width-plotMargin-104), y+9, deviceLabel(t.ID, config), black)
+		}
+	}
+
+	if metersPerPixel > 0 {
+		meters := niceLength(metersPerPixel * float64(width) / 5)
+		length := meters / metersPerPixel
+		x, y := float64(plotMargin), float64(height-plotMargin/2)
+		canvas.rect(x, y-2, length, 4, black)
+		label := fmt.Sprintf("%g m", meters)
+		if meters >= 1000 {
+			label = fmt.Sprintf("%g km", meters/1000)
+		}
+		canvas.text(x, y-8, label, black)
+	}
+}
+
+// plotTracks projects the tracks to web mercator and fits them into the plot, keeping their
+// shape. It also returns the meters a pixel covers in the middle of the plot.
+func plotTracks(records []Record, width, height int) ([]plotTrack, float64) {
+	groups := groupByID(records)
+	var tracks []plotTrack
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, id := range sortedIDs(groups) {
+		group := groups[id]
+		sortByTime(group)
+		t := plotTrack{ID: id}
+		for i := range group {
+			r := &group[i]
+			if r.Outlier {
+				continue
+			}
+			x, y := mercator(r.Latitude, r.Longitude)
+			t.X = append(t.X, x)
+			t.Y = append(t.Y, y)
+			t.Speed = append(t.Speed, r.Speed)
+			minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+			minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+		}
+		if len(t.X) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil, 0
+	}
+
+	// A single point, or points in a straight line, still need an area to fit (1e-7 is about 4 m)
+	scale := math.Min(float64(width-2*plotMargin)/math.Max(maxX-minX, 1e-7), float64(height-2*plotMargin)/math.Max(maxY-minY, 1e-7))
+	offsetX := (float64(width) - (maxX-minX)*scale) / 2
+	offsetY := (float64(height) - (maxY-minY)*scale) / 2
+	for i := range tracks {
+		t := &tracks[i]
+		for j := range t.X {
+			t.X[j] = offsetX + (t.X[j]-minX)*scale
+			t.Y[j] = offsetY + (t.Y[j]-minY)*scale
+		}
+	}
+	lat, _ := unmercator(0, (minY+maxY)/2)
+	return tracks, earthCircumference * math.Cos(lat*math.Pi/180) / scale
+}
+
+// plotSpeedScale returns the speed at the top of the color scale
+func plotSpeedScale(tracks []plotTrack) float64 {
+	var speeds []float64
+	for _, t := range tracks {
+		speeds = append(speeds, t.Speed[1:]...)
+	}
+	if len(speeds) == 0 {
+		return 1
+	}
+	sort.Float64s(speeds)
+	top := speeds[int(float64(len(speeds)-1)*plotSpeedPercentile)]
+	if top <= 0 {
+		return 1
+	}
+	return top
+}
+
+// speedColor returns the color of a speed as a fraction of the top of the scale, from blue
+// through green and yellow to red
+func speedColor(f float64) color.RGBA {
+	f = math.Max(0, math.Min(1, f))
+	stops := []color.RGBA{{43, 131, 186, 255}, {171, 221, 164, 255}, {253, 174, 97, 255}, {215, 25, 28, 255}}
+	pos := f * float64(len(stops)-1)
+	i := int(math.Min(pos, float64(len(stops)-2)))
+	t := pos - float64(i)
+	mix := func(a, b uint8) uint8 { return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5) }
+	return color.RGBA{mix(stops[i].R, stops[i+1].R), mix(stops[i].G, stops[i+1].G), mix(stops[i].B, stops[i+1].B), 255}
+}
+
+// niceLength rounds a length in meters down to 1, 2 or 5 times a power of ten
+func niceLength(meters float64) float64 {
+	if meters <= 0 {
+		return 1
+	}
+	power := math.Pow(10, math.Floor(math.Log10(meters)))
+	for _, step := range []float64{5, 2, 1} {
+		if step*power <= meters {
+			return step * power
+		}
+	}
+	return power
+}
+
+// svgCanvas collects the SVG elements of the plot
+type svgCanvas struct {
+	body strings.Builder
+}
+
+func (c *svgCanvas) polyline(x, y []float64, col color.RGBA, width float64) {
+	if len(x) < 2 {
+		return
+	}
+	points := make([]string, len(x))
+	for i := range x {
+		points[i] = strconv.FormatFloat(x[i], 'f', 1, 64) + "," + strconv.FormatFloat(y[i], 'f', 1, 64)
+	}
+	fmt.Fprintf(&c.body, "<polyline fill=\"none\" stroke=\"%s\" stroke-width=\"%g\" stroke-linejoin=\"round\" points=\"%s\"/>\n",
+		svgColor(col), width, strings.Join(points, " "))
+}
+
+func (c *svgCanvas) rect(x, y, w, h float64, col color.RGBA) {
+	fmt.Fprintf(&c.body, "<rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" fill=\"%s\"/>\n", x, y, w, h, svgColor(col))
+}
+
+func (c *svgCanvas) text(x, y float64, s string, col color.RGBA) {
+	fmt.Fprintf(&c.body, "<text x=\"%.1f\" y=\"%.1f\" fill=\"%s\">%s</text>\n", x, y, svgColor(col), html.EscapeString(s))
+}
+
+// svgColor formats a color as #rrggbb
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// pngCanvas draws the plot on an image
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func newPNGCanvas(width, height int) *pngCanvas {
+	return &pngCanvas{img: image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+// polyline draws the line by stamping a square of the line width every half pixel along it
+func (c *pngCanvas) polyline(x, y []float64, col color.RGBA, width float64) {
+	half := width / 2
+	for i := 1; i < len(x); i++ {
+		steps := int(math.Ceil(math.Hypot(x[i]-x[i-1], y[i]-y[i-1])*2)) + 1
+		for s := 0; s <= steps; s++ {
+			t := float64(s) / float64(steps)
+			px, py := x[i-1]+(x[i]-x[i-1])*t, y[i-1]+(y[i]-y[i-1])*t
+			c.rect(px-half, py-half, width, width, col)
+		}
+	}
+}
+
+func (c *pngCanvas) rect(x, y, w, h float64, col color.RGBA) {
+	r := image.Rect(int(math.Round(x)), int(math.Round(y)), int(math.Round(x+w)), int(math.Round(y+h)))
+	draw.Draw(c.img, r, image.NewUniform(col), image.Point{}, draw.Src)
+}
+
+func (c *pngCanvas) text(x, y float64, s string, col color.RGBA) {
+	d := &font.Drawer{Dst: c.img, Src: image.NewUniform(col), Face: basicfont.Face7x13,
+		Dot: fixed.P(int(x), int(y))}
+	d.DrawString(s)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"gps-processor/haversine"
+)
+
+// Privacy defaults
+const (
+	defaultHomeRadiusM = 200
+	hashedIDLength     = 16 // hex characters kept of a hashed device ID
+)
+
+// SensitiveZone is an area, such as a home or workplace, whose points are removed or fuzzed
+type SensitiveZone struct {
+	Name    string       `yaml:"name"`
+	Polygon [][2]float64 `yaml:"polygon"` // [longitude, latitude] positions of the boundary, as in GeoJSON
+}
+
+// checkPrivacy validates the privacy section
+func checkPrivacy(config *Config) error {
+	p := &config.Privacy
+	switch p.IDs {
+	case "":
+		if p.MappingFile != "" {
+			return fmt.Errorf("privacy.mapping_file requires privacy.ids")
+		}
+	case "hash":
+		// An unsalted hash of a known ID can be recomputed by anyone
+		if p.Salt == "" {
+			return fmt.Errorf("privacy.ids hash requires privacy.salt (or GPSPROC_PRIVACY_SALT)")
+		}
+	case "sequential":
+	default:
+		return fmt.Errorf("unknown privacy.ids %q (use hash or sequential)", p.IDs)
+	}
+	if p.CoordinateDecimals < 0 || p.CoordinateDecimals > 8 {
+		return fmt.Errorf("privacy.coordinate_decimals must be between 1 and 8 (0 = unchanged)")
+	}
+	if len(p.HomeLocations) > 0 && p.HomeRadiusM <= 0 {
+		return fmt.Errorf("privacy.home_radius_m must be positive")
+	}
+	for _, home := range p.HomeLocations {
+		if home.Latitude < -90 || home.Latitude > 90 || home.Longitude < -180 || home.Longitude > 180 {
+			return fmt.Errorf("privacy home location %q is not a valid latitude and longitude", home.Name)
+		}
+	}
+	for i, zone := range p.SensitiveZones {
+		if len(zone.Polygon) < 3 {
+			return fmt.Errorf("sensitive zone %d (%s) needs at least three positions", i+1, zone.Name)
+		}
+		for _, pos := range zone.Polygon {
+			if pos[1] < -90 || pos[1] > 90 || pos[0] < -180 || pos[0] > 180 {
+				return fmt.Errorf("sensitive zone %d (%s) has an invalid position %v; positions are [longitude, latitude]", i+1, zone.Name, pos)
+			}
+		}
+	}
+	switch p.SensitiveAction {
+	case "", "remove", "fuzz":
+	default:
+		return fmt.Errorf("unknown privacy.sensitive_action %q (use remove or fuzz)", p.SensitiveAction)
+	}
+	if p.SensitiveFuzzM < 0 {
+		return fmt.Errorf("privacy.sensitive_fuzz_m must not be negative")
+	}
+	if p.TimeShiftDays < 0 {
+		return fmt.Errorf("privacy.time_shift_days must not be negative")
+	}
+	if p.TimeShiftWholeDays && p.TimeShiftDays > 0 && p.TimeShiftDays < 1 {
+		return fmt.Errorf("privacy.time_shift_whole_days needs a time_shift_days of at least 1")
+	}
+	return nil
+}
+
+// loadSensitiveZones returns the zones of privacy.sensitive_zones and
+// privacy.sensitive_zones_file, or nil when there are none
+func loadSensitiveZones(config *Config) (*zoneSet, error) {
+	p := &config.Privacy
+	if p.SensitiveZonesFile == "" && len(p.SensitiveZones) == 0 {
+		return nil, nil
+	}
+	zs := &zoneSet{}
+	if p.SensitiveZonesFile != "" {
+		var err error
+		if zs, err = loadZones(p.SensitiveZonesFile); err != nil {
+			return nil, fmt.Errorf("privacy.sensitive_zones_file: %w", err)
+		}
+	}
+	for i, zone := range p.SensitiveZones {
+		name := zone.Name
+		if name == "" {
+			name = fmt.Sprintf("sensitive_%d", i+1)
+		}
+		zs.add(name, [][][][2]float64{{zone.Polygon}})
+	}
+	zs.build()
+	return zs, nil
+}
+
+// cloakSensitiveZones removes the points inside the sensitive zones or, with
+// privacy.sensitive_action fuzz, moves them all to one spot drawn at random within
+// privacy.sensitive_fuzz_m of the zone's center, so the time spent in the zone remains but
+// not where in it. It runs before distances are calculated and returns the remaining
+// records and how many points were removed and fuzzed.
+func cloakSensitiveZones(records []Record, zones *zoneSet, config *Config) ([]Record, int, int) {
+	fuzz := config.Privacy.SensitiveAction == "fuzz"
+	spots := make(map[int][2]float64)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	kept := records[:0]
+	removed, fuzzed := 0, 0
+	for _, record := range records {
+		zone := zones.zoneAt(record.Latitude, record.Longitude)
+		if zone < 0 {
+			kept = append(kept, record)
+			continue
+		}
+		if !fuzz {
+			removed++
+			continue
+		}
+		spot, ok := spots[zone]
+		if !ok {
+			// A new spot each run, uniformly spread over the disc around the center
+			lat, lon := zones.center(zone)
+			r := config.Privacy.SensitiveFuzzM / 1000 * math.Sqrt(rng.Float64())
+			angle := rng.Float64() * 2 * math.Pi
+			lat += r / 111.32 * math.Cos(angle)
+			lon += r / (111.32 * math.Cos(lat*math.Pi/180)) * math.Sin(angle)
+			spot = [2]float64{lat, lon}
+			spots[zone] = spot
+		}
+		record.Latitude, record.Longitude = spot[0], spot[1]
+		record.HasAltitude = false
+		kept = append(kept, record)
+		fuzzed++
+	}
+	return kept, removed, fuzzed
+}
+
+// removeHomePoints drops the points within privacy.home_radius_m of a home location and
+// returns the remaining records and how many were dropped. It runs before distances are
+// calculated, so no kept point refers back to a dropped one.
+func removeHomePoints(records []Record, config *Config) ([]Record, int) {
+	homes := config.Privacy.HomeLocations
+	if len(homes) == 0 {
+		return records, 0
+	}
+	radiusKm := config.Privacy.HomeRadiusM / 1000
+	kept := records[:0]
+	for _, record := range records {
+		near := false
+		for _, home := range homes {
+			if haversine.Distance(record.Latitude, record.Longitude, home.Latitude, home.Longitude) <= radiusKm {
+				near = true
+				break
+			}
+		}
+		if !near {
+			kept = append(kept, record)
+		}
+	}
+	return kept, len(records) - len(kept)
+}
+
+// shiftTimestamps moves each device's timestamps by its own offset of up to
+// privacy.time_shift_days either way, keeping the intervals between its points. With a salt,
+// the offset is derived from it and the device ID, so a device is shifted the same way in
+// every run; without one, offsets are drawn anew each run. It returns the number of devices.
+func shiftTimestamps(records []Record, config *Config) int {
+	p := &config.Privacy
+	maxShift := p.TimeShiftDays * 24 * float64(time.Hour)
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	offsets := make(map[string]time.Duration)
+	for i := range records {
+		id := records[i].ID
+		offset, ok := offsets[id]
+		if !ok {
+			u := rng.Float64()
+			if p.Salt != "" {
+				mac := hmac.New(sha256.New, []byte(p.Salt))
+				mac.Write([]byte("time_shift:" + id))
+				u = float64(binary.BigEndian.Uint64(mac.Sum(nil))>>11) / (1 << 53)
+			}
+			offset = time.Duration((2*u - 1) * maxShift)
+			if p.TimeShiftWholeDays {
+				offset = offset.Round(24 * time.Hour)
+			} else {
+				offset = offset.Round(time.Second)
+			}
+			offsets[id] = offset
+		}
+		records[i].Timestamp = records[i].Timestamp.Add(offset)
+	}
+	return len(offsets)
+}
+
+// pseudonymizer replaces device IDs by salted hashes or sequential names
+type pseudonymizer struct {
+	mode    string
+	salt    []byte
+	mapping map[string]string
+}
+
+// pseudonym returns the replacement of a device ID
+func (p *pseudonymizer) pseudonym(id string) string {
+	if name, ok := p.mapping[id]; ok {
+		return name
+	}
+	var name string
+	if p.mode == "hash" {
+		mac := hmac.New(sha256.New, p.salt)
+		mac.Write([]byte(id))
+		name = hex.EncodeToString(mac.Sum(nil))[:hashedIDLength]
+	} else {
+		name = fmt.Sprintf("device-%04d", len(p.mapping)+1)
+	}
+	p.mapping[id] = name
+	return name
+}
+
+// applyPrivacy replaces the device IDs and truncates the coordinates of the processed
+// records, as configured in the privacy section, and does the same to the records kept for
+// the KML filtered layer. Settings keyed by device ID that are used after processing are
+// rekeyed to the new IDs. It returns the original and new IDs, sorted by original ID.
+func applyPrivacy(records []Record, config *Config) [][2]string {
+	p := &config.Privacy
+	var ids *pseudonymizer
+	if p.IDs != "" {
+		ids = &pseudonymizer{mode: p.IDs, salt: []byte(p.Salt), mapping: make(map[string]string)}
+		// Sequential names follow the order of the original IDs, not the order of the records
+		for _, id := range sortedRecordIDs(records) {
+			ids.pseudonym(id)
+		}
+	}
+	anonymize := func(r *Record) {
+		if ids != nil {
+			r.ID = ids.pseudonym(r.ID)
+		}
+		if p.CoordinateDecimals > 0 {
+			truncateCoordinates(r, p.CoordinateDecimals)
+		}
+	}
+	for i := range records {
+		anonymize(&records[i])
+	}
+	for i := range config.discarded {
+		anonymize(&config.discarded[i].Record)
+	}
+	if ids == nil {
+		return nil
+	}
+
+	if classes := config.Emissions.Classes; len(classes) > 0 {
+		config.Emissions.Classes = make(map[string]string, len(classes))
+		for id, class := range classes {
+			if name, ok := ids.mapping[id]; ok {
+				config.Emissions.Classes[name] = class
+			}
+		}
+	}
+	if config.metadata != nil {
+		config.metadata = config.metadata.rekey(ids.mapping)
+	}
+	if len(config.Parameters.DeviceThresholds) > 0 {
+		config.Parameters.DeviceThresholds = NewThresholdSet(config).rekey(ids.mapping)
+	}
+	mapping := make([][2]string, 0, len(ids.mapping))
+	for id, name := range ids.mapping {
+		mapping = append(mapping, [2]string{id, name})
+	}
+	sort.Slice(mapping, func(i, j int) bool { return mapping[i][0] < mapping[j][0] })
+	return mapping
+}
+
+// sortedRecordIDs returns the distinct device IDs of the records, sorted
+func sortedRecordIDs(records []Record) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for i := range records {
+		if !seen[records[i].ID] {
+			seen[records[i].ID] = true
+			ids = append(ids, records[i].ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// truncateCoordinates cuts the coordinates of a record and of its previous point to the
+// given number of decimals. Projected coordinates are rounded to a grid of about the same
+// size, 10^(5-decimals) meters.
+func truncateCoordinates(r *Record, decimals int) {
+	scale := math.Pow(10, float64(decimals))
+	cut := func(v float64) float64 { return math.Trunc(v*scale) / scale }
+	r.Latitude, r.Longitude = cut(r.Latitude), cut(r.Longitude)
+	if r.PreviousRow > 0 {
+		r.PrevLatitude, r.PrevLongitude = cut(r.PrevLatitude), cut(r.PrevLongitude)
+	}
+	grid := math.Pow(10, float64(5-decimals))
+	r.Easting = math.Round(r.Easting/grid) * grid
+	r.Northing = math.Round(r.Northing/grid) * grid
+}
+
+// writeIDMapping writes the original and replaced device IDs to a CSV file that only the
+// owner can read, since it undoes the pseudonymization
+func writeIDMapping(filename string, mapping [][2]string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create ID mapping file: %w", err)
+	}
+	w := csv.NewWriter(file)
+	_ = w.Write([]string{"original_id", "pseudonym"})
+	for _, pair := range mapping {
+		_ = w.Write(pair[:])
+	}
+	w.Flush()
+	err = w.Error()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write ID mapping file: %w", err)
+	}
+	return nil
+}
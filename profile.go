@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// profiler writes the pprof CPU and heap profiles requested with --cpu-profile and
+// --mem-profile
+type profiler struct {
+	cpu     *os.File
+	memPath string
+}
+
+// startProfiles starts CPU profiling if cpuPath is set; the heap profile is written to
+// memPath when the profiles are stopped. It returns nil when neither is requested.
+func startProfiles(cpuPath, memPath string) (*profiler, error) {
+	if cpuPath == "" && memPath == "" {
+		return nil, nil
+	}
+	p := &profiler{memPath: memPath}
+	if cpuPath != "" {
+		file, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("unable to start CPU profile: %w", err)
+		}
+		p.cpu = file
+	}
+	return p, nil
+}
+
+// stop ends CPU profiling and writes the heap profile
+func (p *profiler) stop() {
+	if p == nil {
+		return
+	}
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		if err := p.cpu.Close(); err != nil {
+			logWarn("Unable to write CPU profile: %v", err)
+		}
+		p.cpu = nil
+	}
+	if p.memPath != "" {
+		file, err := os.Create(p.memPath)
+		if err == nil {
+			// Collect first, so the profile shows the memory still in use
+			runtime.GC()
+			err = pprof.WriteHeapProfile(file)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			logWarn("Unable to write memory profile: %v", err)
+		}
+		p.memPath = ""
+	}
+}
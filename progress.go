@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// progressMode controls how long-running steps report progress:
+// "bar" (interactive progress bars), "text" or "json" (periodic log lines), or "none"
+var progressMode = "bar"
+
+// barActive is set while an interactive progress bar is being drawn
+var barActive bool
+
+// progressLogInterval is how often log-based progress reporters emit a line
+const progressLogInterval = 5 * time.Second
+
+// ProgressReporter tracks progress of a single processing step
+type ProgressReporter interface {
+	// Add records that n more items were processed
+	Add(n int) error
+	// Finish ends the step, terminating the bar or logging a final line
+	Finish()
+}
+
+// newProgress creates a progress reporter for a step with the given total item count.
+// A negative total means the count is not known in advance.
+func newProgress(description string, total int) ProgressReporter {
+	description = translate(description)
+	switch progressMode {
+	case "none":
+		return NoProgress{}
+	case "text", "json":
+		now := time.Now()
+		return &logProgress{
+			description: description,
+			total:       total,
+			json:        progressMode == "json",
+			start:       now,
+			lastLog:     now,
+		}
+	}
+
+	if total < 0 {
+		// The row count is not known up front, so show an indeterminate spinner
+		return &barProgress{progressbar.NewOptions(
+			-1,
+			progressbar.OptionSetDescription(description),
+			progressbar.OptionShowCount(),
+		)}
+	}
+	return &barProgress{progressbar.NewOptions(
+		total,
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetTheme(progressbar.Theme{
+			Saucer:        "=",
+			SaucerHead:    ">",
+			SaucerPadding: " ",
+			BarStart:      "[",
+			BarEnd:        "]",
+		}),
+	)}
+}
+
+// newByteProgress creates a progress reporter for a step measured in bytes, such as
+// reading a file whose size is known but whose row count is not
+func newByteProgress(description string, totalBytes int64) ProgressReporter {
+	switch progressMode {
+	case "none":
+		return NoProgress{}
+	case "text", "json":
+		now := time.Now()
+		return &logProgress{
+			description: description,
+			total:       int(totalBytes),
+			bytes:       true,
+			json:        progressMode == "json",
+			start:       now,
+			lastLog:     now,
+		}
+	}
+
+	return &barProgress{progressbar.NewOptions64(
+		totalBytes,
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetTheme(progressbar.Theme{
+			Saucer:        "=",
+			SaucerHead:    ">",
+			SaucerPadding: " ",
+			BarStart:      "[",
+			BarEnd:        "]",
+		}),
+	)}
+}
+
+// barProgress shows an interactive progress bar on the terminal
+type barProgress struct {
+	bar *progressbar.ProgressBar
+}
+
+func (p *barProgress) Add(n int) error {
+	barActive = true
+	return p.bar.Add(n)
+}
+
+func (p *barProgress) Finish() {
+	barActive = false
+	fmt.Println() // Add newline after progress bar
+}
+
+// NoProgress discards all progress updates
+type NoProgress struct{}
+
+func (NoProgress) Add(int) error { return nil }
+func (NoProgress) Finish()       {}
+
+// logProgress writes periodic progress lines suitable for log collectors
+type logProgress struct {
+	description string
+	total       int
+	bytes       bool // done and total count bytes rather than items
+	json        bool
+	done        int
+	start       time.Time
+	lastLog     time.Time
+}
+
+func (p *logProgress) Add(n int) error {
+	p.done += n
+	if now := time.Now(); now.Sub(p.lastLog) >= progressLogInterval {
+		p.lastLog = now
+		p.log("progress")
+	}
+	return nil
+}
+
+func (p *logProgress) Finish() {
+	p.log("done")
+}
+
+// log writes a single progress line with counts, throughput and estimated time remaining
+func (p *logProgress) log(event string) {
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+	eta := -1.0
+	if p.total >= 0 && rate > 0 {
+		eta = float64(p.total-p.done) / rate
+	}
+
+	if p.json {
+		line := map[string]interface{}{
+			"time":         time.Now().Format(time.RFC3339),
+			"event":        event,
+			"step":         p.description,
+			"done":         p.done,
+			"rate_per_sec": rate,
+		}
+		if p.total >= 0 {
+			line["total"] = p.total
+		}
+		if eta >= 0 {
+			line["eta_seconds"] = eta
+		}
+		if p.bytes {
+			line["unit"] = "bytes"
+		}
+		data, _ := json.Marshal(line)
+		fmt.Fprintln(os.Stderr, string(data))
+		return
+	}
+
+	msg := fmt.Sprintf("%s %s step=%q done=%d", time.Now().Format(time.RFC3339), event, p.description, p.done)
+	if p.total >= 0 {
+		msg += fmt.Sprintf(" total=%d", p.total)
+	}
+	if p.bytes {
+		msg += " unit=bytes"
+	}
+	msg += fmt.Sprintf(" rate=%.1f/s", rate)
+	if eta >= 0 {
+		msg += fmt.Sprintf(" eta=%.0fs", eta)
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
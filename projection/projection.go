@@ -0,0 +1,154 @@
+package projection
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// WGS84 ellipsoid parameters
+const (
+	semiMajorAxis = 6378137.0         // equatorial radius in meters
+	flattening    = 1 / 298.257223563 // ellipsoid flattening
+)
+
+// Projection converts between projected x/y coordinates in meters and WGS84 latitude/longitude
+type Projection interface {
+	// ToWGS84 converts projected coordinates (easting/x, northing/y) to latitude and longitude in degrees
+	ToWGS84(x, y float64) (lat, lon float64)
+	// FromWGS84 converts latitude and longitude in degrees to projected coordinates (easting/x, northing/y)
+	FromWGS84(lat, lon float64) (x, y float64)
+}
+
+// Parse returns the projection for an EPSG code such as "EPSG:32633". Supported codes are
+// EPSG:4326 (WGS84 latitude/longitude, returned as nil), EPSG:3857 (Web Mercator), and
+// EPSG:32601-32660 and EPSG:32701-32760 (UTM zones, northern and southern hemisphere).
+func Parse(code string) (Projection, error) {
+	normalized := strings.ToUpper(strings.TrimSpace(code))
+	if normalized == "" || normalized == "WGS84" {
+		return nil, nil
+	}
+	number, err := strconv.Atoi(strings.TrimPrefix(normalized, "EPSG:"))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported CRS %q (expected an EPSG code such as EPSG:32633)", code)
+	}
+
+	switch {
+	case number == 4326:
+		return nil, nil
+	case number == 3857:
+		return WebMercator{}, nil
+	case number > 32600 && number <= 32660:
+		return NewUTM(number-32600, false), nil
+	case number > 32700 && number <= 32760:
+		return NewUTM(number-32700, true), nil
+	}
+	return nil, fmt.Errorf("unsupported CRS %q (supported: EPSG:4326, EPSG:3857, EPSG:326xx and EPSG:327xx UTM zones)", code)
+}
+
+// WebMercator is the spherical Mercator projection used by web maps (EPSG:3857)
+type WebMercator struct{}
+
+// ToWGS84 converts Web Mercator x/y in meters to latitude and longitude in degrees
+func (WebMercator) ToWGS84(x, y float64) (lat, lon float64) {
+	lon = x / semiMajorAxis * 180 / math.Pi
+	lat = (2*math.Atan(math.Exp(y/semiMajorAxis)) - math.Pi/2) * 180 / math.Pi
+	return lat, lon
+}
+
+// FromWGS84 converts latitude and longitude in degrees to Web Mercator x/y in meters
+func (WebMercator) FromWGS84(lat, lon float64) (x, y float64) {
+	x = semiMajorAxis * lon * math.Pi / 180
+	y = semiMajorAxis * math.Log(math.Tan(math.Pi/4+lat*math.Pi/360))
+	return x, y
+}
+
+// UTM is a Universal Transverse Mercator zone on the WGS84 ellipsoid, computed with the
+// Krüger series, which is accurate to about a millimeter within the zone
+type UTM struct {
+	Zone     int  // zone number, 1 to 60
+	South    bool // southern hemisphere (false northing of 10,000 km)
+	meridian float64
+}
+
+// UTM scale factor, false easting and false northing (southern hemisphere)
+const (
+	utmScale         = 0.9996
+	utmFalseEasting  = 500000.0
+	utmFalseNorthing = 10000000.0
+)
+
+// Krüger series coefficients for the WGS84 ellipsoid
+var (
+	n     = flattening / (2 - flattening)
+	rectA = semiMajorAxis / (1 + n) * (1 + n*n/4 + n*n*n*n/64)
+	alpha = [3]float64{
+		n/2 - 2*n*n/3 + 5*n*n*n/16,
+		13*n*n/48 - 3*n*n*n/5,
+		61 * n * n * n / 240,
+	}
+	beta = [3]float64{
+		n/2 - 2*n*n/3 + 37*n*n*n/96,
+		n*n/48 + n*n*n/15,
+		17 * n * n * n / 480,
+	}
+	delta = [3]float64{
+		2*n - 2*n*n/3 - 2*n*n*n,
+		7*n*n/3 - 8*n*n*n/5,
+		56 * n * n * n / 15,
+	}
+)
+
+// NewUTM returns the UTM projection for a zone in the northern or southern hemisphere
+func NewUTM(zone int, south bool) UTM {
+	return UTM{Zone: zone, South: south, meridian: float64(zone*6-183) * math.Pi / 180}
+}
+
+// ToWGS84 converts UTM easting and northing in meters to latitude and longitude in degrees
+func (u UTM) ToWGS84(easting, northing float64) (lat, lon float64) {
+	if u.South {
+		northing -= utmFalseNorthing
+	}
+	xi := northing / (utmScale * rectA)
+	eta := (easting - utmFalseEasting) / (utmScale * rectA)
+
+	xiP, etaP := xi, eta
+	for j := 1; j <= 3; j++ {
+		xiP -= beta[j-1] * math.Sin(2*float64(j)*xi) * math.Cosh(2*float64(j)*eta)
+		etaP -= beta[j-1] * math.Cos(2*float64(j)*xi) * math.Sinh(2*float64(j)*eta)
+	}
+
+	chi := math.Asin(math.Sin(xiP) / math.Cosh(etaP))
+	phi := chi
+	for j := 1; j <= 3; j++ {
+		phi += delta[j-1] * math.Sin(2*float64(j)*chi)
+	}
+	lambda := u.meridian + math.Atan2(math.Sinh(etaP), math.Cos(xiP))
+
+	return phi * 180 / math.Pi, lambda * 180 / math.Pi
+}
+
+// FromWGS84 converts latitude and longitude in degrees to UTM easting and northing in meters
+func (u UTM) FromWGS84(lat, lon float64) (easting, northing float64) {
+	phi := lat * math.Pi / 180
+	dLambda := lon*math.Pi/180 - u.meridian
+
+	k := 2 * math.Sqrt(n) / (1 + n)
+	t := math.Sinh(math.Atanh(math.Sin(phi)) - k*math.Atanh(k*math.Sin(phi)))
+	xiP := math.Atan2(t, math.Cos(dLambda))
+	etaP := math.Atanh(math.Sin(dLambda) / math.Sqrt(1+t*t))
+
+	xi, eta := xiP, etaP
+	for j := 1; j <= 3; j++ {
+		xi += alpha[j-1] * math.Sin(2*float64(j)*xiP) * math.Cosh(2*float64(j)*etaP)
+		eta += alpha[j-1] * math.Cos(2*float64(j)*xiP) * math.Sinh(2*float64(j)*etaP)
+	}
+
+	easting = utmFalseEasting + utmScale*rectA*eta
+	northing = utmScale * rectA * xi
+	if u.South {
+		northing += utmFalseNorthing
+	}
+	return easting, northing
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"gps-processor/haversine"
+	"gps-processor/spatial"
+)
+
+// defaultProximityToleranceS is how far apart in time two fixes may be to count as simultaneous
+const defaultProximityToleranceS = 30.0
+
+// proximityWindowMargin widens the index query around each fix so that rounding in the flat
+// projection cannot leave out a pair the haversine distance puts within range
+const proximityWindowMargin = 1.01
+
+// encounter is a time window in which two devices stayed within the proximity distance
+type encounter struct {
+	A, B        string // device IDs, A < B
+	Start, End  time.Time
+	Contacts    int     // matched pairs of fixes
+	MinDistance float64 // meters
+}
+
+// contact is a single pair of fixes of two devices that were close in space and time
+type contact struct {
+	time     time.Time
+	distance float64
+}
+
+// findEncounters finds the time windows where two devices were within distanceM meters of
+// each other for at least minSeconds. Fixes count as simultaneous when they are at most
+// toleranceS seconds apart, and contacts more than twice that apart start a new encounter.
+// Candidate pairs of fixes come from a k-d tree over position and time, so only fixes
+// already close in both are compared.
+func findEncounters(records []Record, distanceM, minSeconds, toleranceS float64) []encounter {
+	// Index x/y in meters on a flat projection and time in seconds since the first record
+	var points []int
+	for i := range records {
+		if !records[i].Outlier {
+			points = append(points, i)
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	origin := records[points[0]].Timestamp
+	// Every point shares the longitude scale of the latitude farthest from the equator. A scale
+	// taken from each point's own latitude would project two points due north of each other
+	// apart in x; the shared one never places nearby points farther apart than they are, so no
+	// pair within distanceM is missed, and the haversine distance confirms each candidate.
+	maxLat := 0.0
+	for _, i := range points {
+		maxLat = math.Max(maxLat, math.Abs(records[i].Latitude))
+	}
+	lonScale := metersPerDegree * math.Cos(maxLat*math.Pi/180)
+	position := func(r *Record) [3]float64 {
+		return [3]float64{
+			r.Longitude * lonScale,
+			r.Latitude * metersPerDegree,
+			r.Timestamp.Sub(origin).Seconds(),
+		}
+	}
+	tree := spatial.NewKDTree(len(points), 3, func(i, dim int) float64 {
+		return position(&records[points[i]])[dim]
+	})
+
+	// Collect the contacts of every pair of devices
+	contacts := make(map[[2]string][]contact)
+	for _, i := range points {
+		a := &records[i]
+		p := position(a)
+		// metersPerDegree is a little longer than a degree on the haversine sphere
+		window := distanceM * proximityWindowMargin
+		min := []float64{p[0] - window, p[1] - window, p[2] - toleranceS}
+		max := []float64{p[0] + window, p[1] + window, p[2] + toleranceS}
+		tree.Range(min, max, func(j int) bool {
+			b := &records[points[j]]
+			// Compare each pair of fixes once, from the earlier device ID
+			if a.ID >= b.ID {
+				return true
+			}
+			d := haversine.Distance(a.Latitude, a.Longitude, b.Latitude, b.Longitude) * 1000
+			if d > distanceM {
+				return true
+			}
+			at := a.Timestamp
+			if b.Timestamp.Before(at) {
+				at = b.Timestamp
+			}
+			pair := [2]string{a.ID, b.ID}
+			contacts[pair] = append(contacts[pair], contact{time: at, distance: d})
+			return true
+		})
+	}
+
+	tolerance := time.Duration(toleranceS * float64(time.Second))
+	// Merge each pair's contacts into encounters
+	var encounters []encounter
+	for pair, list := range contacts {
+		sort.Slice(list, func(i, j int) bool { return list[i].time.Before(list[j].time) })
+		var current *encounter
+		flush := func() {
+			if current != nil && current.End.Sub(current.Start).Seconds() >= minSeconds {
+				encounters = append(encounters, *current)
+			}
+		}
+		for _, c := range list {
+			if current == nil || c.time.Sub(current.End) > 2*tolerance {
+				flush()
+				current = &encounter{A: pair[0], B: pair[1], Start: c.time, MinDistance: c.distance}
+			}
+			current.End = c.time
+			current.Contacts++
+			current.MinDistance = math.Min(current.MinDistance, c.distance)
+		}
+		flush()
+	}
+
+	sort.Slice(encounters, func(i, j int) bool {
+		if !encounters[i].Start.Equal(encounters[j].Start) {
+			return encounters[i].Start.Before(encounters[j].Start)
+		}
+		if encounters[i].A != encounters[j].A {
+			return encounters[i].A < encounters[j].A
+		}
+		return encounters[i].B < encounters[j].B
+	})
+	return encounters
+}
+
+// writeEncounterReport writes one CSV row per encounter
+func writeEncounterReport(filename string, encounters []encounter) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create encounter report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"device_a", "device_b", "start", "end", "duration_seconds", "contacts", "min_distance_m"})
+	for _, e := range encounters {
+		_ = writer.Write([]string{
+			e.A,
+			e.B,
+			e.Start.Format(outputTimeLayout),
+			e.End.Format(outputTimeLayout),
+			strconv.FormatFloat(e.End.Sub(e.Start).Seconds(), 'f', 0, 64),
+			strconv.Itoa(e.Contacts),
+			strconv.FormatFloat(e.MinDistance, 'f', 1, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis client settings
+const (
+	redisTimeout          = 5 * time.Second
+	defaultRedisKeyPrefix = "gps-processor:last:"
+)
+
+// redisStore keeps the last fix of each device in Redis, so several stream instances can
+// share state and a restarted instance continues where the last one stopped
+type redisStore struct {
+	addr     string
+	host     string // server name checked against the TLS certificate
+	useTLS   bool
+	username string
+	password string
+	db       int
+	prefix   string
+	ttl      time.Duration // expiry of a device's state after its last fix; 0 keeps it
+
+	conn   net.Conn
+	reader *bufio.Reader
+	// connections counts the connections opened, so a key watched on a connection that has
+	// since been lost is not taken as still watched
+	connections int
+	watched     int // connection on which get watches a device's key, 0 when none
+}
+
+// newRedisStore parses a redis:// or rediss:// URL and connects to the server
+func newRedisStore(rawURL, prefix string, ttl time.Duration) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("invalid stream.redis_url %q (use redis://[user:password@]host:port[/db])", rawURL)
+	}
+	s := &redisStore{addr: u.Host, host: u.Hostname(), useTLS: u.Scheme == "rediss", prefix: prefix, ttl: ttl}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q in stream.redis_url", db)
+		}
+	}
+	if s.prefix == "" {
+		s.prefix = defaultRedisKeyPrefix
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect opens the connection, authenticates and selects the database
+func (s *redisStore) connect() error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if s.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: s.host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to connect to Redis: %w", err)
+	}
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+	s.connections++
+
+	// A password without a user name is the password of the default user (the part before
+	// the colon is empty in redis://:password@host)
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := s.command(args...); err != nil {
+			s.close()
+			return fmt.Errorf("Redis authentication failed: %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.command("SELECT", strconv.Itoa(s.db)); err != nil {
+			s.close()
+			return fmt.Errorf("unable to select Redis database %d: %w", s.db, err)
+		}
+	}
+	return nil
+}
+
+// close closes the connection
+func (s *redisStore) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// redisError is an error reply from the server, as opposed to a connection problem
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// do runs a command, reconnecting once if the connection was lost
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	if s.conn != nil {
+		reply, err := s.command(args...)
+		var replyErr redisError
+		if err == nil || errors.As(err, &replyErr) {
+			return reply, err
+		}
+		logWarn("Redis connection lost (%v), reconnecting", err)
+		s.close()
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s.command(args...)
+}
+
+// command sends a command and reads its reply
+func (s *redisStore) command(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_ = s.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := s.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return s.readReply()
+}
+
+// readReply reads one RESP reply: a simple string, error, integer, bulk string (nil when
+// missing) or array
+func (s *redisStore) readReply() (interface{}, error) {
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply from Redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = s.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply from Redis: %q", line)
+}
+
+// get returns the last fix of a device, if Redis has one, and watches its key so put can
+// tell whether another instance changed it in the meantime
+func (s *redisStore) get(id string) (streamPoint, bool, error) {
+	// A key watched for a fix that was not saved would make the next put fail needlessly
+	if s.watched != 0 && s.watched == s.connections && s.conn != nil {
+		if _, err := s.command("UNWATCH"); err != nil {
+			s.close()
+		}
+	}
+	s.watched = 0
+	if _, err := s.do("WATCH", s.prefix+id); err != nil {
+		return streamPoint{}, false, fmt.Errorf("reading state of device %s from Redis: %w", id, err)
+	}
+	s.watched = s.connections
+	reply, err := s.do("GET", s.prefix+id)
+	if err != nil {
+		return streamPoint{}, false, fmt.Errorf("reading state of device %s from Redis: %w", id, err)
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return streamPoint{}, false, nil
+	}
+	var p streamPoint
+	if err := json.Unmarshal([]byte(value), &p); err != nil {
+		return streamPoint{}, false, fmt.Errorf("invalid state of device %s in Redis: %w", id, err)
+	}
+	return p, true, nil
+}
+
+// put saves the last fix of a device in a transaction on the key get watched, so it is only
+// saved if no other instance has changed the device's state since. It reports false when
+// the state changed, or when the connection was lost and the key is no longer watched.
+func (s *redisStore) put(id string, p streamPoint) (bool, error) {
+	watched := s.watched != 0 && s.watched == s.connections && s.conn != nil
+	s.watched = 0
+	if !watched {
+		return false, nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return false, err
+	}
+	set := []string{"SET", s.prefix + id, string(data)}
+	if s.ttl > 0 {
+		set = append(set, "PX", strconv.FormatInt(s.ttl.Milliseconds(), 10))
+	}
+	// Without reconnecting, which would lose the watch; get reconnects for the next attempt
+	var reply interface{}
+	for _, args := range [][]string{{"MULTI"}, set, {"EXEC"}} {
+		if reply, err = s.command(args...); err != nil {
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				s.command("DISCARD")
+				return false, fmt.Errorf("saving state of device %s to Redis: %w", id, err)
+			}
+			logWarn("Redis connection lost (%v), reconnecting", err)
+			s.close()
+			return false, nil
+		}
+	}
+	// EXEC replies with a null array when a watched key changed
+	return reply != nil, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-memory server for the commands redisStore uses, with the WATCH, MULTI
+// and EXEC semantics of Redis: a transaction fails when a key its connection watches was
+// written since it was watched
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	values   map[string]string
+	versions map[string]int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, values: make(map[string]string), versions: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return f
+}
+
+func (f *fakeRedis) url() string { return "redis://" + f.listener.Addr().String() }
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	watched := make(map[string]int)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		if inMulti && name != "EXEC" && name != "DISCARD" {
+			queued = append(queued, args)
+			io.WriteString(conn, "+QUEUED\r\n")
+			continue
+		}
+		f.mu.Lock()
+		switch name {
+		case "WATCH":
+			for _, key := range args[1:] {
+				watched[key] = f.versions[key]
+			}
+			io.WriteString(conn, "+OK\r\n")
+		case "UNWATCH":
+			watched = make(map[string]int)
+			io.WriteString(conn, "+OK\r\n")
+		case "MULTI":
+			inMulti = true
+			io.WriteString(conn, "+OK\r\n")
+		case "DISCARD":
+			inMulti, queued, watched = false, nil, make(map[string]int)
+			io.WriteString(conn, "+OK\r\n")
+		case "EXEC":
+			changed := false
+			for key, version := range watched {
+				changed = changed || f.versions[key] != version
+			}
+			if changed {
+				io.WriteString(conn, "*-1\r\n")
+			} else {
+				fmt.Fprintf(conn, "*%d\r\n", len(queued))
+				for _, command := range queued {
+					f.values[command[1]] = command[2]
+					f.versions[command[1]]++
+					io.WriteString(conn, "+OK\r\n")
+				}
+			}
+			inMulti, queued, watched = false, nil, make(map[string]int)
+		case "GET":
+			if value, ok := f.values[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				io.WriteString(conn, "$-1\r\n")
+			}
+		case "SET":
+			f.values[args[1]] = args[2]
+			f.versions[args[1]]++
+			io.WriteString(conn, "+OK\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		f.mu.Unlock()
+	}
+}
+
+// readCommand reads a command sent as a RESP array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		value, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(value, "\r\n")
+	}
+	return args, nil
+}
+
+func TestRedisStorePutAfterConcurrentWrite(t *testing.T) {
+	f := newFakeRedis(t)
+	a, err := newRedisStore(f.url(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newRedisStore(f.url(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := streamPoint{Latitude: 52, Timestamp: testTime(60), Row: 2}
+	newer := streamPoint{Latitude: 53, Timestamp: testTime(120), Row: 3}
+
+	tests := []struct {
+		name      string
+		run       func() (bool, error)
+		wantSaved bool
+	}{
+		{
+			name: "no other writer",
+			run: func() (bool, error) {
+				if _, _, err := a.get("d"); err != nil {
+					return false, err
+				}
+				return a.put("d", older)
+			},
+			wantSaved: true,
+		},
+		{
+			name: "another instance saved in between",
+			run: func() (bool, error) {
+				if _, _, err := a.get("d"); err != nil {
+					return false, err
+				}
+				if _, _, err := b.get("d"); err != nil {
+					return false, err
+				}
+				if saved, err := b.put("d", newer); err != nil || !saved {
+					return false, fmt.Errorf("the other instance did not save: %v", err)
+				}
+				return a.put("d", older)
+			},
+			wantSaved: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved, err := tt.run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved != tt.wantSaved {
+				t.Errorf("saved %v, want %v", saved, tt.wantSaved)
+			}
+		})
+	}
+	p, ok, err := a.get("d")
+	if err != nil || !ok || !p.Timestamp.Equal(newer.Timestamp) {
+		t.Errorf("state %+v, %v, %v; want the newer fix", p, ok, err)
+	}
+}
+
+func TestStreamInstancesShareRedisState(t *testing.T) {
+	f := newFakeRedis(t)
+	const instances, fixes = 4, 200
+
+	var wg sync.WaitGroup
+	errs := make(chan error, instances)
+	for n := 0; n < instances; n++ {
+		config := &Config{}
+		config.Columns.ID, config.Columns.Latitude, config.Columns.Longitude, config.Columns.Timestamp = "id", "lat", "lon", "time"
+		config.Stream.State, config.Stream.RedisURL = "redis", f.url()
+		s, err := newStreamProcessor(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		// Each instance gets every fourth fix of the same device, in order, so the instances
+		// keep saving fixes of the device at the same time
+		go func(n int) {
+			defer wg.Done()
+			for i := n; i < fixes; i += instances {
+				line := fmt.Sprintf(`{"id":"d","lat":52.0,"lon":%f,"time":%q}`, 4+float64(i)*0.001,
+					testTime(i).Format(time.RFC3339))
+				if _, err := s.process([]byte(line), i+1); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	store, err := newRedisStore(f.url(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok, err := store.get("d")
+	if err != nil || !ok {
+		t.Fatalf("no state saved: %v", err)
+	}
+	if want := testTime(fixes - 1); !p.Timestamp.Equal(want) {
+		t.Errorf("last fix at %s, want the newest fix at %s", p.Timestamp, want)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Exit codes returned by the processor so orchestration tools can react to the outcome
+const (
+	exitOK            = 0 // processing completed and produced records
+	exitError         = 1 // unexpected failure not covered by a more specific code
+	exitUsage         = 2 // invalid command line arguments
+	exitConfigCreated = 3 // a default config.yaml was created and needs review
+	exitConfigError   = 4 // the configuration is invalid
+	exitInputError    = 5 // the input file could not be read or parsed
+	exitNoRecords     = 6 // processing completed but no records remained after filtering
+	exitOutputError   = 7 // an output file could not be written
+	exitCompareFailed = 8 // the output differs from the --compare file beyond the tolerances
+)
+
+// configError marks errors caused by a configuration that does not match the input
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+
+// runReport is the machine-readable summary of a run written by --report
+type runReport struct {
+	Status          string              `json:"status"`
+	ExitCode        int                 `json:"exit_code"`
+	Error           string              `json:"error,omitempty"`
+	InputFile       string              `json:"input_file,omitempty"`
+	ConfigFile      string              `json:"config_file,omitempty"`
+	StartTime       time.Time           `json:"start_time"`
+	EndTime         time.Time           `json:"end_time"`
+	DurationSeconds float64             `json:"duration_seconds"`
+	StepSeconds     map[string]float64  `json:"step_seconds"`
+	Counts          map[string]int      `json:"counts"`
+	Outputs         map[string][]string `json:"outputs"`
+	Warnings        []string            `json:"warnings,omitempty"`
+
+	path      string    // where the report is written; empty disables the report
+	notify    *notifier // posts the report when the run ends, if configured
+	profile   *profiler // profiles written when the run ends, if requested
+	stepStart time.Time // start of the step currently being timed
+	stepName  string
+}
+
+// newRunReport creates a report that will be written to path when the run ends
+func newRunReport(path string) *runReport {
+	return &runReport{
+		path:        path,
+		StartTime:   time.Now(),
+		StepSeconds: make(map[string]float64),
+		Counts:      make(map[string]int),
+		Outputs:     make(map[string][]string),
+	}
+}
+
+// step ends the current step timing, if any, and starts timing the named step
+func (r *runReport) step(name string) {
+	now := time.Now()
+	if r.stepName != "" {
+		seconds := now.Sub(r.stepStart).Seconds()
+		r.StepSeconds[r.stepName] += seconds
+		logDebug("Step %s took %.2f seconds", r.stepName, seconds)
+	}
+	r.stepName = name
+	r.stepStart = now
+}
+
+// write finalizes the report, saves it as JSON if a report path was given, and sends the
+// completion notification
+func (r *runReport) write(code int) {
+	r.step("")
+	r.ExitCode = code
+	r.Status = "success"
+	switch code {
+	case exitOK:
+	case exitNoRecords:
+		r.Status = "empty"
+	case exitConfigCreated:
+		r.Status = "config_created"
+	case exitCompareFailed:
+		r.Status = "different"
+	default:
+		r.Status = "failed"
+	}
+	r.EndTime = time.Now()
+	r.DurationSeconds = r.EndTime.Sub(r.StartTime).Seconds()
+	r.Warnings = logger.warnings
+	r.profile.stop()
+
+	if r.path != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err == nil {
+			err = os.WriteFile(r.path, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			logWarn("Unable to write run report: %v", err)
+		}
+	}
+	r.notify.send(r)
+	logger.close()
+}
+
+// exit writes the report and terminates the process with the given code
+func (r *runReport) exit(code int) {
+	r.write(code)
+	os.Exit(code)
+}
+
+// fail prints an error message, records it in the report and exits with the given code
+func (r *runReport) fail(code int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logError("%s", msg)
+	r.Error = msg
+	r.exit(code)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // time zone names must resolve on Windows, which has no zoneinfo database
+
+	"gps-processor/solar"
+)
+
+// rollupPeriods maps the values of output.rollups to the function giving the start of the
+// period a time falls in
+var rollupPeriods = map[string]func(t time.Time) time.Time{
+	"daily": func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	},
+	"weekly": func(t time.Time) time.Time {
+		// Weeks start on Monday, as in ISO 8601
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+	},
+}
+
+// rollupRow holds the totals of one device over one period
+type rollupRow struct {
+	ID       string
+	Period   time.Time
+	Points   int
+	Distance float64 // kilometers
+	Duration float64 // seconds
+	Trips    int
+	MaxSpeed float64 // kilometers per hour
+
+	NightDistance float64 // kilometers driven in darkness, when output.day_night is set
+}
+
+// checkRollups validates output.rollups and parameters.report_timezone
+func checkRollups(config *Config) error {
+	for _, name := range config.Output.Rollups {
+		if _, ok := rollupPeriods[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("unknown rollup %q in output.rollups (use daily or weekly)", name)
+		}
+	}
+	_, err := reportLocation(config)
+	return err
+}
+
+// reportLocation returns the time zone of parameters.report_timezone, or UTC when it is not set
+func reportLocation(config *Config) (*time.Location, error) {
+	if config.Parameters.ReportTimezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(config.Parameters.ReportTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameters.report_timezone %q (use an IANA name such as America/Chicago)", config.Parameters.ReportTimezone)
+	}
+	return loc, nil
+}
+
+// rollup totals records per device and period, sorted by device ID and period. Periods start
+// at midnight in loc. Each segment counts towards the period of the point it ends at, and each
+// trip towards the period it starts in. With dayNight, segments ending in darkness are also
+// totalled as night distance.
+func rollup(records []Record, period func(t time.Time) time.Time, loc *time.Location, dayNight bool) []rollupRow {
+	type key struct {
+		id     string
+		period time.Time
+	}
+	type trip struct {
+		id     string
+		number int
+	}
+	rows := make(map[key]*rollupRow)
+	tripStarts := make(map[trip]time.Time)
+	for i := range records {
+		r := &records[i]
+		k := key{r.ID, period(r.Timestamp.In(loc))}
+		row, ok := rows[k]
+		if !ok {
+			row = &rollupRow{ID: r.ID, Period: k.period}
+			rows[k] = row
+		}
+
+		row.Points++
+		if r.Trip != 0 {
+			t := trip{r.ID, r.Trip}
+			if start, ok := tripStarts[t]; !ok || r.Timestamp.Before(start) {
+				tripStarts[t] = r.Timestamp
+			}
+		}
+		// Flagged outliers count as points but not towards distance or speed, as in the summary
+		if r.Outlier {
+			continue
+		}
+		row.Distance += r.Distance
+		if dayNight && !solar.IsDaylight(r.Latitude, r.Longitude, r.Timestamp) {
+			row.NightDistance += r.Distance
+		}
+		row.Duration += r.TimeDiff
+		if r.Speed > row.MaxSpeed {
+			row.MaxSpeed = r.Speed
+		}
+	}
+
+	for t, start := range tripStarts {
+		rows[key{t.id, period(start.In(loc))}].Trips++
+	}
+
+	result := make([]rollupRow, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, *row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Period.Before(result[j].Period)
+	})
+	return result
+}
+
+// writeRollup writes one CSV row per device and period
+func writeRollup(filename string, rows []rollupRow, config *Config) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create rollup report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	header := []string{"ID", "period_start", "points", "distance_km", "duration_seconds", "trips", "max_speed_kmh"}
+	if config.Output.DayNight {
+		header = append(header, "night_distance_km")
+	}
+	_ = writer.Write(header)
+	for _, row := range rows {
+		line := []string{
+			row.ID,
+			row.Period.Format("2006-01-02"),
+			strconv.Itoa(row.Points),
+			strconv.FormatFloat(row.Distance, 'f', outputPrecision(config, "distance"), 64),
+			strconv.FormatFloat(row.Duration, 'f', 0, 64),
+			strconv.Itoa(row.Trips),
+			strconv.FormatFloat(row.MaxSpeed, 'f', outputPrecision(config, "speed"), 64),
+		}
+		if config.Output.DayNight {
+			line = append(line, strconv.FormatFloat(row.NightDistance, 'f', outputPrecision(config, "distance"), 64))
+		}
+		_ = writer.Write(line)
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gps-processor/spatial"
+)
+
+// defaultRouteDeviationM is the distance from the planned route beyond which a point is off route
+const defaultRouteDeviationM = 100.0
+
+// routePoint is a vertex of a planned route
+type routePoint struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// plannedRoute is a device's planned route with its segments indexed for nearest-segment queries
+type plannedRoute struct {
+	points []routePoint
+	index  *spatial.RTree // bounding box of segment i, from points[i] to points[i+1], in degrees
+}
+
+// newPlannedRoute indexes the segments of a route
+func newPlannedRoute(points []routePoint) *plannedRoute {
+	boxes := make([]spatial.Box, len(points)-1)
+	for i := range boxes {
+		a, b := points[i], points[i+1]
+		boxes[i] = spatial.Box{
+			MinX: math.Min(a.Longitude, b.Longitude),
+			MinY: math.Min(a.Latitude, b.Latitude),
+			MaxX: math.Max(a.Longitude, b.Longitude),
+			MaxY: math.Max(a.Latitude, b.Latitude),
+		}
+	}
+	return &plannedRoute{points: points, index: spatial.NewRTree(boxes)}
+}
+
+// routeSet loads the planned routes of the devices, configured per device in
+// parameters.route_files or found as <id>.gpx or <id>.geojson in parameters.route_dir
+type routeSet struct {
+	files     map[string]string
+	dir       string
+	threshold float64
+}
+
+// newRouteSet builds the route set from the configuration.
+// It returns nil when no routes are configured.
+func newRouteSet(config *Config) *routeSet {
+	p := &config.Parameters
+	if len(p.RouteFiles) == 0 && p.RouteDir == "" {
+		return nil
+	}
+	threshold := p.RouteDeviationM
+	if threshold <= 0 {
+		threshold = defaultRouteDeviationM
+	}
+	return &routeSet{files: p.RouteFiles, dir: p.RouteDir, threshold: threshold}
+}
+
+// route loads the planned route of a device; it returns nil when the device has no route
+func (rs *routeSet) route(id string) (*plannedRoute, error) {
+	filename, ok := rs.files[id]
+	if !ok && rs.dir != "" {
+		for _, ext := range []string{".gpx", ".geojson", ".json"} {
+			candidate := filepath.Join(rs.dir, sanitizeFilename(id)+ext)
+			if _, err := os.Stat(candidate); err == nil {
+				filename, ok = candidate, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	var points []routePoint
+	var err error
+	if strings.EqualFold(filepath.Ext(filename), ".gpx") {
+		points, err = readGPXRoute(filename)
+	} else {
+		points, err = readGeoJSONRoute(filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("route for device %s: %w", id, err)
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("route for device %s: %s has fewer than 2 points", id, filename)
+	}
+	return newPlannedRoute(points), nil
+}
+
+// readGPXRoute reads the route points (rtept) or, if there are none, the track points (trkpt) of a GPX file
+func readGPXRoute(filename string) ([]routePoint, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	type gpxPoint struct {
+		Lat float64 `xml:"lat,attr"`
+		Lon float64 `xml:"lon,attr"`
+	}
+	var doc struct {
+		Routes []struct {
+			Points []gpxPoint `xml:"rtept"`
+		} `xml:"rte"`
+		Tracks []struct {
+			Segments []struct {
+				Points []gpxPoint `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", filename, err)
+	}
+
+	var points []routePoint
+	for _, rte := range doc.Routes {
+		for _, p := range rte.Points {
+			points = append(points, routePoint{p.Lat, p.Lon})
+		}
+	}
+	if len(points) == 0 {
+		for _, trk := range doc.Tracks {
+			for _, seg := range trk.Segments {
+				for _, p := range seg.Points {
+					points = append(points, routePoint{p.Lat, p.Lon})
+				}
+			}
+		}
+	}
+	return points, nil
+}
+
+// readGeoJSONRoute reads the first LineString or MultiLineString of a GeoJSON geometry,
+// feature or feature collection
+func readGeoJSONRoute(filename string) ([]routePoint, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	type geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+	var doc struct {
+		geometry
+		Geometry *geometry `json:"geometry"`
+		Features []struct {
+			Geometry *geometry `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", filename, err)
+	}
+
+	geometries := []*geometry{&doc.geometry, doc.Geometry}
+	for _, feature := range doc.Features {
+		geometries = append(geometries, feature.Geometry)
+	}
+	for _, g := range geometries {
+		if g == nil {
+			continue
+		}
+		var lines [][][]float64
+		switch g.Type {
+		case "LineString":
+			var line [][]float64
+			if err := json.Unmarshal(g.Coordinates, &line); err != nil {
+				return nil, fmt.Errorf("invalid LineString in %s: %w", filename, err)
+			}
+			lines = [][][]float64{line}
+		case "MultiLineString":
+			if err := json.Unmarshal(g.Coordinates, &lines); err != nil {
+				return nil, fmt.Errorf("invalid MultiLineString in %s: %w", filename, err)
+			}
+		default:
+			continue
+		}
+
+		// GeoJSON positions are [longitude, latitude]
+		var points []routePoint
+		for _, line := range lines {
+			for _, position := range line {
+				if len(position) >= 2 {
+					points = append(points, routePoint{position[1], position[0]})
+				}
+			}
+		}
+		return points, nil
+	}
+	return nil, fmt.Errorf("no LineString found in %s", filename)
+}
+
+// applyRoute sets the cross-track distance to the planned route on each record of a group
+// and flags records farther away than the threshold
+func (rs *routeSet) applyRoute(group []Record, route *plannedRoute) {
+	for i := range group {
+		if route == nil {
+			group[i].RouteDistance = -1
+			group[i].OffRoute = false
+			continue
+		}
+		group[i].RouteDistance = route.distance(group[i].Latitude, group[i].Longitude)
+		group[i].OffRoute = group[i].RouteDistance > rs.threshold
+	}
+}
+
+// distance returns the distance in meters from a point to the nearest segment of the
+// route, measured in a local flat projection around the point
+func (r *plannedRoute) distance(lat, lon float64) float64 {
+	lonScale := metersPerDegree * math.Cos(lat*math.Pi/180)
+	project := func(p routePoint) (float64, float64) {
+		return (p.Longitude - lon) * lonScale, (p.Latitude - lat) * metersPerDegree
+	}
+
+	// A segment is never closer than its bounding box
+	bound := func(b spatial.Box) float64 {
+		dx := math.Max(0, math.Max(b.MinX-lon, lon-b.MaxX)) * lonScale
+		dy := math.Max(0, math.Max(b.MinY-lat, lat-b.MaxY)) * metersPerDegree
+		return math.Hypot(dx, dy)
+	}
+	segment := func(i int) float64 {
+		ax, ay := project(r.points[i])
+		bx, by := project(r.points[i+1])
+		return segmentDistance(0, 0, ax, ay, bx, by)
+	}
+	_, nearest := r.index.Nearest(bound, segment)
+	return nearest
+}
+
+// routeDeviation is a run of consecutive off-route points of one device
+type routeDeviation struct {
+	ID          string
+	Start       time.Time
+	End         time.Time
+	Points      int
+	MaxDistance float64 // meters
+}
+
+// findDeviations collects the runs of off-route points from records grouped by device and
+// sorted by time
+func findDeviations(records []Record) []routeDeviation {
+	var deviations []routeDeviation
+	var current *routeDeviation
+	for i := range records {
+		r := &records[i]
+		if !r.OffRoute || (current != nil && current.ID != r.ID) {
+			current = nil
+		}
+		if !r.OffRoute {
+			continue
+		}
+		if current == nil {
+			deviations = append(deviations, routeDeviation{ID: r.ID, Start: r.Timestamp})
+			current = &deviations[len(deviations)-1]
+		}
+		current.End = r.Timestamp
+		current.Points++
+		current.MaxDistance = math.Max(current.MaxDistance, r.RouteDistance)
+	}
+	return deviations
+}
+
+// writeDeviationReport writes one CSV row per route deviation
+func writeDeviationReport(filename string, deviations []routeDeviation) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create deviation report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"ID", "start", "end", "duration_seconds", "points", "max_distance_m"})
+	for _, d := range deviations {
+		_ = writer.Write([]string{
+			d.ID,
+			d.Start.Format(outputTimeLayout),
+			d.End.Format(outputTimeLayout),
+			strconv.FormatFloat(d.End.Sub(d.Start).Seconds(), 'f', 0, 64),
+			strconv.Itoa(d.Points),
+			strconv.FormatFloat(d.MaxDistance, 'f', 1, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
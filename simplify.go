@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+)
+
+// simplifyTrack marks the points of a time-sorted group that the Ramer–Douglas–Peucker
+// algorithm keeps at the given tolerance in meters, setting Simplified on them. Flagged
+// outliers are never kept.
+func simplifyTrack(group []Record, epsilonMeters float64) {
+	// Work on the points that are not outliers, projected to local meters
+	var points []int
+	for i := range group {
+		group[i].Simplified = false
+		if !group[i].Outlier {
+			points = append(points, i)
+		}
+	}
+	if len(points) == 0 {
+		return
+	}
+	if len(points) <= 2 {
+		for _, i := range points {
+			group[i].Simplified = true
+		}
+		return
+	}
+
+	origin := &group[points[0]]
+	lonScale := metersPerDegree * math.Cos(origin.Latitude*math.Pi/180)
+	xs := make([]float64, len(points))
+	ys := make([]float64, len(points))
+	for k, i := range points {
+		xs[k] = (group[i].Longitude - origin.Longitude) * lonScale
+		ys[k] = (group[i].Latitude - origin.Latitude) * metersPerDegree
+	}
+
+	// Iterative RDP with an explicit stack, so long tracks cannot overflow the call stack
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		span := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		first, last := span[0], span[1]
+
+		farthest, maxDist := -1, 0.0
+		for k := first + 1; k < last; k++ {
+			if d := segmentDistance(xs[k], ys[k], xs[first], ys[first], xs[last], ys[last]); d > maxDist {
+				farthest, maxDist = k, d
+			}
+		}
+		if farthest >= 0 && maxDist > epsilonMeters {
+			keep[farthest] = true
+			stack = append(stack, [2]int{first, farthest}, [2]int{farthest, last})
+		}
+	}
+
+	for k, i := range points {
+		group[i].Simplified = keep[k]
+	}
+}
+
+// segmentDistance returns the distance from point (px, py) to the segment from (ax, ay) to (bx, by)
+func segmentDistance(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	lengthSq := dx*dx + dy*dy
+	if lengthSq == 0 {
+		return math.Hypot(px-ax, py-ay)
+	}
+	t := ((px-ax)*dx + (py-ay)*dy) / lengthSq
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
@@ -0,0 +1,62 @@
+// Package solar computes the position of the sun, following the NOAA solar calculator
+// equations, to tell daylight from darkness at a place and time.
+package solar
+
+import (
+	"math"
+	"time"
+)
+
+// HorizonElevation is the sun's elevation in degrees at sunrise and sunset: the upper limb
+// touches the horizon, allowing for atmospheric refraction
+const HorizonElevation = -0.833
+
+// Elevation returns the elevation of the sun's center above the horizon in degrees, without
+// refraction, as seen from lat, lon at time t. Accuracy is about a minute of time for dates
+// between 1800 and 2100.
+func Elevation(lat, lon float64, t time.Time) float64 {
+	t = t.UTC()
+	julianDay := float64(t.UnixNano())/86400e9 + 2440587.5
+	centuries := (julianDay - 2451545) / 36525
+
+	meanLong := math.Mod(280.46646+centuries*(36000.76983+centuries*0.0003032), 360)
+	meanAnomaly := 357.52911 + centuries*(35999.05029-0.0001537*centuries)
+	eccentricity := 0.016708634 - centuries*(0.000042037+0.0000001267*centuries)
+
+	m := radians(meanAnomaly)
+	center := math.Sin(m)*(1.914602-centuries*(0.004817+0.000014*centuries)) +
+		math.Sin(2*m)*(0.019993-0.000101*centuries) +
+		math.Sin(3*m)*0.000289
+	omega := radians(125.04 - 1934.136*centuries)
+	apparentLong := radians(meanLong + center - 0.00569 - 0.00478*math.Sin(omega))
+
+	meanObliquity := 23 + (26+(21.448-centuries*(46.815+centuries*(0.00059-centuries*0.001813)))/60)/60
+	obliquity := radians(meanObliquity + 0.00256*math.Cos(omega))
+	declination := math.Asin(math.Sin(obliquity) * math.Sin(apparentLong))
+
+	// Equation of time in minutes: how far solar noon drifts from clock noon over the year
+	y := math.Pow(math.Tan(obliquity/2), 2)
+	l0 := radians(meanLong)
+	equationOfTime := 4 * degrees(y*math.Sin(2*l0)-
+		2*eccentricity*math.Sin(m)+
+		4*eccentricity*y*math.Sin(m)*math.Cos(2*l0)-
+		0.5*y*y*math.Sin(4*l0)-
+		1.25*eccentricity*eccentricity*math.Sin(2*m))
+
+	minutes := float64(t.Hour()*60+t.Minute()) + (float64(t.Second())+float64(t.Nanosecond())/1e9)/60
+	solarTime := math.Mod(minutes+equationOfTime+4*lon, 1440)
+	hourAngle := radians(solarTime/4 - 180)
+
+	phi := radians(lat)
+	cosZenith := math.Sin(phi)*math.Sin(declination) + math.Cos(phi)*math.Cos(declination)*math.Cos(hourAngle)
+	return 90 - degrees(math.Acos(math.Max(-1, math.Min(1, cosZenith))))
+}
+
+// IsDaylight reports whether t falls between sunrise and sunset at lat, lon
+func IsDaylight(lat, lon float64, t time.Time) bool {
+	return Elevation(lat, lon, t) > HorizonElevation
+}
+
+func radians(deg float64) float64 { return deg * math.Pi / 180 }
+
+func degrees(rad float64) float64 { return rad * 180 / math.Pi }
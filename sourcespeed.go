@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// speedUnits are the units accepted by columns.speed_unit, as the factor converting them to km/h
+var speedUnits = map[string]float64{
+	"kmh":   1,
+	"km/h":  1,
+	"mph":   1.609344,
+	"knots": 1.852,
+	"kn":    1.852,
+	"m/s":   3.6,
+	"mps":   3.6,
+}
+
+// checkSourceSpeed validates columns.speed_unit and parameters.speed_source
+func checkSourceSpeed(config *Config) error {
+	if _, err := sourceSpeedFactor(config); err != nil {
+		return err
+	}
+	switch config.Parameters.SpeedSource {
+	case "", "computed":
+	case "source", "both":
+		if config.Columns.Speed == "" {
+			return fmt.Errorf("parameters.speed_source %s requires a speed column; set columns.speed", config.Parameters.SpeedSource)
+		}
+	default:
+		return fmt.Errorf("unknown parameters.speed_source %q (use computed, source or both)", config.Parameters.SpeedSource)
+	}
+	return nil
+}
+
+// sourceSpeedFactor returns the factor converting the speeds of columns.speed to km/h
+func sourceSpeedFactor(config *Config) (float64, error) {
+	unit := strings.ToLower(strings.TrimSpace(config.Columns.SpeedUnit))
+	if unit == "" {
+		return 1, nil
+	}
+	factor, ok := speedUnits[unit]
+	if !ok {
+		units := make([]string, 0, len(speedUnits))
+		for name := range speedUnits {
+			units = append(units, name)
+		}
+		sort.Strings(units)
+		return 0, fmt.Errorf("unknown columns.speed_unit %q (use %s)", config.Columns.SpeedUnit, strings.Join(units, ", "))
+	}
+	return factor, nil
+}
+
+// sourceSpeedColumn returns the source_speed_kmh output column, written with
+// parameters.speed_source: both next to the computed speed_kmh. It is empty for rows without
+// a source speed.
+func sourceSpeedColumn(config *Config) outputColumn {
+	decimals := config.Output.SpeedPrecision
+	return outputColumn{Name: "source_speed_kmh", Numeric: true, Value: func(r *Record) string {
+		if !r.HasSourceSpeed {
+			return ""
+		}
+		return strconv.FormatFloat(r.SourceSpeed, 'f', decimals, 64)
+	}}
+}
+
+// defaultSpeedDiscrepancyKmh is the difference between the source and computed speeds that
+// is reported when parameters.speed_discrepancy_kmh is not set
+const defaultSpeedDiscrepancyKmh = 10.0
+
+// speedDiscrepancy is a stretch of a device's track over which its source speed differed
+// from the speed computed from its positions by more than the threshold, in one direction
+type speedDiscrepancy struct {
+	ID            string
+	Start, End    time.Time
+	Points        int
+	Duration      float64 // seconds
+	Distance      float64 // computed, in kilometers
+	SourceTotal   float64 // source speed times seconds, for the time-weighted mean
+	MaxDifference float64 // source less computed speed where they differed most, in km/h
+}
+
+// meanComputed returns the mean speed computed from the positions over the stretch
+func (d *speedDiscrepancy) meanComputed() float64 {
+	return d.Distance / (d.Duration / 3600)
+}
+
+// meanSource returns the time-weighted mean source speed over the stretch
+func (d *speedDiscrepancy) meanSource() float64 {
+	return d.SourceTotal / d.Duration
+}
+
+// computedSpeed returns the speed computed from the distance and time to the previous
+// point, which parameters.speed_source: source replaces in Speed
+func computedSpeed(r *Record) float64 {
+	return r.Distance / (r.TimeDiff / 3600)
+}
+
+// findSpeedDiscrepancies compares the source speed of each point with the speed computed
+// over the segment from the previous point, and joins consecutive segments that differ by
+// more than parameters.speed_discrepancy_kmh in the same direction. A source speed lower than
+// the computed one over a long stretch suggests a tampered odometer; a higher one, or
+// positions that do not move with the vehicle, suggests spoofed positions. Points without a
+// source speed, outliers and the first point of each device end a stretch.
+func findSpeedDiscrepancies(records []Record, config *Config) []speedDiscrepancy {
+	threshold := config.Parameters.SpeedDiscrepancyKmh
+	if threshold <= 0 {
+		threshold = defaultSpeedDiscrepancyKmh
+	}
+	var found []speedDiscrepancy
+	groups := groupByID(records)
+	for _, id := range sortedIDs(groups) {
+		group := groups[id]
+		sortByTime(group)
+		var current *speedDiscrepancy
+		finish := func() {
+			if current != nil && current.Duration >= config.Parameters.SpeedDiscrepancyMinSeconds {
+				found = append(found, *current)
+			}
+			current = nil
+		}
+		for i := range group {
+			r := &group[i]
+			if r.PreviousRow == 0 || r.Outlier || !r.HasSourceSpeed || r.TimeDiff <= 0 {
+				finish()
+				continue
+			}
+			difference := r.SourceSpeed - computedSpeed(r)
+			if math.Abs(difference) <= threshold {
+				finish()
+				continue
+			}
+			if current != nil && (current.MaxDifference > 0) != (difference > 0) {
+				finish()
+			}
+			if current == nil {
+				current = &speedDiscrepancy{ID: id, Start: r.PrevTimestamp}
+			}
+			current.End = r.Timestamp
+			current.Points++
+			current.Duration += r.TimeDiff
+			current.Distance += r.Distance
+			current.SourceTotal += r.SourceSpeed * r.TimeDiff
+			if math.Abs(difference) > math.Abs(current.MaxDifference) {
+				current.MaxDifference = difference
+			}
+		}
+		finish()
+	}
+	return found
+}
+
+// writeSpeedDiscrepancies writes one CSV row per speed discrepancy
+func writeSpeedDiscrepancies(filename string, discrepancies []speedDiscrepancy) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create speed discrepancy report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"ID", "start", "end", "points", "duration_seconds", "distance_km",
+		"computed_speed_kmh", "source_speed_kmh", "difference_kmh", "max_difference_kmh", "direction"})
+	for i := range discrepancies {
+		d := &discrepancies[i]
+		direction := "source_higher"
+		if d.MaxDifference < 0 {
+			direction = "source_lower"
+		}
+		_ = writer.Write([]string{
+			d.ID,
+			d.Start.Format(outputTimeLayout),
+			d.End.Format(outputTimeLayout),
+			strconv.Itoa(d.Points),
+			strconv.FormatFloat(d.Duration, 'f', 0, 64),
+			strconv.FormatFloat(d.Distance, 'f', 3, 64),
+			strconv.FormatFloat(d.meanComputed(), 'f', 1, 64),
+			strconv.FormatFloat(d.meanSource(), 'f', 1, 64),
+			strconv.FormatFloat(d.meanSource()-d.meanComputed(), 'f', 1, 64),
+			strconv.FormatFloat(d.MaxDifference, 'f', 1, 64),
+			direction,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
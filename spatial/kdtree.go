@@ -0,0 +1,142 @@
+// Package spatial provides static in-memory spatial indexes: a k-d tree over points for
+// range queries and an R-tree over bounding boxes for intersection and nearest-item queries.
+// Both are built once from all items and work in whatever planar or angular units the
+// caller supplies.
+package spatial
+
+// KDTree is a static k-d tree over points with any number of dimensions. It is built once
+// from all points and answers box queries without scanning every point.
+type KDTree struct {
+	dims   int
+	coords []float64 // point coordinates, dims values per point, in tree order
+	ids    []int     // original index of each point, in tree order
+}
+
+// kdLeafSize is the number of points below which a subtree is scanned linearly
+const kdLeafSize = 16
+
+// NewKDTree builds a tree over n points whose coordinates are given by coord(i, dim)
+func NewKDTree(n, dims int, coord func(i, dim int) float64) *KDTree {
+	t := &KDTree{
+		dims:   dims,
+		coords: make([]float64, n*dims),
+		ids:    make([]int, n),
+	}
+	for i := 0; i < n; i++ {
+		t.ids[i] = i
+		for d := 0; d < dims; d++ {
+			t.coords[i*dims+d] = coord(i, d)
+		}
+	}
+	t.build(0, n-1, 0)
+	return t
+}
+
+// Len returns the number of points in the tree
+func (t *KDTree) Len() int {
+	return len(t.ids)
+}
+
+// build arranges points lo..hi so that each median splits its range on the axis of its depth
+func (t *KDTree) build(lo, hi, axis int) {
+	if hi-lo < kdLeafSize {
+		return
+	}
+	mid := (lo + hi) / 2
+	t.selectNth(mid, lo, hi, axis)
+	next := (axis + 1) % t.dims
+	t.build(lo, mid-1, next)
+	t.build(mid+1, hi, next)
+}
+
+// selectNth partially sorts lo..hi on an axis so that the k-th point is in its sorted
+// position, with smaller values before it and larger ones after (Hoare-style quickselect)
+func (t *KDTree) selectNth(k, lo, hi, axis int) {
+	for hi > lo {
+		pivot := t.coord(k, axis)
+		t.swap(lo, k)
+		if t.coord(hi, axis) > pivot {
+			t.swap(lo, hi)
+		}
+		i, j := lo, hi
+		for i < j {
+			t.swap(i, j)
+			i++
+			j--
+			for t.coord(i, axis) < pivot {
+				i++
+			}
+			for t.coord(j, axis) > pivot {
+				j--
+			}
+		}
+		if t.coord(lo, axis) == pivot {
+			t.swap(lo, j)
+		} else {
+			j++
+			t.swap(j, hi)
+		}
+		if j <= k {
+			lo = j + 1
+		}
+		if k <= j {
+			hi = j - 1
+		}
+	}
+}
+
+func (t *KDTree) coord(i, axis int) float64 {
+	return t.coords[i*t.dims+axis]
+}
+
+func (t *KDTree) swap(i, j int) {
+	t.ids[i], t.ids[j] = t.ids[j], t.ids[i]
+	for d := 0; d < t.dims; d++ {
+		a, b := i*t.dims+d, j*t.dims+d
+		t.coords[a], t.coords[b] = t.coords[b], t.coords[a]
+	}
+}
+
+// Range calls fn with the original index of every point inside the box min..max, bounds
+// included. It stops early when fn returns false.
+func (t *KDTree) Range(min, max []float64, fn func(i int) bool) {
+	if len(t.ids) == 0 {
+		return
+	}
+	t.search(min, max, 0, len(t.ids)-1, 0, fn)
+}
+
+func (t *KDTree) search(min, max []float64, lo, hi, axis int, fn func(i int) bool) bool {
+	if hi-lo < kdLeafSize {
+		for i := lo; i <= hi; i++ {
+			if t.inside(i, min, max) && !fn(t.ids[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	mid := (lo + hi) / 2
+	value := t.coord(mid, axis)
+	if t.inside(mid, min, max) && !fn(t.ids[mid]) {
+		return false
+	}
+	next := (axis + 1) % t.dims
+	if min[axis] <= value && !t.search(min, max, lo, mid-1, next, fn) {
+		return false
+	}
+	if max[axis] >= value && !t.search(min, max, mid+1, hi, next, fn) {
+		return false
+	}
+	return true
+}
+
+func (t *KDTree) inside(i int, min, max []float64) bool {
+	for d := 0; d < t.dims; d++ {
+		v := t.coords[i*t.dims+d]
+		if v < min[d] || v > max[d] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package spatial
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// Box is an axis-aligned bounding box
+type Box struct {
+	MinX, MinY, MaxX, MaxY float64
+}
+
+// Intersects reports whether two boxes overlap, touching edges included
+func (b Box) Intersects(o Box) bool {
+	return b.MinX <= o.MaxX && o.MinX <= b.MaxX && b.MinY <= o.MaxY && o.MinY <= b.MaxY
+}
+
+// Contains reports whether a point lies inside the box, edges included
+func (b Box) Contains(x, y float64) bool {
+	return x >= b.MinX && x <= b.MaxX && y >= b.MinY && y <= b.MaxY
+}
+
+// extend grows the box to cover another one
+func (b Box) extend(o Box) Box {
+	return Box{
+		MinX: math.Min(b.MinX, o.MinX),
+		MinY: math.Min(b.MinY, o.MinY),
+		MaxX: math.Max(b.MaxX, o.MaxX),
+		MaxY: math.Max(b.MaxY, o.MaxY),
+	}
+}
+
+// rtreeNodeSize is the maximum number of entries in an R-tree node
+const rtreeNodeSize = 16
+
+// RTree is a static R-tree over boxes, bulk loaded with the Sort-Tile-Recursive algorithm.
+// It indexes items with extent, such as route segments or geofence polygons.
+type RTree struct {
+	root *rtreeNode
+	size int
+}
+
+type rtreeNode struct {
+	box      Box
+	children []*rtreeNode // nil for leaves
+	id       int          // original index of a leaf's box
+}
+
+func (n *rtreeNode) leaf() bool {
+	return n.children == nil
+}
+
+// NewRTree builds a tree over boxes, identified by their index in the slice
+func NewRTree(boxes []Box) *RTree {
+	nodes := make([]*rtreeNode, len(boxes))
+	for i, b := range boxes {
+		nodes[i] = &rtreeNode{box: b, id: i}
+	}
+	t := &RTree{size: len(boxes)}
+	if len(nodes) == 0 {
+		return t
+	}
+	for len(nodes) > 1 {
+		nodes = packLevel(nodes)
+	}
+	t.root = nodes[0]
+	return t
+}
+
+// packLevel groups nodes into parents of up to rtreeNodeSize children: sorted into vertical
+// slices by x, then into runs by y within each slice
+func packLevel(nodes []*rtreeNode) []*rtreeNode {
+	centerX := func(n *rtreeNode) float64 { return n.box.MinX + n.box.MaxX }
+	centerY := func(n *rtreeNode) float64 { return n.box.MinY + n.box.MaxY }
+
+	parents := int(math.Ceil(float64(len(nodes)) / rtreeNodeSize))
+	slices := int(math.Ceil(math.Sqrt(float64(parents))))
+	sliceSize := slices * rtreeNodeSize
+
+	sort.Slice(nodes, func(i, j int) bool { return centerX(nodes[i]) < centerX(nodes[j]) })
+	var level []*rtreeNode
+	for start := 0; start < len(nodes); start += sliceSize {
+		slice := nodes[start:min(start+sliceSize, len(nodes))]
+		sort.Slice(slice, func(i, j int) bool { return centerY(slice[i]) < centerY(slice[j]) })
+		for i := 0; i < len(slice); i += rtreeNodeSize {
+			children := slice[i:min(i+rtreeNodeSize, len(slice))]
+			parent := &rtreeNode{box: children[0].box, children: append([]*rtreeNode(nil), children...)}
+			for _, c := range children[1:] {
+				parent.box = parent.box.extend(c.box)
+			}
+			level = append(level, parent)
+		}
+	}
+	return level
+}
+
+// Len returns the number of boxes in the tree
+func (t *RTree) Len() int {
+	return t.size
+}
+
+// Search calls fn with the index of every box that intersects the query box.
+// It stops early when fn returns false.
+func (t *RTree) Search(query Box, fn func(i int) bool) {
+	if t.root == nil || !t.root.box.Intersects(query) {
+		return
+	}
+	stack := []*rtreeNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if n.leaf() {
+			if !fn(n.id) {
+				return
+			}
+			continue
+		}
+		for _, c := range n.children {
+			if c.box.Intersects(query) {
+				stack = append(stack, c)
+			}
+		}
+	}
+}
+
+// Nearest returns the index of the item closest by dist and its distance, or -1 when the
+// tree is empty. bound must never exceed the distance of any item inside a box, so that
+// subtrees farther away than the best item found so far can be skipped.
+func (t *RTree) Nearest(bound func(b Box) float64, dist func(i int) float64) (int, float64) {
+	best, bestDist := -1, math.Inf(1)
+	if t.root == nil {
+		return best, bestDist
+	}
+
+	queue := &rtreeQueue{{node: t.root, dist: bound(t.root.box)}}
+	for queue.Len() > 0 {
+		item := heap.Pop(queue).(rtreeQueueItem)
+		if item.dist >= bestDist {
+			break
+		}
+		if item.node.leaf() {
+			if d := dist(item.node.id); d < bestDist {
+				best, bestDist = item.node.id, d
+			}
+			continue
+		}
+		for _, c := range item.node.children {
+			if d := bound(c.box); d < bestDist {
+				heap.Push(queue, rtreeQueueItem{node: c, dist: d})
+			}
+		}
+	}
+	return best, bestDist
+}
+
+// rtreeQueue is a priority queue of nodes ordered by their distance bound
+type rtreeQueue []rtreeQueueItem
+
+type rtreeQueueItem struct {
+	node *rtreeNode
+	dist float64
+}
+
+func (q rtreeQueue) Len() int           { return len(q) }
+func (q rtreeQueue) Less(i, j int) bool { return q[i].dist < q[j].dist }
+func (q rtreeQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *rtreeQueue) Push(x any)        { *q = append(*q, x.(rtreeQueueItem)) }
+func (q *rtreeQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
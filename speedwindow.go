@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// speedWindow is the span over which windowed speed is computed: either a number of
+// points or a duration. The zero value disables windowed speed.
+type speedWindow struct {
+	points   int
+	duration time.Duration
+}
+
+// parseSpeedWindow parses parameters.speed_window: a point count such as "5" or a
+// duration such as "30s" or "2m"
+func parseSpeedWindow(value string) (speedWindow, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return speedWindow{}, nil
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 2 {
+			return speedWindow{}, fmt.Errorf("invalid speed_window %q (a point window needs at least 2 points)", value)
+		}
+		return speedWindow{points: n}, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return speedWindow{}, fmt.Errorf("invalid speed_window %q (use a point count such as 5 or a duration such as 30s)", value)
+	}
+	return speedWindow{duration: d}, nil
+}
+
+// apply sets WindowSpeed on each record of a time-sorted group whose distances have been
+// calculated: the distance travelled over the window ending at the record, divided by the
+// time it spans. The window shrinks at the start of the track.
+func (w speedWindow) apply(group []Record) {
+	if w.points == 0 && w.duration == 0 {
+		return
+	}
+
+	// cumulative[i] is the distance travelled from the first point to point i
+	cumulative := make([]float64, len(group))
+	for i := 1; i < len(group); i++ {
+		cumulative[i] = cumulative[i-1]
+		if !group[i].Outlier {
+			cumulative[i] += group[i].Distance
+		}
+	}
+
+	start := 0
+	for i := range group {
+		if w.points > 0 {
+			start = max(0, i-w.points+1)
+		} else {
+			for group[i].Timestamp.Sub(group[start].Timestamp) > w.duration {
+				start++
+			}
+		}
+
+		group[i].WindowSpeed = 0
+		if hours := group[i].Timestamp.Sub(group[start].Timestamp).Hours(); hours > 0 {
+			group[i].WindowSpeed = (cumulative[i] - cumulative[start]) / hours
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// processingStage is a named step that the pipeline settings can insert between the built-in
+// steps. Run receives the records at that point of the pipeline and returns the records that
+// continue, so a stage can drop, add or change records.
+type processingStage struct {
+	Name        string
+	Description string
+	Run         func(records []Record, config *Config) ([]Record, error)
+
+	// Check optionally validates the settings the stage needs, before any input is read
+	Check func(config *Config) error
+}
+
+// processingStages lists the stages the pipeline settings can use. Custom stages are added
+// with registerStage from an init function in their own file of this package, so a
+// proprietary filter can be built in without changing main.go.
+var processingStages = []processingStage{
+	{Name: "dedupe_timestamps", Description: "keep only the first point of a device at each timestamp", Run: dedupeTimestamps},
+	{Name: "drop_stopped", Description: "remove points recorded while stopped (requires parameters.trip_stop_minutes)", Run: dropStopped, Check: checkDropStopped},
+}
+
+// registerStage makes a custom stage available to the pipeline settings
+func registerStage(stage processingStage) {
+	if findStage(stage.Name) != nil {
+		panic(fmt.Sprintf("processing stage %q registered twice", stage.Name))
+	}
+	processingStages = append(processingStages, stage)
+}
+
+// findStage returns the stage with the given name, or nil
+func findStage(name string) *processingStage {
+	for i := range processingStages {
+		if processingStages[i].Name == name {
+			return &processingStages[i]
+		}
+	}
+	return nil
+}
+
+// availableStages returns a comma-separated list of the stage names
+func availableStages() string {
+	names := make([]string, len(processingStages))
+	for i, stage := range processingStages {
+		names[i] = stage.Name
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// checkPipeline validates the stage names in the pipeline settings
+func checkPipeline(config *Config) error {
+	p := &config.Pipeline
+	for _, names := range [][]string{p.AfterRead, p.AfterCompute, p.AfterFilter} {
+		for _, name := range names {
+			stage := findStage(name)
+			if stage == nil {
+				return fmt.Errorf("unknown pipeline stage %q (available: %s)", name, availableStages())
+			}
+			if stage.Check != nil {
+				if err := stage.Check(config); err != nil {
+					return fmt.Errorf("pipeline stage %s: %w", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// runStages passes the records through the named stages in order
+func runStages(names []string, records []Record, config *Config) ([]Record, error) {
+	for _, name := range names {
+		before := len(records)
+		var err error
+		records, err = findStage(name).Run(records, config)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", name, err)
+		}
+		logInfo("Stage %s: %d records in, %d out", name, before, len(records))
+	}
+	return records, nil
+}
+
+// dedupeTimestamps drops repeated points of a device at a timestamp already seen, such as
+// rows exported twice by overlapping downloads. The first point in input order is kept.
+func dedupeTimestamps(records []Record, config *Config) ([]Record, error) {
+	type key struct {
+		id   string
+		nano int64
+	}
+	seen := make(map[key]bool, len(records))
+	kept := records[:0]
+	for _, record := range records {
+		k := key{record.ID, record.Timestamp.UnixNano()}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		kept = append(kept, record)
+	}
+	return kept, nil
+}
+
+// dropStopped removes the points that are not part of a trip
+func dropStopped(records []Record, config *Config) ([]Record, error) {
+	kept := records[:0]
+	for _, record := range records {
+		if record.Trip > 0 {
+			kept = append(kept, record)
+		}
+	}
+	return kept, nil
+}
+
+// checkDropStopped makes sure trips are segmented, so there are stops to drop
+func checkDropStopped(config *Config) error {
+	if config.Parameters.TripStopMinutes <= 0 {
+		return fmt.Errorf("requires parameters.trip_stop_minutes")
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkStitching validates the stitching and incremental settings
+func checkStitching(config *Config) error {
+	p := &config.Parameters
+	if p.StitchWith != "" && p.IncrementalFrom != "" {
+		return fmt.Errorf("stitch_with and incremental_from cannot be used together")
+	}
+	if p.StitchMaxGapMinutes < 0 {
+		return fmt.Errorf("stitch_max_gap_minutes must not be negative")
+	}
+	if p.IncrementalFrom != "" && config.Privacy.IDs != "" {
+		return fmt.Errorf("incremental_from needs the device IDs of the previous output, which privacy.ids replaces")
+	}
+	return nil
+}
+
+// loadStitchPoints reads parameters.stitch_with, a previous file of the same devices in the
+// same format as the input, and returns the last point of each device in it. The file is
+// read with the input's column and ID settings.
+func loadStitchPoints(config *Config) (map[string]Record, error) {
+	records, err := readInput(config.Parameters.StitchWith, config, nil)
+	if err != nil {
+		return nil, fmt.Errorf("stitch_with: %w", err)
+	}
+	last := make(map[string]Record)
+	for _, r := range records {
+		// Of points at the same time, the last in the file wins, as with duplicate_timestamps: last
+		if point, ok := last[r.ID]; !ok || !r.Timestamp.Before(point.Timestamp) {
+			r.Passthrough = nil
+			last[r.ID] = r
+		}
+	}
+	return last, nil
+}
+
+// stitchPoint returns the point of the stitched file a device's time-sorted group continues
+// from: the device's last point there, when it is earlier than the group's first point and,
+// with parameters.stitch_max_gap_minutes, not too long before it
+func (p *GroupProcessor) stitchPoint(id string, group []Record) (Record, bool) {
+	point, ok := p.config.stitchPoints[id]
+	if !ok || len(group) == 0 || !point.Timestamp.Before(group[0].Timestamp) {
+		return Record{}, false
+	}
+	if maxGap := p.config.Parameters.StitchMaxGapMinutes; maxGap > 0 &&
+		group[0].Timestamp.Sub(point.Timestamp) > time.Duration(maxGap*float64(time.Minute)) {
+		return Record{}, false
+	}
+	return point, true
+}
+
+// loadIncrementalState reads parameters.incremental_from, the CSV output of an earlier run,
+// and returns the last point of each device in it. The file must have the ID, latitude,
+// longitude and timestamp output columns.
+func loadIncrementalState(config *Config) (map[string]Record, error) {
+	filename := config.Parameters.IncrementalFrom
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("incremental_from: %w", err)
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("incremental_from: unable to read the header of %s: %w", filename, err)
+	}
+	index := map[string]int{"ID": -1, "latitude": -1, "longitude": -1, "timestamp": -1, "original_row": -1}
+	for i, name := range header {
+		if _, ok := index[strings.TrimSpace(name)]; ok {
+			index[strings.TrimSpace(name)] = i
+		}
+	}
+	for _, name := range []string{"ID", "latitude", "longitude", "timestamp"} {
+		if index[name] == -1 {
+			return nil, fmt.Errorf("incremental_from: %s has no %s column; it must be a CSV output of this program", filename, name)
+		}
+	}
+
+	last := make(map[string]Record)
+	for row := 2; ; row++ {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("incremental_from: %w", err)
+		}
+		var r Record
+		r.ID = rowField(values, index["ID"])
+		lat, latErr := strconv.ParseFloat(rowField(values, index["latitude"]), 64)
+		lon, lonErr := strconv.ParseFloat(rowField(values, index["longitude"]), 64)
+		t, timeErr := time.Parse(time.RFC3339Nano, rowField(values, index["timestamp"]))
+		if latErr != nil || lonErr != nil || timeErr != nil {
+			return nil, fmt.Errorf("incremental_from: invalid point in row %d of %s", row, filename)
+		}
+		r.Latitude, r.Longitude, r.Timestamp = lat, lon, t
+		// The first point of the new input refers back to this row, so it must not be 0
+		r.OriginalRow = row
+		if index["original_row"] != -1 {
+			if n, err := strconv.Atoi(rowField(values, index["original_row"])); err == nil && n > 0 {
+				r.OriginalRow = n
+			}
+		}
+		if point, ok := last[r.ID]; !ok || !r.Timestamp.Before(point.Timestamp) {
+			last[r.ID] = r
+		}
+	}
+	return last, nil
+}
+
+// skipProcessed drops the points that are not later than their device's last point in the
+// previous output or stitched file, since the earlier run already covered them, and returns
+// the remaining records and how many were dropped
+func skipProcessed(records []Record, last map[string]Record) ([]Record, int) {
+	kept := records[:0]
+	for _, r := range records {
+		if point, ok := last[r.ID]; ok && !r.Timestamp.After(point.Timestamp) {
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return kept, len(records) - len(kept)
+}
+
+// updatedDevice is a device with records in the outputs, for the updated devices list
+type updatedDevice struct {
+	ID          string
+	Records     int
+	First, Last time.Time
+}
+
+// updatedDevices lists the devices that have output records, in ID order. In an incremental
+// run these are the devices with new data.
+func updatedDevices(records []Record) []updatedDevice {
+	byID := make(map[string]*updatedDevice)
+	for i := range records {
+		r := &records[i]
+		d := byID[r.ID]
+		if d == nil {
+			d = &updatedDevice{ID: r.ID, First: r.Timestamp, Last: r.Timestamp}
+			byID[r.ID] = d
+		}
+		d.Records++
+		if r.Timestamp.Before(d.First) {
+			d.First = r.Timestamp
+		}
+		if r.Timestamp.After(d.Last) {
+			d.Last = r.Timestamp
+		}
+	}
+	devices := make([]updatedDevice, 0, len(byID))
+	for _, d := range byID {
+		devices = append(devices, *d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// writeUpdatedDevices writes one CSV row per updated device
+func writeUpdatedDevices(filename string, devices []updatedDevice) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create updated devices list: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"ID", "records", "first_timestamp", "last_timestamp"})
+	for _, d := range devices {
+		_ = writer.Write([]string{d.ID, strconv.Itoa(d.Records), d.First.Format(outputTimeLayout), d.Last.Format(outputTimeLayout)})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gps-processor/haversine"
+)
+
+// maxStreamWarnings is the number of skipped lines reported as warnings; later ones are
+// debug messages
+const maxStreamWarnings = 100
+
+// streamPoint is the last accepted fix of a device, which the next fix is measured from
+type streamPoint struct {
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Timestamp time.Time `json:"timestamp"`
+	Row       int       `json:"row"`
+}
+
+// maxStateAttempts is how often a fix is measured again because another instance saved a
+// newer fix of the device in the meantime, before the stream gives up
+const maxStateAttempts = 10
+
+// streamState stores the last fix of each device between fixes. put saves a device's new
+// last fix only if the state has not changed since get read it, and reports whether it did.
+type streamState interface {
+	get(id string) (streamPoint, bool, error)
+	put(id string, p streamPoint) (bool, error)
+}
+
+// memoryState keeps the last fixes in memory, for a single instance
+type memoryState map[string]streamPoint
+
+func (m memoryState) get(id string) (streamPoint, bool, error) {
+	p, ok := m[id]
+	return p, ok, nil
+}
+
+func (m memoryState) put(id string, p streamPoint) (bool, error) {
+	m[id] = p
+	return true, nil
+}
+
+// stateError is a failure of the state store, which stops the stream instead of skipping
+// the fix, so no fix is passed on without its previous fix
+type stateError struct{ err error }
+
+func (e *stateError) Error() string { return e.err.Error() }
+func (e *stateError) Unwrap() error { return e.err }
+
+// newStreamState returns the state store configured in the stream section
+func newStreamState(config *Config) (streamState, error) {
+	st := &config.Stream
+	switch st.State {
+	case "", "memory":
+		return make(memoryState), nil
+	case "redis":
+		if st.RedisURL == "" {
+			return nil, fmt.Errorf("stream.state redis requires stream.redis_url")
+		}
+		if st.RedisTTLHours < 0 {
+			return nil, fmt.Errorf("stream.redis_ttl_hours must not be negative")
+		}
+		ttl := time.Duration(st.RedisTTLHours * float64(time.Hour))
+		return newRedisStore(st.RedisURL, st.RedisKeyPrefix, ttl)
+	}
+	return nil, fmt.Errorf("unknown stream.state %q (use memory or redis)", st.State)
+}
+
+// runStream implements the stream subcommand: it reads GPS fixes as JSON objects, one per
+// line, from standard input and writes each one back to standard output with the distance,
+// time and speed from the device's previous fix added. With stream.kafka_brokers set, the
+// fixes are consumed from and published to Kafka topics instead. Only the last fix of each
+// device is kept, in memory or in Redis, so the stream can run indefinitely.
+func runStream(args []string, config *Config) int {
+	var overrides repeatedString
+	fs := flag.NewFlagSet("gps-processor stream", flag.ContinueOnError)
+	fs.Var(&overrides, "set", "override a config value, e.g. parameters.filter_above_kph=2.5; may be repeated")
+	profile := fs.String("profile", "", "apply the named profile from the config file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gps-processor stream [config_file] [--set PATH=VAL] [--profile NAME] < fixes.jsonl > enriched.jsonl")
+		fmt.Fprintln(os.Stderr, "\nReads one JSON object per line from standard input, with the ID, latitude,")
+		fmt.Fprintln(os.Stderr, "longitude and timestamp fields named as in the columns section, and writes each")
+		fmt.Fprintln(os.Stderr, "object to standard output with time_diff_seconds, distance_km, speed_kmh,")
+		fmt.Fprintln(os.Stderr, "bearing_deg and the previous fix of the same device added.")
+		fmt.Fprintln(os.Stderr, "\nWith stream.kafka_brokers set, the fixes are read from stream.kafka_input_topic")
+		fmt.Fprintln(os.Stderr, "and published to stream.kafka_output_topic until the stream is stopped.")
+	}
+	args, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	if err != nil {
+		return exitUsage
+	}
+
+	// Standard output carries the records, so messages go to standard error
+	logger.stdout = os.Stderr
+	progressMode = "none"
+
+	if len(args) > 0 {
+		if err := loadConfig(args[0], config); err != nil {
+			logError("Error loading config file: %v", err)
+			return exitConfigError
+		}
+	}
+	if *profile != "" {
+		if err := applyProfile(config, *profile); err != nil {
+			logError("Error: %v", err)
+			return exitConfigError
+		}
+	}
+	if _, err := applyEnvOverrides(config); err != nil {
+		logError("Error: %v", err)
+		return exitConfigError
+	}
+	if err := applySetOverrides(config, overrides); err != nil {
+		logError("Error: %v", err)
+		return exitConfigError
+	}
+
+	s, err := newStreamProcessor(config)
+	if err != nil {
+		logError("Error: %v", err)
+		return exitConfigError
+	}
+	if len(config.Stream.KafkaBrokers) > 0 {
+		source, sink, err := newKafkaClients(config)
+		if err != nil {
+			logError("Error: %v", err)
+			return exitConfigError
+		}
+		defer source.Close()
+		defer sink.Close()
+		// The stream runs until it is stopped
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		logInfo("Streaming from Kafka topic %s to %s", config.Stream.KafkaInputTopic, config.Stream.KafkaOutputTopic)
+		err = s.runKafka(ctx, source, sink, kafkaBatchSize(config))
+		if err != nil {
+			logError("Error: %v", err)
+			return exitInputError
+		}
+	} else if err := s.run(os.Stdin, os.Stdout); err != nil {
+		logError("Error: %v", err)
+		return exitInputError
+	}
+	logInfo("Stream ended: %d fixes read, %d written, %d skipped", s.read, s.written, s.skipped)
+	return exitOK
+}
+
+// streamProcessor computes the per-fix values of a stream from the last fix of each device
+type streamProcessor struct {
+	config     *Config
+	calc       distanceCalculator
+	ids        *idFilter
+	normalize  *idNormalizer
+	numbers    numberFormat
+	timestamps timestampParser
+	thresholds *ThresholdSet
+	last       streamState
+
+	read, written, skipped int
+}
+
+// newStreamProcessor validates the settings the stream uses
+func newStreamProcessor(config *Config) (*streamProcessor, error) {
+	calc, err := selectedDistance(config)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := newIDFilter(config)
+	if err != nil {
+		return nil, err
+	}
+	numbers, err := inputNumberFormat(config)
+	if err != nil {
+		return nil, err
+	}
+	timestamps, err := newTimestampParser(config)
+	if err != nil {
+		return nil, err
+	}
+	normalize, err := newIDNormalizer(config)
+	if err != nil {
+		return nil, err
+	}
+	last, err := newStreamState(config)
+	if err != nil {
+		return nil, err
+	}
+	return &streamProcessor{config: config, calc: calc, ids: ids, normalize: normalize, numbers: numbers, timestamps: timestamps,
+		thresholds: NewThresholdSet(config), last: last}, nil
+}
+
+// run processes the stream until the input ends or the state store fails. Lines that cannot
+// be parsed are skipped with a warning rather than stopping the stream.
+func (s *streamProcessor) run(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxEnrichLine)
+	writer := bufio.NewWriter(out)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		data, err := s.next(line)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if _, err := writer.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		s.written++
+		// Each fix is passed on as soon as it is processed
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// next processes one fix and returns the enriched object, or nil when the fix is skipped or
+// dropped. Only a failure of the state store is returned as an error.
+func (s *streamProcessor) next(line []byte) ([]byte, error) {
+	s.read++
+	data, err := s.process(line, s.read)
+	var storeErr *stateError
+	if errors.As(err, &storeErr) {
+		return nil, err
+	}
+	if err != nil {
+		// Warnings are kept for the run summary, so a long stream of bad lines is only sampled
+		if s.skipped++; s.skipped <= maxStreamWarnings {
+			logWarn("Skipping line %d: %v", s.read, err)
+		} else {
+			logDebug("Skipping line %d: %v", s.read, err)
+		}
+		return nil, nil
+	}
+	return data, nil
+}
+
+// process handles one line and returns the enriched object, or nil when the fix is dropped
+// by the ID or speed filter. A fix that is not newer than the device's last fix has no
+// previous fix to measure from, so like a device's first fix it is dropped, and it does not
+// replace the last fix.
+func (s *streamProcessor) process(line []byte, row int) ([]byte, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(line, &object); err != nil {
+		return nil, err
+	}
+	c := &s.config.Columns
+	// The ID fields come first: one, or the parts of a composite ID
+	fields := []string{c.ID}
+	if len(c.IDColumns) > 0 {
+		fields = append([]string(nil), c.IDColumns...)
+	}
+	k := len(fields)
+	fields = append(fields, c.Latitude, c.Longitude, c.Timestamp)
+	if c.Date != "" {
+		fields = append(fields[:k+2], c.Date, c.Time)
+	}
+	values := make([]string, len(fields))
+	for i, name := range fields {
+		raw, ok := object[name]
+		if !ok {
+			return nil, fmt.Errorf("missing field %q", name)
+		}
+		values[i] = enrichValue(raw)
+	}
+	cols := inputColumns{ID: 0, Latitude: k, Longitude: k + 1, Timestamp: k + 2, Altitude: -1, Speed: -1, Date: -1, Time: -1,
+		Numbers: s.numbers, DMS: c.CoordinateFormat == "dms", Timestamps: s.timestamps, IDs: s.normalize}
+	if c.Date != "" {
+		cols.Timestamp, cols.Date, cols.Time = -1, k+2, k+3
+	}
+	if len(c.IDColumns) > 0 {
+		for i := 0; i < k; i++ {
+			cols.IDParts = append(cols.IDParts, i)
+		}
+		cols.IDSeparator = idSeparator(s.config)
+	}
+	cols.setDeviceID(values)
+	record, err := parseRecord(values, cols, row)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ids.Match(record.ID) {
+		return nil, nil
+	}
+
+	// Another instance sharing the state may save a fix of the device between reading its
+	// last fix and saving this one; the fix is then measured again from that fix
+	parsed := record
+	for attempt := 1; ; attempt++ {
+		record = parsed
+		prev, ok, err := s.last.get(record.ID)
+		if err != nil {
+			return nil, &stateError{err}
+		}
+		if ok && record.Timestamp.After(prev.Timestamp) {
+			from := &Record{Latitude: prev.Latitude, Longitude: prev.Longitude}
+			record.TimeDiff = record.Timestamp.Sub(prev.Timestamp).Seconds()
+			record.Distance = s.calc.Distance(from, &record)
+			record.Speed = record.Distance / (record.TimeDiff / 3600)
+			record.Bearing = haversine.Bearing(prev.Latitude, prev.Longitude, record.Latitude, record.Longitude)
+			record.PreviousRow = prev.Row
+			record.PrevLatitude, record.PrevLongitude, record.PrevTimestamp = prev.Latitude, prev.Longitude, prev.Timestamp
+		}
+		if ok && record.PreviousRow == 0 {
+			break
+		}
+		saved, err := s.last.put(record.ID, streamPoint{record.Latitude, record.Longitude, record.Timestamp, row})
+		if err != nil {
+			return nil, &stateError{err}
+		}
+		if saved {
+			break
+		}
+		if attempt == maxStateAttempts {
+			return nil, &stateError{fmt.Errorf("the state of device %s kept changing while saving it", record.ID)}
+		}
+	}
+
+	// The speed filter drops fixes as in a batch run, including each device's first fix
+	if filterReason(&record, s.thresholds.speedThreshold(record.ID), nil) != "" {
+		return nil, nil
+	}
+
+	number := func(v float64, setting string) json.Number {
+		return json.Number(strconv.FormatFloat(v, 'f', outputPrecision(s.config, setting), 64))
+	}
+	added := map[string]interface{}{
+		"time_diff_seconds": number(record.TimeDiff, ""),
+		"distance_km":       number(record.Distance, "distance"),
+		"speed_kmh":         number(record.Speed, "speed"),
+		"bearing_deg":       number(record.Bearing, ""),
+		"prev_latitude":     number(record.PrevLatitude, "coordinate"),
+		"prev_longitude":    number(record.PrevLongitude, "coordinate"),
+		"prev_timestamp":    record.PrevTimestamp.Format(outputTimeLayout),
+	}
+	for key, value := range added {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		object[key] = data
+	}
+	return json.Marshal(object)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// DeviceSummary holds aggregate statistics for a single device
+type DeviceSummary struct {
+	ID        string
+	Points    int
+	StartTime time.Time
+	EndTime   time.Time
+	Distance  float64 // total distance in kilometers
+	Duration  float64 // total time in seconds
+	MaxSpeed  float64 // maximum speed in kilometers per hour
+	AvgSpeed  float64 // average speed in kilometers per hour
+}
+
+// summarizeDevices computes per-device statistics, sorted by device ID
+func summarizeDevices(records []Record) []DeviceSummary {
+	summaries := make(map[string]*DeviceSummary)
+	for _, record := range records {
+		summary, ok := summaries[record.ID]
+		if !ok {
+			summary = &DeviceSummary{
+				ID:        record.ID,
+				StartTime: record.Timestamp,
+				EndTime:   record.Timestamp,
+			}
+			summaries[record.ID] = summary
+		}
+
+		summary.Points++
+		if record.Timestamp.Before(summary.StartTime) {
+			summary.StartTime = record.Timestamp
+		}
+		if record.Timestamp.After(summary.EndTime) {
+			summary.EndTime = record.Timestamp
+		}
+		// Flagged outliers are kept as points but do not count towards distance or speed
+		if record.Outlier {
+			continue
+		}
+		summary.Distance += record.Distance
+		summary.Duration += record.TimeDiff
+		if record.Speed > summary.MaxSpeed {
+			summary.MaxSpeed = record.Speed
+		}
+	}
+
+	result := make([]DeviceSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		// Average speed over the time actually covered by the segments
+		if summary.Duration > 0 {
+			summary.AvgSpeed = summary.Distance / (summary.Duration / 3600)
+		}
+		result = append(result, *summary)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// DeviceThresholds overrides processing thresholds for the devices it is configured for;
+// settings left out keep their global value
+type DeviceThresholds struct {
+	FilterAboveKph   *float64 `yaml:"filter_above_kph"`
+	OutlierThreshold *float64 `yaml:"outlier_threshold"`
+	OutlierMinMeters *float64 `yaml:"outlier_min_meters"`
+}
+
+// checkDeviceThresholds validates parameters.device_thresholds
+func checkDeviceThresholds(config *Config) error {
+	for key, t := range config.Parameters.DeviceThresholds {
+		if _, err := path.Match(key, ""); err != nil {
+			return fmt.Errorf("device_thresholds: invalid pattern %q", key)
+		}
+		for _, v := range []*float64{t.FilterAboveKph, t.OutlierThreshold, t.OutlierMinMeters} {
+			if v != nil && *v < 0 {
+				return fmt.Errorf("device_thresholds %q: thresholds must not be negative", key)
+			}
+		}
+	}
+	return nil
+}
+
+// ThresholdSet finds the thresholds that apply to each device
+type ThresholdSet struct {
+	filterAboveKph float64 // global speed filter threshold
+	byID           map[string]*DeviceThresholds
+	patterns       []string // keys with wildcards, in sorted order
+	resolved       map[string]*DeviceThresholds
+}
+
+// NewThresholdSet builds the thresholds of parameters.filter_above_kph and
+// parameters.device_thresholds
+func NewThresholdSet(config *Config) *ThresholdSet {
+	t := &ThresholdSet{
+		filterAboveKph: config.Parameters.FilterAboveKph,
+		byID:           make(map[string]*DeviceThresholds),
+		resolved:       make(map[string]*DeviceThresholds),
+	}
+	for key, overrides := range config.Parameters.DeviceThresholds {
+		overrides := overrides
+		t.byID[key] = &overrides
+		if hasWildcard(key) {
+			t.patterns = append(t.patterns, key)
+		}
+	}
+	sort.Strings(t.patterns)
+	return t
+}
+
+// hasWildcard reports whether a device_thresholds key is a glob pattern
+func hasWildcard(key string) bool {
+	for _, c := range key {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the overrides of a device, or nil when there are none. An exact device ID
+// wins over patterns; among patterns, the first in sorted order that matches wins.
+func (t *ThresholdSet) lookup(id string) *DeviceThresholds {
+	if t == nil || len(t.byID) == 0 {
+		return nil
+	}
+	if overrides, ok := t.resolved[id]; ok {
+		return overrides
+	}
+	overrides := t.byID[id]
+	if overrides == nil {
+		for _, pattern := range t.patterns {
+			if ok, _ := path.Match(pattern, id); ok {
+				overrides = t.byID[pattern]
+				break
+			}
+		}
+	}
+	t.resolved[id] = overrides
+	return overrides
+}
+
+// speedThreshold returns the filter_above_kph of a device
+func (t *ThresholdSet) speedThreshold(id string) float64 {
+	if o := t.lookup(id); o != nil && o.FilterAboveKph != nil {
+		return *o.FilterAboveKph
+	}
+	return t.filterAboveKph
+}
+
+// rekey returns overrides keyed by the new device IDs, resolved for the original IDs, for
+// use after the IDs are pseudonymized
+func (t *ThresholdSet) rekey(mapping map[string]string) map[string]DeviceThresholds {
+	rekeyed := make(map[string]DeviceThresholds)
+	for id, name := range mapping {
+		if o := t.lookup(id); o != nil {
+			rekeyed[name] = *o
+		}
+	}
+	return rekeyed
+}
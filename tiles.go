@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gps-processor/mbtiles"
+	"gps-processor/mvt"
+)
+
+// Vector tile settings
+const (
+	defaultTileMaxZoom = 14
+	maxTileZoom        = 18
+	tileBuffer         = 64     // tile units drawn past each edge, so lines join across tiles
+	maxMercatorLat     = 85.051 // web mercator cuts off the poles here
+	tileLayerName      = "trajectories"
+)
+
+// checkVectorTiles validates the zoom range and container of output.vector_tiles
+func checkVectorTiles(config *Config) error {
+	minZoom, maxZoom := tileZooms(config)
+	if minZoom < 0 || maxZoom > maxTileZoom || minZoom > maxZoom {
+		return fmt.Errorf("invalid tile zooms %d to %d (use 0 <= tile_min_zoom <= tile_max_zoom <= %d)", minZoom, maxZoom, maxTileZoom)
+	}
+	switch config.Output.TileFormat {
+	case "", "directory", "mbtiles":
+	default:
+		return fmt.Errorf("unknown output.tile_format %q (use directory or mbtiles)", config.Output.TileFormat)
+	}
+	return nil
+}
+
+// tileZooms returns the configured zoom range with the default maximum applied
+func tileZooms(config *Config) (int, int) {
+	maxZoom := config.Output.TileMaxZoom
+	if maxZoom == 0 {
+		maxZoom = defaultTileMaxZoom
+	}
+	return config.Output.TileMinZoom, maxZoom
+}
+
+// tilesDirectory returns the path of the tile directory, <basename>_tiles next to the outputs
+func tilesDirectory(inputFile string, config *Config) string {
+	return strings.TrimSuffix(reportFilename(inputFile, "tiles", config), ".csv")
+}
+
+// mbtilesFilename returns the path of the MBTiles file, <basename>_tiles.mbtiles next to the
+// outputs
+func mbtilesFilename(inputFile string, config *Config) string {
+	return tilesDirectory(inputFile, config) + ".mbtiles"
+}
+
+// tileLine is one trajectory to draw: a device's track, or one trip of it when trips are
+// segmented, in web mercator coordinates from 0 to 1
+type tileLine struct {
+	ID         string
+	Trip       int
+	Start, End time.Time
+	X, Y       []float64
+}
+
+// mercator projects a position to web mercator coordinates from 0 to 1, y growing southward
+func mercator(lat, lon float64) (float64, float64) {
+	lat = math.Max(-maxMercatorLat, math.Min(maxMercatorLat, lat))
+	sin := math.Sin(lat * math.Pi / 180)
+	return (lon + 180) / 360, 0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)
+}
+
+// tileLines builds the trajectories of the records, time-sorted per device and split where
+// the trip number changes. Outliers are skipped.
+func tileLines(records []Record) []tileLine {
+	groups := groupByID(records)
+	var lines []tileLine
+	for _, id := range sortedIDs(groups) {
+		group := groups[id]
+		sort.SliceStable(group, func(i, j int) bool { return group[i].Timestamp.Before(group[j].Timestamp) })
+		var line *tileLine
+		for i := range group {
+			r := &group[i]
+			if r.Outlier {
+				continue
+			}
+			if line == nil || line.Trip != r.Trip {
+				lines = append(lines, tileLine{ID: r.ID, Trip: r.Trip, Start: r.Timestamp})
+				line = &lines[len(lines)-1]
+			}
+			x, y := mercator(r.Latitude, r.Longitude)
+			line.X = append(line.X, x)
+			line.Y = append(line.Y, y)
+			line.End = r.Timestamp
+		}
+	}
+	return lines
+}
+
+// tileKey identifies a tile within a zoom level
+type tileKey struct {
+	x, y int
+}
+
+// tilePieces collects the clipped parts of each line in one tile, by line index
+type tilePieces map[int][][]mvt.Point
+
+// cutTiles clips the lines to the tiles of a zoom level. Segments are cut into pieces no
+// longer than a tile, so each piece only has to be clipped against the few tiles around it.
+func cutTiles(lines []tileLine, zoom int) map[tileKey]tilePieces {
+	scale := float64(int(1)<<zoom) * mvt.Extent
+	tiles := make(map[tileKey]tilePieces)
+	for l := range lines {
+		line := &lines[l]
+		for i := 1; i < len(line.X); i++ {
+			x0, y0 := line.X[i-1]*scale, line.Y[i-1]*scale
+			x1, y1 := line.X[i]*scale, line.Y[i]*scale
+			steps := int(math.Ceil(math.Max(math.Abs(x1-x0), math.Abs(y1-y0)) / mvt.Extent))
+			if steps < 1 {
+				steps = 1
+			}
+			for s := 0; s < steps; s++ {
+				t0, t1 := float64(s)/float64(steps), float64(s+1)/float64(steps)
+				addPiece(tiles, l, zoom,
+					x0+(x1-x0)*t0, y0+(y1-y0)*t0,
+					x0+(x1-x0)*t1, y0+(y1-y0)*t1)
+			}
+		}
+	}
+	return tiles
+}
+
+// addPiece clips a short segment, in zoom-level tile units, to each buffered tile it touches
+// and appends it to the line's current part in that tile, or starts a new part
+func addPiece(tiles map[tileKey]tilePieces, line, zoom int, x0, y0, x1, y1 float64) {
+	last := (1 << zoom) - 1
+	first := func(v float64) int { return max(0, int(math.Floor((v-tileBuffer)/mvt.Extent))) }
+	final := func(v float64) int { return min(last, int(math.Floor((v+tileBuffer)/mvt.Extent))) }
+	for tx := first(math.Min(x0, x1)); tx <= final(math.Max(x0, x1)); tx++ {
+		for ty := first(math.Min(y0, y1)); ty <= final(math.Max(y0, y1)); ty++ {
+			left, top := float64(tx*mvt.Extent), float64(ty*mvt.Extent)
+			a0, a1, ok := clipSegment(x0-left, y0-top, x1-left, y1-top, -tileBuffer, mvt.Extent+tileBuffer)
+			if !ok {
+				continue
+			}
+			start := mvt.Point{X: int32(math.Round(x0 - left + a0*(x1-x0))), Y: int32(math.Round(y0 - top + a0*(y1-y0)))}
+			end := mvt.Point{X: int32(math.Round(x0 - left + a1*(x1-x0))), Y: int32(math.Round(y0 - top + a1*(y1-y0)))}
+
+			key := tileKey{tx, ty}
+			pieces := tiles[key]
+			if pieces == nil {
+				pieces = make(tilePieces)
+				tiles[key] = pieces
+			}
+			parts := pieces[line]
+			if n := len(parts); n > 0 && parts[n-1][len(parts[n-1])-1] == start {
+				parts[n-1] = append(parts[n-1], end)
+			} else {
+				parts = append(parts, []mvt.Point{start, end})
+			}
+			pieces[line] = parts
+		}
+	}
+}
+
+// clipSegment clips the segment from (x0, y0) to (x1, y1) to the square from lo to hi on both
+// axes with the Liang–Barsky algorithm. It returns the part kept as fractions of the segment.
+func clipSegment(x0, y0, x1, y1, lo, hi float64) (float64, float64, bool) {
+	t0, t1 := 0.0, 1.0
+	dx, dy := x1-x0, y1-y0
+	for _, edge := range [4][2]float64{{-dx, x0 - lo}, {dx, hi - x0}, {-dy, y0 - lo}, {dy, hi - y0}} {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return 0, 0, false
+			}
+			continue
+		}
+		r := q / p
+		if p < 0 {
+			t0 = math.Max(t0, r)
+		} else {
+			t1 = math.Min(t1, r)
+		}
+		if t0 > t1 {
+			return 0, 0, false
+		}
+	}
+	return t0, t1, true
+}
+
+// encodeTile encodes the parts of the lines that fall in one tile
+func encodeTile(lines []tileLine, pieces tilePieces, trips bool) []byte {
+	indexes := make([]int, 0, len(pieces))
+	for l := range pieces {
+		indexes = append(indexes, l)
+	}
+	sort.Ints(indexes)
+
+	layer := mvt.Layer{Name: tileLayerName}
+	for _, l := range indexes {
+		line := &lines[l]
+		tags := []mvt.Tag{
+			{Key: "ID", Value: line.ID},
+			{Key: "start", Value: line.Start.Format(outputTimeLayout)},
+			{Key: "end", Value: line.End.Format(outputTimeLayout)},
+		}
+		if trips {
+			tags = append(tags, mvt.Tag{Key: "trip", Value: line.Trip})
+		}
+		layer.Features = append(layer.Features, mvt.Feature{ID: uint64(l + 1), Tags: tags, Lines: pieces[l]})
+	}
+	return mvt.Encode([]mvt.Layer{layer})
+}
+
+// writeVectorTiles writes the trajectories as vector tiles to dir/{z}/{x}/{y}.pbf for each
+// zoom in the configured range, with a TileJSON description in dir/metadata.json. The tiles
+// are built in a temporary directory that replaces dir once complete. It returns the directory
+// actually written, which output.if_exists may rename, and the number of tiles.
+func writeVectorTiles(dir string, records []Record, config *Config) (string, int, error) {
+	dir, err := resolveOutputPath(dir, config)
+	if err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".*.tmp")
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to create tile directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	_ = os.Chmod(tmp, 0755)
+
+	lines := tileLines(records)
+	trips := config.Parameters.TripStopMinutes > 0
+	minZoom, maxZoom := tileZooms(config)
+	count, err := eachTile(lines, trips, minZoom, maxZoom, func(zoom, x, y int, data []byte) error {
+		tileDir := filepath.Join(tmp, fmt.Sprint(zoom), fmt.Sprint(x))
+		if err := os.MkdirAll(tileDir, 0755); err != nil {
+			return fmt.Errorf("unable to create tile directory: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(tileDir, fmt.Sprintf("%d.pbf", y)), data, 0644); err != nil {
+			return fmt.Errorf("unable to write tile: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := writeTileJSON(filepath.Join(tmp, "metadata.json"), lines, trips, minZoom, maxZoom); err != nil {
+		return "", 0, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", 0, fmt.Errorf("unable to replace %s: %w", dir, err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", 0, fmt.Errorf("unable to move tile directory into place: %w", err)
+	}
+	config.manifest.add(filepath.Join(dir, "metadata.json"), "vector_tiles", count)
+	return dir, count, nil
+}
+
+// eachTile cuts the lines into the tiles of each zoom in the range and passes every tile
+// with content to write, in zoom, x and y order. It returns the number of tiles.
+func eachTile(lines []tileLine, trips bool, minZoom, maxZoom int, write func(zoom, x, y int, data []byte) error) (int, error) {
+	bar := newProgress("Writing vector tiles", maxZoom-minZoom+1)
+	count := 0
+	for zoom := minZoom; zoom <= maxZoom; zoom++ {
+		tiles := cutTiles(lines, zoom)
+		keys := make([]tileKey, 0, len(tiles))
+		for key := range tiles {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].x != keys[j].x {
+				return keys[i].x < keys[j].x
+			}
+			return keys[i].y < keys[j].y
+		})
+		for _, key := range keys {
+			data := encodeTile(lines, tiles[key], trips)
+			if len(data) == 0 {
+				continue
+			}
+			if err := write(zoom, key.x, key.y, data); err != nil {
+				return count, err
+			}
+			count++
+		}
+		_ = bar.Add(1)
+	}
+	bar.Finish()
+	return count, nil
+}
+
+// writeMBTiles writes the trajectories as vector tiles to a single MBTiles file for each zoom
+// in the configured range, gzip-compressed as MBTiles readers expect, with the same
+// description as the TileJSON of a tile directory in its metadata table. It returns the file
+// actually written, which output.if_exists may rename, and the number of tiles.
+func writeMBTiles(filename string, records []Record, config *Config) (string, int, error) {
+	lines := tileLines(records)
+	trips := config.Parameters.TripStopMinutes > 0
+	minZoom, maxZoom := tileZooms(config)
+	count := 0
+	// The tile count is only known once written, so the manifest lists the file without it
+	filename, err := writeAtomic(filename, "vector_tiles", -1, config, func(tmp string) error {
+		w, err := mbtiles.Create(tmp)
+		if err != nil {
+			return fmt.Errorf("unable to create MBTiles file: %w", err)
+		}
+		var buf bytes.Buffer
+		count, err = eachTile(lines, trips, minZoom, maxZoom, func(zoom, x, y int, data []byte) error {
+			buf.Reset()
+			gz := gzip.NewWriter(&buf)
+			_, _ = gz.Write(data)
+			_ = gz.Close()
+			return w.AddTile(zoom, x, y, buf.Bytes())
+		})
+		if err != nil {
+			w.Close()
+			return err
+		}
+
+		west, south, east, north := tileBounds(lines)
+		layers, err := json.Marshal(map[string]interface{}{"vector_layers": vectorLayers(trips, minZoom, maxZoom)})
+		if err != nil {
+			w.Close()
+			return err
+		}
+		w.SetMetadata("name", "GPS Trajectories")
+		w.SetMetadata("format", "pbf")
+		w.SetMetadata("type", "overlay")
+		w.SetMetadata("minzoom", strconv.Itoa(minZoom))
+		w.SetMetadata("maxzoom", strconv.Itoa(maxZoom))
+		w.SetMetadata("bounds", fmt.Sprintf("%.6f,%.6f,%.6f,%.6f", west, south, east, north))
+		w.SetMetadata("center", fmt.Sprintf("%.6f,%.6f,%d", (west+east)/2, (south+north)/2, minZoom))
+		w.SetMetadata("json", string(layers))
+		return w.Close()
+	})
+	return filename, count, err
+}
+
+// tileBounds returns the west, south, east and north edges of the lines, or of the web
+// mercator world when there are none
+func tileBounds(lines []tileLine) (float64, float64, float64, float64) {
+	west, south, east, north := 180.0, 85.0, -180.0, -85.0
+	for i := range lines {
+		for j := range lines[i].X {
+			lon := lines[i].X[j]*360 - 180
+			lat := math.Atan(math.Sinh(math.Pi*(1-2*lines[i].Y[j]))) * 180 / math.Pi
+			west, east = math.Min(west, lon), math.Max(east, lon)
+			south, north = math.Min(south, lat), math.Max(north, lat)
+		}
+	}
+	if west > east {
+		west, south, east, north = -180, -85, 180, 85
+	}
+	return west, south, east, north
+}
+
+// vectorLayers describes the layer of the tiles and its fields, for TileJSON and MBTiles
+func vectorLayers(trips bool, minZoom, maxZoom int) []map[string]interface{} {
+	fields := map[string]string{"ID": "String", "start": "String", "end": "String"}
+	if trips {
+		fields["trip"] = "Number"
+	}
+	return []map[string]interface{}{
+		{"id": tileLayerName, "fields": fields, "minzoom": minZoom, "maxzoom": maxZoom},
+	}
+}
+
+// writeTileJSON describes the tile set in TileJSON 3.0 format, for map libraries to load
+func writeTileJSON(filename string, lines []tileLine, trips bool, minZoom, maxZoom int) error {
+	west, south, east, north := tileBounds(lines)
+	metadata := map[string]interface{}{
+		"tilejson":      "3.0.0",
+		"name":          "GPS Trajectories",
+		"scheme":        "xyz",
+		"tiles":         []string{"{z}/{x}/{y}.pbf"},
+		"minzoom":       minZoom,
+		"maxzoom":       maxZoom,
+		"bounds":        []float64{west, south, east, north},
+		"vector_layers": vectorLayers(trips, minZoom, maxZoom),
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write tile metadata: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// outputTimeLayout writes the timestamps of the data with their fractional seconds, so the
+// points of high-rate logs stay apart; whole seconds are written as plain RFC3339
+const outputTimeLayout = time.RFC3339Nano
+
+// defaultDateTimeFormat is the format of a date and a time column joined by a space
+const defaultDateTimeFormat = "YYYY-MM-DD HH:mm:ss"
+
+// timestampTokens translate the tokens of columns.timestamp_format to Go layout elements,
+// longest first so that YYYY is not read as two YY
+var timestampTokens = []struct{ token, layout string }{
+	{"YYYY", "2006"},
+	{"YY", "06"},
+	{"MMMM", "January"},
+	{"MMM", "Jan"},
+	{"MM", "01"},
+	{"DD", "02"},
+	{"HH", "15"},
+	{"hh", "03"},
+	{"mm", "04"},
+	{"ss", "05"},
+	{"SSSSSS", "000000"},
+	{"SSS", "000"},
+	{"A", "PM"},
+	{"ZZ", "-0700"},
+	{"Z", "Z07:00"},
+}
+
+// timestampLayout converts columns.timestamp_format to a Go time layout. The format is
+// written with tokens such as YYYY-MM-DD HH:mm:ss; other characters are taken literally.
+// A format holding the year 2006 is already a Go layout and is used as is.
+func timestampLayout(format string) (string, error) {
+	if strings.Contains(format, "2006") {
+		return format, nil
+	}
+	var b strings.Builder
+	for rest := format; rest != ""; {
+		matched := false
+		for _, t := range timestampTokens {
+			if strings.HasPrefix(rest, t.token) {
+				b.WriteString(t.layout)
+				rest = rest[len(t.token):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		// Digits would be read as layout elements by the time package
+		if c := rest[0]; c >= '0' && c <= '9' {
+			return "", fmt.Errorf("columns.timestamp_format %q contains the digit %c; use tokens such as YYYY-MM-DD HH:mm:ss or a Go layout", format, c)
+		}
+		b.WriteByte(rest[0])
+		rest = rest[1:]
+	}
+	return b.String(), nil
+}
+
+// timestampParser parses the timestamp of an input row
+type timestampParser struct {
+	layout   string         // Go layout, RFC3339 unless columns.timestamp_format is set
+	location *time.Location // zone of timestamps without an offset
+}
+
+// newTimestampParser returns the parser of columns.timestamp_format and columns.timezone.
+// With separate date and time columns the default format is YYYY-MM-DD HH:mm:ss.
+func newTimestampParser(config *Config) (timestampParser, error) {
+	p := timestampParser{layout: time.RFC3339, location: time.UTC}
+	format := config.Columns.TimestampFormat
+	if format == "" && config.Columns.Date != "" {
+		format = defaultDateTimeFormat
+	}
+	if format != "" {
+		layout, err := timestampLayout(format)
+		if err != nil {
+			return p, err
+		}
+		p.layout = layout
+	}
+	if config.Columns.Timezone != "" {
+		loc, err := time.LoadLocation(config.Columns.Timezone)
+		if err != nil {
+			return p, fmt.Errorf("invalid columns.timezone %q: %w", config.Columns.Timezone, err)
+		}
+		p.location = loc
+	}
+	return p, nil
+}
+
+// parse parses a timestamp, or a date and a time joined by a space. The zero parser reads
+// RFC3339. A leap second, such as 23:59:60, is read as the start of the next second.
+func (p timestampParser) parse(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	t, err := p.parseLayout(value)
+	if err != nil && strings.Contains(value, ":60") {
+		if leap, leapErr := p.parseLayout(strings.Replace(value, ":60", ":59", 1)); leapErr == nil {
+			return leap.Add(time.Second), nil
+		}
+	}
+	return t, err
+}
+
+// parseLayout parses a trimmed value with the parser's layout
+func (p timestampParser) parseLayout(value string) (time.Time, error) {
+	if p.layout == "" {
+		return time.Parse(time.RFC3339, value)
+	}
+	return time.ParseInLocation(p.layout, value, p.location)
+}
+
+// timestampFormatName describes the configured timestamp format for messages
+func timestampFormatName(config *Config) string {
+	switch {
+	case config.Columns.TimestampFormat != "":
+		return config.Columns.TimestampFormat
+	case config.Columns.Date != "":
+		return defaultDateTimeFormat
+	}
+	return "RFC3339"
+}
+
+// timestampColumnName names the timestamp column, or the date and time columns, for messages
+func timestampColumnName(config *Config) string {
+	if config.Columns.Date != "" {
+		return config.Columns.Date + "+" + config.Columns.Time
+	}
+	return config.Columns.Timestamp
+}
+
+// checkTimestampColumns validates the timestamp settings of the columns section
+func checkTimestampColumns(config *Config) error {
+	c := &config.Columns
+	if (c.Date == "") != (c.Time == "") {
+		return fmt.Errorf("columns.date and columns.time must be set together")
+	}
+	if c.MinYear < 0 || c.MinYear > 9999 {
+		return fmt.Errorf("columns.min_year must be a year between 1 and 9999 (0 = no limit)")
+	}
+	if _, _, err := timestampBounds(config, time.Now()); err != nil {
+		return err
+	}
+	_, err := newTimestampParser(config)
+	return err
+}
+
+// timestampBounds returns the earliest and latest plausible timestamps: the start of
+// columns.min_year and now plus columns.max_clock_skew. Either is zero when not set.
+func timestampBounds(config *Config, now time.Time) (earliest, latest time.Time, err error) {
+	c := &config.Columns
+	if c.MinYear > 0 {
+		earliest = time.Date(c.MinYear, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if c.MaxClockSkew != "" {
+		skew, err := time.ParseDuration(c.MaxClockSkew)
+		if err != nil || skew < 0 {
+			return earliest, latest, fmt.Errorf("invalid columns.max_clock_skew %q (use a duration such as 5m or 1h)", c.MaxClockSkew)
+		}
+		latest = now.Add(skew)
+	}
+	return earliest, latest, nil
+}
+
+// checkTimestampBounds finds the records dated before columns.min_year or further in the
+// future than columns.max_clock_skew. Like rows that cannot be parsed, they stop the run or,
+// with columns.invalid_rows: skip, are left out with a warning. It returns the remaining
+// records and how many were left out.
+func checkTimestampBounds(records []Record, config *Config) ([]Record, int, error) {
+	earliest, latest, err := timestampBounds(config, time.Now())
+	if err != nil || earliest.IsZero() && latest.IsZero() {
+		return records, 0, err
+	}
+	skip := config.Columns.InvalidRows == "skip"
+	kept := records[:0]
+	skipped := 0
+	for _, record := range records {
+		var problem error
+		switch t := record.Timestamp; {
+		case !earliest.IsZero() && t.Before(earliest):
+			problem = fmt.Errorf("implausible timestamp at row %d: %s is before %d", record.OriginalRow, t.Format(outputTimeLayout), config.Columns.MinYear)
+		case !latest.IsZero() && t.After(latest):
+			problem = fmt.Errorf("implausible timestamp at row %d: %s is in the future", record.OriginalRow, t.Format(outputTimeLayout))
+		}
+		if problem == nil {
+			kept = append(kept, record)
+			continue
+		}
+		if !skip {
+			return nil, skipped, problem
+		}
+		if skipped++; skipped <= maxInvalidRowWarnings {
+			logWarn("Skipping %v", problem)
+		} else {
+			logDebug("Skipping %v", problem)
+		}
+	}
+	if skipped > 0 {
+		logWarn("Skipped %d rows with implausible timestamps", skipped)
+	}
+	return kept, skipped, nil
+}
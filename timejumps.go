@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Time jump defaults
+const (
+	gpsWeekRolloverDays      = 1024 * 7 // the GPS week number wraps every 1024 weeks
+	defaultTimeJumpTolerance = 3600     // seconds a jump may differ from a known offset
+)
+
+// gpsRolloverCutoff returns the date before which timestamps are taken to have rolled over:
+// parameters.gps_rollover_before, or 1024 weeks before now
+func gpsRolloverCutoff(config *Config, now time.Time) (time.Time, error) {
+	before := config.Parameters.GPSRolloverBefore
+	if before == "" {
+		return now.AddDate(0, 0, -gpsWeekRolloverDays), nil
+	}
+	cutoff, err := time.Parse("2006-01-02", before)
+	if err != nil {
+		return cutoff, fmt.Errorf("invalid gps_rollover_before %q (use YYYY-MM-DD)", before)
+	}
+	return cutoff, nil
+}
+
+// correctGPSRollover moves the timestamps before the rollover cutoff forward by 1024 weeks,
+// repeatedly if they rolled over more than once, as long as they do not end up in the future.
+// Receivers with the week rollover bug report dates about 19.7 years in the past throughout,
+// so unlike a jump in the middle of a track, there is no earlier point to compare with. It
+// returns the number of timestamps moved.
+func correctGPSRollover(records []Record, config *Config) (int, error) {
+	now := time.Now()
+	cutoff, err := gpsRolloverCutoff(config, now)
+	if err != nil {
+		return 0, err
+	}
+	rollover := gpsWeekRolloverDays * 24 * time.Hour
+	// Clocks that are a little fast are not a reason to leave a timestamp in the past
+	latest := now.Add(24 * time.Hour)
+	corrected := 0
+	for i := range records {
+		t := records[i].Timestamp
+		for t.Before(cutoff) && !t.Add(rollover).After(latest) {
+			t = t.Add(rollover)
+		}
+		if !t.Equal(records[i].Timestamp) {
+			records[i].Timestamp = t
+			corrected++
+		}
+	}
+	return corrected, nil
+}
+
+// timeJump is a point whose timestamp is earlier than the device's previous point in the input
+type timeJump struct {
+	ID            string
+	Row, PrevRow  int
+	Timestamp     time.Time     // as read
+	PrevTimestamp time.Time     // of the previous point, after any correction
+	Correction    time.Duration // added to this and the following points by time_jumps: correct
+}
+
+// checkTimeJumps validates the time jump and GPS rollover settings
+func checkTimeJumps(config *Config) error {
+	p := &config.Parameters
+	switch p.TimeJumps {
+	case "", "off", "report", "correct":
+	default:
+		return fmt.Errorf("unknown time_jumps %q (supported: off, report, correct)", p.TimeJumps)
+	}
+	if p.TimeJumpMinSeconds < 0 || p.TimeJumpToleranceS < 0 {
+		return fmt.Errorf("time_jump_min_seconds and time_jump_tolerance_s must not be negative")
+	}
+	if _, err := gpsRolloverCutoff(config, time.Now()); err != nil {
+		return err
+	}
+	for _, days := range p.TimeJumpOffsetsDays {
+		if days <= 0 {
+			return fmt.Errorf("time_jump_offsets_days must be positive")
+		}
+	}
+	return nil
+}
+
+// timeJumpOffsets returns the known clock offsets a correction may undo
+func timeJumpOffsets(config *Config) []time.Duration {
+	days := config.Parameters.TimeJumpOffsetsDays
+	if len(days) == 0 {
+		days = []float64{gpsWeekRolloverDays}
+	}
+	offsets := make([]time.Duration, len(days))
+	for i, d := range days {
+		offsets[i] = time.Duration(d * 24 * float64(time.Hour))
+	}
+	return offsets
+}
+
+// findTimeJumps walks each device's points in input order and returns the points whose
+// timestamp goes back more than parameters.time_jump_min_seconds from the previous one, as
+// after a GPS week rollover or a clock reset. Sorting by time would silently move such points
+// elsewhere in the track. With time_jumps: correct, a jump back by about a known offset
+// shifts that point and the device's following points forward by the offset, until the
+// clock jumps forward by it again.
+func findTimeJumps(records []Record, config *Config) []timeJump {
+	p := &config.Parameters
+	correct := p.TimeJumps == "correct"
+	offsets := timeJumpOffsets(config)
+	tolerance := time.Duration(p.TimeJumpToleranceS * float64(time.Second))
+	if tolerance == 0 {
+		tolerance = defaultTimeJumpTolerance * time.Second
+	}
+	minJump := time.Duration(p.TimeJumpMinSeconds * float64(time.Second))
+
+	type deviceClock struct {
+		raw, corrected time.Time
+		row            int
+		correction     time.Duration
+	}
+	clocks := make(map[string]*deviceClock)
+	var jumps []timeJump
+	for i := range records {
+		r := &records[i]
+		raw := r.Timestamp
+		clock, seen := clocks[r.ID]
+		if !seen {
+			clocks[r.ID] = &deviceClock{raw: raw, corrected: raw, row: r.OriginalRow}
+			continue
+		}
+
+		applied := time.Duration(0)
+		if correct {
+			step := raw.Sub(clock.raw)
+			for _, offset := range offsets {
+				if absDuration(step+offset) <= tolerance {
+					clock.correction += offset
+					applied = offset
+					break
+				}
+				if absDuration(step-offset) <= tolerance && clock.correction >= offset {
+					// The clock is right again
+					clock.correction -= offset
+					applied = -offset
+					break
+				}
+			}
+		}
+		r.Timestamp = raw.Add(clock.correction)
+		if applied != 0 || r.Timestamp.Before(clock.corrected.Add(-minJump)) {
+			jumps = append(jumps, timeJump{ID: r.ID, Row: r.OriginalRow, PrevRow: clock.row, Timestamp: raw,
+				PrevTimestamp: clock.corrected, Correction: applied})
+		}
+		clock.raw, clock.corrected, clock.row = raw, r.Timestamp, r.OriginalRow
+	}
+	return jumps
+}
+
+// absDuration returns the absolute value of a duration
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// writeTimeJumpReport writes one CSV row per backwards time jump and per correction
+func writeTimeJumpReport(filename string, jumps []timeJump) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create time jump report: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"ID", "row", "previous_row", "timestamp", "previous_timestamp", "jump_seconds", "correction_seconds"})
+	for _, j := range jumps {
+		_ = writer.Write([]string{
+			j.ID,
+			strconv.Itoa(j.Row),
+			strconv.Itoa(j.PrevRow),
+			j.Timestamp.Format(outputTimeLayout),
+			j.PrevTimestamp.Format(outputTimeLayout),
+			strconv.FormatFloat(j.Timestamp.Sub(j.PrevTimestamp).Seconds(), 'f', -1, 64),
+			strconv.FormatFloat(j.Correction.Seconds(), 'f', 0, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// pseudonymizeTimeJumps replaces the device IDs of the time jumps by those applyPrivacy gave
+// the records. Jumps of devices with no new ID are left out, so no original ID is reported.
+func pseudonymizeTimeJumps(jumps []timeJump, mapping [][2]string) []timeJump {
+	names := make(map[string]string, len(mapping))
+	for _, pair := range mapping {
+		names[pair[0]] = pair[1]
+	}
+	kept := jumps[:0]
+	for _, j := range jumps {
+		if name, ok := names[j.ID]; ok {
+			j.ID = name
+			kept = append(kept, j)
+		}
+	}
+	return kept
+}
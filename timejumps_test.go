@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTimeJumpReportPseudonymized(t *testing.T) {
+	for _, mode := range []string{"hash", "sequential"} {
+		t.Run(mode, func(t *testing.T) {
+			config := &Config{}
+			config.Parameters.TimeJumps = "report"
+			config.Privacy.IDs = mode
+			config.Privacy.Salt = "salt"
+			records := []Record{
+				{ID: "secretA", Timestamp: testTime(60), OriginalRow: 2},
+				{ID: "secretA", Timestamp: testTime(0), OriginalRow: 3},
+				{ID: "secretB", Timestamp: testTime(120), OriginalRow: 4},
+				{ID: "secretB", Timestamp: testTime(30), OriginalRow: 5},
+			}
+			jumps := findTimeJumps(records, config)
+			if len(jumps) != 2 {
+				t.Fatalf("found %d time jumps, want 2", len(jumps))
+			}
+			mapping := applyPrivacy(records, config)
+			jumps = pseudonymizeTimeJumps(jumps, mapping)
+
+			filename := filepath.Join(t.TempDir(), "time_jumps.csv")
+			if err := writeTimeJumpReport(filename, jumps); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := string(data)
+			if strings.Contains(report, "secret") {
+				t.Errorf("report contains an original device ID:\n%s", report)
+			}
+			for _, pair := range mapping {
+				if !strings.Contains(report, pair[1]) {
+					t.Errorf("report lacks the new ID %s of %s:\n%s", pair[1], pair[0], report)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"gps-processor/geohash"
+	"gps-processor/haversine"
+)
+
+// defaultTripStopRadiusM is how far a device may wander while still counting as stopped
+const defaultTripStopRadiusM = 50.0
+
+// defaultODGeohashPrecision is the geohash length of OD matrix cells, about 4.9 km by 4.9 km
+const defaultODGeohashPrecision = 5
+
+// stay is a run of points where a device stayed put, as indexes of its first and last
+// record in the device's group
+type stay struct {
+	first, last int
+}
+
+// findStays returns the runs of points of a device's time-sorted records that stay within
+// radiusM meters of their first point for at least minSeconds. Outliers are skipped.
+func findStays(group []Record, minSeconds, radiusM float64) []stay {
+	var points []int
+	for i := range group {
+		if !group[i].Outlier {
+			points = append(points, i)
+		}
+	}
+
+	var stays []stay
+	for i := 0; i < len(points); {
+		anchor := &group[points[i]]
+		j := i + 1
+		for j < len(points) {
+			p := &group[points[j]]
+			if haversine.Distance(anchor.Latitude, anchor.Longitude, p.Latitude, p.Longitude)*1000 > radiusM {
+				break
+			}
+			j++
+		}
+		if group[points[j-1]].Timestamp.Sub(anchor.Timestamp).Seconds() >= minSeconds {
+			stays = append(stays, stay{first: points[i], last: points[j-1]})
+			i = j
+		} else {
+			i++
+		}
+	}
+	return stays
+}
+
+// segmentTrips numbers the trips of a device's time-sorted records. A trip ends where the
+// device stays within radiusM meters for at least stopSeconds, or stops reporting for that
+// long. Records of a trip get its 1-based number in Trip; other stopped records and outliers get 0.
+func segmentTrips(group []Record, stopSeconds, radiusM float64) {
+	var points []int
+	for i := range group {
+		group[i].Trip = 0
+		if !group[i].Outlier {
+			points = append(points, i)
+		}
+	}
+
+	// Mark the points of the stops
+	inStay := make([]bool, len(group))
+	for _, s := range findStays(group, stopSeconds, radiusM) {
+		for i := s.first; i <= s.last; i++ {
+			inStay[i] = true
+		}
+	}
+	stopped := make([]bool, len(points))
+	for k, i := range points {
+		stopped[k] = inStay[i]
+	}
+
+	// Number the runs of moving points, splitting at reporting gaps. A trip departs from the
+	// last point of the stop before it and arrives at the first point of the stop after it.
+	within := func(a, b int) bool {
+		return group[points[b]].Timestamp.Sub(group[points[a]].Timestamp).Seconds() < stopSeconds
+	}
+	trip := 0
+	start := -1 // first point of the current trip
+	for k := 0; k <= len(points); k++ {
+		moving := k < len(points) && !stopped[k]
+		if start >= 0 && (!moving || !within(k-1, k)) {
+			end := k
+			if k < len(points) && stopped[k] && within(k-1, k) {
+				end++
+			}
+			// A single point is not a trip
+			if end-start >= 2 {
+				trip++
+				for m := start; m < end; m++ {
+					group[points[m]].Trip = trip
+				}
+			}
+			start = -1
+		}
+		if moving && start < 0 {
+			start = k
+			if k > 0 && stopped[k-1] && within(k-1, k) {
+				start--
+			}
+		}
+	}
+}
+
+// tripSummary describes one trip of a device
+type tripSummary struct {
+	ID                   string
+	Trip                 int
+	Start, End           time.Time
+	Points               int
+	Distance             float64 // kilometers
+	Energy               float64 // kWh, when the energy model is on
+	HasAltitude          bool    // whether any two points of the trip had an altitude
+	Ascent, Descent      float64 // total climb and descent in meters
+	MaxGrade             float64 // steepest slope between points, as a percentage
+	OriginLat, OriginLon float64
+	DestLat, DestLon     float64
+	Path                 [][2]float64 // longitude and latitude of the points that are not outliers
+}
+
+// collectTrips summarizes the trips of records grouped by device and sorted by time
+func collectTrips(records []Record) []tripSummary {
+	var trips []tripSummary
+	var current *tripSummary
+	var lastAlt *Record   // last point of the current trip with an altitude
+	var gradeFrom *Record // point the current grade is measured from
+	horizontal := 0.0     // meters travelled since gradeFrom
+	for i := range records {
+		r := &records[i]
+		if r.Trip == 0 {
+			continue
+		}
+		if current == nil || current.ID != r.ID || current.Trip != r.Trip {
+			lastAlt, gradeFrom, horizontal = nil, nil, 0
+			trips = append(trips, tripSummary{
+				ID:        r.ID,
+				Trip:      r.Trip,
+				Start:     r.Timestamp,
+				OriginLat: r.Latitude,
+				OriginLon: r.Longitude,
+			})
+			current = &trips[len(trips)-1]
+		} else {
+			current.Distance += r.Distance
+			current.Energy += r.Energy
+			horizontal += r.Distance * 1000
+		}
+		if r.HasAltitude && !r.Outlier {
+			if lastAlt != nil {
+				current.addClimb(r.Altitude - lastAlt.Altitude)
+			}
+			lastAlt = r
+			if gradeFrom == nil {
+				gradeFrom, horizontal = r, 0
+			} else if horizontal >= minGradeDistanceM {
+				current.MaxGrade = math.Max(current.MaxGrade, math.Abs(r.Altitude-gradeFrom.Altitude)/horizontal*100)
+				gradeFrom, horizontal = r, 0
+			}
+		}
+		if !r.Outlier {
+			current.Path = append(current.Path, [2]float64{r.Longitude, r.Latitude})
+		}
+		current.End = r.Timestamp
+		current.Points++
+		current.DestLat, current.DestLon = r.Latitude, r.Longitude
+	}
+	return trips
+}
+
+// minGradeDistanceM is the shortest horizontal distance a grade is measured over, so that
+// altitude noise between close points does not show up as a steep slope
+const minGradeDistanceM = 20.0
+
+// addClimb adds the altitude change between two points in meters to the trip
+func (t *tripSummary) addClimb(rise float64) {
+	t.HasAltitude = true
+	if rise > 0 {
+		t.Ascent += rise
+	} else {
+		t.Descent -= rise
+	}
+}
+
+// writeTripSummary writes one CSV row per trip
+func writeTripSummary(filename string, trips []tripSummary, config *Config) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create trip summary: %w", err)
+	}
+	defer file.Close()
+
+	coord := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', outputPrecision(config, "coordinate"), 64)
+	}
+	writer := csv.NewWriter(file)
+	header := []string{"ID", "trip", "start", "end", "duration_seconds", "points", "distance_km",
+		"origin_latitude", "origin_longitude", "destination_latitude", "destination_longitude",
+		"ascent_m", "descent_m", "max_grade_pct"}
+	if config.Output.Geometry != "" {
+		header = append(header, "geometry")
+	}
+	_ = writer.Write(header)
+	for _, t := range trips {
+		climb := []string{"", "", ""}
+		if t.HasAltitude {
+			climb = []string{
+				strconv.FormatFloat(t.Ascent, 'f', 1, 64),
+				strconv.FormatFloat(t.Descent, 'f', 1, 64),
+				strconv.FormatFloat(t.MaxGrade, 'f', 1, 64),
+			}
+		}
+		row := append([]string{
+			t.ID,
+			strconv.Itoa(t.Trip),
+			t.Start.Format(outputTimeLayout),
+			t.End.Format(outputTimeLayout),
+			strconv.FormatFloat(t.End.Sub(t.Start).Seconds(), 'f', 0, 64),
+			strconv.Itoa(t.Points),
+			strconv.FormatFloat(t.Distance, 'f', outputPrecision(config, "distance"), 64),
+			coord(t.OriginLat), coord(t.OriginLon), coord(t.DestLat), coord(t.DestLon),
+		}, climb...)
+		if config.Output.Geometry != "" {
+			row = append(row, lineGeometry(t.Path, config))
+		}
+		_ = writer.Write(row)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// checkODMatrix validates the OD matrix settings
+func checkODMatrix(config *Config) error {
+	if config.Parameters.TripStopMinutes <= 0 {
+		return fmt.Errorf("output.od_matrix requires trip segmentation; set parameters.trip_stop_minutes")
+	}
+	if p := config.Output.ODGeohashPrecision; p < 1 || p > geohash.MaxPrecision {
+		return fmt.Errorf("invalid output.od_geohash_precision %d (use 1 to %d)", p, geohash.MaxPrecision)
+	}
+	return nil
+}
+
+// odPair counts the trips between an origin and a destination zone or cell
+type odPair struct {
+	Origin      string
+	Destination string
+	Trips       int
+	Distance    float64 // total kilometers
+}
+
+// odMatrix aggregates trips by origin and destination. With zones, trip ends are assigned
+// to the zone containing them ("outside" when none does); otherwise to a geohash cell.
+func odMatrix(trips []tripSummary, zones *zoneSet, precision int) []odPair {
+	locate := func(lat, lon float64) string {
+		if zones == nil {
+			return geohash.Encode(lat, lon, precision)
+		}
+		if name := zones.locate(lat, lon); name != "" {
+			return name
+		}
+		return "outside"
+	}
+
+	pairs := make(map[[2]string]*odPair)
+	for _, t := range trips {
+		key := [2]string{locate(t.OriginLat, t.OriginLon), locate(t.DestLat, t.DestLon)}
+		pair, ok := pairs[key]
+		if !ok {
+			pair = &odPair{Origin: key[0], Destination: key[1]}
+			pairs[key] = pair
+		}
+		pair.Trips++
+		pair.Distance += t.Distance
+	}
+
+	result := make([]odPair, 0, len(pairs))
+	for _, pair := range pairs {
+		result = append(result, *pair)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Trips != result[j].Trips {
+			return result[i].Trips > result[j].Trips
+		}
+		if result[i].Origin != result[j].Origin {
+			return result[i].Origin < result[j].Origin
+		}
+		return result[i].Destination < result[j].Destination
+	})
+	return result
+}
+
+// writeODMatrix writes one CSV row per origin-destination pair
+func writeODMatrix(filename string, pairs []odPair) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create OD matrix: %w", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	_ = writer.Write([]string{"origin", "destination", "trips", "total_distance_km"})
+	for _, p := range pairs {
+		_ = writer.Write([]string{
+			p.Origin,
+			p.Destination,
+			strconv.Itoa(p.Trips),
+			strconv.FormatFloat(p.Distance, 'f', 3, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxValidationErrors limits how many row errors are listed in the validation report
+const maxValidationErrors = 10
+
+// validateInput checks the configuration against the header and the first sampleRows rows
+// of the input without processing it, printing what a real run would do. It returns an
+// error describing the first problem that would make the run fail.
+func validateInput(inputFile string, config *Config, formats []outputFormat, sampleRows int, runTime time.Time) error {
+	fmt.Println("=== Validation ===")
+
+	reader, closer, err := openInput(inputFile, config.Columns.Encoding)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading header: %w", err)
+	}
+
+	// Show every input column and what it is mapped to
+	mapped := map[string]string{
+		config.Columns.ID:        "ID",
+		config.Columns.Latitude:  "latitude",
+		config.Columns.Longitude: "longitude",
+		config.Columns.Timestamp: "timestamp",
+	}
+	if config.Columns.Altitude != "" {
+		mapped[config.Columns.Altitude] = "altitude"
+	}
+	if config.Columns.Speed != "" {
+		mapped[config.Columns.Speed] = "speed"
+	}
+	if len(config.Columns.IDColumns) > 0 {
+		delete(mapped, config.Columns.ID)
+		for _, col := range config.Columns.IDColumns {
+			mapped[col] = "ID (part)"
+		}
+	}
+	if config.Columns.Date != "" {
+		delete(mapped, config.Columns.Timestamp)
+		mapped[config.Columns.Date] = "date"
+		mapped[config.Columns.Time] = "time"
+	}
+	fmt.Printf("Detected %d columns:\n", len(header))
+	for i, col := range header {
+		if role, ok := mapped[col]; ok {
+			fmt.Printf("  %2d. %-24s -> %s\n", i+1, col, role)
+		} else if config.Output.PassthroughColumns {
+			fmt.Printf("  %2d. %-24s (passthrough)\n", i+1, col)
+		} else {
+			fmt.Printf("  %2d. %-24s (ignored)\n", i+1, col)
+		}
+	}
+
+	cols, err := findColumns(header, config)
+	if err != nil {
+		for col, role := range mapped {
+			if !containsString(header, col) {
+				fmt.Printf("✗ Column %q for %s not found in input\n", col, role)
+			}
+		}
+		return &configError{err}
+	}
+	config.passthroughColumns = nil
+	for _, idx := range cols.Passthrough {
+		config.passthroughColumns = append(config.passthroughColumns, header[idx])
+	}
+	if _, err := selectedColumns(config); err != nil {
+		return &configError{err}
+	}
+	if _, err := NewRecordFilter(config); err != nil {
+		return &configError{err}
+	}
+
+	// Parse a sample of rows with the same rules as a real run. Rows that columns.ragged_rows
+	// or columns.invalid_rows leave out are skipped, as in a real run, and do not fail it.
+	var rowErrors, skipped []string
+	skipInvalid := config.Columns.InvalidRows == "skip"
+	sampled, sampledBytes := 0, 0
+	var first, last time.Time
+	for rowNumber := 2; sampled < sampleRows; rowNumber++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, csv.ErrFieldCount) {
+			var rejected *raggedRowError
+			if row, err = fitRow(row, len(header), rowNumber, config); errors.As(err, &rejected) && rejected.skip {
+				sampled++
+				skipped = append(skipped, err.Error())
+				continue
+			}
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, err.Error())
+			break
+		}
+		sampled++
+		sampledBytes += len(strings.Join(row, ",")) + 1
+
+		cols.setDeviceID(row)
+		record, err := parseRecord(row, cols, rowNumber)
+		if err != nil && skipInvalid {
+			skipped = append(skipped, err.Error())
+			continue
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, err.Error())
+			continue
+		}
+		if first.IsZero() || record.Timestamp.Before(first) {
+			first = record.Timestamp
+		}
+		if record.Timestamp.After(last) {
+			last = record.Timestamp
+		}
+	}
+
+	parsed := sampled - len(rowErrors) - len(skipped)
+	if len(skipped) > 0 {
+		fmt.Printf("\nSampled %d rows: %d parsed, %d skipped by ragged_rows/invalid_rows, %d failed\n", sampled, parsed, len(skipped), len(rowErrors))
+	} else {
+		fmt.Printf("\nSampled %d rows: %d parsed, %d failed\n", sampled, parsed, len(rowErrors))
+	}
+	if parsed > 0 {
+		fmt.Printf("Timestamp format: %s (sample spans %s to %s)\n", timestampFormatName(config),
+			first.Format(outputTimeLayout), last.Format(outputTimeLayout))
+	}
+	for i, msg := range rowErrors {
+		if i == maxValidationErrors {
+			fmt.Printf("  ... and %d more\n", len(rowErrors)-maxValidationErrors)
+			break
+		}
+		fmt.Printf("  ✗ %s\n", msg)
+	}
+	for i, msg := range skipped {
+		if i == maxValidationErrors {
+			fmt.Printf("  ... and %d more skipped\n", len(skipped)-maxValidationErrors)
+			break
+		}
+		fmt.Printf("  - skipped %s\n", msg)
+	}
+
+	// Estimate the total row count from the average size of the sampled rows
+	if info, err := os.Stat(inputFile); err == nil && sampled > 0 && !isExcelFile(inputFile) {
+		estimate := int(float64(info.Size()) / (float64(sampledBytes) / float64(sampled)))
+		fmt.Printf("Estimated row count: ~%d (file size %d bytes)\n", estimate, info.Size())
+	}
+
+	// List the outputs a real run would write
+	fmt.Println("\nOutputs that would be written:")
+	for _, format := range formats {
+		id := ""
+		if config.Output.SplitByDevice {
+			id = "{id}"
+		}
+		fmt.Printf("  %s: %s\n", format.Label, getOutputFilename(inputFile, format.Name, id, config, runTime))
+	}
+
+	if len(rowErrors) > 0 {
+		return fmt.Errorf("%d of %d sampled rows could not be parsed", len(rowErrors), sampled)
+	}
+	fmt.Println("\n✓ Validation passed")
+	return nil
+}
+
+// containsString reports whether the slice contains the value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// wizardPreviewRows is how many data rows the init wizard shows as a preview
+const wizardPreviewRows = 5
+
+// prompter asks questions on the console and reads the answers
+type prompter struct {
+	in *bufio.Reader
+}
+
+// ask shows a question with a default answer and returns the answer, or the default when
+// the answer is empty or input has ended
+func (p *prompter) ask(question string, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := p.in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if err == io.EOF && answer == "" {
+		fmt.Println()
+	}
+	if answer == "" {
+		return def
+	}
+	return answer
+}
+
+// askYesNo asks a yes/no question and returns the answer
+func (p *prompter) askYesNo(question string, def bool) bool {
+	defAnswer := "y/N"
+	if def {
+		defAnswer = "Y/n"
+	}
+	answer := strings.ToLower(p.ask(question+" ("+defAnswer+")", ""))
+	if answer == "" {
+		return def
+	}
+	return answer == "y" || answer == "yes"
+}
+
+// runInit implements the init subcommand, which inspects a sample input file and writes
+// a config file tailored to it after asking a few questions
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("gps-processor init", flag.ContinueOnError)
+	output := fs.String("output", "config.yaml", "config file to write")
+	fs.Usage = func() {
+		fmt.Println("Usage: gps-processor init [sample_file] [--output config.yaml]")
+		fmt.Println("\nInspects a sample CSV or Excel file, proposes column mappings and")
+		fmt.Println("writes a configuration file after asking a few questions.")
+	}
+	args, err := parseArgs(fs, args)
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	if err != nil {
+		return exitUsage
+	}
+
+	p := &prompter{in: bufio.NewReader(os.Stdin)}
+	fmt.Println("=== GPS Data Processor Setup ===")
+
+	// Find a sample file to inspect
+	sample := ""
+	if len(args) > 0 {
+		sample = args[0]
+	} else if single := findSingleFileByExtension(".csv"); single != "" {
+		sample = single
+	} else if single := findSingleFileByExtension(".xlsx"); single != "" {
+		sample = single
+	}
+	sample = p.ask("Sample input file", sample)
+	if sample == "" {
+		fmt.Fprintln(os.Stderr, "Error: a sample input file is required")
+		return exitUsage
+	}
+
+	header, rows, err := readSample(sample, "auto", detectSampleRows)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading sample: %v\n", err)
+		return exitInputError
+	}
+
+	// Show what the file looks like
+	fmt.Printf("\nDetected %d columns: %s\n", len(header), strings.Join(header, ", "))
+	fmt.Println("\nPreview:")
+	fmt.Printf("  %s\n", strings.Join(header, " | "))
+	for i, row := range rows {
+		if i == wizardPreviewRows {
+			break
+		}
+		fmt.Printf("  %s\n", strings.Join(row, " | "))
+	}
+
+	// Confirm or correct each mapped column
+	m := detectColumns(header, rows)
+	fmt.Println("\nColumn mappings (press Enter to accept the detected column):")
+	askColumn := func(role string, detected string) string {
+		for {
+			answer := p.ask(fmt.Sprintf("  Column for %s", role), detected)
+			if containsString(header, answer) {
+				return answer
+			}
+			fmt.Printf("  %q is not a column in %s\n", answer, sample)
+			if answer == detected {
+				// Nothing sensible to offer; avoid looping forever on closed input
+				detected = header[0]
+			}
+		}
+	}
+	m.ID = askColumn("device ID", m.ID)
+	m.Latitude = askColumn("latitude", m.Latitude)
+	m.Longitude = askColumn("longitude", m.Longitude)
+	m.Timestamp = askColumn("timestamp", m.Timestamp)
+
+	// Processing parameters
+	var filter float64
+	for {
+		answer := p.ask("\nMinimum speed to keep, in km/h", "1.0")
+		if filter, err = strconv.ParseFloat(answer, 64); err == nil {
+			break
+		}
+		fmt.Printf("%q is not a number\n", answer)
+	}
+	var formats stringList
+	for {
+		formats = nil
+		_ = formats.Set(p.ask("Output formats (csv, kml, xlsx, geojsonseq, ndjson)", "csv, kml"))
+		valid := len(formats) > 0
+		for _, format := range formats {
+			if !isKnownOutputFormat(format) {
+				fmt.Printf("Unknown format %q\n", format)
+				valid = false
+			}
+		}
+		if valid {
+			break
+		}
+	}
+
+	// Write the config, asking before replacing an existing one
+	if _, err := os.Stat(*output); err == nil {
+		if !p.askYesNo(fmt.Sprintf("\n%s already exists. Overwrite it?", *output), false) {
+			fmt.Println("Setup cancelled; no changes written.")
+			return exitOK
+		}
+	}
+	if err := os.WriteFile(*output, []byte(renderConfig(m, filter, formats)), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing config: %v\n", err)
+		return exitError
+	}
+
+	fmt.Printf("\n✓ Configuration written to %s\n", *output)
+	fmt.Printf("ℹ Check it against your data with: gps-processor %s %s --validate\n", sample, *output)
+	return exitOK
+}
+
+// renderConfig produces a commented config file for the given mapping and settings
+func renderConfig(m columnMapping, filterAboveKph float64, formats []string) string {
+	return fmt.Sprintf(`# GPS Processor Configuration
+
+# CSV Column Mappings (specify the column names in your CSV file)
+columns:
+  id: %q               # Device/track identifier
+  latitude: %q   # Latitude coordinate
+  longitude: %q # Longitude coordinate
+  timestamp: %q # Timestamp in RFC3339 format
+
+# Processing Parameters
+parameters:
+  filter_above_kph: %s  # Filter out records with speed below this value (km/h)
+
+# Output Settings
+output:
+  formats: [%s]  # Output files to write: csv, kml, xlsx, geojsonseq, ndjson
+`, m.ID, m.Latitude, m.Longitude, m.Timestamp,
+		strconv.FormatFloat(filterAboveKph, 'f', -1, 64), strings.Join(formats, ", "))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// isExcelFile reports whether the filename refers to an Excel workbook
+func isExcelFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".xlsx")
+}
+
+// xlsxRowReader adapts an Excel sheet row iterator to the rowReader interface
+type xlsxRowReader struct {
+	file  *excelize.File
+	rows  *excelize.Rows
+	width int // number of header columns, used to pad short rows
+}
+
+// Read returns the next non-empty row, or io.EOF when the sheet is exhausted
+func (r *xlsxRowReader) Read() ([]string, error) {
+	for r.rows.Next() {
+		row, err := r.rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		// Skip blank rows, which are common at the end of hand-edited sheets
+		if len(row) == 0 {
+			continue
+		}
+
+		// Excel omits trailing empty cells, so pad to the header width
+		if r.width == 0 {
+			r.width = len(row)
+		}
+		for len(row) < r.width {
+			row = append(row, "")
+		}
+		return row, nil
+	}
+	if err := r.rows.Error(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close releases the row iterator and the workbook
+func (r *xlsxRowReader) Close() error {
+	r.rows.Close()
+	return r.file.Close()
+}
+
+// openXLSX opens the first sheet of an Excel workbook for reading
+func openXLSX(filename string) (rowReader, io.Closer, error) {
+	f, err := excelize.OpenFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open file: %w", err)
+	}
+
+	sheets := f.GetSheetList()
+	if len(sheets) == 0 {
+		f.Close()
+		return nil, nil, fmt.Errorf("workbook contains no sheets")
+	}
+
+	rows, err := f.Rows(sheets[0])
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("unable to read sheet %q: %w", sheets[0], err)
+	}
+
+	reader := &xlsxRowReader{file: f, rows: rows}
+	return reader, reader, nil
+}
+
+// writeOutputXLSX writes the processed records and a per-device summary to an Excel workbook
+func writeOutputXLSX(filename string, records []Record, config *Config) error {
+	columns, err := selectedColumns(config)
+	if err != nil {
+		return err
+	}
+
+	f := excelize.NewFile()
+	defer f.Close()
+
+	// Rename the default sheet rather than leaving an empty "Sheet1" behind
+	const recordsSheet = "Records"
+	const summarySheet = "Summary"
+	if err := f.SetSheetName(f.GetSheetName(0), recordsSheet); err != nil {
+		return fmt.Errorf("unable to create records sheet: %w", err)
+	}
+	if _, err := f.NewSheet(summarySheet); err != nil {
+		return fmt.Errorf("unable to create summary sheet: %w", err)
+	}
+
+	// Create progress bar for writing Excel
+	bar := newProgress("Writing output Excel", len(records))
+
+	// Records sheet, streamed since it can be large
+	sw, err := f.NewStreamWriter(recordsSheet)
+	if err != nil {
+		return fmt.Errorf("unable to create records sheet: %w", err)
+	}
+	if err := sw.SetRow("A1", toCells(columnHeader(columns), nil)); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+	for i := range records {
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		if err := sw.SetRow(cell, toCells(formatRow(&records[i], columns), columns)); err != nil {
+			return fmt.Errorf("error writing row: %w", err)
+		}
+		_ = bar.Add(1)
+	}
+	if err := sw.Flush(); err != nil {
+		return fmt.Errorf("error writing records sheet: %w", err)
+	}
+
+	// Summary sheet with one row per device
+	summaryHeader := []string{
+		"ID",
+		"points",
+		"start_time",
+		"end_time",
+		"duration_seconds",
+		"distance_km",
+		"avg_speed_kmh",
+		"max_speed_kmh",
+	}
+	if config.metadata != nil {
+		summaryHeader = append(summaryHeader, config.metadata.columns...)
+	}
+	sw, err = f.NewStreamWriter(summarySheet)
+	if err != nil {
+		return fmt.Errorf("unable to create summary sheet: %w", err)
+	}
+	if err := sw.SetRow("A1", toCells(summaryHeader, nil)); err != nil {
+		return fmt.Errorf("error writing summary header: %w", err)
+	}
+	for i, summary := range summarizeDevices(records) {
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		row := []interface{}{
+			summary.ID,
+			summary.Points,
+			summary.StartTime.Format(outputTimeLayout),
+			summary.EndTime.Format(outputTimeLayout),
+			summary.Duration,
+			summary.Distance,
+			summary.AvgSpeed,
+			summary.MaxSpeed,
+		}
+		if md := config.metadata; md != nil {
+			for i := range md.columns {
+				row = append(row, md.value(summary.ID, i))
+			}
+		}
+		if err := sw.SetRow(cell, row); err != nil {
+			return fmt.Errorf("error writing summary row: %w", err)
+		}
+	}
+	if err := sw.Flush(); err != nil {
+		return fmt.Errorf("error writing summary sheet: %w", err)
+	}
+
+	if err := f.SaveAs(filename); err != nil {
+		return fmt.Errorf("unable to save Excel file: %w", err)
+	}
+
+	bar.Finish()
+	return nil
+}
+
+// toCells converts formatted values to Excel cells, storing numeric columns as numbers.
+// When columns is nil every value is written as text.
+func toCells(values []string, columns []outputColumn) []interface{} {
+	cells := make([]interface{}, len(values))
+	for i, value := range values {
+		cells[i] = value
+		if columns == nil || !columns[i].Numeric {
+			continue
+		}
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			cells[i] = number
+		}
+	}
+	return cells
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	"gps-processor/spatial"
+)
+
+// zoneSet holds the named areas of parameters.zones_file. Each zone is made of one or more
+// polygons, each a list of rings of [longitude, latitude] positions whose first ring is the
+// outer boundary and the rest are holes. The bounding boxes of the polygons are indexed.
+type zoneSet struct {
+	names    []string
+	polygons [][][][2]float64
+	owners   []int // zone of each polygon
+	boxes    []spatial.Box
+	index    *spatial.RTree
+}
+
+// loadZones reads the Polygon and MultiPolygon features of a GeoJSON feature collection.
+// A zone is named by its "name" property, then its feature id, then its position in the file.
+func loadZones(filename string) (*zoneSet, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read zones: %w", err)
+	}
+	var doc struct {
+		Features []struct {
+			ID         any            `json:"id"`
+			Properties map[string]any `json:"properties"`
+			Geometry   *struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", filename, err)
+	}
+
+	zs := &zoneSet{}
+	for i, feature := range doc.Features {
+		if feature.Geometry == nil {
+			continue
+		}
+		var polygons [][][][2]float64
+		switch feature.Geometry.Type {
+		case "Polygon":
+			var polygon [][][2]float64
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &polygon); err != nil {
+				return nil, fmt.Errorf("invalid Polygon in %s: %w", filename, err)
+			}
+			polygons = [][][][2]float64{polygon}
+		case "MultiPolygon":
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &polygons); err != nil {
+				return nil, fmt.Errorf("invalid MultiPolygon in %s: %w", filename, err)
+			}
+		default:
+			continue
+		}
+
+		name := fmt.Sprintf("zone_%d", i+1)
+		if n, ok := feature.Properties["name"].(string); ok && n != "" {
+			name = n
+		} else if feature.ID != nil {
+			switch id := feature.ID.(type) {
+			case string:
+				name = id
+			case float64:
+				name = strconv.FormatFloat(id, 'f', -1, 64)
+			}
+		}
+
+		zs.add(name, polygons)
+	}
+	if len(zs.polygons) == 0 {
+		return nil, fmt.Errorf("no Polygon or MultiPolygon features found in %s", filename)
+	}
+	zs.build()
+	return zs, nil
+}
+
+// add adds a zone made of polygons, skipping polygons with fewer than three positions.
+// Call build once all zones are added.
+func (zs *zoneSet) add(name string, polygons [][][][2]float64) {
+	for _, polygon := range polygons {
+		if len(polygon) == 0 || len(polygon[0]) < 3 {
+			continue
+		}
+		box := spatial.Box{MinX: math.Inf(1), MinY: math.Inf(1), MaxX: math.Inf(-1), MaxY: math.Inf(-1)}
+		for _, p := range polygon[0] {
+			box.MinX, box.MaxX = math.Min(box.MinX, p[0]), math.Max(box.MaxX, p[0])
+			box.MinY, box.MaxY = math.Min(box.MinY, p[1]), math.Max(box.MaxY, p[1])
+		}
+		zs.boxes = append(zs.boxes, box)
+		zs.polygons = append(zs.polygons, polygon)
+		zs.owners = append(zs.owners, len(zs.names))
+	}
+	zs.names = append(zs.names, name)
+}
+
+// build indexes the bounding boxes of the polygons
+func (zs *zoneSet) build() {
+	zs.index = spatial.NewRTree(zs.boxes)
+}
+
+// locate returns the name of the zone containing a point, or "" when it is in none.
+// Where zones overlap, the one listed first in the file wins.
+func (zs *zoneSet) locate(lat, lon float64) string {
+	found := zs.zoneAt(lat, lon)
+	if found < 0 {
+		return ""
+	}
+	return zs.names[found]
+}
+
+// zoneAt returns the position of the zone containing a point, or -1 when it is in none
+func (zs *zoneSet) zoneAt(lat, lon float64) int {
+	found := -1
+	zs.index.Search(spatial.Box{MinX: lon, MinY: lat, MaxX: lon, MaxY: lat}, func(i int) bool {
+		if (found < 0 || zs.owners[i] < found) && polygonContains(zs.polygons[i], lon, lat) {
+			found = zs.owners[i]
+		}
+		return true
+	})
+	return found
+}
+
+// center returns the center of the bounding box of a zone's polygons
+func (zs *zoneSet) center(zone int) (lat, lon float64) {
+	box := spatial.Box{MinX: math.Inf(1), MinY: math.Inf(1), MaxX: math.Inf(-1), MaxY: math.Inf(-1)}
+	for i, owner := range zs.owners {
+		if owner == zone {
+			b := zs.boxes[i]
+			box.MinX, box.MaxX = math.Min(box.MinX, b.MinX), math.Max(box.MaxX, b.MaxX)
+			box.MinY, box.MaxY = math.Min(box.MinY, b.MinY), math.Max(box.MaxY, b.MaxY)
+		}
+	}
+	return (box.MinY + box.MaxY) / 2, (box.MinX + box.MaxX) / 2
+}
+
+// has reports whether a zone with the given name is defined
+func (zs *zoneSet) has(name string) bool {
+	for _, n := range zs.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// polygonContains reports whether a point is inside the outer ring of a polygon and outside its holes
+func polygonContains(polygon [][][2]float64, x, y float64) bool {
+	if !ringContains(polygon[0], x, y) {
+		return false
+	}
+	for _, hole := range polygon[1:] {
+		if ringContains(hole, x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains tests a point against a ring by counting the edges a ray from it crosses
+func ringContains(ring [][2]float64, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}